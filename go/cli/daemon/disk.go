@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/docker/go-units"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+func fmtSize(bytes int64) string {
+	return units.HumanSize(float64(bytes))
+}
+
+type Df struct {
+	Host       string
+	P2pPrivKey string
+
+	Filters    []string
+	StaleAfter time.Duration
+	// List each cache record instead of totals by type
+	Verbose bool
+}
+
+func (s *Df) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon df")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DiskUsage(ctx, &pb.DiskUsageReq{
+		Filters:    s.Filters,
+		StaleAfter: int64(s.StaleAfter.Seconds()),
+	})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc DiskUsage: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	if s.Verbose {
+		records := tui.NewTable("ID", "Type", "Size", "In use", "Last used", "Description")
+		for _, r := range res.Records {
+			lastUsed := "never"
+			if r.LastUsed > 0 {
+				lastUsed = fmtSince(r.LastUsed) + " ago"
+			}
+
+			records.Row(r.Id, r.Type, fmtSize(r.Size), fmt.Sprint(r.InUse), lastUsed, r.Description)
+		}
+		fmt.Println(records.Render())
+		fmt.Println()
+	}
+
+	type typeTotal struct {
+		count       int
+		size        int64
+		reclaimable int64
+	}
+
+	var total, reclaimable int64
+	totals := make(map[string]*typeTotal)
+	for _, r := range res.Records {
+		t, ok := totals[r.Type]
+		if !ok {
+			t = &typeTotal{}
+			totals[r.Type] = t
+		}
+
+		t.count++
+		t.size += r.Size
+		total += r.Size
+
+		if !r.InUse {
+			t.reclaimable += r.Size
+			reclaimable += r.Size
+		}
+	}
+
+	types := make([]string, 0, len(totals))
+	for typ := range totals {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	cache := tui.NewTable("Cache type", "Records", "Size", "Reclaimable")
+	for _, typ := range types {
+		t := totals[typ]
+		cache.Row(typ, fmt.Sprint(t.count), fmtSize(t.size), fmtSize(t.reclaimable))
+	}
+	cache.Row("total", fmt.Sprint(len(res.Records)), fmtSize(total), fmtSize(reclaimable))
+	fmt.Println(cache.Render())
+	fmt.Println()
+
+	if len(res.Apps) > 0 {
+		apps := tui.NewTable("App", "Size", "Stale")
+		for _, a := range res.Apps {
+			apps.Row(a.App, fmtSize(a.Size), fmt.Sprint(a.Stale))
+		}
+		fmt.Println(apps.Render())
+		fmt.Println()
+	}
+
+	if res.DiskTotal > 0 {
+		fmt.Println(tui.TitleStyle.Render("Disk free:"), fmtSize(res.DiskFree), "of", fmtSize(res.DiskTotal))
+	}
+
+	return nil
+}
+
+type Prune struct {
+	Host       string
+	P2pPrivKey string
+
+	KeepStorage  string
+	KeepDuration time.Duration
+	Filters      []string
+	All          bool
+
+	Apps       bool
+	StaleAfter time.Duration
+}
+
+func (s *Prune) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon prune")
+	defer span.End()
+
+	var keepStorage int64
+	if s.KeepStorage != "" {
+		var err error
+		keepStorage, err = units.RAMInBytes(s.KeepStorage)
+		if err != nil {
+			return fmt.Errorf("--keep-storage: %w", err)
+		}
+	}
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Prune(ctx, &pb.PruneReq{
+		KeepStorage:  keepStorage,
+		KeepDuration: int64(s.KeepDuration.Seconds()),
+		Filters:      s.Filters,
+		All:          s.All,
+		Apps:         s.Apps,
+		StaleAfter:   int64(s.StaleAfter.Seconds()),
+	})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc Prune: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	for _, name := range res.RemovedApps {
+		fmt.Println(tui.TitleStyle.Render("Removed app:"), name)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Reclaimed:"), fmtSize(res.Reclaimed), "from", len(res.Pruned), "cache records")
+
+	return nil
+}
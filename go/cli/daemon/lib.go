@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+type Restart struct {
+	Host       string
+	P2pPrivKey string
+}
+
+func (s *Restart) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon restart")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Restart(ctx, &pb.RestartReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc Restart: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	fmt.Println("The daemon is stopping the apps and will then restart")
+
+	return nil
+}
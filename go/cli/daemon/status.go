@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"premai.io/Ayup/go/cli/status"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type Status struct {
+	Host       string
+	P2pPrivKey string
+}
+
+func fmtHealth(h *pb.Health) string {
+	if h == nil {
+		return "not used"
+	}
+
+	if h.GetOk() {
+		return "ok"
+	}
+
+	return tui.ErrorStyle.Render("error: ") + h.GetError()
+}
+
+func fmtDisk(bytes int64) string {
+	if bytes < 0 {
+		return "unknown"
+	}
+
+	return units.HumanSize(float64(bytes))
+}
+
+func fmtSince(unix int64) string {
+	return time.Since(time.Unix(unix, 0)).Round(time.Second).String()
+}
+
+func (s *Status) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon status")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DaemonStatus(ctx, &pb.DaemonStatusReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc DaemonStatus: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	var workers []string
+	for _, w := range res.Workers {
+		workers = append(workers, fmt.Sprintf("%s (%s)", w.Id, strings.Join(w.Platforms, ", ")))
+	}
+	if len(workers) < 1 {
+		workers = append(workers, "none")
+	}
+
+	summary := tui.NewTable("Daemon", "")
+	summary.Row("Version", "v"+res.Version)
+	summary.Row("Uptime", fmtSince(res.Started))
+	summary.Row("Rootless helper", fmtHealth(res.Inrootless))
+	summary.Row("Buildkit", fmtHealth(res.Buildkit))
+	if sup := res.Supervisor; sup != nil {
+		if sup.Degraded {
+			summary.Row("State", tui.ErrorStyle.Render("degraded")+", builds are rejected until Buildkit is up")
+		}
+		summary.Row("Buildkit restarts", fmt.Sprint(sup.Restarts))
+		if sup.LastExit > 0 {
+			summary.Row("Last exit", fmt.Sprintf("%s ago: %s", fmtSince(sup.LastExit), sup.LastError))
+		}
+		if sup.NextStart > 0 {
+			summary.Row("Next start", "in "+time.Until(time.Unix(sup.NextStart, 0)).Round(time.Second).String())
+		}
+	}
+	summary.Row("Workers", strings.Join(workers, "\n"))
+	summary.Row("Network", res.NetMode)
+	summary.Row("Buildkit disk", fmtDisk(res.BuildkitDiskUsage))
+	summary.Row("Apps disk", fmtDisk(res.AppsDiskUsage))
+	fmt.Println(summary.Render())
+	fmt.Println()
+
+	if len(res.Peers) > 0 {
+		peers := tui.NewTable("Peer", "Address", "Authorized")
+		for _, p := range res.Peers {
+			peers.Row(p.PeerId, strings.Join(p.Addrs, "\n"), fmt.Sprint(p.Authorized))
+		}
+		fmt.Println(peers.Render())
+	} else {
+		fmt.Println("No P2P clients are connected")
+	}
+	fmt.Println()
+
+	if len(res.Sessions) > 0 {
+		sessions := tui.NewTable("Session", "App", "Peer", "Duration")
+		for _, sess := range res.Sessions {
+			sessions.Row(sess.Method, sess.App, sess.Peer, fmtSince(sess.Started))
+		}
+		fmt.Println(sessions.Render())
+	} else {
+		fmt.Println("No active sessions")
+	}
+	fmt.Println()
+
+	if len(res.Apps) > 0 {
+		fmt.Println(status.AppsTable(res.Apps).Render())
+	} else {
+		fmt.Println("No apps have been pushed yet")
+	}
+
+	return nil
+}
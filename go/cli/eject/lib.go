@@ -0,0 +1,81 @@
+package eject
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type Eject struct {
+	Host       string
+	P2pPrivKey string
+
+	App    string
+	SrcDir string
+	// Replace a Dockerfile or .dockerignore which is already in the source
+	Force bool
+}
+
+// Run fetches a Dockerfile made from the app's last analysis and writes it into the source
+func (s *Eject) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "eject")
+	defer span.End()
+
+	dockerfilePath := filepath.Join(s.SrcDir, "Dockerfile")
+	dockerignorePath := filepath.Join(s.SrcDir, ".dockerignore")
+
+	if !s.Force {
+		for _, path := range []string{dockerfilePath, dockerignorePath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, use --force to replace it", path)
+			} else if !os.IsNotExist(err) {
+				return terror.Errorf(ctx, "os Stat: %w", err)
+			}
+		}
+	}
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Eject(ctx, &pb.EjectReq{App: s.App})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc Eject: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	if err := os.WriteFile(dockerfilePath, []byte(res.Dockerfile), 0644); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+	if err := os.WriteFile(dockerignorePath, []byte(res.Dockerignore), 0644); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Wrote:"), dockerfilePath)
+	fmt.Println(tui.TitleStyle.Render("Wrote:"), dockerignorePath)
+
+	// It may have been guessed on the server and not downloaded
+	if _, err := os.Stat(filepath.Join(s.SrcDir, "requirements.txt")); os.IsNotExist(err) {
+		fmt.Println(tui.ErrorStyle.Render("Warning:"), "the Dockerfile needs requirements.txt, which isn't in the source")
+	}
+
+	fmt.Println("The next push builds the app from the Dockerfile")
+
+	return nil
+}
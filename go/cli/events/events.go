@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type Events struct {
+	Host       string
+	P2pPrivKey string
+
+	App   string
+	Types []string
+}
+
+func fmtEvent(ev *pb.Event) string {
+	desc := ev.Type.String()
+
+	switch ev.Type {
+	case pb.EventType_buildFinished:
+		if ev.Ok {
+			desc += " ok"
+		} else {
+			desc += " " + tui.ErrorStyle.Render("failed")
+		}
+	case pb.EventType_appCrashed:
+		desc = tui.ErrorStyle.Render(desc)
+		if ev.State == pb.AppState_exited {
+			desc += fmt.Sprintf(" exited (%d)", ev.ExitCode)
+		} else {
+			desc += " " + ev.State.String()
+		}
+	}
+
+	if ev.App != "" {
+		desc = tui.TitleStyle.Render(ev.App) + " " + desc
+	}
+	if ev.Peer != "" {
+		desc += " by " + ev.Peer
+	}
+
+	return time.Unix(ev.Time, 0).Format(time.DateTime) + " " + desc
+}
+
+// Run prints the daemon's events until interrupted
+func (s *Events) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "events")
+	defer span.End()
+
+	req := &pb.EventsReq{App: s.App}
+	for _, name := range s.Types {
+		typ, ok := pb.EventType_value[name]
+		if !ok || typ == int32(pb.EventType_unknownEvent) {
+			return fmt.Errorf("unknown event type: %s", name)
+		}
+		req.Types = append(req.Types, pb.EventType(typ))
+	}
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	stream, err := c.Events(ctx, req)
+	if err != nil {
+		return terror.Errorf(ctx, "grpc Events: %w", err)
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return terror.Errorf(ctx, "stream Recv: %w", err)
+		}
+
+		fmt.Println(fmtEvent(ev))
+	}
+}
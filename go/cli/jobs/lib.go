@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type Jobs struct {
+	Host       string
+	P2pPrivKey string
+
+	App string
+	// Print the log of this job instead of listing them
+	Log string
+	// How many runs ago the log is from
+	RunsAgo uint32
+}
+
+func fmtRun(job *pb.Job) (string, string) {
+	if len(job.Runs) < 1 {
+		if job.Running {
+			return "-", "running"
+		}
+		return "never", "-"
+	}
+
+	last := job.Runs[0]
+	started := time.Unix(last.Started, 0).Format(time.DateTime)
+
+	result := fmt.Sprintf("exited (%d)", last.ExitCode)
+	if last.Error != "" {
+		result = tui.ErrorStyle.Render("failed")
+	} else if last.ExitCode != 0 {
+		result = tui.ErrorStyle.Render(result)
+	}
+
+	if job.Running {
+		result = "running"
+	}
+
+	return started, result
+}
+
+func (s *Jobs) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "jobs")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	if s.Log != "" {
+		res, err := c.JobLog(ctx, &pb.JobLogReq{App: s.App, Job: s.Log, Run: s.RunsAgo})
+		if err != nil {
+			return terror.Errorf(ctx, "grpc JobLog: %w", err)
+		}
+
+		if res.GetError() != nil {
+			return fmt.Errorf("remote error: %s", res.GetError().Error)
+		}
+
+		_, err = os.Stdout.Write(res.Log)
+		return err
+	}
+
+	res, err := c.Jobs(ctx, &pb.JobsReq{App: s.App})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc Jobs: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	if len(res.Jobs) < 1 {
+		fmt.Println("No jobs are declared in the app's .ayup-conf")
+		return nil
+	}
+
+	t := tui.NewTable("Job", "Schedule", "Command", "Last run", "Result")
+	for _, job := range res.Jobs {
+		started, result := fmtRun(job)
+		t.Row(job.Name, job.Schedule, job.Command, started, result)
+	}
+	fmt.Println(t.Render())
+
+	return nil
+}
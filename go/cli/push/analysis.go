@@ -5,6 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"os/signal"
 	"runtime/pprof"
 	"strings"
 
@@ -19,6 +22,7 @@ import (
 	attr "go.opentelemetry.io/otel/attribute"
 	tr "go.opentelemetry.io/otel/trace"
 
+	"premai.io/Ayup/go/internal/choices"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 )
 
@@ -28,21 +32,60 @@ type AnalysisView struct {
 	stream pb.Srv_AnalysisClient
 
 	choice       *huh.Form
+	chosen       func() *pb.Chosen
 	spinner      spinner.Model
 	hist         *strings.Builder
 	histContLine bool
 	histPrevSrc  string
 
-	done   bool
-	result *pb.AnalysisResult
-	err    error
+	done bool
+	err  error
+
+	session string
+
+	// Print the logs as they come instead of rendering the view, choices can't be shown
+	plain bool
+	// Answers choices without asking, returns nil if there is no answer
+	answer func(*pb.Choice) (*pb.Chosen, error)
+	// Where files are picked from
+	srcDir string
+
+	// The user canceled the push
+	canceled bool
+	// Watch mode canceled the analysis to start a new one
+	stopping bool
+	// The latest rebuilds in watch mode
+	rebuilds string
 
 	braceStyle  lipgloss.Style
 	nameStyle   lipgloss.Style
 	sourceStyle lipgloss.Style
 }
 
-type choiceMsg *pb.ChoiceBool
+type choiceMsg *pb.Choice
+
+// sessionMsg announces the session which can be attached to if the connection drops
+type sessionMsg struct {
+	id  string
+	log LogMsg
+}
+
+type disconnectedMsg struct {
+	err error
+}
+
+// stopMsg cancels the analysis because there is a new version to push
+type stopMsg struct{}
+
+// disconnectedError explains how to reattach to the session if there is one
+func disconnectedError(err error, session string) error {
+	if session == "" {
+		return err
+	}
+
+	return fmt.Errorf("%w\nThe push carries on without a client for a while, reattach with 'ay push --attach %s'",
+		err, session)
+}
 
 func NewAnalysisView(ctx context.Context, stream pb.Srv_AnalysisClient) AnalysisView {
 	var hist strings.Builder
@@ -71,7 +114,17 @@ func (s AnalysisView) recvMsgCmd() tea.Cmd {
 			if err == io.EOF {
 				return func() DoneMsg { return DoneMsg{} }
 			}
-			return terror.Errorf(s.ctx, "stream recv: %w", err)
+			return disconnectedMsg{err: terror.Errorf(s.ctx, "stream recv: %w", err)}
+		}
+
+		if res.Session != "" {
+			return sessionMsg{
+				id: res.Session,
+				log: LogMsg{
+					source: res.GetSource(),
+					body:   res.GetLog(),
+				},
+			}
 		}
 
 		if res.Variant == nil {
@@ -89,13 +142,15 @@ func (s AnalysisView) recvMsgCmd() tea.Cmd {
 				body:   v.Log,
 			}
 		case *pb.ActReply_Choice:
-			choice := v.Choice.GetBool()
-			if choice != nil {
-				return choiceMsg(choice)
+			if v.Choice.Variant != nil {
+				return choiceMsg(v.Choice)
 			}
 		case *pb.ActReply_AnalysisResult:
 			trace.Event(s.ctx, "recv analysis result")
 			return DoneMsg{}
+		case *pb.ActReply_BuildStep:
+			// The steps are in the logs, these are for a client which started the session
+			return s.recvMsgCmd()()
 		}
 
 		return terror.Errorf(s.ctx, "Can't handle remote response: %v", res)
@@ -115,11 +170,13 @@ func (s AnalysisView) sendCmd(req *pb.ActReq) tea.Cmd {
 }
 
 func (s AnalysisView) Init() tea.Cmd {
+	if s.plain {
+		return s.recvMsgCmd()
+	}
+
 	return tea.Batch(s.recvMsgCmd(), s.spinner.Tick)
 }
 
-const formKeyBool = "bool"
-
 func (s AnalysisView) fmtLogHeader(source string) string {
 	return fmt.Sprintf(
 		"%s%s%s%s%s ",
@@ -135,6 +192,65 @@ func (s AnalysisView) writeLogHeader(source string) {
 	s.hist.WriteString(s.fmtLogHeader(source))
 }
 
+// writeLog adds the message to the history, each line has a header unless it continues a line
+// from the same source
+func (s *AnalysisView) writeLog(msg LogMsg) {
+	bs := []byte(msg.body)
+
+	if s.histPrevSrc != msg.source && s.histContLine {
+		s.histContLine = false
+		s.histPrevSrc = msg.source
+		s.hist.WriteByte('\n')
+	}
+
+	if len(bs) < 1 {
+		trace.Event(s.ctx, "received empty log message", attr.String("source", msg.source))
+		return
+	} else {
+		trace.Event(s.ctx, "received log message", attr.String("source", msg.source), attr.String("body", msg.body))
+	}
+
+	for {
+		i := bytes.IndexByte(bs, '\n')
+		if i == -1 {
+			break
+		}
+
+		line := bs[:i+1]
+		bs = bs[i+1:]
+
+		if s.histContLine {
+			s.hist.Write(line)
+			s.histContLine = false
+			continue
+		}
+
+		s.writeLogHeader(msg.source)
+		s.hist.Write(line)
+
+		if len(bs) < 1 {
+			return
+		}
+	}
+
+	if !s.histContLine {
+		s.writeLogHeader(msg.source)
+	}
+	s.hist.Write(bs)
+	s.histContLine = true
+	s.histPrevSrc = msg.source
+}
+
+// flushPlain prints the history when there is no renderer to show it
+func (s *AnalysisView) flushPlain() {
+	if !s.plain {
+		return
+	}
+
+	fmt.Print(s.hist.String())
+	s.hist.Reset()
+}
+
 func (s AnalysisView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
@@ -142,73 +258,64 @@ func (s AnalysisView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		switch msg.String() {
 		case "ctrl+c":
+			s.canceled = true
 			return s, s.sendCmd(&pb.ActReq{
 				Cancel: true,
 			})
 		}
+	case stopMsg:
+		s.stopping = true
+		s.choice = nil
+		s.chosen = nil
+		return s, s.sendCmd(&pb.ActReq{Cancel: true})
 	case error:
+		// Such as the analysis being canceled before the app started
+		if s.stopping {
+			return s.Update(DoneMsg{})
+		}
+
 		s.err = msg
 		return s, tea.Quit
+	case disconnectedMsg:
+		s.err = disconnectedError(msg.err, s.session)
+		return s, tea.Quit
+	case sessionMsg:
+		s.session = msg.id
+		return s.Update(msg.log)
 	case LogMsg:
-		bs := []byte(msg.body)
-
-		if s.histPrevSrc != msg.source && s.histContLine {
-			s.histContLine = false
-			s.histPrevSrc = msg.source
-			s.hist.WriteByte('\n')
-		}
-
-		if len(bs) < 1 {
-			trace.Event(s.ctx, "received empty log message", attr.String("source", msg.source))
-			return s, s.recvMsgCmd()
-		} else {
-			trace.Event(s.ctx, "received log message", attr.String("source", msg.source), attr.String("body", msg.body))
-		}
+		s.writeLog(msg)
+		s.flushPlain()
 
-		for {
-			i := bytes.IndexByte(bs, '\n')
-			if i == -1 {
-				break
+		return s, s.recvMsgCmd()
+	case choiceMsg:
+		if s.answer != nil {
+			chosen, err := s.answer(msg)
+			if err == nil && chosen == nil && s.plain {
+				err = noAnswerError(msg)
 			}
-
-			line := bs[:i+1]
-			bs = bs[i+1:]
-
-			if s.histContLine {
-				s.hist.Write(line)
-				s.histContLine = false
-				continue
+			if err != nil {
+				s.err = err
+				return s, tea.Sequence(s.sendCmd(&pb.ActReq{Cancel: true}), tea.Quit)
 			}
 
-			s.writeLogHeader(msg.source)
-			s.hist.Write(line)
+			if chosen != nil {
+				s.writeLog(LogMsg{
+					source: "ayup",
+					body:   fmt.Sprintf("%s %s\n", choices.Title(msg), chosenText(chosen)),
+				})
+				s.flushPlain()
 
-			if len(bs) < 1 {
-				return s, s.recvMsgCmd()
+				return s, tea.Batch(s.sendCmd(&pb.ActReq{Choice: chosen}), s.recvMsgCmd())
 			}
 		}
 
-		if !s.histContLine {
-			s.writeLogHeader(msg.source)
-		}
-		s.hist.Write(bs)
-		s.histContLine = true
-
-		return s, s.recvMsgCmd()
-	case choiceMsg:
 		var f *huh.Form
 
 		pprof.Do(s.ctx, pprof.Labels("hotspot", "create form"), func(ctx context.Context) {
 			trace.Event(s.ctx, "before create choice field")
 
-			v := msg.Value
-			c := huh.NewConfirm().
-				Key(formKeyBool).
-				Title(msg.Title).
-				Description(msg.Description).
-				Affirmative(msg.Affirmative).
-				Negative(msg.Negative).
-				Value(&v)
+			var c huh.Field
+			c, s.chosen = choiceField(msg, s.srcDir)
 			s.span.AddEvent("before create choice group")
 			g := huh.NewGroup(c)
 			s.span.AddEvent("before create choice form")
@@ -219,6 +326,10 @@ func (s AnalysisView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		return s, tea.Batch(f.Init(), s.recvMsgCmd())
 	case DoneMsg:
+		if s.plain && s.histContLine {
+			fmt.Println()
+		}
+
 		if err := s.stream.CloseSend(); err != nil {
 			terror.Ackf(s.ctx, "close send: %w", err)
 		}
@@ -245,16 +356,11 @@ func (s AnalysisView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				s.choice = nil
 				return s, s.sendCmd(&pb.ActReq{Cancel: true})
 			case huh.StateCompleted:
-				c := s.choice.GetBool(formKeyBool)
+				c := s.chosen()
 				s.choice = nil
+				s.chosen = nil
 				return s, s.sendCmd(&pb.ActReq{
-					Choice: &pb.Chosen{
-						Variant: &pb.Chosen_Bool{
-							Bool: &pb.ChosenBool{
-								Value: c,
-							},
-						},
-					},
+					Choice: c,
 				})
 			}
 		}
@@ -268,6 +374,15 @@ func (s AnalysisView) View() string {
 		return fmt.Sprintf("%s\n", s.hist.String())
 	}
 
+	if s.rebuilds != "" {
+		return fmt.Sprintf("%s\n%s", s.sourceStyle.Render(s.rebuilds), s.view())
+	}
+
+	return s.view()
+}
+
+func (s AnalysisView) view() string {
+
 	if s.choice != nil {
 		return fmt.Sprintf(
 			"%s\n%s",
@@ -294,13 +409,27 @@ func (s AnalysisView) View() string {
 	}
 }
 
-func (s *Pusher) Analysis(pctx context.Context) (result *pb.AnalysisResult, err error) {
+// gitRevision is the commit the source is checked out at, empty if it isn't a git repository or
+// git isn't installed
+func gitRevision(ctx context.Context, dir string) string {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		trace.Event(ctx, "no git revision", attr.String("error", err.Error()))
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// Analysis builds and runs the app until it exits, the user cancels it or stop is closed. Which
+// is canceled is reported.
+func (s *Pusher) Analysis(pctx context.Context, stop <-chan struct{}) (canceled bool, err error) {
 	ctx, span := trace.Span(pctx, "analysis")
 	defer span.End()
 
 	stream, err := s.Client.Analysis(ctx)
 	if err != nil {
-		return nil, terror.Errorf(ctx, "client analysis: %w", err)
+		return false, terror.Errorf(ctx, "client analysis: %w", err)
 	}
 	defer func() {
 		err2 := stream.CloseSend()
@@ -309,22 +438,73 @@ func (s *Pusher) Analysis(pctx context.Context) (result *pb.AnalysisResult, err
 		}
 	}()
 
-	err = stream.Send(&pb.ActReq{})
+	first := &pb.ActReq{
+		App:        s.App,
+		Session:    s.Attach,
+		BuildSteps: s.out != nil,
+		Dev:        s.Dev,
+		Publish:    s.Publish,
+		Revision:   gitRevision(ctx, s.SrcDir),
+	}
+	if s.Export != nil {
+		first.Export = s.Export.toPb()
+	}
+
+	err = stream.Send(first)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+
+	if s.out != nil {
+		return s.analysisJSON(ctx, stream, stop)
 	}
 
 	view := NewAnalysisView(ctx, stream)
-	prog := tea.NewProgram(view, tea.WithContext(ctx))
+	view.plain = !s.Interactive
+	view.answer = s.answer
+	view.srcDir = s.SrcDir
+	view.rebuilds = s.rebuildHistory()
+
+	opts := []tea.ProgramOption{tea.WithContext(ctx)}
+	if view.plain {
+		opts = append(opts, tea.WithoutRenderer(), tea.WithInput(nil), tea.WithoutSignalHandler())
+	}
+	prog := tea.NewProgram(view, opts...)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	interrupt := make(chan os.Signal, 1)
+	if view.plain {
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				prog.Send(stopMsg{})
+				stop = nil
+			case <-interrupt:
+				// A second interrupt kills the client
+				signal.Stop(interrupt)
+				prog.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	model, err := prog.Run()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
 	view = model.(AnalysisView)
 
 	if view.err != nil {
-		return nil, view.err
+		return view.canceled, view.err
 	}
 
 	msg, err := stream.Recv()
@@ -332,8 +512,8 @@ func (s *Pusher) Analysis(pctx context.Context) (result *pb.AnalysisResult, err
 		trace.Event(ctx, "stream rcv", attr.String("msg", msg.String()))
 	}
 	if err != io.EOF {
-		return nil, terror.Errorf(ctx, "stream recv should end: %w", err)
+		return view.canceled, terror.Errorf(ctx, "stream recv should end: %w", err)
 	}
 
-	return view.result, nil
+	return view.canceled, nil
 }
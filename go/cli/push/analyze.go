@@ -0,0 +1,170 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type outputMatch struct {
+	Name       string   `json:"name"`
+	Confidence float64  `json:"confidence"`
+	Reasons    []string `json:"reasons"`
+}
+
+// outputReport is what ay analyze found, see pb.AnalysisReport
+type outputReport struct {
+	Detector          string        `json:"detector"`
+	Matches           []outputMatch `json:"matches"`
+	Reasons           []string      `json:"reasons"`
+	BaseImage         string        `json:"baseImage,omitempty"`
+	AptPackages       []string      `json:"aptPackages"`
+	PipPackages       []string      `json:"pipPackages"`
+	GuessRequirements bool          `json:"guessRequirements"`
+	Entrypoint        []string      `json:"entrypoint"`
+	Ports             []uint32      `json:"ports"`
+	Assistant         bool          `json:"assistant"`
+	Result            outputResult  `json:"result"`
+}
+
+func toOutputReport(r *pb.AnalysisReport) *outputReport {
+	matches := []outputMatch{}
+	for _, m := range r.Matches {
+		matches = append(matches, outputMatch{
+			Name:       m.Name,
+			Confidence: m.Confidence,
+			Reasons:    append([]string{}, m.Reasons...),
+		})
+	}
+
+	// Empty lists instead of null
+	return &outputReport{
+		Detector:          r.Detector,
+		Matches:           matches,
+		Reasons:           append([]string{}, r.Reasons...),
+		BaseImage:         r.BaseImage,
+		AptPackages:       append([]string{}, r.AptPackages...),
+		PipPackages:       append([]string{}, r.PipPackages...),
+		GuessRequirements: r.GuessRequirements,
+		Entrypoint:        append([]string{}, r.Entrypoint...),
+		Ports:             append([]uint32{}, r.Ports...),
+		Assistant:         r.Assistant,
+		Result: outputResult{
+			UseDockerfile:         r.Result.GetUseDockerfile(),
+			UsePythonRequirements: r.Result.GetUsePythonRequirements(),
+			NeedsGit:              r.Result.GetNeedsGit(),
+			NeedsLibGL:            r.Result.GetNeedsLibGL(),
+			NeedsLibGlib:          r.Result.GetNeedsLibGlib(),
+		},
+	}
+}
+
+func fmtList(items []string) string {
+	if len(items) < 1 {
+		return "none"
+	}
+
+	return strings.Join(items, "\n")
+}
+
+func printReport(r *pb.AnalysisReport) {
+	var ports []string
+	for _, p := range r.Ports {
+		ports = append(ports, fmt.Sprint(p))
+	}
+
+	assistant := "no"
+	if r.Assistant {
+		assistant = "yes"
+	}
+
+	var matches []string
+	for _, m := range r.Matches {
+		matches = append(matches, fmt.Sprintf("%s (%.0f%%)", m.Name, m.Confidence*100))
+	}
+
+	pipPackages := fmtList(r.PipPackages)
+	if r.GuessRequirements {
+		pipPackages = "guessed by pipreqs"
+	} else if r.Result.GetUseDockerfile() {
+		pipPackages = "decided by the Dockerfile"
+	}
+
+	summary := tui.NewTable("Analysis", "")
+	summary.Row("Detector", r.Detector)
+	summary.Row("Matched", fmtList(matches))
+	summary.Row("Base image", r.BaseImage)
+	summary.Row("Apt packages", fmtList(r.AptPackages))
+	summary.Row("Pip packages", pipPackages)
+	summary.Row("Entrypoint", strings.Join(r.Entrypoint, " "))
+	summary.Row("Ports", fmtList(ports))
+	summary.Row("Assistant", assistant)
+	fmt.Println(summary.Render())
+	fmt.Println()
+
+	fmt.Println(tui.TitleStyle.Render("Why:"))
+	for _, reason := range r.Reasons {
+		fmt.Println("  -", reason)
+	}
+}
+
+// analyze asks the server what it would do with the uploaded source, nothing is built or ran
+func (s *Pusher) analyze(ctx context.Context) (err error) {
+	ctx, span := trace.Span(ctx, "analyze")
+	defer span.End()
+
+	stream, err := s.Client.Analysis(ctx)
+	if err != nil {
+		return terror.Errorf(ctx, "client analysis: %w", err)
+	}
+	defer func() {
+		err2 := stream.CloseSend()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	if err := stream.Send(&pb.ActReq{App: s.App, Analyze: true}); err != nil {
+		return terror.Errorf(ctx, "stream Send: %w", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return terror.Errorf(ctx, "stream Recv: %w", err)
+		}
+
+		if res.Session != "" {
+			s.session = res.Session
+		}
+
+		switch v := res.Variant.(type) {
+		case nil:
+			return nil
+		case *pb.ActReply_Log:
+			if s.out != nil {
+				s.out.write(outputLine{Type: "log", Source: res.Source, Text: v.Log})
+			}
+		case *pb.ActReply_AnalysisReport:
+			if s.out != nil {
+				s.out.write(outputLine{Type: "report", Report: toOutputReport(v.AnalysisReport)})
+			} else {
+				printReport(v.AnalysisReport)
+			}
+		case *pb.ActReply_Error:
+			if s.out != nil {
+				s.out.write(outputLine{Type: "error", Source: res.Source, Error: v.Error.Error})
+			}
+			return fmt.Errorf("%s", v.Error.Error)
+		}
+	}
+}
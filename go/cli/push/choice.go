@@ -0,0 +1,233 @@
+package push
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+
+	"premai.io/Ayup/go/internal/choices"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func choiceOptions(options []*pb.ChoiceOption) []huh.Option[string] {
+	opts := make([]huh.Option[string], 0, len(options))
+	for _, o := range options {
+		label := o.Label
+		if label == "" {
+			label = o.Value
+		}
+		opts = append(opts, huh.NewOption(label, o.Value))
+	}
+
+	return opts
+}
+
+// choiceField creates the form field for the choice and a function which returns the answer
+// once the form is completed. Files are picked from srcDir.
+func choiceField(choice *pb.Choice, srcDir string) (huh.Field, func() *pb.Chosen) {
+	seq := choice.Seq
+
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Text:
+		value := v.Text.Value
+		f := huh.NewInput().
+			Title(v.Text.Title).
+			Description(v.Text.Description).
+			Placeholder(v.Text.Placeholder).
+			Value(&value)
+
+		if v.Text.Validate != "" {
+			// The daemon checks the answer as well, so a bad expression is left to it
+			if re, err := choices.TextRegexp(v.Text.Validate); err == nil {
+				f = f.Validate(func(s string) error {
+					if !re.MatchString(s) {
+						return fmt.Errorf("doesn't match `%s`", v.Text.Validate)
+					}
+					return nil
+				})
+			}
+		}
+
+		return f, func() *pb.Chosen {
+			return &pb.Chosen{Seq: seq, Variant: &pb.Chosen_Text{Text: &pb.ChosenText{Value: value}}}
+		}
+	case *pb.Choice_Select:
+		value := v.Select.Value
+		f := huh.NewSelect[string]().
+			Title(v.Select.Title).
+			Description(v.Select.Description).
+			Options(choiceOptions(v.Select.Options)...).
+			Value(&value)
+
+		return f, func() *pb.Chosen {
+			return &pb.Chosen{Seq: seq, Variant: &pb.Chosen_Select{Select: &pb.ChosenSelect{Value: value}}}
+		}
+	case *pb.Choice_MultiSelect:
+		values := v.MultiSelect.Values
+		f := huh.NewMultiSelect[string]().
+			Title(v.MultiSelect.Title).
+			Description(v.MultiSelect.Description).
+			Value(&values).
+			Options(choiceOptions(v.MultiSelect.Options)...).
+			Limit(int(v.MultiSelect.Limit))
+
+		return f, func() *pb.Chosen {
+			return &pb.Chosen{Seq: seq, Variant: &pb.Chosen_MultiSelect{MultiSelect: &pb.ChosenMultiSelect{Values: values}}}
+		}
+	case *pb.Choice_File:
+		if srcDir == "" {
+			srcDir = "."
+		}
+
+		// The picker gives the path it was opened at joined with the file's
+		value := ""
+		if v.File.Value != "" {
+			value = filepath.Join(srcDir, filepath.FromSlash(v.File.Value))
+		}
+		f := huh.NewFilePicker().
+			Title(v.File.Title).
+			Description(v.File.Description).
+			CurrentDirectory(srcDir).
+			AllowedTypes(v.File.Extensions).
+			Picking(true).
+			Validate(func(p string) error {
+				return choices.CheckFile(v.File, srcRelPath(srcDir, p))
+			}).
+			Value(&value)
+
+		return f, func() *pb.Chosen {
+			return &pb.Chosen{Seq: seq, Variant: &pb.Chosen_File{File: &pb.ChosenFile{Value: srcRelPath(srcDir, value)}}}
+		}
+	}
+
+	b := choice.GetBool()
+	value := b.Value
+	f := huh.NewConfirm().
+		Title(b.Title).
+		Description(b.Description).
+		Affirmative(b.Affirmative).
+		Negative(b.Negative).
+		Value(&value)
+
+	return f, func() *pb.Chosen {
+		return &pb.Chosen{Seq: seq, Variant: &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: value}}}
+	}
+}
+
+// srcRelPath is the slash separated path relative to srcDir, which is what the daemon expects
+func srcRelPath(srcDir string, p string) string {
+	rel, err := filepath.Rel(srcDir, p)
+	if err != nil {
+		return p
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func chosenText(chosen *pb.Chosen) string {
+	switch v := chosen.Variant.(type) {
+	case *pb.Chosen_Bool:
+		if v.Bool.Value {
+			return "yes"
+		}
+		return "no"
+	case *pb.Chosen_Text:
+		return v.Text.Value
+	case *pb.Chosen_Select:
+		return v.Select.Value
+	case *pb.Chosen_MultiSelect:
+		return strings.Join(v.MultiSelect.Values, ",")
+	case *pb.Chosen_File:
+		return v.File.Value
+	}
+
+	return ""
+}
+
+func noAnswerError(choice *pb.Choice) error {
+	if choice.Key == "" {
+		return fmt.Errorf("no answer to '%s', it has no key for the answers file; use --yes or --no or run interactively",
+			choices.Title(choice))
+	}
+
+	return fmt.Errorf("no answer to '%s', add '%s=<answer>' to the answers file or use --yes or --no",
+		choices.Title(choice), choice.Key)
+}
+
+// answer the choice from the answers or --yes and --no, nil is returned if it has no answer
+func (s *Pusher) answer(choice *pb.Choice) (*pb.Chosen, error) {
+	value, ok := s.Answers[choice.Key]
+	if choice.Key == "" {
+		ok = false
+	}
+
+	chosen := &pb.Chosen{Seq: choice.Seq}
+
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		var b bool
+		switch {
+		case ok:
+			var err error
+			if b, err = parseYesNo(value); err != nil {
+				return nil, fmt.Errorf("answer to %s: %w", choice.Key, err)
+			}
+		case s.Yes || s.No:
+			b = s.Yes
+		default:
+			return nil, nil
+		}
+		chosen.Variant = &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: b}}
+	case *pb.Choice_Text:
+		if !ok && !s.Yes {
+			return nil, nil
+		} else if !ok {
+			value = v.Text.Value
+		}
+		chosen.Variant = &pb.Chosen_Text{Text: &pb.ChosenText{Value: value}}
+	case *pb.Choice_Select:
+		if !ok && !s.Yes {
+			return nil, nil
+		} else if !ok {
+			value = v.Select.Value
+		}
+		chosen.Variant = &pb.Chosen_Select{Select: &pb.ChosenSelect{Value: value}}
+	case *pb.Choice_MultiSelect:
+		values := v.MultiSelect.Values
+		if ok {
+			values = nil
+			for _, val := range strings.Split(value, ",") {
+				if val = strings.TrimSpace(val); val != "" {
+					values = append(values, val)
+				}
+			}
+		} else if !s.Yes {
+			return nil, nil
+		}
+		chosen.Variant = &pb.Chosen_MultiSelect{MultiSelect: &pb.ChosenMultiSelect{Values: values}}
+	case *pb.Choice_File:
+		if !ok && !s.Yes {
+			return nil, nil
+		} else if !ok {
+			value = v.File.Value
+		}
+		chosen.Variant = &pb.Chosen_File{File: &pb.ChosenFile{Value: value}}
+	default:
+		return nil, nil
+	}
+
+	return chosen, nil
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "y", "yes", "true", "1":
+		return true, nil
+	case "n", "no", "false", "0":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("expected yes or no, got '%s'", value)
+}
@@ -0,0 +1,41 @@
+package push
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func TestUnansweredChoiceFails(t *testing.T) {
+	choice := &pb.Choice{
+		Key: "guessRequirements",
+		Variant: &pb.Choice_Bool{
+			Bool: &pb.ChoiceBool{Title: "No requirements.txt; try guessing it?"},
+		},
+	}
+
+	p := Pusher{}
+	view := NewAnalysisView(context.Background(), nil)
+	view.plain = true
+	view.answer = p.answer
+
+	model, cmd := view.Update(choiceMsg(choice))
+	view = model.(AnalysisView)
+	if view.err == nil || !strings.Contains(view.err.Error(), "guessRequirements=<answer>") {
+		t.Errorf("got error %v, want one saying how to answer", view.err)
+	}
+	if cmd == nil {
+		t.Errorf("the push should be canceled and quit")
+	}
+
+	p.Yes = true
+	view = NewAnalysisView(context.Background(), nil)
+	view.plain = true
+	view.answer = p.answer
+	model, _ = view.Update(choiceMsg(choice))
+	if err := model.(AnalysisView).err; err != nil {
+		t.Errorf("--yes: %v", err)
+	}
+}
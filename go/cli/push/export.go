@@ -0,0 +1,237 @@
+package push
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// ExportOutput is where ay build writes the app after building it
+type ExportOutput struct {
+	// oci for an OCI image layout tarball or local for the image's files in a directory
+	Type string
+	Dest string
+}
+
+// ParseExportOutput parses a comma separated list of keys and values such as
+// type=oci,dest=app.tar
+func ParseExportOutput(spec string) (ExportOutput, error) {
+	out := ExportOutput{Type: "oci"}
+
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return out, fmt.Errorf("expected key=value, got '%s'", field)
+		}
+
+		switch key {
+		case "type":
+			if value != "oci" && value != "local" {
+				return out, fmt.Errorf("type must be oci or local, got '%s'", value)
+			}
+			out.Type = value
+		case "dest":
+			out.Dest = value
+		default:
+			return out, fmt.Errorf("unknown key '%s', expected type or dest", key)
+		}
+	}
+
+	if out.Dest == "" {
+		return out, errors.New("dest is missing e.g. type=oci,dest=app.tar")
+	}
+
+	return out, nil
+}
+
+func (s ExportOutput) toPb() *pb.Export {
+	if s.Type == "local" {
+		return &pb.Export{Type: pb.ExportType_exportTar}
+	}
+
+	return &pb.Export{Type: pb.ExportType_exportOci}
+}
+
+// DownloadExport fetches the export made by the last build and writes it to the destination
+func (s *Pusher) DownloadExport(ctx context.Context) error {
+	ctx, span := trace.Span(ctx, "download export")
+	defer span.End()
+
+	dest, err := filepath.Abs(s.Export.Dest)
+	if err != nil {
+		return terror.Errorf(ctx, "filepath Abs: %w", err)
+	}
+
+	stream, err := s.Client.DownloadExport(ctx, &pb.DownloadReq{App: s.App})
+	if err != nil {
+		return terror.Errorf(ctx, "client DownloadExport: %w", err)
+	}
+
+	// Next to the destination so that it can be renamed to it
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dest), ".ayup-export-")
+	if err != nil {
+		return terror.Errorf(ctx, "os MkdirTemp: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "os RemoveAll: %w", os.RemoveAll(tmpDir)) }()
+
+	retError := func(msg string, args ...any) error {
+		return terror.Errorf(ctx, msg, args...)
+	}
+	fileRecver := rpc.NewFileRecver(stream, nil, retError, retError, tmpDir, tmpDir)
+	if err := fileRecver.RecvDirs(ctx); err != nil {
+		return err
+	}
+
+	path := filepath.Join(tmpDir, rpc.ExportName)
+	if s.Export.Type == "local" {
+		err = extractTar(path, dest)
+	} else {
+		err = os.Rename(path, dest)
+	}
+	if err != nil {
+		return terror.Errorf(ctx, "export: %w", err)
+	}
+
+	fmt.Printf("Exported %s to %s\n", s.App, s.Export.Dest)
+
+	return nil
+}
+
+// inDir checks that path resolves to somewhere in dir, which has had its symlinks resolved,
+// so that a symlink in the tarball can't be used to write outside of it
+func inDir(dir string, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("filepath EvalSymlinks: %w", err)
+	}
+
+	if rel, err := filepath.Rel(dir, resolved); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s is outside of %s", path, dir)
+	}
+
+	return nil
+}
+
+// mkdirIn creates path and its parents after checking that the closest one which exists is in dir
+func mkdirIn(dir string, path string, mode os.FileMode) error {
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	if err := inDir(dir, existing); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, mode); err != nil {
+		return fmt.Errorf("os MkdirAll: %w", err)
+	}
+
+	return nil
+}
+
+// extractTar writes the files in the tarball at path to dir. Device files and the like are
+// skipped.
+func extractTar(path string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os MkdirAll: %w", err)
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("filepath EvalSymlinks: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os Open: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("tar Next: %w", err)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("path is not local: %s", hdr.Name)
+		}
+
+		target := filepath.Join(dir, name)
+		if err := mkdirIn(dir, filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirIn(dir, target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeTarFile(tr, target, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("os RemoveAll: %w", err)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("os Symlink: %w", err)
+			}
+		case tar.TypeLink:
+			link := filepath.Clean(filepath.FromSlash(hdr.Linkname))
+			if !filepath.IsLocal(link) {
+				return fmt.Errorf("link is not local: %s", hdr.Linkname)
+			}
+			if err := inDir(dir, filepath.Dir(filepath.Join(dir, link))); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("os RemoveAll: %w", err)
+			}
+			if err := os.Link(filepath.Join(dir, link), target); err != nil {
+				return fmt.Errorf("os Link: %w", err)
+			}
+		}
+	}
+}
+
+func writeTarFile(r io.Reader, path string, mode os.FileMode) error {
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("os RemoveAll: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode|0600)
+	if err != nil {
+		return fmt.Errorf("os OpenFile: %w", err)
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("io Copy: %w", err)
+	}
+
+	return f.Close()
+}
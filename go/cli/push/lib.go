@@ -3,6 +3,8 @@ package push
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -25,10 +27,45 @@ type Pusher struct {
 
 	AssistantDir string
 	SrcDir       string
+	App          string
+	// The ID of a session to attach to instead of uploading and starting a new one
+	Attach string
+
+	// Show the views and ask the user to make choices, otherwise the logs are printed line by
+	// line and choices need answers given in advance
+	Interactive bool
+	// Answers to choices by their keys
+	Answers map[string]string
+	// Answer yes or no to yes or no choices that aren't in Answers, Yes also takes the default
+	// of other choices
+	Yes bool
+	No  bool
+	// text or json, which writes a line of JSON for each thing that happens, see outputLine
+	Output string
+	// Push again each time the source changes
+	Watch bool
+	// With Watch, sync changes to the running app and restart it instead of rebuilding it,
+	// unless a file in rpc.RebuildFiles changed
+	Dev bool
+	// Build the app and write it here instead of running it
+	Export *ExportOutput
+	// The registry reference the app's image is pushed to after each successful build
+	Publish string
+	// Only analyse the source and print what would be done to build and run it
+	Analyze bool
+
+	out      *jsonOutput
+	session  string
+	rebuilds []rebuild
 }
 
 type LogView struct {
 	name string
+	// Print each log as it comes instead of rendering the view
+	plain bool
+	// With plain, write the logs as JSON lines of this type instead
+	jsonType string
+	out      *jsonOutput
 
 	done       bool
 	cancelChan chan struct{}
@@ -65,7 +102,25 @@ func NewLogView(name string, cancelChan chan struct{}) LogView {
 	}
 }
 
+// newLogViewProg creates a LogView program, which doesn't need a terminal if the push isn't
+// interactive. The JSON output type is used if the output is JSON.
+func (s *Pusher) newLogViewProg(name string, jsonType string, cancelChan chan struct{}) *tea.Program {
+	view := NewLogView(name, cancelChan)
+	if s.Interactive {
+		return tea.NewProgram(view)
+	}
+
+	view.plain = true
+	view.jsonType = jsonType
+	view.out = s.out
+	return tea.NewProgram(view, tea.WithoutRenderer(), tea.WithInput(nil))
+}
+
 func (s LogView) Init() tea.Cmd {
+	if s.plain {
+		return nil
+	}
+
 	return s.spinner.Tick
 }
 
@@ -81,6 +136,14 @@ func (s LogView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		s.done = true
 		return s, tea.Quit
 	case LogMsg:
+		if s.out != nil {
+			s.out.write(outputLine{Type: s.jsonType, Source: msg.source, Text: msg.body})
+			return s, nil
+		} else if s.plain {
+			fmt.Printf("[%s/%s] %s\n", s.name, msg.source, msg.body)
+			return s, nil
+		}
+
 		if s.hist.Len() > 0 {
 			s.hist.WriteString("\n")
 		}
@@ -120,11 +183,17 @@ func (s LogView) View() string {
 	}
 }
 
-func (s *Pusher) Run(ctx context.Context) error {
+func (s *Pusher) Run(ctx context.Context) (err error) {
 	ctx = trace.SetSpanKind(ctx, tr.SpanKindClient)
 	ctx, span := trace.Span(ctx, "push")
 	defer span.End()
 
+	var ports []outputPort
+	if s.Output == "json" {
+		s.out = newJSONOutput(os.Stdout)
+		defer func() { s.writeSummary(ports, err) }()
+	}
+
 	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
 	if err != nil {
 		return err
@@ -136,8 +205,30 @@ func (s *Pusher) Run(ctx context.Context) error {
 	}
 	s.Client = client
 
-	if err := s.Upload(ctx); err != nil {
-		return err
+	if s.Watch && s.Attach != "" {
+		return fmt.Errorf("can't watch the source while attaching to a session")
+	}
+
+	if s.Attach == "" {
+		if err := s.Upload(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.Analyze {
+		return s.analyze(ctx)
+	}
+
+	if s.Export != nil {
+		if _, err := s.Analysis(ctx, nil); err != nil {
+			return err
+		}
+
+		if err := s.DownloadExport(ctx); err != nil {
+			return err
+		}
+
+		return s.Download(ctx)
 	}
 
 	var wg sync.WaitGroup
@@ -149,15 +240,51 @@ func (s *Pusher) Run(ctx context.Context) error {
 			_ = fwdLis.Close()
 		}
 	}()
+	if fwdErr == nil {
+		ports = append(ports, outputPort{Local: fwdLis.Addr().String(), Remote: 5000})
+	}
 
-	_, err = s.Analysis(ctx)
+	if s.Watch {
+		err = s.watch(ctx)
+	} else {
+		_, err = s.Analysis(ctx, nil)
+	}
 	if err != nil {
 		return err
 	}
 
+	// The source may not be where the session was started
+	if s.Attach != "" {
+		return nil
+	}
+
 	if err := s.Download(ctx); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// AppNameFromPath turns a directory name into something the server accepts as an app name
+func AppNameFromPath(path string) string {
+	var name strings.Builder
+
+	for _, r := range strings.ToLower(filepath.Base(path)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			name.WriteRune(r)
+		} else {
+			name.WriteRune('-')
+		}
+	}
+
+	trimmed := strings.Trim(name.String(), "-")
+	if len(trimmed) > 63 {
+		trimmed = strings.Trim(trimmed[:63], "-")
+	}
+
+	if trimmed == "" {
+		return "app"
+	}
+
+	return trimmed
+}
@@ -0,0 +1,317 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	"premai.io/Ayup/go/internal/choices"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// OutputVersion is in each line written by --output json. It is incremented when a field is
+// removed or its meaning changes, fields and line types can be added without incrementing it.
+const OutputVersion = 1
+
+// outputLine is one line of JSON, which fields are set depends on the type. The types are
+// upload, download, log, step, choice, result, report, error, rebuild and summary, which is
+// always the last line.
+type outputLine struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+
+	// Where a log came from e.g. ayup, app or the name of a build step
+	Source string `json:"source,omitempty"`
+	// Progress and logs, which are not necessarily whole lines
+	Text string `json:"text,omitempty"`
+
+	Step    *outputStep    `json:"step,omitempty"`
+	Choice  *outputChoice  `json:"choice,omitempty"`
+	Result  *outputResult  `json:"result,omitempty"`
+	Report  *outputReport  `json:"report,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Rebuild *outputRebuild `json:"rebuild,omitempty"`
+	Summary *outputSummary `json:"summary,omitempty"`
+}
+
+type outputStep struct {
+	Number uint32 `json:"number"`
+	Name   string `json:"name"`
+	// new, started, cached, done or failed
+	State string `json:"state"`
+	// Seconds
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type outputChoice struct {
+	Key string `json:"key,omitempty"`
+	// bool, text, select or multiSelect
+	Kind    string   `json:"kind"`
+	Title   string   `json:"title"`
+	Options []string `json:"options,omitempty"`
+	// A bool, string or list of strings depending on the kind, missing if there was no answer
+	Answer any `json:"answer,omitempty"`
+}
+
+type outputResult struct {
+	UseDockerfile         bool `json:"useDockerfile"`
+	UsePythonRequirements bool `json:"usePythonRequirements"`
+	NeedsGit              bool `json:"needsGit"`
+	NeedsLibGL            bool `json:"needsLibGL"`
+	NeedsLibGlib          bool `json:"needsLibGlib"`
+}
+
+// outputRebuild starts each rebuild in watch mode, the first push is not a rebuild
+type outputRebuild struct {
+	Number int `json:"number"`
+	// The paths that changed, relative to the source directory
+	Changed []string `json:"changed"`
+	// Why the changes couldn't be synced to the app in dev mode
+	SyncError string `json:"syncError,omitempty"`
+}
+
+type outputPort struct {
+	Local  string `json:"local"`
+	Remote int    `json:"remote"`
+}
+
+type outputSummary struct {
+	OK      bool   `json:"ok"`
+	App     string `json:"app"`
+	Session string `json:"session,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Where the daemon proxies HTTP requests to the app
+	ProxyURL       string       `json:"proxyUrl,omitempty"`
+	ForwardedPorts []outputPort `json:"forwardedPorts"`
+}
+
+type jsonOutput struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func newJSONOutput(w io.Writer) *jsonOutput {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	return &jsonOutput{enc: enc}
+}
+
+func (s *jsonOutput) write(line outputLine) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	line.Version = OutputVersion
+	_ = s.enc.Encode(line)
+}
+
+var stepStates = map[pb.BuildStepState]string{
+	pb.BuildStepState_stepNew:     "new",
+	pb.BuildStepState_stepStarted: "started",
+	pb.BuildStepState_stepCached:  "cached",
+	pb.BuildStepState_stepDone:    "done",
+	pb.BuildStepState_stepFailed:  "failed",
+}
+
+func toOutputChoice(choice *pb.Choice, chosen *pb.Chosen) *outputChoice {
+	c := &outputChoice{Key: choice.Key, Title: choices.Title(choice)}
+
+	var options []*pb.ChoiceOption
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		c.Kind = "bool"
+	case *pb.Choice_Text:
+		c.Kind = "text"
+	case *pb.Choice_Select:
+		c.Kind = "select"
+		options = v.Select.Options
+	case *pb.Choice_MultiSelect:
+		c.Kind = "multiSelect"
+		options = v.MultiSelect.Options
+	case *pb.Choice_File:
+		c.Kind = "file"
+	}
+
+	for _, o := range options {
+		c.Options = append(c.Options, o.Value)
+	}
+
+	switch v := chosen.GetVariant().(type) {
+	case *pb.Chosen_Bool:
+		c.Answer = v.Bool.Value
+	case *pb.Chosen_Text:
+		c.Answer = v.Text.Value
+	case *pb.Chosen_Select:
+		c.Answer = v.Select.Value
+	case *pb.Chosen_MultiSelect:
+		c.Answer = append([]string{}, v.MultiSelect.Values...)
+	case *pb.Chosen_File:
+		c.Answer = v.File.Value
+	}
+
+	return c
+}
+
+// proxyURL is where the daemon's HTTP proxy serves the app, judging by the address used to reach
+// the daemon. The app is on a sub-domain, which IP addresses don't have, except for loopback.
+func proxyURL(host string, app string) string {
+	hostname := ""
+
+	if strings.HasPrefix(host, "/") {
+		addr, err := ma.NewMultiaddr(host)
+		if err != nil {
+			return ""
+		}
+
+		for _, p := range []int{ma.P_IP4, ma.P_IP6, ma.P_DNS, ma.P_DNS4, ma.P_DNS6} {
+			if v, err := addr.ValueForProtocol(p); err == nil {
+				hostname = v
+				break
+			}
+		}
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		if !ip.IsLoopback() {
+			return ""
+		}
+		hostname = "localhost"
+	}
+
+	if hostname == "" {
+		return ""
+	}
+
+	return "http://" + net.JoinHostPort(app+"."+hostname, "8080")
+}
+
+// analysisJSON writes each reply as a line of JSON instead of showing the AnalysisView. An
+// interrupt cancels the analysis, a second one kills the client.
+func (s *Pusher) analysisJSON(ctx context.Context, stream pb.Srv_AnalysisClient, stop <-chan struct{}) (canceled bool, err error) {
+	var sendMutex sync.Mutex
+	send := func(req *pb.ActReq) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+
+		return stream.Send(req)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	var stopping, interrupted atomic.Bool
+	go func() {
+		select {
+		case <-interrupt:
+			signal.Stop(interrupt)
+			trace.Event(ctx, "interrupted")
+			interrupted.Store(true)
+		case <-stop:
+			stopping.Store(true)
+		case <-done:
+			return
+		}
+
+		terror.Ackf(ctx, "stream Send: %w", send(&pb.ActReq{Cancel: true}))
+	}()
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return interrupted.Load(), nil
+		}
+		if err != nil {
+			return interrupted.Load(), disconnectedError(terror.Errorf(ctx, "stream Recv: %w", err), s.session)
+		}
+
+		if res.Session != "" {
+			s.session = res.Session
+		}
+
+		switch v := res.Variant.(type) {
+		case nil:
+			return interrupted.Load(), nil
+		case *pb.ActReply_Log:
+			s.out.write(outputLine{Type: "log", Source: res.Source, Text: v.Log})
+		case *pb.ActReply_BuildStep:
+			s.out.write(outputLine{Type: "step", Source: res.Source, Step: &outputStep{
+				Number:   v.BuildStep.Number,
+				Name:     v.BuildStep.Name,
+				State:    stepStates[v.BuildStep.State],
+				Duration: v.BuildStep.Duration,
+				Error:    v.BuildStep.Error,
+			}})
+		case *pb.ActReply_Choice:
+			chosen, err := s.answer(v.Choice)
+			if err == nil && chosen == nil {
+				err = noAnswerError(v.Choice)
+			}
+
+			s.out.write(outputLine{Type: "choice", Source: res.Source, Choice: toOutputChoice(v.Choice, chosen)})
+
+			if err != nil {
+				terror.Ackf(ctx, "stream Send: %w", send(&pb.ActReq{Cancel: true}))
+				return false, err
+			}
+
+			if err := send(&pb.ActReq{Choice: chosen}); err != nil {
+				return false, terror.Errorf(ctx, "stream Send: %w", err)
+			}
+		case *pb.ActReply_AnalysisResult:
+			r := v.AnalysisResult
+			s.out.write(outputLine{Type: "result", Result: &outputResult{
+				UseDockerfile:         r.UseDockerfile,
+				UsePythonRequirements: r.UsePythonRequirements,
+				NeedsGit:              r.NeedsGit,
+				NeedsLibGL:            r.NeedsLibGL,
+				NeedsLibGlib:          r.NeedsLibGlib,
+			}})
+		case *pb.ActReply_Error:
+			// Such as the analysis being canceled before the app started
+			if stopping.Load() {
+				return false, nil
+			}
+
+			s.out.write(outputLine{Type: "error", Source: res.Source, Error: v.Error.Error})
+			return interrupted.Load(), fmt.Errorf("%s", v.Error.Error)
+		}
+	}
+}
+
+// writeSummary as the last line of output
+func (s *Pusher) writeSummary(ports []outputPort, err error) {
+	summary := &outputSummary{
+		OK:             err == nil,
+		App:            s.App,
+		Session:        s.session,
+		ProxyURL:       proxyURL(s.Host, s.App),
+		ForwardedPorts: ports,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if summary.ForwardedPorts == nil {
+		summary.ForwardedPorts = []outputPort{}
+	}
+
+	s.out.write(outputLine{Type: "summary", Summary: summary})
+}
@@ -91,6 +91,11 @@ func (s *Pusher) startPortForwarder(ctx context.Context, wg *sync.WaitGroup) (ne
 			return
 		}
 
+		if err := stream.Send(&pb.ForwardRequest{App: s.App}); err != nil {
+			terror.Ackf(ctx, "stream send: %w", err)
+			return
+		}
+
 		var wg sync.WaitGroup
 		wg.Add(2)
 
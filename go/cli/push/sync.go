@@ -2,10 +2,10 @@ package push
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"sync"
 
-	tea "github.com/charmbracelet/bubbletea"
 	"golang.org/x/sync/errgroup"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 	"premai.io/Ayup/go/internal/rpc"
@@ -18,7 +18,7 @@ func (s *Pusher) Download(ctx context.Context) error {
 	ctx, span := trace.Span(ctx, "download")
 	defer span.End()
 
-	stream, err := s.Client.Download(ctx, &pb.DownloadReq{})
+	stream, err := s.Client.Download(ctx, &pb.DownloadReq{App: s.App})
 	if err != nil {
 		return terror.Errorf(ctx, "client Download: %w", err)
 	}
@@ -33,7 +33,7 @@ func (s *Pusher) Download(ctx context.Context) error {
 	logChan := make(chan string)
 	cancelChan := make(chan struct{})
 	fileRecver := rpc.NewFileRecver(stream, logChan, retError, retError, s.SrcDir, s.AssistantDir)
-	logViewProg := tea.NewProgram(NewLogView("sync", cancelChan))
+	logViewProg := s.newLogViewProg("sync", "download", cancelChan)
 
 	var g errgroup.Group
 
@@ -76,7 +76,13 @@ func (s *Pusher) Download(ctx context.Context) error {
 	return g.Wait()
 }
 
-func (s *Pusher) Upload(pctx context.Context) (err error) {
+func (s *Pusher) Upload(ctx context.Context) error {
+	return s.upload(ctx, nil)
+}
+
+// upload the source, or if changed is not nil, only the changed paths which are relative to the
+// source directory
+func (s *Pusher) upload(pctx context.Context, changed []string) (err error) {
 	ctx, span := trace.Span(pctx, "upload")
 	defer span.End()
 
@@ -108,7 +114,7 @@ func (s *Pusher) Upload(pctx context.Context) (err error) {
 	defer wg.Wait()
 
 	cancelChan := make(chan struct{})
-	logViewProg := tea.NewProgram(NewLogView("sync", cancelChan))
+	logViewProg := s.newLogViewProg("sync", "upload", cancelChan)
 	defer logViewProg.Send(DoneMsg{})
 
 	wg.Add(1)
@@ -141,8 +147,17 @@ func (s *Pusher) Upload(pctx context.Context) (err error) {
 		return terror.Errorf(ctx, msg, args...)
 	}
 
+	// A dry run's source doesn't replace the app's
+	if err := stream.Send(&pb.FileChunks{App: s.App, Incremental: changed != nil, Analyze: s.Analyze}); err != nil {
+		return terror.Errorf(ctx, "stream send: %w", err)
+	}
+
 	sender := rpc.NewFileSender(stream, cancelChan, logChan, retError, retError)
 
+	if changed != nil {
+		return sender.SendFiles(ctx, pb.Source_app, src, changed)
+	}
+
 	if err := sender.SendDir(ctx, pb.Source_app, src); err != nil {
 		return err
 	}
@@ -153,3 +168,38 @@ func (s *Pusher) Upload(pctx context.Context) (err error) {
 
 	return sender.SendDir(ctx, pb.Source_assistant, s.AssistantDir)
 }
+
+// syncDev sends the changed paths to the app while it runs in dev mode, so it is restarted
+// without being rebuilt. An error is returned if the daemon can't apply them.
+func (s *Pusher) syncDev(pctx context.Context, changed []string) (err error) {
+	ctx, span := trace.Span(pctx, "sync dev")
+	defer span.End()
+
+	stream, err := s.Client.Upload(ctx)
+	if err != nil {
+		return terror.Errorf(ctx, "sync stream: %w", err)
+	}
+
+	// An older daemon only sees incremental and says the app is busy
+	if err := stream.Send(&pb.FileChunks{App: s.App, Incremental: true, Sync: true}); err != nil {
+		return terror.Errorf(ctx, "stream send: %w", err)
+	}
+
+	retError := func(msg string, args ...any) error {
+		return terror.Errorf(ctx, msg, args...)
+	}
+	sender := rpc.NewFileSender(stream, nil, nil, retError, retError)
+	if err := sender.SendFiles(ctx, pb.Source_app, s.SrcDir, changed); err != nil {
+		return err
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return terror.Errorf(ctx, "stream close and recv: %w", err)
+	}
+	if res.Error != nil {
+		return fmt.Errorf("%s", res.Error.Error)
+	}
+
+	return nil
+}
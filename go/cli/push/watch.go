@@ -0,0 +1,304 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+const (
+	// How long the source has to stay the same before it is pushed again
+	watchDebounce = 300 * time.Millisecond
+	// How many of the latest rebuilds are shown
+	watchHistory = 5
+)
+
+type rebuild struct {
+	number  int
+	at      time.Time
+	changed []string
+
+	// Set once the app has stopped or been replaced
+	finished bool
+	err      error
+}
+
+func (s rebuild) String() string {
+	files := strings.Join(s.changed[:min(2, len(s.changed))], ", ")
+	if len(s.changed) > 2 {
+		files += fmt.Sprintf(" +%d", len(s.changed)-2)
+	}
+
+	state := "running"
+	if s.err != nil {
+		state = "failed"
+	} else if s.finished {
+		state = "ok"
+	}
+
+	return fmt.Sprintf("#%d %s %s %s", s.number, s.at.Format(time.TimeOnly), files, state)
+}
+
+// rebuildHistory is a line showing the latest rebuilds, empty if there are none
+func (s *Pusher) rebuildHistory() string {
+	if len(s.rebuilds) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, r := range s.rebuilds[max(0, len(s.rebuilds)-watchHistory):] {
+		parts = append(parts, r.String())
+	}
+
+	return "Rebuilds: " + strings.Join(parts, " | ")
+}
+
+func (s *Pusher) finishRebuild(err error) {
+	if len(s.rebuilds) == 0 {
+		return
+	}
+
+	r := &s.rebuilds[len(s.rebuilds)-1]
+	r.finished = true
+	r.err = err
+}
+
+// addWatchDirs watches dir and the directories below it, except those which aren't uploaded. The
+// files found are returned relative to root.
+func addWatchDirs(w *fsnotify.Watcher, root string, dir string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != dir && rpc.Ignored(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return w.Add(path)
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+
+		return nil
+	})
+
+	return files, err
+}
+
+// watchChanges sends the paths which changed, relative to root, once nothing has changed for
+// watchDebounce. New directories are watched as they are created.
+func watchChanges(ctx context.Context, w *fsnotify.Watcher, root string, batches chan<- []string) {
+	changed := make(map[string]bool)
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			rel, err := filepath.Rel(root, ev.Name)
+			if err != nil || slices.ContainsFunc(strings.Split(filepath.ToSlash(rel), "/"), rpc.Ignored) {
+				continue
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+
+			trace.Event(ctx, "source changed", attribute.String("path", rel), attribute.String("op", ev.Op.String()))
+
+			if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+				if ev.Has(fsnotify.Create) {
+					files, err := addWatchDirs(w, root, ev.Name)
+					terror.Ackf(ctx, "addWatchDirs: %w", err)
+					for _, f := range files {
+						changed[f] = true
+					}
+				}
+			} else {
+				changed[rel] = true
+			}
+
+			if len(changed) > 0 {
+				debounce = time.After(watchDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			terror.Ackf(ctx, "watcher: %w", err)
+		case <-debounce:
+			debounce = nil
+			batch := make([]string, 0, len(changed))
+			for path := range changed {
+				batch = append(batch, path)
+			}
+			slices.Sort(batch)
+			changed = make(map[string]bool)
+
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printWatch tells the user what watch mode is doing when the output is text
+func (s *Pusher) printWatch(msg string) {
+	if s.out != nil {
+		return
+	}
+
+	fmt.Printf("[watch] %s\n", msg)
+}
+
+// waitChanges returns the next batch of changes, or nil if the user interrupts first
+func waitChanges(ctx context.Context, batches <-chan []string) ([]string, error) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	select {
+	case changed := <-batches:
+		return changed, nil
+	case <-interrupt:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type analysisEnd struct {
+	canceled bool
+	err      error
+}
+
+// nextRebuild waits for changes which need the app to be rebuilt, unless the analysis ends first.
+// In dev mode other changes are synced to the running app, if that fails the error is returned
+// with the changes.
+func (s *Pusher) nextRebuild(ctx context.Context, batches <-chan []string, ended <-chan analysisEnd) ([]string, *analysisEnd, error) {
+	for {
+		select {
+		case changed := <-batches:
+			if !s.Dev {
+				return changed, nil, nil
+			}
+
+			if path := rpc.RebuildFile(changed); path != "" {
+				trace.Event(ctx, "rebuild file changed", attribute.String("path", path))
+				return changed, nil, nil
+			}
+
+			if err := s.syncDev(ctx, changed); err != nil {
+				return changed, nil, err
+			}
+		case end := <-ended:
+			return nil, &end, nil
+		}
+	}
+}
+
+// watch pushes the app again each time the source changes, until the user cancels the push. The
+// port forwarder is left running, so it keeps working across pushes.
+func (s *Pusher) watch(ctx context.Context) error {
+	ctx, span := trace.Span(ctx, "watch")
+	defer span.End()
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return terror.Errorf(ctx, "fsnotify NewWatcher: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "watcher Close: %w", w.Close()) }()
+
+	if _, err := addWatchDirs(w, s.SrcDir, s.SrcDir); err != nil {
+		return terror.Errorf(ctx, "addWatchDirs: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan []string)
+	go watchChanges(ctx, w, s.SrcDir, batches)
+
+	for {
+		stop := make(chan struct{})
+		ended := make(chan analysisEnd, 1)
+		go func() {
+			canceled, err := s.Analysis(ctx, stop)
+			ended <- analysisEnd{canceled: canceled, err: err}
+		}()
+
+		changed, end, syncErr := s.nextRebuild(ctx, batches, ended)
+		if end == nil {
+			close(stop)
+			end := <-ended
+			s.finishRebuild(end.err)
+
+			if syncErr != nil {
+				s.printWatch(fmt.Sprintf("Can't sync the changes, rebuilding: %v", syncErr))
+			}
+		} else {
+			s.finishRebuild(end.err)
+			if end.canceled {
+				return end.err
+			}
+
+			if end.err != nil && s.out == nil {
+				fmt.Println(tui.ErrorStyle.Render("Error!"), end.err)
+			}
+			s.printWatch("Waiting for the source to change, interrupt to stop")
+
+			if changed, err = waitChanges(ctx, batches); changed == nil {
+				return err
+			}
+		}
+
+		s.rebuilds = append(s.rebuilds, rebuild{
+			number:  len(s.rebuilds) + 1,
+			at:      time.Now(),
+			changed: changed,
+		})
+		if s.out != nil {
+			r := &outputRebuild{Number: len(s.rebuilds), Changed: changed}
+			if syncErr != nil {
+				r.SyncError = syncErr.Error()
+			}
+			s.out.write(outputLine{Type: "rebuild", Rebuild: r})
+		}
+		s.printWatch(fmt.Sprintf("Rebuild %s", s.rebuilds[len(s.rebuilds)-1]))
+
+		if err := s.upload(ctx, changed); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+type Run struct {
+	Host       string
+	P2pPrivKey string
+
+	App  string
+	Args []string
+}
+
+// ExitError is returned when the remote command exits with a non-zero code
+type ExitError struct {
+	Code int32
+}
+
+func (s *ExitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", s.Code)
+}
+
+func (s *Run) Run(pctx context.Context) (err error) {
+	ctx, span := trace.Span(pctx, "run")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	stream, err := c.Run(ctx)
+	if err != nil {
+		return terror.Errorf(ctx, "client Run: %w", err)
+	}
+	defer func() {
+		terror.Ackf(ctx, "stream CloseSend: %w", stream.CloseSend())
+	}()
+
+	if err := stream.Send(&pb.ActReq{App: s.App, Args: s.Args}); err != nil {
+		return terror.Errorf(ctx, "stream Send: %w", err)
+	}
+
+	// Forward Ctrl-C to the remote command, repeating it escalates to SIGTERM then SIGKILL
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	defer signal.Stop(sigChan)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigChan:
+				terror.Ackf(ctx, "stream Send: %w", stream.Send(&pb.ActReq{Cancel: true}))
+			}
+		}
+	}()
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("the server closed the stream without an exit code")
+			}
+			return terror.Errorf(ctx, "stream Recv: %w", err)
+		}
+
+		switch v := res.Variant.(type) {
+		case *pb.ActReply_Log:
+			out := os.Stderr
+			if res.Source == "task" {
+				out = os.Stdout
+			}
+			_, _ = out.WriteString(v.Log)
+		case *pb.ActReply_Error:
+			return fmt.Errorf("remote error: %s", v.Error.Error)
+		case *pb.ActReply_ExitCode:
+			if v.ExitCode != 0 {
+				return &ExitError{Code: v.ExitCode}
+			}
+			return nil
+		}
+	}
+}
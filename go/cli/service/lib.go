@@ -0,0 +1,419 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/logfile"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+const unitName = "ayup.service"
+
+// Scope is whether the service is managed by the user's systemd instance or the system's. A system
+// service still runs as the user who installed it because Ayup is rootless. Root access is gained
+// with sudo where it is needed.
+type Scope struct {
+	System bool
+}
+
+func (s Scope) unitPath() (string, error) {
+	if s.System {
+		return filepath.Join("/etc/systemd/system", unitName), nil
+	}
+
+	confDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(confDir, "systemd", "user", unitName), nil
+}
+
+// command returns a command which will run with the right privileges and flags for the scope
+func (s Scope) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if !s.System {
+		args = append([]string{"--user"}, args...)
+	} else if os.Geteuid() != 0 {
+		args = append([]string{name}, args...)
+		name = "sudo"
+	}
+
+	trace.Event(ctx, "exec", attribute.String("name", name), attribute.StringSlice("args", args))
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd
+}
+
+func (s Scope) systemctl(ctx context.Context, args ...string) error {
+	if err := s.command(ctx, "systemctl", args...).Run(); err != nil {
+		return terror.Errorf(ctx, "systemctl %s: %w", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+func (s Scope) writeUnit(ctx context.Context, path string, unit []byte) error {
+	if !s.System {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return terror.Errorf(ctx, "os MkdirAll: %w", err)
+		}
+
+		if err := os.WriteFile(path, unit, 0644); err != nil {
+			return terror.Errorf(ctx, "os WriteFile: %w", err)
+		}
+
+		return nil
+	}
+
+	cmd := s.command(ctx, "tee", path)
+	cmd.Stdin = bytes.NewReader(unit)
+	cmd.Stdout = nil
+	if err := cmd.Run(); err != nil {
+		return terror.Errorf(ctx, "tee: %w", err)
+	}
+
+	return nil
+}
+
+func (s Scope) removeUnit(ctx context.Context, path string) error {
+	if !s.System {
+		if err := os.Remove(path); err != nil {
+			return terror.Errorf(ctx, "os Remove: %w", err)
+		}
+		return nil
+	}
+
+	if err := s.command(ctx, "rm", path).Run(); err != nil {
+		return terror.Errorf(ctx, "rm: %w", err)
+	}
+
+	return nil
+}
+
+var unitTemplate = template.Must(template.New("unit").Parse(`# Generated by ay daemon install, changes will be shown before being overwritten
+[Unit]
+Description=Ayup daemon
+Documentation=https://github.com/premAI-io/Ayup
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{ .Exe }} daemon start
+EnvironmentFile={{ .EnvFile }}
+Environment="PATH={{ .Path }}"
+{{- if .System }}
+User={{ .User }}
+RuntimeDirectory=ayup
+{{- end }}
+Restart=on-failure
+RestartSec=5
+# Only signal the daemon, it stops the apps before Buildkit
+KillMode=mixed
+TimeoutStopSec=60
+# Needed to apply resource limits to apps
+Delegate=yes
+
+[Install]
+WantedBy={{ if .System }}multi-user.target{{ else }}default.target{{ end }}
+`))
+
+type unitVars struct {
+	Exe     string
+	EnvFile string
+	Path    string
+	System  bool
+	User    string
+}
+
+type Install struct {
+	Scope
+	Force bool
+
+	Host                 string
+	P2pPrivKey           string
+	P2pAuthorizedClients string
+}
+
+// saveEnv stores the daemon's settings in Ayup's config file which the service reads
+func (s *Install) saveEnv(ctx context.Context) (string, error) {
+	if s.P2pPrivKey == "" {
+		// Stores a new key in the config file
+		if _, err := rpc.EnsurePrivKey(ctx, "AYUP_SERVER_P2P_PRIV_KEY", ""); err != nil {
+			return "", err
+		}
+	} else if err := conf.Set(ctx, "AYUP_SERVER_P2P_PRIV_KEY", s.P2pPrivKey); err != nil {
+		return "", err
+	}
+
+	if err := conf.Set(ctx, "AYUP_DAEMON_HOST", s.Host); err != nil {
+		return "", err
+	}
+
+	if s.P2pAuthorizedClients != "" {
+		if err := conf.Set(ctx, "AYUP_P2P_AUTHORIZED_CLIENTS", s.P2pAuthorizedClients); err != nil {
+			return "", err
+		}
+	}
+
+	return conf.FilePath(ctx)
+}
+
+func (s *Install) unit(ctx context.Context, envFile string) ([]byte, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, terror.Errorf(ctx, "os Executable: %w", err)
+	}
+
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "filepath EvalSymlinks: %w", err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, terror.Errorf(ctx, "user Current: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := unitTemplate.Execute(&buf, unitVars{
+		Exe:     exe,
+		EnvFile: envFile,
+		Path:    os.Getenv("PATH"),
+		System:  s.System,
+		User:    u.Username,
+	}); err != nil {
+		return nil, terror.Errorf(ctx, "template Execute: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *Install) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon install")
+	defer span.End()
+
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("the daemon runs rootless; install it as the user it should run as and sudo will be used where needed")
+	}
+
+	for _, dep := range []string{"rootlesskit", "buildkitd"} {
+		if _, err := exec.LookPath(dep); err != nil {
+			fmt.Println(tui.ErrorStyle.Render("Warning:"), dep, "was not found in PATH, the service will fail to start without it")
+		}
+	}
+
+	envFile, err := s.saveEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	unit, err := s.unit(ctx, envFile)
+	if err != nil {
+		return err
+	}
+
+	path, err := s.unitPath()
+	if err != nil {
+		return terror.Errorf(ctx, "unitPath: %w", err)
+	}
+
+	changed := true
+	old, err := os.ReadFile(path)
+	if err == nil {
+		if bytes.Equal(old, unit) {
+			changed = false
+			fmt.Println(tui.TitleStyle.Render("Unit file is up to date:"), path)
+		} else {
+			diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        difflib.SplitLines(string(old)),
+				B:        difflib.SplitLines(string(unit)),
+				FromFile: path,
+				ToFile:   path + " (new)",
+				Context:  3,
+			})
+			if err != nil {
+				return terror.Errorf(ctx, "difflib GetUnifiedDiffString: %w", err)
+			}
+
+			fmt.Println(tui.TitleStyle.Render("The unit file would change:"))
+			fmt.Println(diff)
+
+			if !s.Force {
+				return fmt.Errorf("not replacing the existing unit file, use --force to replace it")
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return terror.Errorf(ctx, "os ReadFile: %w", err)
+	}
+
+	if changed {
+		if err := s.writeUnit(ctx, path, unit); err != nil {
+			return err
+		}
+		fmt.Println(tui.TitleStyle.Render("Wrote unit file:"), path)
+
+		if err := s.systemctl(ctx, "daemon-reload"); err != nil {
+			return err
+		}
+	}
+
+	if err := s.systemctl(ctx, "enable", "--now", unitName); err != nil {
+		return err
+	}
+
+	// enable --now doesn't restart an already running service
+	if changed && old != nil {
+		if err := s.systemctl(ctx, "restart", unitName); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Service enabled:"), unitName)
+	if !s.System {
+		fmt.Println("To keep the daemon running after you log out, run: loginctl enable-linger")
+	}
+
+	return nil
+}
+
+type Uninstall struct {
+	Scope
+}
+
+func (s *Uninstall) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon uninstall")
+	defer span.End()
+
+	path, err := s.unitPath()
+	if err != nil {
+		return terror.Errorf(ctx, "unitPath: %w", err)
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		fmt.Println("The service is not installed:", path)
+		return nil
+	}
+
+	if err := s.systemctl(ctx, "disable", "--now", unitName); err != nil {
+		return err
+	}
+
+	if err := s.removeUnit(ctx, path); err != nil {
+		return err
+	}
+
+	if err := s.systemctl(ctx, "daemon-reload"); err != nil {
+		return err
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Removed:"), path)
+
+	return nil
+}
+
+type Logs struct {
+	Scope
+	// daemon for the service's journal, otherwise the name of a component's log file
+	Component string
+	Follow    bool
+	Lines     int
+}
+
+// componentLogs prints a log file written by the daemon, these are kept when it isn't a service
+func (s *Logs) componentLogs(ctx context.Context) error {
+	path := conf.LogPath(s.Component)
+
+	tail, err := logfile.Tail(path, s.Lines)
+	if err != nil {
+		return terror.Errorf(ctx, "logfile Tail: %w", err)
+	}
+
+	if _, err := os.Stdout.Write(tail); err != nil {
+		return err
+	}
+
+	if !s.Follow {
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := logfile.Follow(ctx, path, os.Stdout); err != nil {
+		return terror.Errorf(ctx, "logfile Follow: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Logs) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "daemon logs")
+	defer span.End()
+
+	if s.Component != "daemon" {
+		return s.componentLogs(ctx)
+	}
+
+	args := []string{"--unit", unitName, "--lines", fmt.Sprint(s.Lines)}
+	if s.Follow {
+		args = append(args, "--follow")
+	}
+
+	// Reading the system journal doesn't need root if the user is in the right group
+	cmd := s.command(ctx, "journalctl", args...)
+	if s.System {
+		cmd = exec.CommandContext(ctx, "journalctl", args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := cmd.Run(); err != nil {
+		return terror.Errorf(ctx, "journalctl: %w", err)
+	}
+
+	return nil
+}
+
+// Status prints systemd's view of the service
+func Status(ctx context.Context, scope Scope) error {
+	cmd := exec.CommandContext(ctx, "systemctl", "status", "--no-pager", unitName)
+	if !scope.System {
+		cmd = exec.CommandContext(ctx, "systemctl", "--user", "status", "--no-pager", unitName)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// systemctl status exits non-zero when the service isn't running
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil
+		}
+		return terror.Errorf(ctx, "systemctl status: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/docker/go-units"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+type Status struct {
+	Host       string
+	P2pPrivKey string
+}
+
+func fmtState(app *pb.AppStatus) string {
+	switch app.State {
+	case pb.AppState_exited:
+		return fmt.Sprintf("exited (%d)", app.ExitCode)
+	case pb.AppState_failed:
+		return tui.ErrorStyle.Render("failed")
+	case pb.AppState_oomKilled:
+		return tui.ErrorStyle.Render("OOM killed")
+	default:
+		return app.State.String()
+	}
+}
+
+func fmtLimits(l *pb.Limits) string {
+	if l == nil {
+		return "-"
+	}
+
+	var parts []string
+	if l.MemoryMax > 0 {
+		parts = append(parts, "memory "+units.BytesSize(float64(l.MemoryMax)))
+	}
+	if l.Cpus > 0 {
+		parts = append(parts, fmt.Sprintf("cpus %g", l.Cpus))
+	}
+	if l.CpuWeight > 0 {
+		parts = append(parts, fmt.Sprintf("cpu weight %d", l.CpuWeight))
+	}
+	if l.PidsMax > 0 {
+		parts = append(parts, fmt.Sprintf("pids %d", l.PidsMax))
+	}
+
+	if len(parts) < 1 {
+		return "none"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (s *Status) Run(pctx context.Context) error {
+	ctx, span := trace.Span(pctx, "status")
+	defer span.End()
+
+	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+	if err != nil {
+		return err
+	}
+
+	c, err := rpc.Client(ctx, s.Host, privKey)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Status(ctx, &pb.StatusReq{})
+	if err != nil {
+		return terror.Errorf(ctx, "grpc status: %w", err)
+	}
+
+	if res.GetError() != nil {
+		return fmt.Errorf("remote error: %s", res.GetError().Error)
+	}
+
+	if len(res.Apps) < 1 {
+		fmt.Println("No apps have been pushed yet")
+		return nil
+	}
+
+	fmt.Println(AppsTable(res.Apps).Render())
+
+	return nil
+}
+
+func AppsTable(apps []*pb.AppStatus) *table.Table {
+	t := tui.NewTable("App", "State", "Limits")
+	for _, app := range apps {
+		t.Row(app.Name, fmtState(app), fmtLimits(app.Limits))
+	}
+
+	return t
+}
@@ -5,11 +5,15 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
 
 	"go.opentelemetry.io/otel/trace"
 
@@ -19,25 +23,44 @@ import (
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/joho/godotenv"
+	"github.com/mattn/go-isatty"
 	"github.com/muesli/termenv"
 
+	"premai.io/Ayup/go/cli/daemon"
+	"premai.io/Ayup/go/cli/eject"
+	"premai.io/Ayup/go/cli/events"
+	"premai.io/Ayup/go/cli/jobs"
 	"premai.io/Ayup/go/cli/key"
 	"premai.io/Ayup/go/cli/login"
 	"premai.io/Ayup/go/cli/push"
+	"premai.io/Ayup/go/cli/run"
+	"premai.io/Ayup/go/cli/status"
 	"premai.io/Ayup/go/internal/terror"
 	ayTrace "premai.io/Ayup/go/internal/trace"
 	"premai.io/Ayup/go/internal/tui"
 )
 
 type Globals struct {
-	Ctx    context.Context
-	Tracer trace.Tracer
-	Logger *slog.Logger
+	Ctx     context.Context
+	Tracer  trace.Tracer
+	Logger  *slog.Logger
+	Version string
 }
 
 type PushCmd struct {
 	Path      string `arg:"" optional:"" name:"path" help:"Path to the source code to be pushed" type:"path"`
+	Name      string `help:"The app's name on the server, defaults to the source directory's name"`
 	Assistant string `env:"AYUP_ASSISTANT_PATH" help:"The location of the assistant plugin source if any" type:"path"`
+	Attach    string `help:"Attach to a push which is still going on the server, such as after the connection dropped, instead of uploading the source; the session's ID is printed at the start of the push"`
+	Watch     bool   `help:"Keep the push going and push the changes each time the source is edited, the app is rebuilt and restarted while forwarded ports stay open"`
+	Dev       bool   `help:"Like --watch, but changes are copied into the running app which is restarted without a rebuild, unless a dependency file such as requirements.txt changed"`
+	Publish   string `help:"Push the app's image to this registry reference after each successful build e.g. registry.local:5000/team/app:tag, overrides AYUP_PUBLISH in .ayup-conf"`
+
+	NonInteractive bool   `env:"AYUP_NON_INTERACTIVE" help:"Print the output line by line and don't ask questions, choices without an answer make the push fail; this is the default when stdout is not a terminal"`
+	Yes            bool   `xor:"answer" help:"Answer yes to questions which aren't in the answers file, other questions get the server's suggestion"`
+	No             bool   `xor:"answer" help:"Answer no to yes or no questions which aren't in the answers file"`
+	Answers        string `env:"AYUP_ANSWERS" help:"A file of answers to questions by their keys, in dotenv format e.g. guessRequirements=yes; multiple selections are comma separated" type:"existingfile"`
+	Output         string `enum:"text,json" default:"text" help:"How to show what happens, json writes one object per line and implies --non-interactive"`
 
 	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of a service we can push to"`
 	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
@@ -53,12 +76,35 @@ func (s *PushCmd) Run(g Globals) (err error) {
 			}
 		}
 
+		if s.Name == "" {
+			s.Name = push.AppNameFromPath(s.Path)
+		}
+
+		var answers map[string]string
+		if s.Answers != "" {
+			answers, err = godotenv.Read(s.Answers)
+			if err != nil {
+				err = terror.Errorf(ctx, "godotenv Read: %w", err)
+				return
+			}
+		}
+
 		p := push.Pusher{
 			Tracer:       g.Tracer,
 			Host:         s.Host,
 			P2pPrivKey:   s.P2pPrivKey,
 			AssistantDir: s.Assistant,
 			SrcDir:       s.Path,
+			App:          s.Name,
+			Attach:       s.Attach,
+			Watch:        s.Watch || s.Dev,
+			Dev:          s.Dev,
+			Publish:      s.Publish,
+			Interactive:  !s.NonInteractive && s.Output == "text" && isatty.IsTerminal(os.Stdout.Fd()),
+			Answers:      answers,
+			Yes:          s.Yes,
+			No:           s.No,
+			Output:       s.Output,
 		}
 
 		err = p.Run(pprof.WithLabels(g.Ctx, pprof.Labels("command", "push")))
@@ -67,6 +113,118 @@ func (s *PushCmd) Run(g Globals) (err error) {
 	return
 }
 
+type BuildCmd struct {
+	Path   string `arg:"" optional:"" name:"path" help:"Path to the source code to be built" type:"path"`
+	Name   string `help:"The app's name on the server, defaults to the source directory's name"`
+	Output string `short:"o" help:"Where to write the build, type=oci,dest=app.tar for an OCI image or type=local,dest=dir for its files; defaults to an OCI image named after the app"`
+
+	NonInteractive bool   `env:"AYUP_NON_INTERACTIVE" help:"Print the output line by line and don't ask questions, choices without an answer make the build fail; this is the default when stdout is not a terminal"`
+	Yes            bool   `xor:"answer" help:"Answer yes to questions which aren't in the answers file, other questions get the server's suggestion"`
+	No             bool   `xor:"answer" help:"Answer no to yes or no questions which aren't in the answers file"`
+	Answers        string `env:"AYUP_ANSWERS" help:"A file of answers to questions by their keys, in dotenv format e.g. guessRequirements=yes; multiple selections are comma separated" type:"existingfile"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of a service we can push to"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *BuildCmd) Run(g Globals) (err error) {
+	pprof.Do(g.Ctx, pprof.Labels("command", "build"), func(ctx context.Context) {
+		if s.Path == "" {
+			s.Path, err = os.Getwd()
+			if err != nil {
+				err = terror.Errorf(ctx, "getwd: %w", err)
+				return
+			}
+		}
+
+		if s.Name == "" {
+			s.Name = push.AppNameFromPath(s.Path)
+		}
+
+		if s.Output == "" {
+			s.Output = fmt.Sprintf("type=oci,dest=%s.tar", s.Name)
+		}
+		var export push.ExportOutput
+		export, err = push.ParseExportOutput(s.Output)
+		if err != nil {
+			err = fmt.Errorf("--output: %w", err)
+			return
+		}
+
+		var answers map[string]string
+		if s.Answers != "" {
+			answers, err = godotenv.Read(s.Answers)
+			if err != nil {
+				err = terror.Errorf(ctx, "godotenv Read: %w", err)
+				return
+			}
+		}
+
+		p := push.Pusher{
+			Tracer:      g.Tracer,
+			Host:        s.Host,
+			P2pPrivKey:  s.P2pPrivKey,
+			SrcDir:      s.Path,
+			App:         s.Name,
+			Export:      &export,
+			Interactive: !s.NonInteractive && isatty.IsTerminal(os.Stdout.Fd()),
+			Answers:     answers,
+			Yes:         s.Yes,
+			No:          s.No,
+		}
+
+		err = p.Run(pprof.WithLabels(g.Ctx, pprof.Labels("command", "build")))
+	})
+
+	return
+}
+
+type AnalyzeCmd struct {
+	Path      string `arg:"" optional:"" name:"path" help:"Path to the source code to be analysed" type:"path"`
+	Name      string `help:"The app's name on the server, defaults to the source directory's name"`
+	Assistant string `env:"AYUP_ASSISTANT_PATH" help:"The location of the assistant plugin source if any" type:"path"`
+	Json      bool   `help:"Write the report and anything else that happens as lines of JSON, like 'ay push --output json'"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of a service we can push to"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *AnalyzeCmd) Run(g Globals) (err error) {
+	pprof.Do(g.Ctx, pprof.Labels("command", "analyze"), func(ctx context.Context) {
+		if s.Path == "" {
+			s.Path, err = os.Getwd()
+			if err != nil {
+				err = terror.Errorf(ctx, "getwd: %w", err)
+				return
+			}
+		}
+
+		if s.Name == "" {
+			s.Name = push.AppNameFromPath(s.Path)
+		}
+
+		output := "text"
+		if s.Json {
+			output = "json"
+		}
+
+		p := push.Pusher{
+			Tracer:       g.Tracer,
+			Host:         s.Host,
+			P2pPrivKey:   s.P2pPrivKey,
+			AssistantDir: s.Assistant,
+			SrcDir:       s.Path,
+			App:          s.Name,
+			Analyze:      true,
+			Output:       output,
+		}
+
+		err = p.Run(pprof.WithLabels(g.Ctx, pprof.Labels("command", "analyze")))
+	})
+
+	return
+}
+
 type LoginCmd struct {
 	Host       string `arg:"" env:"AYUP_LOGIN_HOST" help:"The server's P2P multi-address including the peer ID e.g. /dns4/example.com/50051/p2p/1..."`
 	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"The client's private key, generated automatically if not set, also see 'ay key new'"`
@@ -81,6 +239,196 @@ func (s *LoginCmd) Run(g Globals) error {
 	return l.Run(g.Ctx)
 }
 
+type StatusCmd struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *StatusCmd) Run(g Globals) error {
+	st := status.Status{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+	}
+
+	return st.Run(g.Ctx)
+}
+
+type EventsCmd struct {
+	App   string   `help:"Only show the events of this app"`
+	Types []string `name:"type" help:"Only show these events e.g. --type appCrashed --type buildFinished"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *EventsCmd) Run(g Globals) error {
+	e := events.Events{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+		App:        s.App,
+		Types:      s.Types,
+	}
+
+	return e.Run(g.Ctx)
+}
+
+type RunCmd struct {
+	App  string   `arg:"" help:"The name of the app whose last build the command is ran in"`
+	Args []string `arg:"" passthrough:"" help:"The command and its arguments e.g. -- python manage.py migrate"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *RunCmd) Run(g Globals) error {
+	r := run.Run{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+		App:        s.App,
+		Args:       s.Args,
+	}
+
+	return r.Run(g.Ctx)
+}
+
+type JobsCmd struct {
+	App     string `arg:"" help:"The name of the app"`
+	Log     string `help:"Print the output of this job's last run instead of listing the jobs"`
+	RunsAgo uint32 `help:"With --log, print the output from this many runs ago"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *JobsCmd) Run(g Globals) error {
+	j := jobs.Jobs{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+		App:        s.App,
+		Log:        s.Log,
+		RunsAgo:    s.RunsAgo,
+	}
+
+	return j.Run(g.Ctx)
+}
+
+type EjectCmd struct {
+	Path  string `arg:"" optional:"" name:"path" help:"Path to the app's source code, the Dockerfile is written here" type:"path"`
+	Name  string `help:"The app's name on the server, defaults to the source directory's name"`
+	Force bool   `help:"Replace an existing Dockerfile and .dockerignore"`
+
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *EjectCmd) Run(g Globals) error {
+	if s.Path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return terror.Errorf(g.Ctx, "getwd: %w", err)
+		}
+		s.Path = wd
+	}
+
+	if s.Name == "" {
+		s.Name = push.AppNameFromPath(s.Path)
+	}
+
+	e := eject.Eject{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+		App:        s.Name,
+		SrcDir:     s.Path,
+		Force:      s.Force,
+	}
+
+	return e.Run(g.Ctx)
+}
+
+type DaemonRestartCmd struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+}
+
+func (s *DaemonRestartCmd) Run(g Globals) error {
+	r := daemon.Restart{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+	}
+
+	return r.Run(g.Ctx)
+}
+
+type DaemonStatusCmd struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+
+	Service bool `help:"Show the status of the service installed with 'ay daemon install' instead"`
+	ServiceScope
+}
+
+func (s *DaemonStatusCmd) Run(g Globals) error {
+	if s.Service {
+		return serviceStatus(g, s.ServiceScope)
+	}
+
+	st := daemon.Status{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+	}
+
+	return st.Run(g.Ctx)
+}
+
+type DaemonDfCmd struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+
+	Filter     []string      `sep:"none" help:"Only include Buildkit cache records matching the filter e.g. type==exec.cachemount"`
+	StaleAfter time.Duration `default:"168h" help:"Apps that have been idle for this long are shown as stale"`
+	Verbose    bool          `short:"v" help:"List each cache record"`
+}
+
+func (s *DaemonDfCmd) Run(g Globals) error {
+	d := daemon.Df{
+		Host:       s.Host,
+		P2pPrivKey: s.P2pPrivKey,
+		Filters:    s.Filter,
+		StaleAfter: s.StaleAfter,
+		Verbose:    s.Verbose,
+	}
+
+	return d.Run(g.Ctx)
+}
+
+type DaemonPruneCmd struct {
+	Host       string `env:"AYUP_PUSH_HOST" default:"localhost:50051" help:"The location of the service"`
+	P2pPrivKey string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"Secret encryption key produced by 'ay key new'"`
+
+	KeepStorage  string        `help:"Stop once the cache is at most this size e.g. 10G, by default everything unused is pruned"`
+	KeepDuration time.Duration `help:"Keep cache records used within this long e.g. 48h"`
+	Filter       []string      `sep:"none" help:"Only prune Buildkit cache records matching the filter e.g. type==exec.cachemount"`
+	All          bool          `help:"Include Buildkit's internal and frontend records"`
+
+	Apps       bool          `help:"Also remove the source and history of stale apps"`
+	StaleAfter time.Duration `default:"168h" help:"Apps that are not running, have no jobs and have been idle for this long are stale"`
+}
+
+func (s *DaemonPruneCmd) Run(g Globals) error {
+	p := daemon.Prune{
+		Host:         s.Host,
+		P2pPrivKey:   s.P2pPrivKey,
+		KeepStorage:  s.KeepStorage,
+		KeepDuration: s.KeepDuration,
+		Filters:      s.Filter,
+		All:          s.All,
+		Apps:         s.Apps,
+		StaleAfter:   s.StaleAfter,
+	}
+
+	return p.Run(g.Ctx)
+}
+
 type KeyNewCmd struct{}
 
 func (s *KeyNewCmd) Run(g Globals) error {
@@ -88,12 +436,28 @@ func (s *KeyNewCmd) Run(g Globals) error {
 }
 
 var cli struct {
-	Push  PushCmd  `cmd:"" help:"Figure out how to deploy your application"`
-	Login LoginCmd `cmd:"" help:"Login to the Ayup service"`
+	Push    PushCmd    `cmd:"" help:"Figure out how to deploy your application"`
+	Build   BuildCmd   `cmd:"" help:"Build your application without running it and download the result as an OCI image or files"`
+	Analyze AnalyzeCmd `cmd:"" help:"Show how your application would be built and ran without building or running it"`
+	Login   LoginCmd   `cmd:"" help:"Login to the Ayup service"`
+	Status  StatusCmd  `cmd:"" help:"Show the state of the apps on the server"`
+	Run     RunCmd     `cmd:"" help:"Run a one-off command, such as a migration, in a container made from an app's last build"`
+	Jobs    JobsCmd    `cmd:"" help:"Show an app's scheduled jobs and their history"`
+	Events  EventsCmd  `cmd:"" help:"Follow what happens on the server, such as pushes, builds and crashes"`
+	Eject   EjectCmd   `cmd:"" help:"Write a Dockerfile into the source which builds the app like Ayup does, so it can be customised"`
 
 	Daemon struct {
 		Start           DaemonStartCmd           `cmd:"" help:"Start an Ayup service Daemon"`
 		StartInRootless DaemonStartInRootlessCmd `cmd:"" passthrough:"" help:"Start a utility daemon to do tasks such as port forwarding in the Rootlesskit namesapce" hidden:""`
+		Restart         DaemonRestartCmd         `cmd:"" help:"Stop the apps and restart the daemon, the apps that were running are started again"`
+		Status          DaemonStatusCmd          `cmd:"" help:"Show the health of the daemon and what it is doing"`
+		Install         DaemonInstallCmd         `cmd:"" help:"Install and start the daemon as a systemd service"`
+		Uninstall       DaemonUninstallCmd       `cmd:"" help:"Stop and remove the daemon's systemd service"`
+		Logs            DaemonLogsCmd            `cmd:"" help:"Show the logs of the daemon's systemd service"`
+		Df              DaemonDfCmd              `cmd:"" help:"Show the disk space used by Buildkit's cache and the apps"`
+		Prune           DaemonPruneCmd           `cmd:"" help:"Free disk space by pruning Buildkit's cache and removing stale apps"`
+		Token           DaemonTokenCmd           `cmd:"" help:"Create a bearer token for the HTTP API"`
+		RegistryLogin   DaemonRegistryLoginCmd   `cmd:"" help:"Save the credentials used to publish apps to a container registry, the password or token is read from stdin"`
 	} `cmd:"" help:"Self host Ayup on Linux"`
 
 	Key struct {
@@ -107,16 +471,78 @@ var cli struct {
 	ProfilingEndpoint       string `group:"monitoring" env:"PYROSCOPE_ADHOC_SERVER_ADDRESS" help:"URL performance data is sent to; e.g. http://localhost:4040"`
 }
 
+// errRestart is returned by a command when the process should be replaced by a new one with the
+// same arguments once everything has been cleaned up
+var errRestart = errors.New("restart")
+
+// restartSelf replaces the process with a new one that has the same arguments
+func restartSelf() error {
+	selfExe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("os Executable: %w", err)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Restarting:"), selfExe)
+
+	if err := syscall.Exec(selfExe, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("syscall Exec: %w", err)
+	}
+
+	return nil
+}
+
+// jsonOutput is true if the command that was parsed writes JSON to stdout
+func jsonOutput(ktx *kong.Context) bool {
+	if ktx.Selected() == nil {
+		return false
+	}
+
+	switch ktx.Selected().Name {
+	case "push":
+		return cli.Push.Output == "json"
+	case "analyze":
+		return cli.Analyze.Json
+	}
+
+	return false
+}
+
+// errExitCode is the process's exit code for a command's error, a remote command's own code is
+// passed on
+func errExitCode(err error) int {
+	var exitErr *run.ExitError
+	if errors.As(err, &exitErr) {
+		return int(exitErr.Code)
+	}
+
+	return 1
+}
+
 func Main(version string) {
 	ctx := context.Background()
 
+	// Deferred first so that it runs after everything else has been cleaned up
+	exitCode := 0
+	restart := false
+	defer func() {
+		if restart {
+			if err := restartSelf(); err != nil {
+				fmt.Fprintln(os.Stderr, tui.ErrorStyle.Render("Error!"), err)
+				exitCode = 1
+			}
+		}
+
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	// Disable dynamic dark background detection
 	// https://github.com/charmbracelet/lipgloss/issues/73
 	lipgloss.SetHasDarkBackground(termenv.HasDarkBackground())
 	titleStyle := tui.TitleStyle
 	versionStyle := tui.VersionStyle
 	errorStyle := tui.ErrorStyle
-	fmt.Print(titleStyle.Render("Ayup!"), " ", versionStyle.Render("v"+version), "\n\n")
 
 	confDir, userConfDirErr := os.UserConfigDir()
 	var godotenvLoadErr error
@@ -126,7 +552,19 @@ func Main(version string) {
 
 	ktx := kong.Parse(&cli, kong.UsageOnError(), kong.Description("Just make it run!"))
 
-	ayTrace.SetupPyroscopeProfiling(cli.ProfilingEndpoint)
+	// Keep stdout for the JSON
+	stdout := io.Writer(os.Stdout)
+	if jsonOutput(ktx) {
+		stdout = os.Stderr
+	}
+	fmt.Fprint(stdout, titleStyle.Render("Ayup!"), " ", versionStyle.Render("v"+version), "\n\n")
+
+	stopProfiling := ayTrace.SetupPyroscopeProfiling(cli.ProfilingEndpoint)
+	defer func() {
+		if err := stopProfiling(); err != nil {
+			log.Println(err)
+		}
+	}()
 
 	if cli.TelemetryEndpoint != "" || cli.TelemetryEndpointTraces != "" {
 		stopTracing, err := ayTrace.SetupOTelSDK(ctx)
@@ -151,16 +589,23 @@ func Main(version string) {
 	terror.Ackf(ctx, "godotenv load: %w", godotenvLoadErr)
 
 	err := ktx.Run(Globals{
-		Ctx:    ctx,
-		Tracer: tracer,
-		Logger: logger,
+		Ctx:     ctx,
+		Tracer:  tracer,
+		Logger:  logger,
+		Version: strings.TrimSpace(version),
 	})
 
 	if err == nil {
 		return
 	}
 
-	fmt.Println(errorStyle.Render("Error!"), err)
+	if errors.Is(err, errRestart) {
+		restart = true
+		return
+	}
+
+	fmt.Fprintln(stdout, errorStyle.Render("Error!"), err)
+	exitCode = errExitCode(err)
 
 	var perr *kong.ParseError
 	if errors.As(err, &perr) {
@@ -0,0 +1,59 @@
+package ay
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/kong"
+
+	"premai.io/Ayup/go/cli/run"
+)
+
+func TestErrExitCode(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		// e.g. ay push --non-interactive when a choice has no answer
+		{name: "unanswered choice", err: errors.New("no answer to 'Guess requirements?', add 'guessRequirements=<answer>' to the answers file or use --yes or --no"), want: 1},
+		{name: "remote command", err: &run.ExitError{Code: 3}, want: 3},
+		{name: "wrapped remote command", err: fmt.Errorf("run: %w", &run.ExitError{Code: 42}), want: 42},
+	}
+
+	for _, c := range cases {
+		if got := errExitCode(c.err); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestJsonOutput(t *testing.T) {
+	cases := []struct {
+		args []string
+		want bool
+	}{
+		{args: []string{"push", "--output", "json"}, want: true},
+		{args: []string{"push"}, want: false},
+		{args: []string{"analyze", "--json"}, want: true},
+		{args: []string{"analyze"}, want: false},
+		{args: []string{"status"}, want: false},
+	}
+
+	for _, c := range cases {
+		parser, err := kong.New(&cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ktx, err := parser.Parse(c.args)
+		if err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+
+		if got := jsonOutput(ktx); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.args, got, c.want)
+		}
+	}
+}
@@ -3,16 +3,28 @@
 package ay
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mattn/go-isatty"
+	"premai.io/Ayup/go/cli/service"
 	"premai.io/Ayup/go/inrootless"
 	"premai.io/Ayup/go/internal/conf"
+	"premai.io/Ayup/go/internal/rpc"
 	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/tui"
 	"premai.io/Ayup/go/srv"
 )
 
@@ -21,17 +33,40 @@ type DaemonStartCmd struct {
 
 	P2pPrivKey           string `env:"AYUP_SERVER_P2P_PRIV_KEY" help:"The server's private key, generated automatically if not set, also see 'ay key new'"`
 	P2pAuthorizedClients string `env:"AYUP_P2P_AUTHORIZED_CLIENTS" help:"Comma deliminated public keys of logged in clients"`
+
+	AppMemoryMax string  `group:"app limits" env:"AYUP_APP_MEMORY_MAX" default:"75%" help:"Default memory limit of an app; a size such as 2G or a percentage of the system's memory, 0 for no limit"`
+	AppCpus      float64 `group:"app limits" env:"AYUP_APP_CPUS" default:"0" help:"Default CPU quota of an app in cores e.g. 1.5, 0 for no limit"`
+	AppCpuWeight uint64  `group:"app limits" env:"AYUP_APP_CPU_WEIGHT" default:"100" help:"Default CPU weight (1-10000) of an app relative to other apps and the build service"`
+	AppPidsMax   int64   `group:"app limits" env:"AYUP_APP_PIDS_MAX" default:"4096" help:"Default maximum number of processes in an app, 0 for no limit"`
+
+	AppStopGracePeriod time.Duration `env:"AYUP_APP_STOP_GRACE_PERIOD" default:"10s" help:"How long apps have to exit after SIGTERM before they are killed when stopped"`
+
+	GcSchedule       string        `group:"garbage collection" env:"AYUP_GC_SCHEDULE" default:"@daily" help:"Cron schedule on which Buildkit's cache is pruned, empty to only prune when disk space is low"`
+	GcMinFree        string        `group:"garbage collection" env:"AYUP_GC_MIN_FREE" default:"10%" help:"Prune when the free space on Buildkit's disk falls below this; a size such as 5G or a percentage of the disk, 0 to disable"`
+	GcKeepStorage    string        `group:"garbage collection" env:"AYUP_GC_KEEP_STORAGE" default:"10G" help:"How much of Buildkit's cache to keep when pruning; a size or a percentage of the disk"`
+	GcStaleAppsAfter time.Duration `group:"garbage collection" env:"AYUP_GC_STALE_APPS_AFTER" default:"0" help:"Also remove apps which have not been pushed, built or ran for this long and have no jobs, 0 to keep them"`
+
+	Verbose bool `short:"v" env:"AYUP_DAEMON_VERBOSE" help:"Print the output of buildkitd, rootlesskit and the rootless helper as well as writing it to their logs"`
+
+	MetricsAddr string `env:"AYUP_METRICS_ADDR" help:"Serve Prometheus metrics at /metrics on this address e.g. localhost:9090, disabled if empty"`
+
+	ApiAddr   string `group:"http api" env:"AYUP_API_ADDR" help:"Serve the HTTP/JSON API on this address e.g. localhost:8081, disabled if empty"`
+	ApiTokens string `group:"http api" env:"AYUP_API_TOKENS" help:"Comma deliminated <peer id>:<token hash> pairs, the bearer tokens accepted by the HTTP API; see 'ay daemon token'"`
+
+	DashboardAddr string `env:"AYUP_DASHBOARD_ADDR" help:"Serve the web dashboard on this address e.g. localhost:8082, disabled if empty; log in with a token from 'ay daemon token'"`
+
+	Webhooks      string `group:"webhooks" env:"AYUP_WEBHOOKS" help:"Semicolon deliminated '<url> [<event>,<event>...]' entries, the events are posted to each URL as JSON; all events are posted if none are given"`
+	WebhookSecret string `group:"webhooks" env:"AYUP_WEBHOOK_SECRET" help:"Webhook requests are signed with this in the X-Ayup-Signature header, an HMAC-SHA256 of the X-Ayup-Timestamp header, a dot and the body"`
+
+	InsecureRegistries []string `env:"AYUP_INSECURE_REGISTRIES" help:"Comma deliminated registry hosts e.g. registry.local:5000, that apps are published to over plain HTTP"`
+
+	Detectors string `env:"AYUP_DETECTORS" help:"Semicolon deliminated '<name> exec=<path>' or '<name> files=<file>,<file> dockerfile=<path> [confidence=<0 to 1>]' entries, extra detectors tried along with the builtin dockerfile and python ones"`
+
+	BuildkitAddr string `env:"AYUP_BUILDKIT_ADDR" help:"Use an existing buildkitd at this address e.g. unix:///run/buildkit/buildkitd.sock instead of starting one in Rootlesskit; resource limits are not available and the app containers must be reachable from this host"`
 }
 
 func (s *DaemonStartCmd) Run(g Globals) (err error) {
 	pprof.Do(g.Ctx, pprof.Labels("command", "deamon start"), func(ctx context.Context) {
-		var tmp string
-		tmp, err = os.MkdirTemp("", "ayup-*")
-		if err != nil {
-			err = terror.Errorf(g.Ctx, "MkdirTemp: %w", err)
-			return
-		}
-
 		err = os.MkdirAll(conf.UserRuntimeDir(), 0770)
 		if err != nil {
 			err = terror.Errorf(g.Ctx, "MkdirAll: %w", err)
@@ -39,10 +74,31 @@ func (s *DaemonStartCmd) Run(g Globals) (err error) {
 		}
 
 		r := srv.Srv{
-			AssistantDir: filepath.Join(tmp, "ass"),
-			SrcDir:       filepath.Join(tmp, "src"),
-			Host:         s.Host,
-			P2pPrivKey:   s.P2pPrivKey,
+			AppsDir:    filepath.Join(conf.UserRoot(), "apps"),
+			SecretsDir: conf.SecretsDir(),
+			Host:       s.Host,
+			P2pPrivKey: s.P2pPrivKey,
+			AppLimits: srv.Limits{
+				MemoryMax: s.AppMemoryMax,
+				Cpus:      s.AppCpus,
+				CpuWeight: s.AppCpuWeight,
+				PidsMax:   s.AppPidsMax,
+			},
+			StopGracePeriod:    s.AppStopGracePeriod,
+			BuildkitdAddr:      s.BuildkitAddr,
+			Verbose:            s.Verbose,
+			MetricsAddr:        s.MetricsAddr,
+			ApiAddr:            s.ApiAddr,
+			DashboardAddr:      s.DashboardAddr,
+			WebhookSecret:      s.WebhookSecret,
+			InsecureRegistries: s.InsecureRegistries,
+			Version:            g.Version,
+			GC: srv.GCPolicy{
+				Schedule:       s.GcSchedule,
+				MinFree:        s.GcMinFree,
+				KeepStorage:    s.GcKeepStorage,
+				StaleAppsAfter: s.GcStaleAppsAfter,
+			},
 		}
 
 		var authedClients []peer.ID
@@ -61,12 +117,186 @@ func (s *DaemonStartCmd) Run(g Globals) (err error) {
 		}
 		r.P2pAuthedClients = authedClients
 
+		r.ApiTokens, err = srv.ParseApiTokens(s.ApiTokens)
+		if err != nil {
+			err = terror.Errorf(g.Ctx, "Error while parsing API tokens: %w", err)
+			return
+		}
+
+		r.Webhooks, err = srv.ParseWebhooks(s.Webhooks)
+		if err != nil {
+			err = terror.Errorf(g.Ctx, "Error while parsing webhooks: %w", err)
+			return
+		}
+
+		r.Detectors, err = srv.ParseDetectors(s.Detectors)
+		if err != nil {
+			err = terror.Errorf(g.Ctx, "Error while parsing detectors: %w", err)
+			return
+		}
+
 		err = r.RunServer(ctx)
+		if errors.Is(err, srv.ErrRestart) {
+			err = errRestart
+		}
 	})
 
 	return
 }
 
+// ServiceScope selects between a systemd user or system service
+type ServiceScope struct {
+	User   bool `xor:"scope" help:"Use the user's systemd instance, this is the default"`
+	System bool `xor:"scope" help:"Use the system's systemd instance, the daemon still runs as the current user"`
+}
+
+func (s ServiceScope) scope() service.Scope {
+	return service.Scope{System: s.System}
+}
+
+type DaemonInstallCmd struct {
+	ServiceScope
+	Force bool `help:"Replace the unit file if it has changed"`
+
+	Host                 string `env:"AYUP_DAEMON_HOST" default:":50051" help:"The addresses and port to listen on"`
+	P2pPrivKey           string `env:"AYUP_SERVER_P2P_PRIV_KEY" help:"The server's private key, generated automatically if not set, also see 'ay key new'"`
+	P2pAuthorizedClients string `env:"AYUP_P2P_AUTHORIZED_CLIENTS" help:"Comma deliminated public keys of clients, login needs a console so clients should be authorized here"`
+}
+
+func (s *DaemonInstallCmd) Run(g Globals) error {
+	i := service.Install{
+		Scope:                s.scope(),
+		Force:                s.Force,
+		Host:                 s.Host,
+		P2pPrivKey:           s.P2pPrivKey,
+		P2pAuthorizedClients: s.P2pAuthorizedClients,
+	}
+
+	return i.Run(g.Ctx)
+}
+
+type DaemonUninstallCmd struct {
+	ServiceScope
+}
+
+func (s *DaemonUninstallCmd) Run(g Globals) error {
+	u := service.Uninstall{
+		Scope: s.scope(),
+	}
+
+	return u.Run(g.Ctx)
+}
+
+type DaemonLogsCmd struct {
+	ServiceScope
+	Component string `short:"c" enum:"daemon,buildkitd,inrootless" default:"daemon" help:"Which logs to show; the daemon's are read from the systemd journal, the others from the files they are written to (${enum})"`
+	Follow    bool   `short:"f" help:"Keep printing new log lines"`
+	Lines     int    `short:"n" default:"100" help:"How many of the most recent lines to print"`
+}
+
+func (s *DaemonLogsCmd) Run(g Globals) error {
+	l := service.Logs{
+		Scope:     s.scope(),
+		Component: s.Component,
+		Follow:    s.Follow,
+		Lines:     s.Lines,
+	}
+
+	return l.Run(g.Ctx)
+}
+
+// serviceStatus prints systemd's view of the installed service
+func serviceStatus(g Globals, scope ServiceScope) error {
+	return service.Status(g.Ctx, scope.scope())
+}
+
+type DaemonTokenCmd struct {
+	Peer string `help:"The peer ID the token acts as, defaults to this host's client key"`
+
+	P2pPrivKey           string `env:"AYUP_CLIENT_P2P_PRIV_KEY" help:"The client's private key, generated automatically if not set, also see 'ay key new'"`
+	P2pAuthorizedClients string `env:"AYUP_P2P_AUTHORIZED_CLIENTS" help:"Comma deliminated public keys of clients, the peer is added if it is not already authorized"`
+}
+
+// Run creates a bearer token for the HTTP API and saves its hash in the daemon's config
+func (s *DaemonTokenCmd) Run(g Globals) error {
+	ctx := g.Ctx
+
+	var peerId peer.ID
+	if s.Peer != "" {
+		var err error
+		peerId, err = peer.Decode(s.Peer)
+		if err != nil {
+			return fmt.Errorf("--peer: %w", err)
+		}
+	} else {
+		privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_CLIENT_P2P_PRIV_KEY", s.P2pPrivKey)
+		if err != nil {
+			return err
+		}
+
+		peerId, err = peer.IDFromPrivateKey(privKey)
+		if err != nil {
+			return terror.Errorf(ctx, "peer IDFromPrivateKey: %w", err)
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return terror.Errorf(ctx, "rand Read: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	if err := conf.Append(ctx, "AYUP_API_TOKENS", peerId.String()+":"+srv.HashApiToken(token)); err != nil {
+		return err
+	}
+
+	if !slices.Contains(strings.Split(s.P2pAuthorizedClients, ","), peerId.String()) {
+		if err := conf.Append(ctx, "AYUP_P2P_AUTHORIZED_CLIENTS", peerId.String()); err != nil {
+			return err
+		}
+		fmt.Println(tui.TitleStyle.Render("Authorized client:"), peerId)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Peer ID:"), peerId)
+	fmt.Println(tui.TitleStyle.Render("API token:"), token)
+	fmt.Println()
+	fmt.Println("The token is only shown once, restart the daemon for it to be accepted e.g. 'ay daemon restart'")
+
+	return nil
+}
+
+type DaemonRegistryLoginCmd struct {
+	Host     string `arg:"" help:"The registry's host and port if any e.g. registry.local:5000"`
+	Username string `required:"" help:"The user to push images as"`
+}
+
+// Run saves the credentials that the daemon publishes images to the registry with. The password
+// or token is read from stdin so that it doesn't end up in the shell's history.
+func (s *DaemonRegistryLoginCmd) Run(g Globals) error {
+	ctx := g.Ctx
+
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Print("Password or token: ")
+	}
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return terror.Errorf(ctx, "stdin ReadString: %w", err)
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return terror.Errorf(ctx, "no password or token was given on stdin")
+	}
+
+	if err := srv.SetRegistryCreds(conf.SecretsDir(), s.Host, s.Username, secret); err != nil {
+		return terror.Errorf(ctx, "SetRegistryCreds: %w", err)
+	}
+
+	fmt.Println(tui.TitleStyle.Render("Saved credentials for:"), s.Host)
+
+	return nil
+}
+
 type DaemonStartInRootlessCmd struct {
 	BuildkitArgs []string `arg:"" help:"Buildkitd's arguments"`
 }
@@ -21,3 +21,45 @@ type DaemonStartInRootlessCmd struct {
 func (s *DaemonStartInRootlessCmd) Run(g Globals) (err error) {
 	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
 }
+
+type DaemonTokenCmd struct {
+}
+
+func (s *DaemonTokenCmd) Run(g Globals) (err error) {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
+
+type DaemonRegistryLoginCmd struct {
+}
+
+func (s *DaemonRegistryLoginCmd) Run(g Globals) (err error) {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
+
+type ServiceScope struct {
+}
+
+type DaemonInstallCmd struct {
+}
+
+func (s *DaemonInstallCmd) Run(g Globals) (err error) {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
+
+type DaemonUninstallCmd struct {
+}
+
+func (s *DaemonUninstallCmd) Run(g Globals) (err error) {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
+
+type DaemonLogsCmd struct {
+}
+
+func (s *DaemonLogsCmd) Run(g Globals) (err error) {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
+
+func serviceStatus(g Globals, scope ServiceScope) error {
+	return terror.Errorf(g.Ctx, "Not supported on: %s", runtime.GOOS)
+}
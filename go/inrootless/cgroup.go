@@ -0,0 +1,161 @@
+package inrootless
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/inrootless"
+	"premai.io/Ayup/go/internal/proc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Rootlesskit is started with --cgroupns and --evacuate-cgroup2 so the root of the cgroup
+// namespace is the delegated subtree and has no processes of its own.
+const cgroupRoot = "/sys/fs/cgroup"
+
+func appCgroupPath(app string) string {
+	return filepath.Join(cgroupRoot, "apps", app)
+}
+
+func writeCgroupFile(ctx context.Context, dir string, name string, val string) error {
+	trace.Event(ctx, "cgroup write", attribute.String("dir", dir), attribute.String("name", name), attribute.String("val", val))
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(val), 0); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return terror.Errorf(ctx, "cgroup file %s missing, is the controller delegated? %w", name, err)
+		}
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// enableControllers for the children of dir. Not all controllers may be delegated to us, so
+// failures are ignored here and reported when the limit is written.
+func enableControllers(ctx context.Context, dir string) {
+	for _, ctrl := range []string{"cpu", "memory", "pids"} {
+		err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+ctrl), 0)
+		terror.Ackf(ctx, "enable controller: %w", err)
+	}
+}
+
+func (s *inrSrv) Limit(ctx context.Context, req *pb.LimitRequest) (*pb.LimitResponse, error) {
+	ctx, span := trace.Span(ctx, "limit", attribute.String("app", req.App))
+	defer span.End()
+
+	pid, err := proc.WaitGated(ctx, req.Gate)
+	if err != nil {
+		return nil, err
+	}
+	s.setAppPid(req.App, pid)
+
+	if req.MemoryMax == 0 && req.CpuQuota == 0 && req.CpuWeight == 0 && req.PidsMax == 0 {
+		return &pb.LimitResponse{}, nil
+	}
+
+	appsDir := filepath.Join(cgroupRoot, "apps")
+	dir := appCgroupPath(req.App)
+
+	enableControllers(ctx, cgroupRoot)
+	if err := os.MkdirAll(appsDir, 0755); err != nil {
+		return nil, terror.Errorf(ctx, "os MkdirAll: %w", err)
+	}
+	enableControllers(ctx, appsDir)
+
+	// A previous instance may have left its cgroup behind
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		terror.Ackf(ctx, "os Remove: %w", err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, terror.Errorf(ctx, "os Mkdir: %w", err)
+	}
+
+	if req.MemoryMax > 0 {
+		if err := writeCgroupFile(ctx, dir, "memory.max", strconv.FormatInt(req.MemoryMax, 10)); err != nil {
+			return nil, err
+		}
+
+		// Kill the whole app instead of leaving it half alive
+		if err := writeCgroupFile(ctx, dir, "memory.oom.group", "1"); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.CpuQuota > 0 {
+		val := fmt.Sprintf("%d %d", req.CpuQuota, req.CpuPeriod)
+		if err := writeCgroupFile(ctx, dir, "cpu.max", val); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.CpuWeight > 0 {
+		if err := writeCgroupFile(ctx, dir, "cpu.weight", strconv.FormatUint(req.CpuWeight, 10)); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.PidsMax > 0 {
+		if err := writeCgroupFile(ctx, dir, "pids.max", strconv.FormatInt(req.PidsMax, 10)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Children are created in the cgroup of their parent, so this is the whole app
+	if err := writeCgroupFile(ctx, dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return nil, err
+	}
+
+	return &pb.LimitResponse{}, nil
+}
+
+func readMemoryEvent(path string, event string) (uint64, error) {
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) != 2 || fields[0] != event {
+			continue
+		}
+
+		return strconv.ParseUint(fields[1], 10, 64)
+	}
+
+	return 0, lines.Err()
+}
+
+func (s *inrSrv) Release(ctx context.Context, req *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	ctx, span := trace.Span(ctx, "release", attribute.String("app", req.App))
+	defer span.End()
+
+	s.setAppPid(req.App, 0)
+	dir := appCgroupPath(req.App)
+
+	oomKills, err := readMemoryEvent(dir, "oom_kill")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		terror.Ackf(ctx, "readMemoryEvent: %w", err)
+	}
+
+	trace.Event(ctx, "oom kills", attribute.Int64("count", int64(oomKills)))
+
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		terror.Ackf(ctx, "os Remove: %w", err)
+	}
+
+	return &pb.ReleaseResponse{
+		OomKilled: oomKills > 0,
+	}, nil
+}
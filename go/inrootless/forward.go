@@ -1,13 +1,11 @@
 package inrootless
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"io"
 	"net"
-	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"go.opentelemetry.io/otel/attribute"
@@ -17,54 +15,57 @@ import (
 	"premai.io/Ayup/go/internal/trace"
 )
 
-// Copied from buildkit
-func withDetachedNetNSIfAny(ctx context.Context, fn func(context.Context) error) error {
-	if stateDir := os.Getenv("ROOTLESSKIT_STATE_DIR"); stateDir != "" {
-		detachedNetNS := filepath.Join(stateDir, "netns")
-		if _, err := os.Lstat(detachedNetNS); !errors.Is(err, os.ErrNotExist) {
-			return ns.WithNetNSPath(detachedNetNS, func(_ ns.NetNS) error {
-				err2 := fn(ctx)
-				return err2
-			})
-		}
+// withAppNetNS runs fn inside the network namespace of the app's container
+func (s *inrSrv) withAppNetNS(ctx context.Context, app string, fn func(context.Context) error) error {
+	pid := s.appPid(app)
+	if pid == 0 {
+		return terror.Errorf(ctx, "the app is not running: %s", app)
 	}
 
-	return terror.Errorf(ctx, "ROOTLESSKIT_STATE_DIR not set")
+	netNS := filepath.Join("/proc", strconv.Itoa(pid), "ns", "net")
+	trace.Event(ctx, "app netns", attribute.String("path", netNS))
+
+	return ns.WithNetNSPath(netNS, func(_ ns.NetNS) error {
+		return fn(ctx)
+	})
 }
 
 func (s *inrSrv) Forward(stream pb.InRootless_ForwardServer) error {
 	ctx := stream.Context()
 
-	bs, err := os.ReadFile("/var/lib/cni/networks/buildkit/last_reserved_ip.0")
+	first, err := stream.Recv()
 	if err != nil {
-		return terror.Errorf(ctx, "os ReadFile: %w", err)
+		return terror.Errorf(ctx, "stream recv: %w", err)
 	}
 
-	trace.Event(ctx, "last reserved IP", attribute.String("ip", string(bs)))
-
-	return withDetachedNetNSIfAny(ctx, func(ctx context.Context) error {
-		conn, err := net.Dial("tcp", string(bytes.TrimSpace(bs))+":5000")
+	return s.withAppNetNS(ctx, first.App, func(ctx context.Context) error {
+		conn, err := net.Dial("tcp", "127.0.0.1:5000")
 		if err != nil {
 			return terror.Errorf(ctx, "net dial: %w", err)
 		}
 		defer func() { terror.Ackf(ctx, "conn close: %w", conn.Close()) }()
-		trace.Event(ctx, "connected to port 5000")
+		trace.Event(ctx, "connected to port 5000", attribute.String("app", first.App))
 
-		doneChan := make(chan error)
+		if _, err := conn.Write(first.Data); err != nil {
+			return terror.Errorf(ctx, "conn write: %w", err)
+		}
 
 		var g errgroup.Group
 
 		g.Go(func() error {
 			for {
 				req, err := stream.Recv()
-				if err != nil {
-					if err != io.EOF {
-						return terror.Errorf(ctx, "stream recv: %w", err)
-					} else {
-						trace.Event(ctx, "ingress done")
-						doneChan <- nil
+				if err == io.EOF {
+					trace.Event(ctx, "ingress done")
+					// The app can still reply after the client is done sending
+					if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+						return terror.Errorf(ctx, "conn CloseWrite: %w", err)
 					}
-					break
+					return nil
+				} else if err != nil {
+					// Unblock the egress, the stream is gone
+					terror.Ackf(ctx, "conn close: %w", conn.Close())
+					return terror.Errorf(ctx, "stream recv: %w", err)
 				}
 
 				trace.Event(ctx, "ingress recv")
@@ -75,8 +76,6 @@ func (s *inrSrv) Forward(stream pb.InRootless_ForwardServer) error {
 
 				trace.Event(ctx, "ingress write")
 			}
-
-			return terror.Errorf(ctx, "conn close: %w", conn.Close())
 		})
 
 		g.Go(func() error {
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
@@ -15,6 +16,7 @@ import (
 
 	"premai.io/Ayup/go/internal/conf"
 	pb "premai.io/Ayup/go/internal/grpc/inrootless"
+	"premai.io/Ayup/go/internal/logfile"
 	"premai.io/Ayup/go/internal/proc"
 	"premai.io/Ayup/go/internal/terror"
 	"premai.io/Ayup/go/internal/trace"
@@ -22,9 +24,35 @@ import (
 
 type inrSrv struct {
 	pb.UnimplementedInRootlessServer
+
+	// The first process of each running app, found when it is put in the app's cgroup
+	pidsMutex sync.Mutex
+	appPids   map[string]int
+}
+
+func (s *inrSrv) setAppPid(app string, pid int) {
+	s.pidsMutex.Lock()
+	defer s.pidsMutex.Unlock()
+
+	if s.appPids == nil {
+		s.appPids = make(map[string]int)
+	}
+
+	if pid == 0 {
+		delete(s.appPids, app)
+	} else {
+		s.appPids[app] = pid
+	}
 }
 
-func (inrSrv) Ping(context.Context, *pb.PingRequest) (*pb.PingResponse, error) {
+func (s *inrSrv) appPid(app string) int {
+	s.pidsMutex.Lock()
+	defer s.pidsMutex.Unlock()
+
+	return s.appPids[app]
+}
+
+func (*inrSrv) Ping(context.Context, *pb.PingRequest) (*pb.PingResponse, error) {
 	return &pb.PingResponse{}, nil
 }
 
@@ -41,6 +69,11 @@ func fixup(ctx context.Context) error {
 		return terror.Errorf(ctx, "os RemoveAll: %w", err)
 	}
 
+	// Left behind if the helper was killed, for e.g. by the rootless namespace crashing
+	if err := os.Remove(conf.InrootlessAddr()); err != nil && !os.IsNotExist(err) {
+		return terror.Errorf(ctx, "os Remove: %w", err)
+	}
+
 	return nil
 }
 
@@ -75,7 +108,13 @@ func RunServer(ctx context.Context, builkitCmdArgs []string) error {
 
 	ctx, buildkitSpan := trace.Span(ctx, "buildkitd")
 	defer buildkitSpan.End()
-	_, pout := proc.Start(ctx, cmd)
+	log, err := logfile.Open(conf.LogPath("buildkitd"))
+	if err != nil {
+		return terror.Errorf(ctx, "logfile Open: %w", err)
+	}
+	defer func() { terror.Ackf(ctx, "log Close: %w", log.Close()) }()
+
+	_, pout := proc.StartWithLog(ctx, cmd, log)
 
 	var g errgroup.Group
 
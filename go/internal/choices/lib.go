@@ -0,0 +1,53 @@
+// Package choices has what the daemon and the clients both need to know about choices
+package choices
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+// Title of the choice whatever its kind
+func Title(choice *pb.Choice) string {
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		return v.Bool.Title
+	case *pb.Choice_Text:
+		return v.Text.Title
+	case *pb.Choice_Select:
+		return v.Select.Title
+	case *pb.Choice_MultiSelect:
+		return v.MultiSelect.Title
+	case *pb.Choice_File:
+		return v.File.Title
+	}
+
+	return ""
+}
+
+// TextRegexp compiles a text choice's validation so that it has to match the whole answer
+func TextRegexp(validate string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + validate + ")$")
+}
+
+// CheckFile returns an error if the path can't be the answer to the file choice. The path is
+// slash separated and relative to the app's source, it isn't checked that the file exists.
+func CheckFile(file *pb.ChoiceFile, p string) error {
+	if p == "" || p == "." {
+		return fmt.Errorf("no file picked")
+	}
+
+	if path.IsAbs(p) || p != path.Clean(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("'%s' is not inside the app's source", p)
+	}
+
+	if len(file.Extensions) > 0 && !slices.Contains(file.Extensions, path.Ext(p)) {
+		return fmt.Errorf("'%s' is not a %s file", p, strings.Join(file.Extensions, " or "))
+	}
+
+	return nil
+}
@@ -53,6 +53,16 @@ func UserConfigDir() string {
 	return "/etc/ayup"
 }
 
+// LogPath returns where the output of a component such as buildkitd is written
+func LogPath(component string) string {
+	return filepath.Join(UserRoot(), "logs", component+".log")
+}
+
+// SecretsDir returns where the daemon keeps secrets such as registry credentials
+func SecretsDir() string {
+	return filepath.Join(UserRoot(), "secrets")
+}
+
 func InrootlessAddr() string {
 	return filepath.Join(UserRuntimeDir(), "rootless.sock")
 }
@@ -67,6 +77,11 @@ func confFilePath(ctx context.Context) (string, error) {
 	return filepath.Join(confDir, "env"), nil
 }
 
+// FilePath returns the location of Ayup's own config file, creating its directory if needed
+func FilePath(ctx context.Context) (string, error) {
+	return confFilePath(ctx)
+}
+
 func read(ctx context.Context, path string) (confMap map[string]string, err error) {
 	confMap, err = godotenv.Read(path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -0,0 +1,204 @@
+// Package logfile writes process output to log files which are rotated by size and reads them back
+package logfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Size a log file can grow to before it is rotated
+	MaxSize = 10 * 1024 * 1024
+	// How many rotated files are kept, named <path>.1 to <path>.<Keep> with .1 being the newest
+	Keep = 3
+	// How often Follow checks for new lines or a rotation
+	followInterval = 250 * time.Millisecond
+)
+
+// File is a log file that is safe for concurrent use and rotates itself when it gets too big
+type File struct {
+	path string
+
+	mutex sync.Mutex
+	f     *os.File
+	size  int64
+}
+
+// Open the log file at path for appending, creating it and its directory if needed
+func Open(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("os MkdirAll: %w", err)
+	}
+
+	l := &File{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("os OpenFile: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("file Stat: %w", err)
+	}
+
+	l.f = f
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("file Close: %w", err)
+	}
+
+	for i := Keep - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", l.path, i)
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os Rename: %w", err)
+		}
+	}
+
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("os Rename: %w", err)
+	}
+
+	return l.open()
+}
+
+func (l *File) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(p)) > MaxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+
+	return n, err
+}
+
+func (l *File) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.f.Close()
+}
+
+// Tail returns the last n lines of the log file, if there are less than n lines in the current
+// file then the rest are taken from the rotated files
+func Tail(path string, n int) ([]byte, error) {
+	var lines [][]byte
+
+	for i := 0; i <= Keep && len(lines) < n; i++ {
+		p := path
+		if i > 0 {
+			p = fmt.Sprintf("%s.%d", path, i)
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return nil, err
+		}
+
+		fileLines := bytes.SplitAfter(data, []byte("\n"))
+		if len(fileLines[len(fileLines)-1]) == 0 {
+			fileLines = fileLines[:len(fileLines)-1]
+		}
+
+		if len(fileLines) > n-len(lines) {
+			fileLines = fileLines[len(fileLines)-(n-len(lines)):]
+		}
+
+		lines = append(fileLines, lines...)
+	}
+
+	return bytes.Join(lines, nil), nil
+}
+
+// Follow writes lines appended to the log file after it was called to w until the context is
+// done. It carries on from the start of the new file when the log is rotated.
+func Follow(ctx context.Context, path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if f != nil {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		if f != nil {
+			n, err := f.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followInterval):
+		}
+
+		// The file at path has changed after a rotation, or it has been created
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if f != nil {
+			current, err := f.Stat()
+			if err == nil && os.SameFile(info, current) {
+				continue
+			}
+
+			// Anything written before the rotation
+			if _, err := io.Copy(w, f); err != nil {
+				return err
+			}
+			_ = f.Close()
+		}
+
+		f, _ = os.Open(path)
+	}
+}
@@ -0,0 +1,210 @@
+package logfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "test.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Four chunks fill a file exactly, so each fifth write rotates it
+	chunk := func(i int) []byte {
+		return append(bytes.Repeat([]byte{'a' + byte(i)}, MaxSize/4-1), '\n')
+	}
+
+	writes := 4 * (Keep + 2)
+	for i := 0; i < writes; i++ {
+		if _, err := l.Write(chunk(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i <= Keep; i++ {
+		p := path
+		if i > 0 {
+			p = fmt.Sprintf("%s.%d", path, i)
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) != MaxSize {
+			t.Errorf("%s: got %d bytes, want %d", p, len(data), MaxSize)
+		}
+
+		// Newest first
+		first := writes - 4*(i+1)
+		if want := chunk(first); !bytes.HasPrefix(data, want[:1]) {
+			t.Errorf("%s: starts with %q, want %q", p, data[0], want[0])
+		}
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, Keep+1)); !os.IsNotExist(err) {
+		t.Errorf("more than %d rotated files were kept: %v", Keep, err)
+	}
+}
+
+func TestReopenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	for _, line := range []string{"one\n", "two\n"} {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one\ntwo\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestTail(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name string, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("full.log.2", "a\nb\n")
+	write("full.log.1", "c\nd\n")
+	write("full.log", "e\nf")
+
+	// A gap in the rotated files stops the search
+	write("gap.log.2", "a\n")
+	write("gap.log", "b\n")
+
+	write("empty.log", "")
+	write("empty.log.1", "a\nb\n")
+
+	cases := []struct {
+		path string
+		n    int
+		want string
+	}{
+		{path: "full.log", n: 0, want: ""},
+		{path: "full.log", n: 1, want: "f"},
+		{path: "full.log", n: 2, want: "e\nf"},
+		{path: "full.log", n: 3, want: "d\ne\nf"},
+		{path: "full.log", n: 10, want: "a\nb\nc\nd\ne\nf"},
+		{path: "gap.log", n: 10, want: "b\n"},
+		{path: "empty.log", n: 1, want: "b\n"},
+		{path: "missing.log", n: 10, want: ""},
+	}
+
+	for _, c := range cases {
+		got, err := Tail(filepath.Join(dir, c.path), c.n)
+		if err != nil {
+			t.Errorf("Tail(%s, %d): %v", c.path, c.n, err)
+		} else if string(got) != c.want {
+			t.Errorf("Tail(%s, %d) = %q, want %q", c.path, c.n, got, c.want)
+		}
+	}
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.buf.String()
+}
+
+func TestFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	if err := os.WriteFile(path, []byte("before\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- Follow(ctx, path, &out)
+	}()
+
+	waitFor := func(want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for out.String() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %q, want %q", out.String(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Follow opens the file in the background, so give it a chance to seek to the end
+	time.Sleep(2 * followInterval)
+
+	if _, err := l.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("one\n")
+
+	l.mutex.Lock()
+	err = l.rotate()
+	l.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Write([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("one\ntwo\n")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "before") {
+		t.Errorf("lines written before Follow was called were copied")
+	}
+}
@@ -0,0 +1,78 @@
+package proc
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	attr "go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// GatedTimeout is how long a gated process has to appear after the daemon starts it
+const GatedTimeout = 10 * time.Second
+
+// FindGated returns the process which has the gate token as one of its arguments. The daemon
+// starts the app's first process with a fresh token and it waits on stdin until the daemon or
+// the rootless helper has set it up, so nothing can fork or change its arguments before then.
+func FindGated(token string) (int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Processes can exit or belong to someone else
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		if slices.ContainsFunc(bytes.Split(cmdline, []byte{0}), func(arg []byte) bool {
+			return string(arg) == token
+		}) {
+			return pid, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// WaitGated polls for the gated process because it is looked for at the same time as the
+// container is being started
+func WaitGated(ctx context.Context, token string) (int, error) {
+	deadline := time.Now().Add(GatedTimeout)
+
+	for {
+		pid, err := FindGated(token)
+		if err != nil {
+			return 0, terror.Errorf(ctx, "FindGated: %w", err)
+		}
+
+		if pid > 0 {
+			trace.Event(ctx, "found gated pid", attr.Int("pid", pid))
+			return pid, nil
+		}
+
+		if time.Now().After(deadline) {
+			return 0, terror.Errorf(ctx, "no process found for the gate")
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, terror.Errorf(ctx, "waiting for the gated process: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
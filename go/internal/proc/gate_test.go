@@ -0,0 +1,39 @@
+//go:build linux
+
+package proc
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestWaitGated(t *testing.T) {
+	token := "ayup-gate-test"
+
+	if pid, err := FindGated(token); err != nil || pid != 0 {
+		t.Fatalf("found a process before one was started: %d, %v", pid, err)
+	}
+
+	// The token is the script's $0, so it appears in the arguments
+	cmd := exec.Command("sh", "-c", "read line", token)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	pid, err := WaitGated(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != cmd.Process.Pid {
+		t.Errorf("got pid %d, want %d", pid, cmd.Process.Pid)
+	}
+}
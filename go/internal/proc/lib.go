@@ -3,6 +3,8 @@ package proc
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"sync"
@@ -23,6 +25,12 @@ type In struct {
 }
 
 func Start(ctx context.Context, cmd *exec.Cmd) (chan<- In, <-chan Out) {
+	return StartWithLog(ctx, cmd, nil)
+}
+
+// StartWithLog is like Start, but also writes each line of the process's stdout and stderr to
+// log, which must be safe to write to concurrently
+func StartWithLog(ctx context.Context, cmd *exec.Cmd, log io.Writer) (chan<- In, <-chan Out) {
 	span := tr.SpanFromContext(ctx)
 	procInChan := make(chan In, 1)
 	procOutChan := make(chan Out, 1)
@@ -65,6 +73,10 @@ func Start(ctx context.Context, cmd *exec.Cmd) (chan<- In, <-chan Out) {
 		for scanner.Scan() {
 			text := scanner.Text()
 			span.AddEvent("log", tr.WithAttributes(attr.String("text", text)))
+
+			if log != nil {
+				_, _ = fmt.Fprintln(log, text)
+			}
 		}
 	}
 
@@ -3,6 +3,7 @@ package rpc
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"net"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
@@ -30,6 +31,14 @@ import (
 
 const Libp2pProtocol = protocol.ID("/ayup/grpc/1.0.0")
 
+const (
+	// Incremented when the Srv service changes in a way that older clients or daemons can't handle
+	ProtocolVersion = 2
+	// The oldest version the other side may speak. Choices other than yes or no were added in 2 and
+	// older clients can't answer them.
+	MinProtocolVersion = 2
+)
+
 func EnsurePrivKey(ctx context.Context, confName string, b64PrivKey string) (privKey crypto.PrivKey, err error) {
 	if b64PrivKey == "" {
 		ptrace.Event(ctx, "creating private key")
@@ -94,7 +103,33 @@ func Listen(ctx context.Context, addr string, priv crypto.PrivKey) (net.Listener
 	return lis, host, nil
 }
 
+// Conn to the daemon, when using libp2p it also owns the client's host
+type Conn struct {
+	*grpc.ClientConn
+	host host.Host
+}
+
+func (s *Conn) Close() error {
+	err := s.ClientConn.Close()
+	if s.host != nil {
+		err = errors.Join(err, s.host.Close())
+	}
+
+	return err
+}
+
 func Client(ctx context.Context, target string, priv crypto.PrivKey) (pb.SrvClient, error) {
+	conn, err := Dial(ctx, target, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewSrvClient(conn), nil
+}
+
+// Dial the daemon at target which is either a libp2p multi-address including the peer ID or a plain
+// address for an insecure connection
+func Dial(ctx context.Context, target string, priv crypto.PrivKey) (*Conn, error) {
 	provider := trace.SpanFromContext(ctx).TracerProvider()
 
 	maddr, err := multiaddr.NewMultiaddr(target)
@@ -114,7 +149,7 @@ func Client(ctx context.Context, target string, priv crypto.PrivKey) (pb.SrvClie
 			return nil, err
 		}
 
-		return pb.NewSrvClient(conn), nil
+		return &Conn{ClientConn: conn}, nil
 	}
 
 	peerInfo, err := peer.AddrInfoFromP2pAddr(maddr)
@@ -157,8 +192,8 @@ func Client(ctx context.Context, target string, priv crypto.PrivKey) (pb.SrvClie
 	)
 
 	if err != nil {
-		return nil, terror.Errorf(ctx, "grpc dial: %w", err)
+		return nil, errors.Join(terror.Errorf(ctx, "grpc dial: %w", err), host.Close())
 	}
 
-	return pb.NewSrvClient(conn), nil
+	return &Conn{ClientConn: conn, host: host}, nil
 }
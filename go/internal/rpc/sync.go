@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	pb "premai.io/Ayup/go/internal/grpc/srv"
@@ -116,6 +117,16 @@ func (s *fileRecver) RecvDirs(ctx context.Context) error {
 				return s.internalError("unrecognized source: %d", chunk.Source)
 			}
 
+			if chunk.Removed {
+				if s.logChan != nil {
+					s.logChan <- fmt.Sprintf("Removing: %s: %s", chunk.Source.String(), path)
+				}
+				if err := os.RemoveAll(dstPath); err != nil {
+					return s.internalError("os RemoveAll: %w", err)
+				}
+				continue
+			}
+
 			file, alreadyOpen := openFiles[dstPath]
 			if !alreadyOpen {
 				dir := filepath.Dir(dstPath)
@@ -159,6 +170,9 @@ type fileSender struct {
 	logChan       chan string
 	sendError     func(string, ...any) error
 	internalError func(string, ...any) error
+
+	// Called before each file is sent if set
+	OnFile func(source pb.Source, path string, size int64)
 }
 
 func NewFileSender(
@@ -177,133 +191,207 @@ func NewFileSender(
 	}
 }
 
-func (s fileSender) SendDir(ctx context.Context, source pb.Source, path string) (err error) {
-	_, span := trace.Span(ctx, "sync dir", attr.String("path", path))
-	defer span.End()
-
-	buf := make([]byte, 16*1024)
-	chunks := make([]*pb.FileChunk, 0, 32)
+// chunkBatch collects the chunks of files into messages
+type chunkBatch struct {
+	sender fileSender
+	buf    []byte
+	chunks []*pb.FileChunk
 	// not including overhead, remember the 4MB grpc limit if playing with the envelope size
-	length := 0
-
-	sendFileChunks := func() error {
-		if len(chunks) < 1 {
-			return nil
-		}
+	length int
+}
 
-		select {
-		case <-s.cancelChan:
-			if err := s.stream.Send(&pb.FileChunks{
-				Cancel: true,
-			}); err != nil {
-				return s.internalError("stream send: %w", err)
-			}
+func (s fileSender) newChunkBatch() *chunkBatch {
+	return &chunkBatch{
+		sender: s,
+		buf:    make([]byte, 16*1024),
+		chunks: make([]*pb.FileChunk, 0, 32),
+	}
+}
 
-			return s.sendError("User cancelled")
-		default:
-		}
+func (s *chunkBatch) flush() error {
+	if len(s.chunks) < 1 {
+		return nil
+	}
 
-		if err := s.stream.Send(&pb.FileChunks{
-			Chunk: chunks,
+	select {
+	case <-s.sender.cancelChan:
+		if err := s.sender.stream.Send(&pb.FileChunks{
+			Cancel: true,
 		}); err != nil {
-			return s.internalError("stream send: %w", err)
+			return s.sender.internalError("stream send: %w", err)
 		}
 
-		length = 0
-		chunks = make([]*pb.FileChunk, 0, 32)
+		return s.sender.sendError("User cancelled")
+	default:
+	}
 
-		return nil
+	if err := s.sender.stream.Send(&pb.FileChunks{
+		Chunk: s.chunks,
+	}); err != nil {
+		return s.sender.internalError("stream send: %w", err)
 	}
 
-	sendFile := func(path string, r fs.File) error {
-		offset := 0
+	s.length = 0
+	s.chunks = make([]*pb.FileChunk, 0, 32)
 
-		for {
-			if length > 15*1024 || len(chunks) >= 512 {
-				if err := sendFileChunks(); err != nil {
-					return err
-				}
-			}
+	return nil
+}
 
-			last := false
-			chunkLength := 0
+func (s *chunkBatch) addFile(source pb.Source, path string, r io.Reader) error {
+	offset := 0
 
-			for {
-				data := buf[length+chunkLength:]
-				c, err := r.Read(data)
+	for {
+		if s.length > 15*1024 || len(s.chunks) >= 512 {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
 
-				if c < 0 {
-					return s.internalError("file read: bytes written is negative: %d", c)
-				}
+		last := false
+		chunkLength := 0
 
-				if err != nil {
-					if err == io.EOF {
-						last = true
-					} else {
-						return s.internalError("file read: %w", err)
-					}
-				}
+		for {
+			data := s.buf[s.length+chunkLength:]
+			c, err := r.Read(data)
 
-				chunkLength += c
+			if c < 0 {
+				return s.sender.internalError("file read: bytes written is negative: %d", c)
+			}
 
-				if last || chunkLength+length > 15*1024 {
-					break
+			if err != nil {
+				if err == io.EOF {
+					last = true
+				} else {
+					return s.sender.internalError("file read: %w", err)
 				}
 			}
 
-			chunks = append(chunks, &pb.FileChunk{
-				Source: source,
-				Path:   path,
-				Last:   last,
-				Data:   buf[length : length+chunkLength],
-				Offset: int64(offset),
-			})
-
-			length += chunkLength
-			offset += chunkLength
+			chunkLength += c
 
-			if last {
+			if last || chunkLength+s.length > 15*1024 {
 				break
 			}
 		}
 
-		return nil
+		s.chunks = append(s.chunks, &pb.FileChunk{
+			Source: source,
+			Path:   path,
+			Last:   last,
+			Data:   s.buf[s.length : s.length+chunkLength],
+			Offset: int64(offset),
+		})
+
+		s.length += chunkLength
+		offset += chunkLength
+
+		if last {
+			break
+		}
 	}
 
-	dfs := os.DirFS(path)
+	return nil
+}
 
-	err = fs.WalkDir(dfs, ".", func(path string, d fs.DirEntry, err error) error {
+func (s *chunkBatch) addRemoved(source pb.Source, path string) error {
+	if len(s.chunks) >= 512 {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+
+	s.chunks = append(s.chunks, &pb.FileChunk{
+		Source:  source,
+		Path:    path,
+		Removed: true,
+	})
+
+	return nil
+}
+
+// Ignored names are not sent, this includes the directories' contents
+func Ignored(name string) bool {
+	return strings.HasPrefix(name, ".") &&
+		name != "." &&
+		name != ".ayup-env" &&
+		name != ".ayup-conf"
+}
+
+// ExportName is the file DownloadExport sends
+const ExportName = "export.tar"
 
-		event_attrs := []attr.KeyValue{
-			attr.String("path", path),
-			attr.Bool("isDir", d.IsDir()),
-			attr.Bool("IsRegular", d.Type().IsRegular()),
+// RebuildFiles change how an app is built, so they can't be synced to it in dev mode
+var RebuildFiles = []string{"requirements.txt", "pyproject.toml", "Dockerfile", ".ayup-conf", ".ayup-env"}
+
+// RebuildFile returns the first of the paths which is in RebuildFiles, or empty if none are
+func RebuildFile(paths []string) string {
+	for _, path := range paths {
+		if slices.Contains(RebuildFiles, filepath.ToSlash(filepath.Clean(path))) {
+			return path
 		}
-		if err != nil {
-			return s.internalError("walkdir func: %w", err)
+	}
+
+	return ""
+}
+
+// sendFile adds the file at path in dfs to the batch unless it isn't a regular file
+func (s fileSender) sendFile(span tr.Span, batch *chunkBatch, source pb.Source, dfs fs.FS, path string, info fs.FileInfo) error {
+	event_attrs := []attr.KeyValue{
+		attr.String("path", path),
+		attr.Bool("isDir", info.IsDir()),
+		attr.Bool("IsRegular", info.Mode().IsRegular()),
+		attr.String("mode", info.Mode().String()),
+		attr.Int64("size", info.Size()),
+	}
+
+	if !info.Mode().IsRegular() {
+		span.AddEvent("skip", tr.WithAttributes(event_attrs...))
+		if s.logChan != nil {
+			s.logChan <- fmt.Sprintf("Skip special file: %s", path)
 		}
 
-		info, err := d.Info()
+		return nil
+	}
+
+	span.AddEvent("copy", tr.WithAttributes(event_attrs...))
+
+	size := info.Size()
+	unit := "b"
+	if size > 1000 {
+		unit = "Kb"
+		size /= 1000
+	}
+	if s.logChan != nil {
+		s.logChan <- fmt.Sprintf("Send %s: %d%s: %s", source, size, unit, path)
+	}
+	if s.OnFile != nil {
+		s.OnFile(source, path, info.Size())
+	}
+	r, err := dfs.Open(path)
+	if err != nil {
+		return s.internalError("open read: %w", err)
+	}
+	defer r.Close()
+
+	return batch.addFile(source, path, r)
+}
+
+func (s fileSender) SendDir(ctx context.Context, source pb.Source, path string) (err error) {
+	_, span := trace.Span(ctx, "sync dir", attr.String("path", path))
+	defer span.End()
+
+	batch := s.newChunkBatch()
+	dfs := os.DirFS(path)
+
+	err = fs.WalkDir(dfs, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return s.internalError("dir info: %w", err)
+			return s.internalError("walkdir func: %w", err)
 		}
 
-		event_attrs = append(event_attrs,
-			attr.String("mode", info.Mode().String()),
-			attr.Int64("size", info.Size()),
-		)
-
-		skipNotice := func(kind string) {
-			span.AddEvent("skip", tr.WithAttributes(event_attrs...))
+		if Ignored(d.Name()) {
+			span.AddEvent("skip", tr.WithAttributes(attr.String("path", path), attr.Bool("isDir", d.IsDir())))
 			if s.logChan != nil {
-				s.logChan <- fmt.Sprintf("Skip %s: %s", kind, path)
+				s.logChan <- fmt.Sprintf("Skip hidden: %s", path)
 			}
-		}
-
-		if strings.HasPrefix(d.Name(), ".") &&
-			d.Name() != "." &&
-			d.Name() != ".ayup-env" {
-			skipNotice("hidden")
 
 			if d.IsDir() {
 				return fs.SkipDir
@@ -311,41 +399,62 @@ func (s fileSender) SendDir(ctx context.Context, source pb.Source, path string)
 			return nil
 		}
 
-		if !d.Type().IsRegular() {
-			skipNotice("special file")
-
-			return nil
-		}
-
 		// TODO: We should probably transmit empty directories
 		if d.IsDir() {
-			span.AddEvent("skip", tr.WithAttributes(event_attrs...))
+			span.AddEvent("skip", tr.WithAttributes(attr.String("path", path), attr.Bool("isDir", true)))
 			return nil
 		}
 
-		span.AddEvent("copy", tr.WithAttributes(event_attrs...))
-
-		size := info.Size()
-		unit := "b"
-		if size > 1000 {
-			unit = "Kb"
-			size /= 1000
-		}
-		if s.logChan != nil {
-			s.logChan <- fmt.Sprintf("Send %s: %d%s: %s", source, size, unit, path)
-		}
-		r, err := dfs.Open(path)
+		info, err := d.Info()
 		if err != nil {
-			return s.internalError("open read: %w", err)
+			return s.internalError("dir info: %w", err)
 		}
-		defer r.Close()
 
-		return sendFile(path, r)
+		return s.sendFile(span, batch, source, dfs, path, info)
 	})
-
-	if err = sendFileChunks(); err != nil {
+	if err != nil {
 		return
 	}
 
-	return
+	return batch.flush()
+}
+
+// SendFiles sends the files at the paths, which are relative to dir, and tells the receiver to
+// remove the ones which no longer exist. Directories and ignored files are skipped.
+func (s fileSender) SendFiles(ctx context.Context, source pb.Source, dir string, paths []string) error {
+	_, span := trace.Span(ctx, "sync files", attr.String("dir", dir), attr.Int("count", len(paths)))
+	defer span.End()
+
+	batch := s.newChunkBatch()
+	dfs := os.DirFS(dir)
+
+	for _, path := range paths {
+		path = filepath.ToSlash(filepath.Clean(path))
+		if slices.ContainsFunc(strings.Split(path, "/"), Ignored) {
+			continue
+		}
+
+		info, err := fs.Stat(dfs, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			if s.logChan != nil {
+				s.logChan <- fmt.Sprintf("Remove %s: %s", source, path)
+			}
+			if err := batch.addRemoved(source, path); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return s.internalError("fs Stat: %w", err)
+		}
+
+		if info.IsDir() {
+			continue
+		}
+
+		if err := s.sendFile(span, batch, source, dfs, path, info); err != nil {
+			return err
+		}
+	}
+
+	return batch.flush()
 }
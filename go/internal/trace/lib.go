@@ -109,7 +109,10 @@ func newLoggerProvider(ctx context.Context) (*log.LoggerProvider, error) {
 	return loggerProvider, nil
 }
 
-func SetupPyroscopeProfiling(endpoint string) {
+// SetupPyroscopeProfiling starts sending profiles to the endpoint if it is set. The returned
+// function flushes and stops the profiler.
+func SetupPyroscopeProfiling(endpoint string) (stop func() error) {
+	stop = func() error { return nil }
 	if endpoint == "" {
 		return
 	}
@@ -117,7 +120,7 @@ func SetupPyroscopeProfiling(endpoint string) {
 	runtime.SetMutexProfileFraction(1)
 	runtime.SetBlockProfileRate(1)
 
-	_, _ = pyroscope.Start(pyroscope.Config{
+	profiler, err := pyroscope.Start(pyroscope.Config{
 		ApplicationName: "premai.io.ayup",
 		ServerAddress:   endpoint,
 		Logger:          nil,
@@ -138,6 +141,11 @@ func SetupPyroscopeProfiling(endpoint string) {
 			pyroscope.ProfileBlockDuration,
 		},
 	})
+	if err != nil {
+		return
+	}
+
+	return profiler.Stop
 }
 
 type traceContextKey string
@@ -1,9 +1,34 @@
 package tui
 
-import "github.com/charmbracelet/lipgloss"
+import (
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+)
 
 var (
 	TitleStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("098")).Bold(true)
 	VersionStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("060"))
 	ErrorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("203")).Bold(true)
 )
+
+// NewTable for printing listings without borders
+func NewTable(headers ...string) *table.Table {
+	cellStyle := lipgloss.NewStyle().PaddingRight(2)
+	headerStyle := TitleStyle.PaddingRight(2)
+
+	return table.New().
+		BorderTop(false).
+		BorderBottom(false).
+		BorderLeft(false).
+		BorderRight(false).
+		BorderHeader(false).
+		BorderColumn(false).
+		StyleFunc(func(row, col int) lipgloss.Style {
+			if row == 0 {
+				return headerStyle
+			}
+
+			return cellStyle
+		}).
+		Headers(headers...)
+}
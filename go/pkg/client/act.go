@@ -0,0 +1,305 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Log is output from the daemon, a build step or the app
+type Log struct {
+	// Where the output came from e.g. ayup, app or the name of a build step
+	Source string
+	// Not necessarily a whole line
+	Text string
+}
+
+// ChoiceKind is what sort of answer a choice needs
+type ChoiceKind int
+
+const (
+	// Yes or no, answered with Answer.Bool
+	ChoiceBool ChoiceKind = iota
+	// Free text, answered with Answer.Text
+	ChoiceText
+	// One of the options, answered with Answer.Text
+	ChoiceSelect
+	// Any number of the options, answered with Answer.Values
+	ChoiceMultiSelect
+	// A file in the app's source, answered with its slash separated path relative to the source in
+	// Answer.Text
+	ChoiceFile
+)
+
+// Option that can be selected
+type Option struct {
+	Value string
+	// Shown instead of the value if set
+	Label string
+}
+
+// Choice the daemon asks the client to make, such as whether to use the requirements file it found
+type Choice struct {
+	// Names the choice so that it can be answered without asking, may be empty
+	Key         string
+	Kind        ChoiceKind
+	Title       string
+	Description string
+
+	// For bools
+	Affirmative string
+	Negative    string
+
+	// For text, a regular expression the whole answer must match
+	Placeholder string
+	Validate    string
+
+	// For selects, Limit is the most options that can be selected by a multi-select
+	Options []Option
+	Limit   int
+
+	// For files, the extensions such as ".py" the file may have, any if empty
+	Extensions []string
+
+	// The daemon's suggestion, used when there is no ChoiceHandler
+	Default Answer
+}
+
+// Answer to a choice, only the field for the choice's kind is used
+type Answer struct {
+	Bool   bool
+	Text   string
+	Values []string
+}
+
+// ChoiceHandler answers a choice, returning an error cancels the action
+type ChoiceHandler func(ctx context.Context, choice Choice) (Answer, error)
+
+func fromPbOptions(options []*pb.ChoiceOption) []Option {
+	opts := make([]Option, 0, len(options))
+	for _, o := range options {
+		opts = append(opts, Option{Value: o.Value, Label: o.Label})
+	}
+
+	return opts
+}
+
+func fromPbChoice(choice *pb.Choice) (Choice, error) {
+	c := Choice{Key: choice.Key}
+
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		c.Kind = ChoiceBool
+		c.Title, c.Description = v.Bool.Title, v.Bool.Description
+		c.Affirmative, c.Negative = v.Bool.Affirmative, v.Bool.Negative
+		c.Default.Bool = v.Bool.Value
+	case *pb.Choice_Text:
+		c.Kind = ChoiceText
+		c.Title, c.Description = v.Text.Title, v.Text.Description
+		c.Placeholder, c.Validate = v.Text.Placeholder, v.Text.Validate
+		c.Default.Text = v.Text.Value
+	case *pb.Choice_Select:
+		c.Kind = ChoiceSelect
+		c.Title, c.Description = v.Select.Title, v.Select.Description
+		c.Options = fromPbOptions(v.Select.Options)
+		c.Default.Text = v.Select.Value
+	case *pb.Choice_MultiSelect:
+		c.Kind = ChoiceMultiSelect
+		c.Title, c.Description = v.MultiSelect.Title, v.MultiSelect.Description
+		c.Options = fromPbOptions(v.MultiSelect.Options)
+		c.Limit = int(v.MultiSelect.Limit)
+		c.Default.Values = v.MultiSelect.Values
+	case *pb.Choice_File:
+		c.Kind = ChoiceFile
+		c.Title, c.Description = v.File.Title, v.File.Description
+		c.Extensions = v.File.Extensions
+		c.Default.Text = v.File.Value
+	default:
+		return c, fmt.Errorf("unsupported choice: %v", choice)
+	}
+
+	return c, nil
+}
+
+func (s Choice) toPbChosen(seq uint32, answer Answer) *pb.Chosen {
+	chosen := &pb.Chosen{Seq: seq}
+
+	switch s.Kind {
+	case ChoiceBool:
+		chosen.Variant = &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: answer.Bool}}
+	case ChoiceText:
+		chosen.Variant = &pb.Chosen_Text{Text: &pb.ChosenText{Value: answer.Text}}
+	case ChoiceSelect:
+		chosen.Variant = &pb.Chosen_Select{Select: &pb.ChosenSelect{Value: answer.Text}}
+	case ChoiceMultiSelect:
+		chosen.Variant = &pb.Chosen_MultiSelect{MultiSelect: &pb.ChosenMultiSelect{Values: answer.Values}}
+	case ChoiceFile:
+		chosen.Variant = &pb.Chosen_File{File: &pb.ChosenFile{Value: answer.Text}}
+	}
+
+	return chosen
+}
+
+// ActHandlers receive what happens during an action such as a push or a run. Each is optional.
+type ActHandlers struct {
+	OnLog    func(Log)
+	OnChoice ChoiceHandler
+	// Called with the ID of an analysis session, which can be attached to if the connection drops
+	OnSession func(id string)
+}
+
+type actStream interface {
+	Send(*pb.ActReq) error
+	Recv() (*pb.ActReply, error)
+	CloseSend() error
+}
+
+// act sends the first request then handles the replies until the daemon ends the stream. When
+// the context is done the action is canceled, which stops the app or command, rather than the
+// stream being cut.
+func act(ctx context.Context, stream actStream, first *pb.ActReq, h ActHandlers) (exitCode int32, err error) {
+	var sendMutex sync.Mutex
+	send := func(req *pb.ActReq) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+
+		return stream.Send(req)
+	}
+
+	if err := send(first); err != nil {
+		return 0, fmt.Errorf("stream Send: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			trace.Event(ctx, "canceling action")
+			_ = send(&pb.ActReq{Cancel: true})
+		case <-done:
+		}
+	}()
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return exitCode, ctx.Err()
+		}
+		if err != nil {
+			return exitCode, fmt.Errorf("stream Recv: %w", err)
+		}
+
+		if res.Session != "" && h.OnSession != nil {
+			h.OnSession(res.Session)
+		}
+
+		switch v := res.Variant.(type) {
+		case *pb.ActReply_Log:
+			if h.OnLog != nil {
+				h.OnLog(Log{Source: res.Source, Text: v.Log})
+			}
+		case *pb.ActReply_Choice:
+			choice, err := fromPbChoice(v.Choice)
+			if err != nil {
+				return exitCode, err
+			}
+
+			answer := choice.Default
+			if h.OnChoice != nil {
+				answer, err = h.OnChoice(ctx, choice)
+				if err != nil {
+					_ = send(&pb.ActReq{Cancel: true})
+					return exitCode, err
+				}
+			}
+
+			if err := send(&pb.ActReq{
+				Choice: choice.toPbChosen(v.Choice.Seq, answer),
+			}); err != nil {
+				return exitCode, fmt.Errorf("stream Send: %w", err)
+			}
+		case *pb.ActReply_Error:
+			return exitCode, remoteError(v.Error)
+		case *pb.ActReply_ExitCode:
+			exitCode = v.ExitCode
+		}
+	}
+}
+
+// Analysis figures out how to build the app from the source that was last uploaded, then builds
+// and runs it. It returns once the app exits or the context is done, which stops the app.
+func (s *Client) Analysis(ctx context.Context, app string, h ActHandlers) error {
+	ctx, span := trace.Span(ctx, "client analysis")
+	defer span.End()
+
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	stream, err := s.srv.Analysis(streamCtx)
+	if err != nil {
+		return fmt.Errorf("grpc Analysis: %w", err)
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	_, err = act(ctx, stream, &pb.ActReq{App: app}, h)
+
+	return err
+}
+
+// Attach to an analysis session which is still going, such as after the connection dropped. The
+// replies the daemon still has are sent again, including any choice that wasn't answered.
+func (s *Client) Attach(ctx context.Context, session string, h ActHandlers) error {
+	ctx, span := trace.Span(ctx, "client attach")
+	defer span.End()
+
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	stream, err := s.srv.Analysis(streamCtx)
+	if err != nil {
+		return fmt.Errorf("grpc Analysis: %w", err)
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	_, err = act(ctx, stream, &pb.ActReq{Session: session}, h)
+
+	return err
+}
+
+// Run a command in a container made from the app's last build and return its exit code
+func (s *Client) Run(ctx context.Context, app string, args []string, h ActHandlers) (int32, error) {
+	ctx, span := trace.Span(ctx, "client run")
+	defer span.End()
+
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	stream, err := s.srv.Run(streamCtx)
+	if err != nil {
+		return 0, fmt.Errorf("grpc Run: %w", err)
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	return act(ctx, stream, &pb.ActReq{App: app, Args: args}, h)
+}
+
+type PushOptions struct {
+	Upload UploadOptions
+	Act    ActHandlers
+}
+
+// Push uploads the app's source then analyses, builds and runs it like 'ay push'
+func (s *Client) Push(ctx context.Context, app string, opts PushOptions) error {
+	if err := s.Upload(ctx, app, opts.Upload); err != nil {
+		return err
+	}
+
+	return s.Analysis(ctx, app, opts.Act)
+}
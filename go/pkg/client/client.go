@@ -0,0 +1,197 @@
+// Package client is the supported Go API for Ayup. It dials the daemon, either over libp2p or a
+// plain connection, checks that both sides speak a compatible protocol and then pushes apps, runs
+// commands and forwards ports to them. Unlike the packages under internal, it only exports its own
+// types so that it can stay stable while the protocol changes.
+//
+//	c, err := client.Dial(ctx, client.Options{Host: host, PrivKey: key})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	err = c.Push(ctx, "my-app", client.PushOptions{
+//		Upload: client.UploadOptions{Dir: "./my-app"},
+//		Act:    client.ActHandlers{OnLog: func(l client.Log) { fmt.Print(l.Text) }},
+//	})
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// ProtocolVersion spoken by this package, the daemon must accept it
+const ProtocolVersion = rpc.ProtocolVersion
+
+// ErrIncompatible is returned by Dial when the client and daemon can't talk to each other
+var ErrIncompatible = errors.New("incompatible protocol versions")
+
+// RemoteError is an error reported by the daemon, such as an app failing to build
+type RemoteError struct {
+	Message string
+}
+
+func (s *RemoteError) Error() string {
+	return "remote error: " + s.Message
+}
+
+func remoteError(err *pb.Error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &RemoteError{Message: err.Error}
+}
+
+type Options struct {
+	// The daemon's P2P multi-address including its peer ID e.g.
+	// /ip4/192.168.1.2/tcp/50051/p2p/12D3Koo..., or host:port for an insecure connection
+	Host string
+	// The client's identity which the daemon authorizes, required for P2P addresses
+	PrivKey crypto.PrivKey
+	// Don't check the daemon's protocol version, for daemons which predate the check
+	SkipVersionCheck bool
+}
+
+type Client struct {
+	conn *rpc.Conn
+	srv  pb.SrvClient
+
+	daemonVersion   string
+	protocolVersion uint32
+}
+
+// PrivKeyFromBase64 decodes a key in the format used by AYUP_CLIENT_P2P_PRIV_KEY and 'ay key new'
+func PrivKeyFromBase64(b64Key string) (crypto.PrivKey, error) {
+	data, err := base64.StdEncoding.DecodeString(b64Key)
+	if err != nil {
+		return nil, fmt.Errorf("base64 DecodeString: %w", err)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("crypto UnmarshalPrivateKey: %w", err)
+	}
+
+	return key, nil
+}
+
+// Dial the daemon and check its protocol version
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	ctx, span := trace.Span(ctx, "client dial")
+	defer span.End()
+
+	if strings.Contains(opts.Host, "/p2p/") && opts.PrivKey == nil {
+		return nil, errors.New("a private key is needed to connect to a P2P address")
+	}
+
+	conn, err := rpc.Dial(ctx, opts.Host, opts.PrivKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn: conn,
+		srv:  pb.NewSrvClient(conn),
+	}
+
+	if opts.SkipVersionCheck {
+		return c, nil
+	}
+
+	if err := c.checkVersion(ctx); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+
+	return c, nil
+}
+
+func (s *Client) checkVersion(ctx context.Context) error {
+	res, err := s.srv.CheckVersion(ctx, &pb.VersionReq{ProtocolVersion: ProtocolVersion})
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("%w: the daemon is older than the protocol version check, upgrade it", ErrIncompatible)
+	}
+	if err != nil {
+		return fmt.Errorf("grpc CheckVersion: %w", err)
+	}
+
+	if res.Error != nil {
+		return fmt.Errorf("%w: %s", ErrIncompatible, res.Error.Error)
+	}
+
+	if res.ProtocolVersion < rpc.MinProtocolVersion {
+		return fmt.Errorf("%w: daemon protocol version %d is too old, the client needs at least %d; upgrade the daemon",
+			ErrIncompatible, res.ProtocolVersion, rpc.MinProtocolVersion)
+	}
+
+	s.daemonVersion = res.Version
+	s.protocolVersion = res.ProtocolVersion
+
+	return nil
+}
+
+// DaemonVersion is the daemon's release, empty if the version check was skipped
+func (s *Client) DaemonVersion() string {
+	return s.daemonVersion
+}
+
+// DaemonProtocolVersion is zero if the version check was skipped
+func (s *Client) DaemonProtocolVersion() uint32 {
+	return s.protocolVersion
+}
+
+func (s *Client) Close() error {
+	return s.conn.Close()
+}
+
+// Login asks the daemon to authorize the client's key, which someone has to confirm on the
+// daemon's console. It returns immediately if the client is already authorized.
+func (s *Client) Login(ctx context.Context) error {
+	res, err := s.srv.Login(ctx, &pb.LoginReq{})
+	if err != nil {
+		return fmt.Errorf("grpc Login: %w", err)
+	}
+
+	return remoteError(res.Error)
+}
+
+type AppStatus struct {
+	Name string
+	// One of stopped, building, running, exited, failed or oomKilled
+	State    string
+	ExitCode int32
+}
+
+// Status of each app on the daemon
+func (s *Client) Status(ctx context.Context) ([]AppStatus, error) {
+	res, err := s.srv.Status(ctx, &pb.StatusReq{})
+	if err != nil {
+		return nil, fmt.Errorf("grpc Status: %w", err)
+	}
+
+	if err := remoteError(res.Error); err != nil {
+		return nil, err
+	}
+
+	apps := make([]AppStatus, 0, len(res.Apps))
+	for _, a := range res.Apps {
+		apps = append(apps, AppStatus{
+			Name:     a.Name,
+			State:    a.State.String(),
+			ExitCode: a.ExitCode,
+		})
+	}
+
+	return apps, nil
+}
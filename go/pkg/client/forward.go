@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// ForwardConn proxies conn to port 5000 of the app until either side closes the connection. The
+// connection is closed when it returns.
+func (s *Client) ForwardConn(ctx context.Context, app string, conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := s.srv.Forward(ctx)
+	if err != nil {
+		return fmt.Errorf("grpc Forward: %w", err)
+	}
+
+	if err := stream.Send(&pb.ForwardRequest{App: app}); err != nil {
+		return fmt.Errorf("stream Send: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	var egressErr, ingressErr error
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		buf := make([]byte, 16*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := stream.Send(&pb.ForwardRequest{Data: buf[:n]}); err != nil {
+					egressErr = fmt.Errorf("stream Send: %w", err)
+					return
+				}
+			}
+
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					egressErr = fmt.Errorf("conn Read: %w", err)
+				}
+
+				terror.Ackf(ctx, "stream CloseSend: %w", stream.CloseSend())
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		// Unblocks the egress read once the app has closed its side
+		defer func() { _ = conn.Close() }()
+
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					ingressErr = fmt.Errorf("stream Recv: %w", err)
+				}
+				return
+			}
+
+			if res.Closed {
+				return
+			}
+
+			if _, err := conn.Write(res.Data); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					ingressErr = fmt.Errorf("conn Write: %w", err)
+				}
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	return errors.Join(ingressErr, egressErr)
+}
+
+// Forward accepts connections on lis and forwards each to the app, like the port forwarding done
+// by 'ay push'. It returns when lis is closed or the context is done.
+func (s *Client) Forward(ctx context.Context, app string, lis net.Listener) error {
+	ctx, span := trace.Span(ctx, "client forward")
+	defer span.End()
+
+	// Connections are closed before waiting for them to end
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("listener Accept: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			terror.Ackf(ctx, "ForwardConn: %w", s.ForwardConn(ctx, app, conn))
+		}()
+	}
+}
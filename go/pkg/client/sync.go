@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// UploadProgress is reported before each file is sent
+type UploadProgress struct {
+	// app or assistant
+	Source string
+	// Relative to the directory being uploaded
+	Path string
+	Size int64
+
+	// Totals so far, including this file
+	Files int
+	Bytes int64
+}
+
+type UploadOptions struct {
+	// The app's source, hidden files other than .ayup-env and .ayup-conf are skipped
+	Dir string
+	// The source of an assistant plugin if any
+	AssistantDir string
+
+	OnProgress func(UploadProgress)
+}
+
+// Upload replaces the app's source on the daemon
+func (s *Client) Upload(ctx context.Context, app string, opts UploadOptions) (err error) {
+	ctx, span := trace.Span(ctx, "client upload")
+	defer span.End()
+
+	stream, err := s.srv.Upload(ctx)
+	if err != nil {
+		return fmt.Errorf("grpc Upload: %w", err)
+	}
+
+	defer func() {
+		res, err2 := stream.CloseAndRecv()
+		if err2 != nil && !errors.Is(err2, io.EOF) {
+			err2 = fmt.Errorf("stream CloseAndRecv: %w", err2)
+		} else if res == nil {
+			err2 = errors.New("stream CloseAndRecv: no response")
+		} else {
+			err2 = remoteError(res.Error)
+		}
+
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	if err := stream.Send(&pb.FileChunks{App: app}); err != nil {
+		return fmt.Errorf("stream Send: %w", err)
+	}
+
+	retError := func(msg string, args ...any) error {
+		return fmt.Errorf(msg, args...)
+	}
+
+	sender := rpc.NewFileSender(stream, nil, nil, retError, retError)
+	if opts.OnProgress != nil {
+		var progress UploadProgress
+		sender.OnFile = func(source pb.Source, path string, size int64) {
+			progress.Source = source.String()
+			progress.Path = path
+			progress.Size = size
+			progress.Files++
+			progress.Bytes += size
+
+			opts.OnProgress(progress)
+		}
+	}
+
+	if err := sender.SendDir(ctx, pb.Source_app, opts.Dir); err != nil {
+		return err
+	}
+
+	if opts.AssistantDir == "" {
+		return nil
+	}
+
+	return sender.SendDir(ctx, pb.Source_assistant, opts.AssistantDir)
+}
+
+// Download the app's source, which an assistant may have changed, into dir and the assistant's
+// into assistantDir
+func (s *Client) Download(ctx context.Context, app string, dir string, assistantDir string) error {
+	ctx, span := trace.Span(ctx, "client download")
+	defer span.End()
+
+	stream, err := s.srv.Download(ctx, &pb.DownloadReq{App: app})
+	if err != nil {
+		return fmt.Errorf("grpc Download: %w", err)
+	}
+
+	retError := func(msg string, args ...any) error {
+		return fmt.Errorf(msg, args...)
+	}
+
+	recver := rpc.NewFileRecver(stream, nil, retError, retError, dir, assistantDir)
+	if err := recver.RecvDirs(ctx); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
@@ -1,7 +1,6 @@
 package srv
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -9,18 +8,20 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	tr "go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
+	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
 	pb "premai.io/Ayup/go/internal/grpc/srv"
 	"premai.io/Ayup/go/internal/trace"
 
+	"github.com/distribution/reference"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
@@ -42,11 +43,29 @@ type ActServer interface {
 	grpc.ServerStream
 }
 
+// replySender is where an action's replies go, a client's stream or a session it attaches to
+type replySender interface {
+	Send(*pb.ActReply) error
+}
+
 type aCtx struct {
 	ctx       context.Context
 	sendMutex *sync.Mutex
-	stream    pb.Srv_AnalysisServer
+	stream    replySender
 	srv       *Srv
+	app       *app
+
+	// Where the app's log is written, this is all that happens to the logs when the daemon
+	// started the app and no client is attached
+	appLog io.Writer
+	// Called once the app's process has started
+	onStarted func()
+	// The steps of the current build, set by buildkitStatusSender
+	steps *buildSteps
+	// Send BuildStep replies as well as logging the steps
+	sendSteps bool
+	// Set when the app's process is restarted with synced source instead of being rebuilt
+	dev *devMode
 }
 
 func (s *aCtx) span(name string, attrs ...attribute.KeyValue) (aCtx, tr.Span) {
@@ -57,6 +76,13 @@ func (s *aCtx) span(name string, attrs ...attribute.KeyValue) (aCtx, tr.Span) {
 		sendMutex: s.sendMutex,
 		stream:    s.stream,
 		srv:       s.srv,
+		app:       s.app,
+
+		appLog:    s.appLog,
+		onStarted: s.onStarted,
+		steps:     s.steps,
+		sendSteps: s.sendSteps,
+		dev:       s.dev,
 	}, span
 }
 
@@ -64,6 +90,25 @@ func (s *aCtx) send(msg *pb.ActReply) error {
 	s.sendMutex.Lock()
 	defer s.sendMutex.Unlock()
 
+	if s.appLog != nil {
+		var err error
+		switch v := msg.Variant.(type) {
+		case *pb.ActReply_Log:
+			_, err = io.WriteString(s.appLog, v.Log)
+		case *pb.ActReply_Error:
+			_, err = fmt.Fprintf(s.appLog, "Error: %s\n", v.Error.Error)
+		}
+
+		if s.stream == nil {
+			return err
+		}
+		terror.Ackf(s.ctx, "appLog Write: %w", err)
+	}
+
+	if s.stream == nil {
+		return nil
+	}
+
 	if err := s.stream.Send(msg); err != nil {
 		return terror.Errorf(s.ctx, "stream Send: %w", err)
 	}
@@ -82,83 +127,145 @@ func (s *aCtx) internalError(fmt string, args ...any) error {
 	return s.sendError("Internal Error: Support ID: %s", span.SpanContext().SpanID())
 }
 
-func (s *aCtx) useDockerfile() (bool, error) {
-	_, err := os.Stat(filepath.Join(s.srv.SrcDir, "Dockerfile"))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return false, s.internalError("stat Dockerfile: %w", err)
-		}
+func (s *aCtx) execProcess(ctr gateway.Container, recvChan chan recvReq, source string, onLog func([]byte)) error {
+	logWriter := logWriter{actx: s, source: source, onLog: onLog}
 
-		return false, nil
-	}
+	var pid gateway.ContainerProcess
+	var stopChan <-chan struct{}
+	waitChan := make(chan error)
 
-	if err := s.send(&pb.ActReply{
-		Source: "ayup",
-		Variant: &pb.ActReply_Log{
-			Log: "Found Dockerfile, will use it",
-		},
-	}); err != nil {
-		return false, err
-	}
+	// start the app's process, in dev mode it is started again after each sync
+	start := func(restart bool) error {
+		if err := s.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: "Executing `python __main__.py`",
+			},
+		}); err != nil {
+			return err
+		}
 
-	s.srv.push.analysis = &pb.AnalysisResult{
-		UseDockerfile: true,
-	}
+		req := gateway.StartRequest{
+			Cwd: pythonAppDir,
+			// TODO: Run the Dockerfile's CMD or entrypoint
+			Args:   []string{"python", "__main__.py"},
+			Env:    []string{"PATH=" + defaultPathEnv},
+			Tty:    false,
+			Stdout: &logWriter,
+			Stderr: &logWriter,
+		}
 
-	return true, nil
-}
+		// The app is held until the rootless helper has put it in its cgroup, or without the
+		// helper, until its address has been found
+		gate, err := newAppGate()
+		if err != nil {
+			return terror.Errorf(s.ctx, "newAppGate: %w", err)
+		}
+		req.Args = gate.args(req.Args)
+		req.Stdin = gate.stdin
 
-func (s *aCtx) execProcess(ctr gateway.Container, recvChan chan recvReq, source string, onLog func([]byte)) error {
-	logWriter := logWriter{actx: s, source: source, onLog: onLog}
+		pid, err = ctr.Start(s.ctx, req)
+		if err != nil {
+			gate.close()
+			return terror.Errorf(s.ctx, "ctr Start: %w", err)
+		}
 
-	if err := s.send(&pb.ActReply{
-		Source: "ayup",
-		Variant: &pb.ActReply_Log{
-			Log: "Executing `python __main__.py`",
-		},
-	}); err != nil {
-		return err
-	}
+		stopChan = s.app.startRunning()
+		if s.srv.rootless() {
+			s.applyLimits(gate)
+		} else {
+			s.findAppAddr(gate)
+		}
+		if !restart {
+			s.srv.emit(s.ctx, &pb.Event{Type: pb.EventType_buildFinished, App: s.app.name, Ok: true})
+		}
+		s.srv.emit(s.ctx, &pb.Event{Type: pb.EventType_appStarted, App: s.app.name})
 
-	pid, err := ctr.Start(s.ctx, gateway.StartRequest{
-		Cwd: "/app",
-		// TODO: Run the Dockerfile's CMD or entrypoint
-		Args:   []string{"python", "__main__.py"},
-		Tty:    false,
-		Stdout: &logWriter,
-		Stderr: &logWriter,
-	})
-	if err != nil {
-		return terror.Errorf(s.ctx, "ctr Start: %w", err)
-	}
+		if s.onStarted != nil && !restart {
+			s.onStarted()
+		}
 
-	waitChan := make(chan error)
+		exitedChan := make(chan struct{})
+
+		go func() {
+			select {
+			case <-time.After(appHealthyAfter):
+				observeAppHealth(s.app.name, true)
+				s.srv.emit(s.ctx, &pb.Event{Type: pb.EventType_appHealthy, App: s.app.name, State: pb.AppState_running})
+			case <-exitedChan:
+				// Being stopped isn't a failed health check
+				if s.app.status().State != pb.AppState_stopped {
+					observeAppHealth(s.app.name, false)
+				}
+				return
+			}
 
-	go func() {
-		var retErr error
-
-		if err := pid.Wait(); err != nil {
-			var exitError *gatewayapi.ExitError
-			if ok := errors.As(err, &exitError); ok {
-				trace.Event(s.ctx, "Child exited",
-					attribute.Int("exitCode", int(exitError.ExitCode)),
-					attribute.String("error", exitError.Error()),
-				)
+			<-exitedChan
+			appHealthy.WithLabelValues(s.app.name).Set(0)
+		}()
 
-				if exitError.ExitCode >= gatewayapi.UnknownExitStatus {
-					retErr = exitError.Err
+		go func(pid gateway.ContainerProcess) {
+			var retErr error
+			var exitCode int32
+
+			if err := pid.Wait(); err != nil {
+				var exitError *gatewayapi.ExitError
+				if ok := errors.As(err, &exitError); ok {
+					trace.Event(s.ctx, "Child exited",
+						attribute.Int("exitCode", int(exitError.ExitCode)),
+						attribute.String("error", exitError.Error()),
+					)
+
+					if exitError.ExitCode >= gatewayapi.UnknownExitStatus {
+						retErr = exitError.Err
+					} else {
+						exitCode = int32(exitError.ExitCode)
+					}
 				}
 			}
-		}
 
-		if retErr != nil {
-			waitChan <- terror.Errorf(s.ctx, "pid Wait: %w", retErr)
-		} else {
-			waitChan <- nil
-		}
-	}()
+			gate.close()
+			oomKilled := false
+			if s.srv.rootless() {
+				oomKilled = s.releaseLimits()
+			}
+
+			state := pb.AppState_exited
+			if oomKilled {
+				state = pb.AppState_oomKilled
+			} else if retErr != nil {
+				state = pb.AppState_failed
+			}
+			s.app.finishRunning(state, exitCode)
+			close(exitedChan)
+
+			if st := s.app.status(); st.State != pb.AppState_stopped && (st.State != pb.AppState_exited || st.ExitCode != 0) {
+				s.srv.emit(s.ctx, &pb.Event{Type: pb.EventType_appCrashed, App: s.app.name, State: st.State, ExitCode: st.ExitCode})
+			}
+
+			if retErr != nil {
+				waitChan <- terror.Errorf(s.ctx, "pid Wait: %w", retErr)
+			} else {
+				waitChan <- nil
+			}
+		}(pid)
+
+		return nil
+	}
+
+	if err := start(false); err != nil {
+		return err
+	}
+
+	var devSyncs chan devSync
+	if s.dev != nil {
+		devSyncs = s.dev.syncs
+	}
+	// The process was stopped to start it again with synced source
+	restarting := false
 
 	cancelCount := 0
+	var graceChan <-chan time.Time
 
 	for {
 		select {
@@ -166,7 +273,79 @@ func (s *aCtx) execProcess(ctr gateway.Container, recvChan chan recvReq, source
 			if err != nil {
 				return err
 			}
+
+			if restarting {
+				restarting = false
+				graceChan = nil
+				if err := start(true); err != nil {
+					return err
+				}
+				continue
+			}
+
 			return nil
+		case <-stopChan:
+			stopChan = nil
+			restarting = false
+
+			s.app.mutex.Lock()
+			grace := s.app.stopGrace
+			s.app.mutex.Unlock()
+
+			trace.Event(s.ctx, "Stopping app", attribute.String("grace", grace.String()))
+			_ = s.send(&pb.ActReply{
+				Source: "ayup",
+				Variant: &pb.ActReply_Log{
+					Log: fmt.Sprintf("%s; stopping the app, it has %s to exit\n", s.app.getStopReason(), grace),
+				},
+			})
+
+			if err := pid.Signal(s.ctx, syscall.SIGTERM); err != nil {
+				return terror.Errorf(s.ctx, "pid Signal: %w", err)
+			}
+			graceChan = time.After(grace)
+		case <-graceChan:
+			trace.Event(s.ctx, "Grace period expired")
+
+			if err := pid.Signal(s.ctx, syscall.SIGKILL); err != nil {
+				return terror.Errorf(s.ctx, "pid Signal: %w", err)
+			}
+		case sync := <-devSyncs:
+			err := s.applySync(ctr, sync.paths)
+			sync.result <- err
+			if err != nil {
+				terror.Ackf(s.ctx, "applySync: %w", err)
+				continue
+			}
+
+			if !s.dev.restart || restarting {
+				_ = s.send(&pb.ActReply{
+					Source: "ayup",
+					Variant: &pb.ActReply_Log{
+						Log: fmt.Sprintf("Synced %d changed files\n", len(sync.paths)),
+					},
+				})
+				continue
+			}
+
+			s.app.mutex.Lock()
+			grace := s.app.stopGrace
+			s.app.mutex.Unlock()
+
+			trace.Event(s.ctx, "Restarting app", attribute.String("grace", grace.String()))
+			_ = s.send(&pb.ActReply{
+				Source: "ayup",
+				Variant: &pb.ActReply_Log{
+					Log: fmt.Sprintf("Synced %d changed files; restarting the app, it has %s to exit\n", len(sync.paths), grace),
+				},
+			})
+
+			restarting = true
+			s.app.setStopReason("The source was synced")
+			if err := pid.Signal(s.ctx, syscall.SIGTERM); err != nil {
+				return terror.Errorf(s.ctx, "pid Signal: %w", err)
+			}
+			graceChan = time.After(grace)
 		case req := <-recvChan:
 			trace.Event(s.ctx, "Got user request")
 
@@ -175,9 +354,11 @@ func (s *aCtx) execProcess(ctr gateway.Container, recvChan chan recvReq, source
 			}
 			if req.req.GetCancel() {
 				trace.Event(s.ctx, "Got cancel", attribute.Int("count", cancelCount))
+				restarting = false
 
 				switch cancelCount {
 				case 0:
+					s.app.setStopReason("Canceled by the client")
 					if err := pid.Signal(s.ctx, syscall.SIGINT); err != nil {
 						return terror.Errorf(s.ctx, "pid Signal: %w", err)
 					}
@@ -201,6 +382,72 @@ func (s *aCtx) execProcess(ctr gateway.Container, recvChan chan recvReq, source
 	}
 }
 
+// applyLimits puts the app's gated process in its own cgroup with the app's limits, then lets
+// it run
+func (s *aCtx) applyLimits(gate *appGate) {
+	s.app.mutex.Lock()
+	limits := s.app.limits
+	s.app.mutex.Unlock()
+
+	if limits == nil {
+		limits = &pb.Limits{}
+	}
+
+	sendLog := func(text string) {
+		_ = s.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: text,
+			},
+		})
+	}
+
+	// The app runs without limits rather than not at all
+	defer func() {
+		terror.Ackf(s.ctx, "gate release: %w", gate.release())
+	}()
+
+	req := limitRequest(s.app.name, limits)
+	req.Gate = gate.token
+	if _, err := s.srv.inrClient.Limit(s.ctx, req); err != nil {
+		terror.Ackf(s.ctx, "inrClient Limit: %w", err)
+		if hasLimits(limits) {
+			sendLog(fmt.Sprintf("Warning: resource limits could not be applied: %v\n", err))
+		}
+		return
+	}
+
+	if hasLimits(limits) {
+		sendLog(fmt.Sprintf("Resource limits: %s\n", fmtLimits(limits)))
+	}
+}
+
+// releaseLimits once the app has exited and report if it was OOM killed
+func (s *aCtx) releaseLimits() bool {
+	// The stream context may already be cancelled
+	ctx := context.WithoutCancel(s.ctx)
+
+	res, err := s.srv.inrClient.Release(ctx, &inrPb.ReleaseRequest{App: s.app.name})
+	if err != nil {
+		terror.Ackf(ctx, "inrClient Release: %w", err)
+		return false
+	}
+
+	if !res.OomKilled {
+		return false
+	}
+
+	trace.Event(ctx, "OOM killed")
+	_ = s.send(&pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_Log{
+			Log: "App was killed because it ran out of memory; consider raising AYUP_MEMORY_MAX in .ayup-conf\n",
+		},
+	})
+
+	return true
+}
+
 type logWriter struct {
 	actx   *aCtx
 	source string
@@ -240,6 +487,9 @@ func (s *logWriter) Close() error {
 
 var ErrUserCancelled = errors.New("user cancelled")
 
+// The environment is not inherited from the image when starting a process in a container
+const defaultPathEnv = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 func (s *aCtx) assistantLlb(secretsRunOpts []llb.RunOption) (*llb.Definition, error) {
 	assLocal := llb.Local("assistant")
 	assMnt := llb.AddMount("/assistant", assLocal)
@@ -258,7 +508,7 @@ func (s *aCtx) assistantLlb(secretsRunOpts []llb.RunOption) (*llb.Definition, er
 	runOpts = append(runOpts, secretsRunOpts...)
 	runOpts = append(runOpts, assMnt, appMnt)
 
-	if _, err := os.Stat(filepath.Join(s.srv.AssistantDir, "in", "log")); err == nil {
+	if _, err := os.Stat(filepath.Join(s.app.assDir, "in", "log")); err == nil {
 		runOpts = append(runOpts, logMnt)
 	}
 
@@ -284,7 +534,7 @@ func (s *aCtx) callAssistant(c *client.Client) error {
 	defer span.End()
 	ctx := actx.ctx
 
-	providerMap, secretsRunOpts, err := actx.srv.loadAyupEnv(ctx, pb.Source_assistant)
+	providerMap, secretsRunOpts, err := actx.app.loadAyupEnv(ctx, pb.Source_assistant)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -295,9 +545,11 @@ func (s *aCtx) callAssistant(c *client.Client) error {
 			return nil, actx.internalError("mkllb: %w", err)
 		}
 
+		started := time.Now()
 		r, err := c.Solve(ctx, gateway.SolveRequest{
 			Definition: def.ToPB(),
 		})
+		observeBuild("assistant", started, err)
 		if err != nil {
 			return nil, actx.internalError("client solve: %w", err)
 		}
@@ -305,8 +557,8 @@ func (s *aCtx) callAssistant(c *client.Client) error {
 		return r, nil
 	}
 
-	assDir := actx.srv.AssistantDir
-	srcDir := actx.srv.SrcDir
+	assDir := actx.app.assDir
+	srcDir := actx.app.srcDir
 	statusChan := actx.buildkitStatusSender("assistant", nil)
 	assistantFS, err := fsutil.NewFS(assDir)
 	if err != nil {
@@ -322,7 +574,7 @@ func (s *aCtx) callAssistant(c *client.Client) error {
 		return actx.internalError("filepath Join: %w", err)
 	}
 
-	appFS, err := fsutil.NewFS(actx.srv.SrcDir)
+	appFS, err := fsutil.NewFS(srcDir)
 	if err != nil {
 		return actx.internalError("fsutil newfs: %w", err)
 	}
@@ -360,7 +612,6 @@ func (s *aCtx) callAssistant(c *client.Client) error {
 
 func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 	ctx := stream.Context()
-	span := tr.SpanFromContext(ctx)
 	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
 
 	actx := aCtx{
@@ -370,35 +621,6 @@ func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 		srv:       s,
 	}
 
-	recvChan := make(chan recvReq)
-
-	proxy := mkProxy()
-	go func() {
-		if err := proxy.Listen(":8080"); err != nil {
-			terror.Ackf(ctx, "proxy listen: %w", err)
-		}
-	}()
-	defer func() {
-		if err := proxy.ShutdownWithContext(ctx); err != nil {
-			terror.Ackf(ctx, "proxy shutdown: %w", err)
-		}
-	}()
-
-	go func(ctx context.Context) {
-		for {
-			req, err := stream.Recv()
-			if err != nil && err != io.EOF {
-				err = terror.Errorf(ctx, "stream recv: %w", err)
-			}
-
-			recvChan <- recvReq{req, err}
-
-			if err == io.EOF {
-				break
-			}
-		}
-	}(ctx)
-
 	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
 		if err != nil {
 			return actx.internalError("checkPeerAuth: %w", err)
@@ -407,270 +629,308 @@ func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 		return actx.sendError("Not authorized")
 	}
 
-	c, err := client.New(ctx, s.BuildkitdAddr)
+	first, err := stream.Recv()
 	if err != nil {
-		return actx.internalError("client new: %w", err)
+		return terror.Errorf(ctx, "stream Recv: %w", err)
 	}
 
-	// TODO: Check if we are dealing with an existing session etc.
-	r, ok := <-recvChan
-	if !ok {
-		return actx.internalError("stream recv: channel closed")
-	}
-	if r.err != nil {
-		return actx.internalError("stream recv: %w", r.err)
+	if first.Session != "" {
+		return s.attachActSession(stream, first)
 	}
 
-	if r.req.Cancel {
-		return actx.sendError("analysis canceled")
-	}
+	return s.startAnalysis(stream, first, nil)
+}
 
-	if r.req.Choice != nil {
-		return actx.sendError("premature choice")
-	}
+// startAnalysis runs the analysis in a new session which the stream is attached to. If locked is
+// set then it is the app named by first and the caller holds its actMutex, which is released when
+// the analysis is done.
+func (s *Srv) startAnalysis(stream pb.Srv_AnalysisServer, first *pb.ActReq, locked *app) error {
+	ctx := stream.Context()
 
-	var onLog func([]byte)
-	if s.push.hasAssistant {
-		if err := actx.callAssistant(c); err != nil {
-			return err
+	// The analysis carries on if the client is disconnected, until the session expires
+	sessCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	sess, err := s.newActSession(sessCtx, cancel)
+	if err != nil {
+		cancel()
+		if locked != nil {
+			locked.actMutex.Unlock()
 		}
 
-		ctxLogFile, err := os.OpenFile(filepath.Join(s.AssistantDir, "in", "log"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-		if err != nil {
-			return terror.Errorf(ctx, "os OpenFile: %w", err)
+		actx := aCtx{
+			ctx:       ctx,
+			sendMutex: &sync.Mutex{},
+			stream:    stream,
+			srv:       s,
 		}
-		defer func() {
-			terror.Ackf(ctx, "ctxLogFile: %w", ctxLogFile.Close())
-		}()
+		return actx.internalError("newActSession: %w", err)
+	}
 
-		onLog = func(b []byte) {
-			trace.Event(ctx, "onLog", attribute.Int("len", len(b)))
-			_, err := ctxLogFile.Write(b)
-			terror.Ackf(ctx, "ctxLogFile Write: %w", err)
+	go func() {
+		defer s.finishActSession(sess)
+
+		if err := s.analysis(sessCtx, sess, first, locked); err != nil {
+			_ = sess.Send(newErrorReply(err.Error()))
 		}
+	}()
+
+	return sess.attach(stream, 0)
+}
+
+// analysis figures out how to build and run the app, then does so. The replies go to the
+// session and the requests after the first come from it.
+func (s *Srv) analysis(ctx context.Context, sess *actSession, first *pb.ActReq, locked *app) error {
+	span := tr.SpanFromContext(ctx)
+
+	if locked != nil {
+		defer locked.actMutex.Unlock()
+	}
+
+	actx := aCtx{
+		ctx:       ctx,
+		sendMutex: &sync.Mutex{},
+		stream:    sess,
+		srv:       s,
+		sendSteps: first.BuildSteps,
 	}
 
-	requirements_path := filepath.Join(s.SrcDir, "requirements.txt")
+	recvChan := sess.recvChan
 
-	if ok, err := actx.useDockerfile(); ok || err != nil {
-		if err != nil {
-			return err
-		}
-		actx, span := actx.span("dockerfile")
-		defer span.End()
+	if s.shuttingDown.Load() {
+		return actx.sendError("The daemon is shutting down")
+	}
 
-		b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
-			r, err := c.Solve(ctx, gateway.SolveRequest{
-				Frontend: "dockerfile.v0",
-			})
-			if err != nil {
-				return nil, actx.internalError("gateway client solve: %w", err)
-			}
+	if err := s.buildkitDown(); err != nil {
+		return actx.sendError("%w", err)
+	}
 
-			ctr, err := c.NewContainer(ctx, gateway.NewContainerRequest{
-				Mounts: []gateway.Mount{
-					{
-						Dest:      "/",
-						MountType: solverPb.MountType_BIND,
-						Ref:       r.Ref,
-					},
-				},
-			})
-			if err != nil {
-				return nil, actx.internalError("gateway client NewContainer: %w", err)
-			}
-			defer func() { terror.Ackf(ctx, "ctr Release: %w", ctr.Release(ctx)) }()
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return actx.internalError("client new: %w", err)
+	}
 
-			if err := actx.execProcess(ctr, recvChan, "app", onLog); err != nil {
-				return nil, err
-			}
+	if first.Cancel {
+		return actx.sendError("analysis canceled")
+	}
 
-			return r, nil
-		}
+	if first.Choice != nil {
+		return actx.sendError("premature choice")
+	}
 
-		contextFS, err := fsutil.NewFS(s.SrcDir)
+	// A dry run reads the source uploaded for it and leaves the app alone
+	if first.Analyze {
+		app, err := s.getApp(ctx, first.App)
 		if err != nil {
-			return actx.internalError("fsutil newfs: %w", err)
+			return actx.sendError("%w", err)
 		}
+		span.SetAttributes(attribute.String("app", app.name))
 
-		statusChan := actx.buildkitStatusSender("dockerfile", onLog)
-		if _, err := c.Build(ctx, client.SolveOpt{
-			LocalMounts: map[string]fsutil.FS{
-				"dockerfile": contextFS,
-				"context":    contextFS,
-			},
-		}, "ayup", b, statusChan); err != nil {
-			return actx.internalError("build: %w", err)
-		}
+		app.analyzeMutex.Lock()
+		defer app.analyzeMutex.Unlock()
 
-		return actx.send(&pb.ActReply{
-			Variant: &pb.ActReply_AnalysisResult{
-				AnalysisResult: &pb.AnalysisResult{
-					UseDockerfile: true,
-				},
-			},
-		})
-	} else if _, err := os.Stat(requirements_path); err != nil {
-		actx, span := actx.span("requirements")
-		defer span.End()
+		srcDir, _ := app.analyzeDirs()
+		if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+			return actx.sendError("Upload the source for a dry run before analysing it: %s", app.name)
+		}
 
-		if !os.IsNotExist(err) {
-			return actx.internalError("stat requirements.txt: %w", err)
+		actx.app = app
+		report, err := actx.analysisReport(srcDir, app.analyzeAssistant)
+		if err != nil {
+			return actx.internalError("analysisReport: %w", err)
 		}
 
-		span.AddEvent("No requirements.txt")
-		err := actx.send(&pb.ActReply{
-			Source: "ayup",
-			Variant: &pb.ActReply_Choice{
-				Choice: &pb.Choice{
-					Variant: &pb.Choice_Bool{
-						Bool: &pb.ChoiceBool{
-							Value:       true,
-							Title:       "No requirements.txt; try guessing it?",
-							Description: "Guess what dependencies the program has by inspecting the source code.",
-							Affirmative: "Yes, guess",
-							Negative:    "No, I'll make it",
-						},
-					},
-				},
+		if err := actx.send(&pb.ActReply{
+			Variant: &pb.ActReply_AnalysisReport{
+				AnalysisReport: report,
 			},
-		})
-		if err != nil {
+		}); err != nil {
 			return err
 		}
 
-		span.AddEvent("Waiting for choice")
-		r, ok := <-recvChan
-		if !ok {
-			return actx.internalError("stream recv: channel closed")
-		}
-		if r.err != nil {
-			return actx.internalError("stream recv: %w", r.err)
-		}
+		return actx.send(&pb.ActReply{})
+	}
 
-		if r.req.Cancel {
-			return actx.sendError("analysis canceled")
+	app := locked
+	if app == nil {
+		if app, err = s.getApp(ctx, first.App); err != nil {
+			return actx.sendError("%w", err)
 		}
 
-		choice := r.req.Choice.GetBool()
-		if choice == nil {
-			return actx.sendError("expected choice for requirements.txt")
-		} else if !choice.Value {
-			return actx.sendError("can't continue without requirements.txt; please provide one!")
+		if !app.actMutex.TryLock() {
+			return actx.sendError("App is busy: %s", app.name)
 		}
+		defer app.actMutex.Unlock()
+	}
+	span.SetAttributes(attribute.String("app", app.name))
 
-		span.AddEvent("Creating requirements.txt")
+	// An export doesn't replace the app that is running
+	exporting := first.Export != nil
+	var exports []client.ExportEntry
+	if exporting {
+		exports = app.exportEntries(first.Export)
+	} else {
+		// The daemon may have started the app without a client
+		app.stop(ctx, "A new version of the app was pushed")
+	}
 
-		local := llb.Local("context", llb.ExcludePatterns([]string{".git"}))
-		st := pythonSlimPip(pythonSlimLlb(), "install pipreqs").
-			File(llb.Copy(local, ".", ".")).
-			Run(llb.Shlex("pipreqs")).Root()
+	actx.app = app
 
-		dt, err := st.Marshal(ctx, llb.LinuxAmd64)
-		if err != nil {
-			return actx.internalError("marshal: %w", err)
+	if err := os.MkdirAll(app.dir, 0700); err != nil {
+		return actx.internalError("os MkdirAll: %w", err)
+	}
+	logName := "log"
+	if exporting {
+		logName = "export-log"
+	}
+	logFile, err := os.Create(filepath.Join(app.dir, logName))
+	if err != nil {
+		return actx.internalError("os Create: %w", err)
+	}
+	defer func() {
+		terror.Ackf(ctx, "logFile Close: %w", logFile.Close())
+	}()
+	actx.appLog = logFile
+
+	if exporting {
+		if err := os.Remove(app.exportPath()); err != nil && !os.IsNotExist(err) {
+			return actx.internalError("os Remove: %w", err)
 		}
+	} else {
+		app.setState(pb.AppState_building, 0)
+	}
+	s.emit(ctx, &pb.Event{Type: pb.EventType_buildStarted, App: app.name})
 
-		b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
-			r, err := c.Solve(ctx, gateway.SolveRequest{
-				Definition: dt.ToPB(),
-			})
-			if err != nil {
-				return nil, actx.internalError("client solve: %w", err)
-			}
+	exported := false
+	// finishExport tells the client that the export can be downloaded
+	finishExport := func() error {
+		exported = true
+		s.emit(ctx, &pb.Event{Type: pb.EventType_buildFinished, App: app.name, Ok: true})
 
-			reqs, err := r.Ref.ReadFile(ctx, gateway.ReadRequest{
-				Filename: "/app/requirements.txt",
-			})
-			if err != nil {
-				return nil, terror.Errorf(ctx, "ref readfile: %w", err)
+		return actx.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: "Exported the build\n",
+			},
+		})
+	}
+	defer func() {
+		if exporting {
+			if !exported {
+				s.emit(ctx, &pb.Event{Type: pb.EventType_buildFinished, App: app.name})
 			}
+			return
+		}
 
-			requirementsFile, err := os.OpenFile(requirements_path, os.O_CREATE|os.O_WRONLY, 0666)
-			if err != nil {
-				return nil, terror.Errorf(ctx, "openfile requirements: %w", err)
-			}
-			defer requirementsFile.Close()
+		app.mutex.Lock()
+		defer app.mutex.Unlock()
 
-			if _, err := requirementsFile.Write(reqs); err != nil {
-				return nil, terror.Errorf(ctx, "requirementsFile write: %w", err)
-			}
+		switch app.state {
+		case pb.AppState_building:
+			app.state = pb.AppState_failed
+			s.emit(ctx, &pb.Event{Type: pb.EventType_buildFinished, App: app.name})
+		case pb.AppState_running:
+			app.state = pb.AppState_stopped
+		}
+	}()
 
-			return r, nil
+	appConf, err := app.loadConf(ctx)
+	if err != nil {
+		return actx.sendError("%w", err)
+	}
+
+	limits, err := s.AppLimits.merge(appConf.limits).resolve(ctx)
+	if err != nil {
+		return actx.sendError("resource limits: %w", err)
+	}
+	app.mutex.Lock()
+	app.limits = limits
+	app.mutex.Unlock()
+
+	publishRef := appConf.publish
+	if first.Publish != "" {
+		publishRef = first.Publish
+	}
+	var publishTo reference.Named
+	if publishRef != "" {
+		if publishTo, err = reference.ParseNormalizedNamed(publishRef); err != nil {
+			return actx.sendError("publish: %s: %w", publishRef, err)
 		}
+	}
+	labels := actx.imageLabels(first.Revision)
 
-		contextFS, err := fsutil.NewFS(s.SrcDir)
+	var onLog func([]byte)
+	if app.hasAssistant {
+		if err := actx.callAssistant(c); err != nil {
+			return err
+		}
+
+		ctxLogFile, err := os.OpenFile(filepath.Join(app.assDir, "in", "log"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 		if err != nil {
-			return actx.internalError("fsutil newfs: %w", err)
+			return terror.Errorf(ctx, "os OpenFile: %w", err)
 		}
+		defer func() {
+			terror.Ackf(ctx, "ctxLogFile: %w", ctxLogFile.Close())
+		}()
 
-		statusChan := actx.buildkitStatusSender("pipreqs", nil)
-		if _, err := c.Build(ctx, client.SolveOpt{
-			LocalMounts: map[string]fsutil.FS{
-				"context": contextFS,
-			},
-		}, "ayup", b, statusChan); err != nil {
-			return actx.internalError("build: %w", err)
+		onLog = func(b []byte) {
+			trace.Event(ctx, "onLog", attribute.Int("len", len(b)))
+			_, err := ctxLogFile.Write(b)
+			terror.Ackf(ctx, "ctxLogFile Write: %w", err)
 		}
+	}
 
-		span.End()
-	} else {
-		span.AddEvent("requirements.txt exists")
+	plan, err := actx.detect(recvChan)
+	if plan == nil {
+		return err
+	}
+	app.analysis = plan
+	builder := planBuilderFor(plan)
 
+	if first.Dev && builder.devDir() == "" {
 		if err := actx.send(&pb.ActReply{
-			Source: "Ayup",
+			Source: "ayup",
 			Variant: &pb.ActReply_Log{
-				Log: "requirements.txt found",
+				Log: "Dev mode doesn't work with a Dockerfile, changes will be rebuilt\n",
 			},
 		}); err != nil {
 			return err
 		}
 	}
 
-	s.push.analysis = &pb.AnalysisResult{
-		UsePythonRequirements: true,
-	}
-
-	requirementsFile, err := os.OpenFile(requirements_path, os.O_RDONLY, 0)
-	if err != nil {
-		return actx.internalError("open file: %w", err)
+	if plan, err = builder.prepare(&actx, c, recvChan, plan); plan == nil {
+		return err
 	}
-	defer requirementsFile.Close()
 
-	gitRegex := regexp.MustCompile(`@\s+git`)
-	opencvRegex := regexp.MustCompile(`^\s*opencv-python\b`)
-	lines := bufio.NewScanner(requirementsFile)
-	for lines.Scan() {
-		line := lines.Text()
+	if err = func() (err error) {
+		actx, span := actx.span("build", attribute.String("source", builder.source()))
+		defer span.End()
 
-		if gitRegex.MatchString(line) {
-			s.push.analysis.NeedsGit = true
+		localMounts, err := app.buildMounts(plan)
+		if err != nil {
+			return actx.internalError("buildMounts: %w", err)
 		}
 
-		if opencvRegex.MatchString(line) {
-			s.push.analysis.NeedsLibGL = true
-			s.push.analysis.NeedsLibGlib = true
+		solve, err := builder.solver(ctx, plan, labels)
+		if err != nil {
+			return actx.internalError("solver: %w", err)
 		}
-	}
 
-	if err = func() (err error) {
-		actx, span := actx.span("app")
-		defer span.End()
-
-		b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
-			def, err := s.MkLlb(ctx)
+		b := func(ctx context.Context, gc gateway.Client) (*gateway.Result, error) {
+			r, err := actx.solveBuild(ctx, gc, solve, plan, appConf, exporting)
 			if err != nil {
-				return nil, actx.internalError("mkllb: %w", err)
+				return nil, err
 			}
 
-			r, err := c.Solve(ctx, gateway.SolveRequest{
-				Definition: def.ToPB(),
-			})
-			if err != nil {
-				return nil, actx.internalError("client solve: %w", err)
+			if publishTo != nil {
+				if err := actx.publish(c, publishTo, localMounts, solve); err != nil {
+					return nil, err
+				}
+			}
+
+			if exporting {
+				return r, nil
 			}
 
-			ctr, err := c.NewContainer(ctx, gateway.NewContainerRequest{
+			ctr, err := gc.NewContainer(ctx, gateway.NewContainerRequest{
 				Hostname: "app",
 				Mounts: []gateway.Mount{
 					{
@@ -685,6 +945,11 @@ func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 			}
 			defer func() { terror.Ackf(ctx, "ctr Release: %w", ctr.Release(ctx)) }()
 
+			if dir := builder.devDir(); first.Dev && dir != "" {
+				actx.dev = app.startDev(dir, !appConf.devSelfReload)
+				defer app.stopDev()
+			}
+
 			if err := actx.execProcess(ctr, recvChan, "app", onLog); err != nil {
 				return nil, err
 			}
@@ -692,19 +957,11 @@ func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 			return r, nil
 		}
 
-		statusChan := actx.buildkitStatusSender("build", onLog)
-		contextFS, err := fsutil.NewFS(s.SrcDir)
-		if err != nil {
-			return actx.internalError("fsutil newfs: %w", err)
-		}
-
-		_, err = c.Build(ctx, client.SolveOpt{
-			LocalMounts: map[string]fsutil.FS{
-				"context": contextFS,
-			},
-		}, "ayup", b, statusChan)
-
-		if err != nil {
+		statusChan := actx.buildkitStatusSender(builder.source(), onLog)
+		if _, err := c.Build(ctx, client.SolveOpt{
+			LocalMounts: localMounts,
+			Exports:     exports,
+		}, "ayup", b, statusChan); err != nil {
 			return actx.internalError("client build: %w", err)
 		}
 
@@ -713,14 +970,55 @@ func (s *Srv) Analysis(stream pb.Srv_AnalysisServer) error {
 		return err
 	}
 
+	if exporting {
+		if err := finishExport(); err != nil {
+			return err
+		}
+	}
+
+	if err := actx.send(&pb.ActReply{
+		Variant: &pb.ActReply_AnalysisResult{
+			AnalysisResult: plan,
+		},
+	}); err != nil {
+		return err
+	}
+
 	return actx.send(&pb.ActReply{})
 }
 
+// solveBuild builds the app and records it as the app's latest build, unless it is only being
+// exported
+func (s *aCtx) solveBuild(ctx context.Context, gc gateway.Client, solve gateway.BuildFunc, plan *pb.AnalysisResult, conf appConf, exporting bool) (*gateway.Result, error) {
+	started := time.Now()
+	r, err := solve(ctx, gc)
+	observeBuild("push", started, err)
+	s.recordBuild("push", started, err)
+	if err != nil {
+		return nil, s.internalError("client solve: %w", err)
+	}
+
+	// An export doesn't replace the app that is running, so tasks, jobs and restarts keep using
+	// what was deployed
+	if !exporting {
+		s.app.setBuilt(ctx, plan, conf, s.srv.StopGracePeriod)
+	}
+
+	return r, nil
+}
+
+const (
+	// The base image of Python apps, MkDockerfile has to be kept in step with MkLlb
+	pythonSlimImage = "docker.io/library/python:3.12-slim"
+	// Where Python apps' source is put and run from
+	pythonAppDir = "/app"
+)
+
 func pythonSlimLlb() llb.State {
-	return llb.Image("docker.io/library/python:3.12-slim").
+	return llb.Image(pythonSlimImage).
 		AddEnv("PYTHONUNBUFFERED", "True").
-		File(llb.Mkdir("/app", 0755)).
-		Dir("/app").
+		File(llb.Mkdir(pythonAppDir, 0755)).
+		Dir(pythonAppDir).
 		File(llb.Rm("/etc/apt/apt.conf.d/docker-clean"))
 }
 
@@ -737,24 +1035,29 @@ func pythonSlimPip(st llb.State, args string, ro ...llb.RunOption) llb.State {
 	return st.Run(ro...).Root()
 }
 
-func (s *Srv) MkLlb(ctx context.Context) (*llb.Definition, error) {
-	local := llb.Local("context", llb.ExcludePatterns([]string{".venv", ".git"}))
-	st := pythonSlimLlb()
-
-	aptDeps := []string{}
-	if s.push.analysis.NeedsGit {
-		aptDeps = append(aptDeps, "git")
+// aptDeps are the Debian packages the app needs according to the analysis
+func aptDeps(analysis *pb.AnalysisResult) []string {
+	deps := []string{}
+	if analysis.NeedsGit {
+		deps = append(deps, "git")
 	}
 
-	if s.push.analysis.NeedsLibGL {
-		aptDeps = append(aptDeps, "libgl1")
+	if analysis.NeedsLibGL {
+		deps = append(deps, "libgl1")
 	}
 
-	if s.push.analysis.NeedsLibGlib {
-		aptDeps = append(aptDeps, "libglib2.0-0")
+	if analysis.NeedsLibGlib {
+		deps = append(deps, "libglib2.0-0")
 	}
 
-	if len(aptDeps) > 0 {
+	return deps
+}
+
+func MkLlb(ctx context.Context, analysis *pb.AnalysisResult) (*llb.Definition, error) {
+	local := llb.Local("context", llb.ExcludePatterns([]string{".venv", ".git"}))
+	st := pythonSlimLlb()
+
+	if aptDeps := aptDeps(analysis); len(aptDeps) > 0 {
 		aptCachePath := "/var/cache/apt"
 
 		cacheAptMnt := llb.AddMount(
@@ -799,29 +1102,39 @@ func (s *aCtx) buildkitStatusSender(source string, onLog func([]byte)) chan *cli
 		})
 	}
 
+	s.steps = &buildSteps{}
+	steps := s.steps
+
 	go func() {
 		verts := make(map[digest.Digest]int)
+		completed := make(map[string]bool)
 
 		for msg := range statusChan {
 			for _, warn := range msg.Warnings {
 				sendLog(fmt.Sprintf("Warning: %v", warn))
 			}
 			for _, vert := range msg.Vertexes {
+				observeVertex(vert, completed)
+				steps.update(vert)
+
 				vertNo, ok := verts[vert.Digest]
 				if !ok {
 					vertNo = len(verts) + 1
 					verts[vert.Digest] = vertNo
 				}
 
-				state := "NEW"
+				state, stepState := "NEW", pb.BuildStepState_stepNew
 				if vert.Started != nil {
-					state = "START"
+					state, stepState = "START", pb.BuildStepState_stepStarted
 				}
 
 				if vert.Cached {
-					state = "CACHED"
+					state, stepState = "CACHED", pb.BuildStepState_stepCached
 				} else if vert.Completed != nil {
-					state = "DONE"
+					state, stepState = "DONE", pb.BuildStepState_stepDone
+					if vert.Error != "" {
+						stepState = pb.BuildStepState_stepFailed
+					}
 				}
 
 				duration := 0.0
@@ -829,6 +1142,21 @@ func (s *aCtx) buildkitStatusSender(source string, onLog func([]byte)) chan *cli
 					duration = vert.Completed.Sub(*vert.Started).Seconds()
 				}
 
+				if s.sendSteps {
+					_ = s.send(&pb.ActReply{
+						Source: source,
+						Variant: &pb.ActReply_BuildStep{
+							BuildStep: &pb.BuildStep{
+								Number:   uint32(vertNo),
+								Name:     vert.Name,
+								State:    stepState,
+								Duration: duration,
+								Error:    vert.Error,
+							},
+						},
+					})
+				}
+
 				if duration < 0.01 {
 					sendLog(fmt.Sprintf("#%d %6s %s\n", vertNo, state, vert.Name))
 				} else {
@@ -0,0 +1,514 @@
+package srv
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/contrib/otelfiber"
+	"github.com/gofiber/fiber/v2"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// HashApiToken is what is stored in the daemon's config instead of the token itself
+func HashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseApiTokens from a comma separated list of <peer id>:<token hash> pairs
+func ParseApiTokens(val string) (map[string]p2pPeer.ID, error) {
+	tokens := make(map[string]p2pPeer.ID)
+	if val == "" {
+		return tokens, nil
+	}
+
+	for _, pair := range strings.Split(val, ",") {
+		peerStr, hash, ok := strings.Cut(pair, ":")
+		if !ok || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("expected <peer id>:<token hash>: `%s`", pair)
+		}
+
+		peerId, err := p2pPeer.Decode(peerStr)
+		if err != nil {
+			return nil, fmt.Errorf("peer Decode: `%s`: %w", peerStr, err)
+		}
+
+		tokens[hash] = peerId
+	}
+
+	return tokens, nil
+}
+
+// tokenAddr makes a request with a bearer token look like it came from the token's peer, so that
+// it is authorized the same way as a libp2p connection
+type tokenAddr struct {
+	id p2pPeer.ID
+}
+
+func (s tokenAddr) Network() string { return gostream.Network }
+func (s tokenAddr) String() string  { return s.id.String() }
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The HTTP status of each gRPC code as used by the Connect protocol
+var apiErrorStatus = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            fiber.StatusInternalServerError,
+	codes.InvalidArgument:    fiber.StatusBadRequest,
+	codes.DeadlineExceeded:   fiber.StatusGatewayTimeout,
+	codes.NotFound:           fiber.StatusNotFound,
+	codes.AlreadyExists:      fiber.StatusConflict,
+	codes.PermissionDenied:   fiber.StatusForbidden,
+	codes.ResourceExhausted:  fiber.StatusTooManyRequests,
+	codes.FailedPrecondition: fiber.StatusBadRequest,
+	codes.Aborted:            fiber.StatusConflict,
+	codes.OutOfRange:         fiber.StatusBadRequest,
+	codes.Unimplemented:      fiber.StatusNotImplemented,
+	codes.Internal:           fiber.StatusInternalServerError,
+	codes.Unavailable:        fiber.StatusServiceUnavailable,
+	codes.DataLoss:           fiber.StatusInternalServerError,
+	codes.Unauthenticated:    fiber.StatusUnauthorized,
+}
+
+// apiCodeName converts e.g. InvalidArgument to invalid_argument
+func apiCodeName(code codes.Code) string {
+	var b strings.Builder
+	for i, r := range code.String() {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func sendApiError(c *fiber.Ctx, code codes.Code, msgf string, args ...any) error {
+	return c.Status(apiErrorStatus[code]).JSON(apiError{
+		Code:    apiCodeName(code),
+		Message: fmt.Sprintf(msgf, args...),
+	})
+}
+
+func sendApiProto(c *fiber.Ctx, msg proto.Message) error {
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return sendApiError(c, codes.Internal, "protojson Marshal: %s", err)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(data)
+}
+
+// authToken maps the token to a peer and checks it is authorized. The returned context carries
+// the peer, so the request looks like it came over libp2p.
+func (s *Srv) authToken(ctx context.Context, token string) (context.Context, error) {
+	return s.authTokenHash(ctx, HashApiToken(token))
+}
+
+// authTokenHash is authToken for when only the token's hash is kept
+func (s *Srv) authTokenHash(ctx context.Context, hash string) (context.Context, error) {
+	peerId, ok := s.ApiTokens[hash]
+	if !ok {
+		return ctx, status.Error(codes.Unauthenticated, "Unknown token")
+	}
+
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: tokenAddr{id: peerId}})
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		terror.Ackf(ctx, "checkPeerAuth: %w", err)
+		return ctx, status.Error(codes.PermissionDenied, "Not authorized")
+	}
+
+	return ctx, nil
+}
+
+// apiAuth checks the bearer token with authToken
+func (s *Srv) apiAuth(c *fiber.Ctx) error {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return sendApiError(c, codes.Unauthenticated, "Missing bearer token, see 'ay daemon token'")
+	}
+
+	ctx, err := s.authToken(c.UserContext(), token)
+	if err != nil {
+		st := status.Convert(err)
+		return sendApiError(c, st.Code(), "%s", st.Message())
+	}
+
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// apiUnary calls a unary method of the Srv service with the JSON request in the body, the reply
+// is returned as JSON even when it contains an error
+func (s *Srv) apiUnary(desc grpc.MethodDesc) fiber.Handler {
+	fullMethod := "/" + pb.Srv_ServiceDesc.ServiceName + "/" + desc.MethodName
+
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		started := time.Now()
+
+		dec := func(in any) error {
+			body := c.Body()
+			if len(bytes.TrimSpace(body)) == 0 {
+				return nil
+			}
+
+			if err := protojson.Unmarshal(body, in.(proto.Message)); err != nil {
+				return status.Errorf(codes.InvalidArgument, "protojson Unmarshal: %s", err)
+			}
+
+			return nil
+		}
+
+		reply, err := desc.Handler(s, ctx, dec, nil)
+		observeRpc(fullMethod, started, err)
+		if err != nil {
+			st, _ := status.FromError(err)
+			return sendApiError(c, st.Code(), "%s", st.Message())
+		}
+
+		return sendApiProto(c, reply.(proto.Message))
+	}
+}
+
+// extractTar writes the regular files and directories in a, possibly gzipped, tarball to dir
+func extractTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	r = br
+
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("gzip NewReader: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar Next: %w", err)
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("tar entry is outside of the app's directory: %s", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return fmt.Errorf("os MkdirAll: %w", err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return fmt.Errorf("os MkdirAll: %w", err)
+			}
+
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm()|0600)
+			if err != nil {
+				return fmt.Errorf("os OpenFile: %w", err)
+			}
+
+			n, err := io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("write %s: %w", name, err)
+			}
+
+			uploadBytes.Add(float64(n))
+			uploadFiles.Inc()
+		}
+	}
+}
+
+// apiActStream drives an action such as Analysis from an HTTP request. Each reply is written as a
+// line of JSON and choices are answered with their defaults.
+type apiActStream struct {
+	ctx    context.Context
+	w      *bufio.Writer
+	chosen chan *pb.ActReq
+	// Called when writing to the client fails
+	cancel func()
+}
+
+func (s *apiActStream) Context() context.Context     { return s.ctx }
+func (s *apiActStream) SetHeader(metadata.MD) error  { return nil }
+func (s *apiActStream) SendHeader(metadata.MD) error { return nil }
+func (s *apiActStream) SetTrailer(metadata.MD)       {}
+func (s *apiActStream) SendMsg(m any) error          { return s.Send(m.(*pb.ActReply)) }
+func (s *apiActStream) RecvMsg(m any) error          { return errors.New("not supported") }
+
+func (s *apiActStream) Send(reply *pb.ActReply) error {
+	data, err := protojson.Marshal(reply)
+	if err != nil {
+		return fmt.Errorf("protojson Marshal: %w", err)
+	}
+
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		s.cancel()
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.cancel()
+		return err
+	}
+
+	if choice := reply.GetChoice(); choice != nil {
+		s.chosen <- &pb.ActReq{Choice: defaultChosen(choice)}
+	}
+
+	return nil
+}
+
+func (s *apiActStream) Recv() (*pb.ActReq, error) {
+	select {
+	case req := <-s.chosen:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+// apiPush replaces the app's source with the tarball in the body then builds and runs it. The
+// output is streamed back until the app exits, is stopped or the client goes away.
+func (s *Srv) apiPush(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	ctx, span := trace.Span(ctx, "api push")
+
+	app, err := s.getApp(ctx, c.Params("app"))
+	if err != nil {
+		span.End()
+		return sendApiError(c, codes.InvalidArgument, "%s", err)
+	}
+	span.SetAttributes(attribute.String("app", app.name))
+
+	if !app.actMutex.TryLock() {
+		span.End()
+		return sendApiError(c, codes.Aborted, "App is busy: %s", app.name)
+	}
+
+	s.emit(ctx, &pb.Event{Type: pb.EventType_pushStarted, App: app.name})
+
+	if err := app.clearSrc(); err != nil {
+		app.actMutex.Unlock()
+		span.End()
+		return sendApiError(c, codes.Internal, "%s", terror.Errorf(ctx, "clearSrc: %w", err))
+	}
+
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	err = extractTar(body, app.srcDir)
+	app.hasAssistant = false
+	if err != nil {
+		app.actMutex.Unlock()
+		span.End()
+		return sendApiError(c, codes.InvalidArgument, "%s", terror.Errorf(ctx, "extractTar: %w", err))
+	}
+	s.emit(ctx, &pb.Event{Type: pb.EventType_uploadDone, App: app.name, Ok: true})
+
+	// Apps must be stopped with their grace period when the daemon shuts down, so the request
+	// is only canceled when the client goes away
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	ctx, endSession := s.beginSession(ctx, "Push (HTTP)")
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer span.End()
+		defer cancel()
+		defer endSession()
+
+		stream := &apiActStream{
+			ctx:    ctx,
+			w:      w,
+			chosen: make(chan *pb.ActReq, 1),
+			cancel: cancel,
+		}
+
+		// The app is still locked, so nothing can replace the source before it is built
+		started := time.Now()
+		err := s.startAnalysis(stream, &pb.ActReq{App: app.name}, app)
+		observeRpc(pb.Srv_Analysis_FullMethodName, started, err)
+		terror.Ackf(ctx, "Analysis: %w", err)
+	})
+
+	return nil
+}
+
+// apiStart starts the app from its last build without a client attached
+func (s *Srv) apiStart(ctx context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		app, err := s.getApp(c.UserContext(), c.Params("app"))
+		if err != nil {
+			return sendApiError(c, codes.InvalidArgument, "%s", err)
+		}
+
+		if err := s.startApp(ctx, app); err != nil {
+			return sendApiProto(c, &pb.Result{Error: &pb.Error{Error: err.Error()}})
+		}
+
+		return sendApiProto(c, &pb.Result{})
+	}
+}
+
+func (s *Srv) apiStop(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	app, err := s.getApp(ctx, c.Params("app"))
+	if err != nil {
+		return sendApiError(c, codes.InvalidArgument, "%s", err)
+	}
+
+	app.stopWithGrace(ctx, "Stopped through the HTTP API")
+
+	return sendApiProto(c, &pb.Result{})
+}
+
+// apiLog returns the output of the app's last push or start
+func (s *Srv) apiLog(c *fiber.Ctx) error {
+	app, err := s.getApp(c.UserContext(), c.Params("app"))
+	if err != nil {
+		return sendApiError(c, codes.InvalidArgument, "%s", err)
+	}
+
+	path := filepath.Join(app.dir, "log")
+	if _, err := os.Stat(path); err != nil {
+		return sendApiError(c, codes.NotFound, "The app has no log yet")
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.SendFile(path)
+}
+
+type apiRoute struct {
+	method  string
+	path    string
+	summary string
+	// The request body and the reply, each is either a message or a content type
+	req     any
+	reply   any
+	handler fiber.Handler
+}
+
+// apiRoutes that are not unary methods of the Srv service
+func (s *Srv) apiRoutes(ctx context.Context) []apiRoute {
+	return []apiRoute{
+		{
+			method:  fiber.MethodPost,
+			path:    "/v1/apps/:app/push",
+			summary: "Replace the app's source with a tarball, then build and run it. The output is streamed as an ActReply per line until the app exits or is stopped.",
+			req:     "application/x-tar",
+			reply:   &pb.ActReply{},
+			handler: s.apiPush,
+		},
+		{
+			method:  fiber.MethodPost,
+			path:    "/v1/apps/:app/start",
+			summary: "Start the app from its last build without a client attached",
+			reply:   &pb.Result{},
+			handler: s.apiStart(context.WithoutCancel(ctx)),
+		},
+		{
+			method:  fiber.MethodPost,
+			path:    "/v1/apps/:app/stop",
+			summary: "Stop the app, this also ends a push of it",
+			reply:   &pb.Result{},
+			handler: s.apiStop,
+		},
+		{
+			method:  fiber.MethodGet,
+			path:    "/v1/apps/:app/log",
+			summary: "The output of the app's last push or start, including the build",
+			reply:   fiber.MIMETextPlain,
+			handler: s.apiLog,
+		},
+	}
+}
+
+func (s *Srv) newApi(ctx context.Context) *fiber.App {
+	api := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		BodyLimit:             1024 * 1024 * 1024,
+		StreamRequestBody:     true,
+	})
+	// The middleware reads the whole response, so a push's output wouldn't be streamed
+	api.Use(otelfiber.Middleware(otelfiber.WithNext(func(c *fiber.Ctx) bool {
+		return strings.HasSuffix(c.Path(), "/push")
+	})))
+
+	routes := s.apiRoutes(ctx)
+
+	openapi, err := openApiDoc(routes)
+	if err != nil {
+		terror.Ackf(ctx, "openApiDoc: %w", err)
+	}
+	api.Get("/openapi.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(openapi)
+	})
+
+	api.Use(s.apiAuth)
+
+	for _, desc := range pb.Srv_ServiceDesc.Methods {
+		api.Post("/"+pb.Srv_ServiceDesc.ServiceName+"/"+desc.MethodName, s.apiUnary(desc))
+	}
+
+	for _, r := range routes {
+		api.Add(r.method, r.path, r.handler)
+	}
+
+	return api
+}
+
+// serveApi on addr until it is shutdown
+func (s *Srv) serveApi(ctx context.Context, api *fiber.App, addr string) {
+	ctx, span := trace.Span(ctx, "api")
+	defer span.End()
+
+	if err := api.Listen(addr); err != nil {
+		terror.Ackf(ctx, "api Listen: %w", err)
+	}
+}
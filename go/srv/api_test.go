@@ -0,0 +1,220 @@
+package srv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newPeerId(t *testing.T) p2pPeer.ID {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := p2pPeer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestParseApiTokens(t *testing.T) {
+	alice, bob := newPeerId(t), newPeerId(t)
+	aliceHash, bobHash := HashApiToken("alice"), HashApiToken("bob")
+
+	cases := []struct {
+		name string
+		val  string
+		want map[string]p2pPeer.ID
+		err  bool
+	}{
+		{name: "empty", val: "", want: map[string]p2pPeer.ID{}},
+		{name: "one", val: alice.String() + ":" + aliceHash, want: map[string]p2pPeer.ID{aliceHash: alice}},
+		{
+			name: "two",
+			val:  alice.String() + ":" + aliceHash + "," + bob.String() + ":" + bobHash,
+			want: map[string]p2pPeer.ID{aliceHash: alice, bobHash: bob},
+		},
+		{name: "no hash", val: alice.String(), err: true},
+		{name: "short hash", val: alice.String() + ":abc", err: true},
+		{name: "bad peer", val: "nobody:" + aliceHash, err: true},
+		{name: "trailing comma", val: alice.String() + ":" + aliceHash + ",", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseApiTokens(c.val)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		for hash, id := range c.want {
+			if got[hash] != id {
+				t.Errorf("%s: %s: got %s, want %s", c.name, hash, got[hash], id)
+			}
+		}
+	}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func mkTar(t *testing.T, entries []tarEntry, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+			Linkname: e.linkname,
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	cases := []struct {
+		name     string
+		entries  []tarEntry
+		compress bool
+		want     map[string]string
+		err      bool
+	}{
+		{
+			name: "files",
+			entries: []tarEntry{
+				{name: "app/", typeflag: tar.TypeDir},
+				{name: "app/__main__.py", typeflag: tar.TypeReg, body: "print('hi')"},
+				{name: "requirements.txt", typeflag: tar.TypeReg, body: "flask"},
+			},
+			want: map[string]string{"app/__main__.py": "print('hi')", "requirements.txt": "flask"},
+		},
+		{
+			name:     "gzip",
+			entries:  []tarEntry{{name: "a/b.txt", typeflag: tar.TypeReg, body: "b"}},
+			compress: true,
+			want:     map[string]string{"a/b.txt": "b"},
+		},
+		{
+			name:    "inner dot dot",
+			entries: []tarEntry{{name: "a/../b.txt", typeflag: tar.TypeReg, body: "b"}},
+			want:    map[string]string{"b.txt": "b"},
+		},
+		{
+			name:    "parent",
+			entries: []tarEntry{{name: "../escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+			err:     true,
+		},
+		{
+			name:    "nested parent",
+			entries: []tarEntry{{name: "a/../../escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+			err:     true,
+		},
+		{
+			name:    "absolute",
+			entries: []tarEntry{{name: "/tmp/escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+			err:     true,
+		},
+		{
+			// Links are skipped so they can't be used to write outside of the directory
+			name: "symlink",
+			entries: []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "link/escaped.txt", typeflag: tar.TypeReg, body: "x"},
+			},
+			want: map[string]string{"link/escaped.txt": "x"},
+		},
+	}
+
+	for _, c := range cases {
+		root := t.TempDir()
+		dir := filepath.Join(root, "src")
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		err := extractTar(bytes.NewReader(mkTar(t, c.entries, c.compress)), dir)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+
+		if entries, err := os.ReadDir(root); err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 1 {
+			t.Errorf("%s: wrote outside of the directory: %v", c.name, entries)
+		}
+
+		for name, body := range c.want {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if string(data) != body {
+				t.Errorf("%s: %s: got %q, want %q", c.name, name, data, body)
+			}
+
+			info, err := os.Lstat(filepath.Join(dir, strings.Split(name, "/")[0]))
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("%s: %s is a symlink", c.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/tonistiigi/fsutil"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// App names end up in host names so they are restricted to a DNS label
+var appNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type app struct {
+	name   string
+	dir    string
+	srcDir string
+	assDir string
+
+	// Held while the app is being analysed, built or ran
+	actMutex sync.Mutex
+
+	hasAssistant bool
+	analysis     *pb.AnalysisResult
+
+	mutex    sync.Mutex
+	state    pb.AppState
+	exitCode int32
+	limits   *pb.Limits
+
+	// Closed to ask the app's process to stop, nil when it is not running
+	stopChan   chan struct{}
+	stopReason string
+	// Closed when the app's process exits
+	exitedChan chan struct{}
+
+	// The analysis of the last successful build, tasks and jobs are run against this
+	built       *pb.AnalysisResult
+	jobs        []*job
+	runningJobs map[string]bool
+	dependsOn   []string
+	stopGrace   time.Duration
+
+	// The container's address while running, only used with an external buildkitd
+	addr string
+
+	// Set while the app runs in dev mode
+	dev *devMode
+
+	// Held for writing while the snapshot of the built source is replaced
+	builtMutex sync.RWMutex
+
+	// Held while source is uploaded for a dry run analysis or analysed
+	analyzeMutex sync.Mutex
+	// An assistant was uploaded with the dry run's source
+	analyzeAssistant bool
+}
+
+func (s *Srv) getApp(ctx context.Context, name string) (*app, error) {
+	if !appNameRegex.MatchString(name) {
+		return nil, terror.Errorf(ctx, "invalid app name, must be lower case alphanumeric or '-': `%s`", name)
+	}
+
+	s.setSessionApp(ctx, name)
+
+	s.appsMutex.Lock()
+	defer s.appsMutex.Unlock()
+
+	if s.apps == nil {
+		s.apps = make(map[string]*app)
+	}
+
+	a, ok := s.apps[name]
+	if !ok {
+		trace.Event(ctx, "new app", attribute.String("name", name))
+
+		dir := filepath.Join(s.AppsDir, name)
+		a = &app{
+			name:   name,
+			dir:    dir,
+			srcDir: filepath.Join(dir, "src"),
+			assDir: filepath.Join(dir, "ass"),
+		}
+		s.apps[name] = a
+	}
+
+	return a, nil
+}
+
+func (s *app) setState(state pb.AppState, exitCode int32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = state
+	s.exitCode = exitCode
+}
+
+// startRunning marks the app as running and returns a channel which is closed when it should stop
+func (s *app) startRunning() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	appStarts.WithLabelValues(s.name).Inc()
+
+	s.state = pb.AppState_running
+	s.exitCode = 0
+	s.stopChan = make(chan struct{})
+	s.stopReason = ""
+	s.exitedChan = make(chan struct{})
+
+	return s.stopChan
+}
+
+// finishRunning records how the app's process exited, if it was asked to stop then it is
+// considered stopped regardless of the exit code
+func (s *app) finishRunning(state pb.AppState, exitCode int32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopReason != "" && state == pb.AppState_exited {
+		state = pb.AppState_stopped
+	}
+	appExits.WithLabelValues(s.name, state.String()).Inc()
+
+	s.state = state
+	s.exitCode = exitCode
+	s.stopChan = nil
+	s.addr = ""
+	close(s.exitedChan)
+}
+
+// stop asks the app's process to stop and waits for it to exit or the context to be done
+func (s *app) stop(ctx context.Context, reason string) {
+	s.mutex.Lock()
+	stopChan, exitedChan := s.stopChan, s.exitedChan
+	if stopChan != nil {
+		s.stopChan = nil
+		s.stopReason = reason
+		close(stopChan)
+	}
+	s.mutex.Unlock()
+
+	if exitedChan == nil {
+		return
+	}
+
+	select {
+	case <-exitedChan:
+	case <-ctx.Done():
+		terror.Ackf(ctx, "waiting for app to stop: %w", ctx.Err())
+	}
+}
+
+// stopWithGrace stops the app, allowing for its grace period and for the signals to be delivered
+// and the container released
+func (s *app) stopWithGrace(ctx context.Context, reason string) {
+	s.mutex.Lock()
+	grace := s.stopGrace
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, grace+5*time.Second)
+	defer cancel()
+
+	s.stop(ctx, reason)
+}
+
+// setStopReason unless the app was already asked to stop for another reason
+func (s *app) setStopReason(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopReason == "" {
+		s.stopReason = reason
+	}
+}
+
+func (s *app) getStopReason() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stopReason
+}
+
+func (s *app) status() *pb.AppStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return &pb.AppStatus{
+		Name:     s.name,
+		State:    s.state,
+		ExitCode: s.exitCode,
+		Limits:   s.limits,
+	}
+}
+
+// loadApps which were pushed before the daemon was last started
+func (s *Srv) loadApps(ctx context.Context) error {
+	entries, err := os.ReadDir(s.AppsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return terror.Errorf(ctx, "os ReadDir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !appNameRegex.MatchString(entry.Name()) {
+			continue
+		}
+
+		a, err := s.getApp(ctx, entry.Name())
+		if err != nil {
+			return err
+		}
+
+		built, err := a.loadBuilt(ctx)
+		if err != nil || built == nil {
+			continue
+		}
+
+		conf, err := a.loadConf(ctx)
+		terror.Ackf(ctx, "loadConf: %w", err)
+
+		limits, err := s.AppLimits.merge(conf.limits).resolve(ctx)
+		terror.Ackf(ctx, "resolve limits: %w", err)
+
+		a.mutex.Lock()
+		a.limits = limits
+		a.mutex.Unlock()
+
+		a.setConf(built, conf, s.StopGracePeriod)
+	}
+
+	return nil
+}
+
+// buildMounts are the locals the app is built from with the plan. The Dockerfile is the one the
+// detector made if there is one, otherwise it is in the source.
+func (s *app) buildMounts(plan *pb.AnalysisResult) (map[string]fsutil.FS, error) {
+	dockerfileDir := s.srcDir
+	if plan.Dockerfile != "" {
+		dockerfileDir = filepath.Join(s.dir, "detected")
+		if err := writeDockerfile(dockerfileDir, plan.Dockerfile); err != nil {
+			return nil, err
+		}
+	}
+
+	return localMounts(s.srcDir, dockerfileDir)
+}
+
+// builtMounts are the locals of the last successful build. They are a snapshot, so anything
+// uploaded since then is not used. Hold builtMutex for reading until they have been solved.
+func (s *app) builtMounts(built *pb.AnalysisResult) (map[string]fsutil.FS, error) {
+	srcDir := filepath.Join(s.builtSrcPath(), "src")
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		// Built before snapshots were kept
+		return s.buildMounts(built)
+	}
+
+	dockerfileDir := srcDir
+	if built.Dockerfile != "" {
+		dockerfileDir = filepath.Join(s.builtSrcPath(), "dockerfile")
+	}
+
+	return localMounts(srcDir, dockerfileDir)
+}
+
+func localMounts(srcDir string, dockerfileDir string) (map[string]fsutil.FS, error) {
+	contextFS, err := fsutil.NewFS(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("fsutil NewFS: %w", err)
+	}
+
+	dockerfileFS, err := fsutil.NewFS(dockerfileDir)
+	if err != nil {
+		return nil, fmt.Errorf("fsutil NewFS: %w", err)
+	}
+
+	return map[string]fsutil.FS{
+		"dockerfile": dockerfileFS,
+		"context":    contextFS,
+	}, nil
+}
+
+func writeDockerfile(dir string, dockerfile string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("os MkdirAll: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0600); err != nil {
+		return fmt.Errorf("os WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+func (s *app) builtSrcPath() string {
+	return filepath.Join(s.dir, "built")
+}
+
+// analyzeDirs are where source uploaded for a dry run analysis goes
+func (s *app) analyzeDirs() (srcDir string, assDir string) {
+	dir := filepath.Join(s.dir, "analyze")
+
+	return filepath.Join(dir, "src"), filepath.Join(dir, "ass")
+}
+
+// snapshotBuilt copies the source, and the detected Dockerfile if any, that were just built. The
+// copy is made beside the old one which is then swapped out under builtMutex.
+func (s *app) snapshotBuilt(built *pb.AnalysisResult) error {
+	next := s.builtSrcPath() + ".next"
+	if err := os.RemoveAll(next); err != nil {
+		return fmt.Errorf("os RemoveAll: %w", err)
+	}
+
+	if err := copyTree(s.srcDir, filepath.Join(next, "src")); err != nil {
+		return err
+	}
+	if built.Dockerfile != "" {
+		if err := writeDockerfile(filepath.Join(next, "dockerfile"), built.Dockerfile); err != nil {
+			return err
+		}
+	}
+
+	s.builtMutex.Lock()
+	defer s.builtMutex.Unlock()
+
+	if err := os.RemoveAll(s.builtSrcPath()); err != nil {
+		return fmt.Errorf("os RemoveAll: %w", err)
+	}
+	if err := os.Rename(next, s.builtSrcPath()); err != nil {
+		return fmt.Errorf("os Rename: %w", err)
+	}
+
+	return nil
+}
+
+// copyTree copies the directories, regular files and symlinks under src to dst
+func copyTree(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("os MkdirAll: %w", err)
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("os Readlink: %w", err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("os Symlink: %w", err)
+			}
+		case d.Type().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("os Open: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("os OpenFile: %w", err)
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("io Copy: %w", err)
+	}
+
+	return out.Close()
+}
+
+func (s *app) builtPath() string {
+	return filepath.Join(s.dir, "build.json")
+}
+
+func (s *app) loadBuilt(ctx context.Context) (*pb.AnalysisResult, error) {
+	data, err := os.ReadFile(s.builtPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, terror.Errorf(ctx, "os ReadFile: %w", err)
+	}
+
+	var built pb.AnalysisResult
+	if err := protojson.Unmarshal(data, &built); err != nil {
+		return nil, terror.Errorf(ctx, "protojson Unmarshal: %w", err)
+	}
+
+	return &built, nil
+}
+
+// setConf sets the analysis of the last successful build along with the config from the source
+// that was built
+func (s *app) setConf(built *pb.AnalysisResult, conf appConf, defaultStopGrace time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.built = built
+	s.jobs = conf.jobs
+	s.dependsOn = conf.dependsOn
+
+	s.stopGrace = defaultStopGrace
+	if conf.stopGrace > 0 {
+		s.stopGrace = conf.stopGrace
+	}
+}
+
+// setBuilt records a successful build so that it can be used after the daemon restarts
+func (s *app) setBuilt(ctx context.Context, built *pb.AnalysisResult, conf appConf, defaultStopGrace time.Duration) {
+	if err := s.snapshotBuilt(built); err != nil {
+		terror.Ackf(ctx, "snapshotBuilt: %w", err)
+
+		// Better to fall back to the source than to use an older snapshot
+		s.builtMutex.Lock()
+		terror.Ackf(ctx, "os RemoveAll: %w", os.RemoveAll(s.builtSrcPath()))
+		s.builtMutex.Unlock()
+	}
+	s.setConf(built, conf, defaultStopGrace)
+
+	data, err := protojson.Marshal(built)
+	if err != nil {
+		terror.Ackf(ctx, "protojson Marshal: %w", err)
+		return
+	}
+
+	terror.Ackf(ctx, "os WriteFile: %w", os.WriteFile(s.builtPath(), data, 0600))
+}
+
+func (s *app) lastBuilt() *pb.AnalysisResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.built
+}
+
+// The project config is read from .ayup-conf in the root of the app's source. It has the same
+// dotenv format as Ayup's own config.
+type appConf struct {
+	limits    Limits
+	jobs      []*job
+	dependsOn []string
+	stopGrace time.Duration
+	// The app reloads itself when its files change, so it isn't restarted after a sync in dev mode
+	devSelfReload bool
+	// The registry reference each successful build's image is pushed to
+	publish string
+}
+
+func (s *app) loadConf(ctx context.Context) (appConf, error) {
+	var conf appConf
+
+	path := filepath.Join(s.srcDir, ".ayup-conf")
+	env, err := godotenv.Read(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			trace.Event(ctx, ".ayup-conf not found", attribute.String("path", path))
+			return conf, nil
+		}
+
+		return conf, terror.Errorf(ctx, "godotenv Read: %w", err)
+	}
+
+	conf.limits, err = limitsFromEnv(env)
+	if err != nil {
+		return conf, fmt.Errorf(".ayup-conf: %w", err)
+	}
+
+	conf.jobs, err = jobsFromEnv(env)
+	if err != nil {
+		return conf, fmt.Errorf(".ayup-conf: %w", err)
+	}
+
+	for _, dep := range strings.Split(env["AYUP_DEPENDS_ON"], ",") {
+		if dep = strings.TrimSpace(dep); dep != "" {
+			conf.dependsOn = append(conf.dependsOn, dep)
+		}
+	}
+
+	if v, ok := env["AYUP_STOP_GRACE_PERIOD"]; ok {
+		if conf.stopGrace, err = time.ParseDuration(v); err != nil {
+			return conf, fmt.Errorf(".ayup-conf: AYUP_STOP_GRACE_PERIOD: %w", err)
+		}
+	}
+
+	if v, ok := env["AYUP_DEV_SELF_RELOAD"]; ok {
+		if conf.devSelfReload, err = strconv.ParseBool(v); err != nil {
+			return conf, fmt.Errorf(".ayup-conf: AYUP_DEV_SELF_RELOAD: %w", err)
+		}
+	}
+
+	conf.publish = env["AYUP_PUBLISH"]
+
+	return conf, nil
+}
+
+func (s *Srv) Status(ctx context.Context, in *pb.StatusReq) (*pb.StatusReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.StatusReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	return &pb.StatusReply{
+		Apps: s.appStatuses(),
+	}, nil
+}
+
+func (s *Srv) appStatuses() []*pb.AppStatus {
+	s.appsMutex.Lock()
+	apps := make([]*pb.AppStatus, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, a.status())
+	}
+	s.appsMutex.Unlock()
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Name < apps[j].Name
+	})
+
+	return apps
+}
@@ -0,0 +1,112 @@
+package srv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func TestSnapshotBuilt(t *testing.T) {
+	dir := t.TempDir()
+	a := &app{dir: dir, srcDir: filepath.Join(dir, "src")}
+
+	if err := os.MkdirAll(filepath.Join(a.srcDir, "pkg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(a.srcDir, "pkg", "main.py"), []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("pkg/main.py", filepath.Join(a.srcDir, "main.py")); err != nil {
+		t.Fatal(err)
+	}
+
+	built := &pb.AnalysisResult{Dockerfile: "FROM scratch\n"}
+	if err := a.snapshotBuilt(built); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload after the build must not change what tasks see
+	if err := os.WriteFile(filepath.Join(a.srcDir, "pkg", "main.py"), []byte("uploaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := filepath.Join(a.builtSrcPath(), "src")
+	for _, p := range []string{"pkg/main.py", "main.py"} {
+		data, err := os.ReadFile(filepath.Join(snapshot, p))
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != "built" {
+			t.Errorf("%s: got %q, want %q", p, data, "built")
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(a.builtSrcPath(), "dockerfile", "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != built.Dockerfile {
+		t.Errorf("Dockerfile: got %q, want %q", data, built.Dockerfile)
+	}
+
+	// A second snapshot replaces the first
+	if err := a.snapshotBuilt(&pb.AnalysisResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(a.builtSrcPath(), "dockerfile")); !os.IsNotExist(err) {
+		t.Errorf("the old detected Dockerfile is still in the snapshot: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(snapshot, "pkg", "main.py"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "uploaded" {
+		t.Errorf("got %q, want %q", data, "uploaded")
+	}
+}
+
+func TestExportKeepsBuilt(t *testing.T) {
+	dir := t.TempDir()
+	a := &app{dir: dir, srcDir: filepath.Join(dir, "src")}
+	if err := os.MkdirAll(a.srcDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := &pb.AnalysisResult{UsePythonRequirements: true}
+	a.setBuilt(context.Background(), deployed, appConf{}, time.Second)
+
+	actx := aCtx{ctx: context.Background(), srv: &Srv{}, app: a}
+	solve := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		return gateway.NewResult(), nil
+	}
+
+	exported := &pb.AnalysisResult{UseDockerfile: true}
+	if _, err := actx.solveBuild(context.Background(), nil, solve, exported, appConf{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastBuilt() != deployed {
+		t.Errorf("the export replaced the app's build with %v", a.lastBuilt())
+	}
+	data, err := os.ReadFile(a.builtPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved pb.AnalysisResult
+	if err := protojson.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	} else if saved.UseDockerfile {
+		t.Errorf("the export replaced the saved build with %v", &saved)
+	}
+
+	pushed := &pb.AnalysisResult{UseDockerfile: true}
+	if _, err := actx.solveBuild(context.Background(), nil, solve, pushed, appConf{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastBuilt() != pushed {
+		t.Errorf("got %v, want the pushed build", a.lastBuilt())
+	}
+}
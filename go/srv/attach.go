@@ -0,0 +1,282 @@
+package srv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/peer"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+const (
+	// How many of the latest replies each session keeps for clients which attach again
+	sessionReplies = 4096
+	// How long a session carries on without a client before it is canceled
+	sessionDetachedFor = 10 * time.Minute
+	// How long a finished session can be attached to, so a client can get the replies it missed
+	sessionLinger = time.Minute
+)
+
+var errSessionDetached = errors.New("no client attached to the session in time")
+
+// actSession lets an analysis carry on when the client is disconnected. Its replies are
+// numbered and the latest are kept, so that a client which attaches sends the last one it got
+// and is sent the ones it missed.
+type actSession struct {
+	id string
+	// The libp2p peer that started the session, only it can attach
+	peer string
+
+	recvChan chan recvReq
+	done     chan struct{}
+	cancel   context.CancelFunc
+
+	mutex   sync.Mutex
+	seq     uint32
+	replies []*pb.ActReply
+	// The last choice, until it is answered
+	choice *pb.ActReply
+	// The attached client's stream, nil when it is detached
+	stream   pb.Srv_AnalysisServer
+	detached chan struct{}
+	expiry   *time.Timer
+}
+
+// newActSession registers a session and announces it in the first reply
+func (s *Srv) newActSession(ctx context.Context, cancel context.CancelFunc) (*actSession, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, terror.Errorf(ctx, "rand Read: %w", err)
+	}
+
+	sess := &actSession{
+		id:       hex.EncodeToString(id),
+		recvChan: make(chan recvReq),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr.Network() == gostream.Network {
+		sess.peer = pr.Addr.String()
+	}
+
+	s.actSessionsMutex.Lock()
+	if s.actSessions == nil {
+		s.actSessions = make(map[string]*actSession)
+	}
+	s.actSessions[sess.id] = sess
+	s.actSessionsMutex.Unlock()
+
+	trace.Event(ctx, "new session", attribute.String("session", sess.id))
+
+	_ = sess.Send(&pb.ActReply{
+		Source:  "ayup",
+		Session: sess.id,
+		Variant: &pb.ActReply_Log{
+			Log: fmt.Sprintf("Session %s, if the connection drops reattach with 'ay push --attach %s'\n", sess.id, sess.id),
+		},
+	})
+
+	return sess, nil
+}
+
+// Send numbers the reply, keeps it and sends it to the client if one is attached. It doesn't
+// fail when the client has gone, instead the client is detached.
+func (s *actSession) Send(msg *pb.ActReply) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	msg.Seq = s.seq
+
+	s.replies = append(s.replies, msg)
+	if len(s.replies) > sessionReplies {
+		s.replies[0] = nil
+		s.replies = s.replies[1:]
+	}
+
+	if _, ok := msg.Variant.(*pb.ActReply_Choice); ok {
+		s.choice = msg
+	}
+
+	if s.stream != nil {
+		if err := s.stream.Send(msg); err != nil {
+			trace.Event(s.stream.Context(), "detaching session", attribute.String("error", err.Error()))
+			s.detach()
+		}
+	}
+
+	return nil
+}
+
+// detach the client, the session is canceled if no client attaches in time. The mutex is held.
+func (s *actSession) detach() {
+	s.stream = nil
+	close(s.detached)
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.expiry = time.AfterFunc(sessionDetachedFor, func() {
+		s.cancel()
+
+		// Unblocks the analysis if it is waiting for a choice
+		select {
+		case s.recvChan <- recvReq{err: errSessionDetached}:
+		case <-s.done:
+		}
+	})
+}
+
+// attach the stream to the session, after sending the replies that came after seq, and forward
+// its requests until the session is done or the stream is detached
+func (s *actSession) attach(stream pb.Srv_AnalysisServer, seq uint32) error {
+	ctx := stream.Context()
+
+	s.mutex.Lock()
+	if s.stream != nil {
+		trace.Event(ctx, "taking over session")
+		s.detach()
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	replay := s.replies
+	if len(replay) > 0 && replay[0].Seq > seq+1 {
+		if err := stream.Send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: fmt.Sprintf("%d earlier messages were dropped\n", replay[0].Seq-seq-1),
+			},
+		}); err != nil {
+			s.mutex.Unlock()
+			return terror.Errorf(ctx, "stream Send: %w", err)
+		}
+	}
+
+	for _, msg := range replay {
+		if msg.Seq <= seq {
+			continue
+		}
+		if err := stream.Send(msg); err != nil {
+			s.mutex.Unlock()
+			return terror.Errorf(ctx, "stream Send: %w", err)
+		}
+	}
+
+	// The client may have disconnected before it answered
+	if s.choice != nil && s.choice.Seq <= seq {
+		if err := stream.Send(s.choice); err != nil {
+			s.mutex.Unlock()
+			return terror.Errorf(ctx, "stream Send: %w", err)
+		}
+	}
+
+	s.stream = stream
+	detached := make(chan struct{})
+	s.detached = detached
+	s.mutex.Unlock()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			if req.Choice != nil {
+				s.mutex.Lock()
+				s.choice = nil
+				s.mutex.Unlock()
+			}
+
+			select {
+			case s.recvChan <- recvReq{req: req}:
+			case <-detached:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-detached:
+			return terror.Errorf(ctx, "detached from the session")
+		case err := <-recvErr:
+			// The client has finished sending, but it still gets the replies
+			if errors.Is(err, io.EOF) {
+				recvErr = nil
+				continue
+			}
+
+			s.mutex.Lock()
+			if s.stream == stream {
+				s.detach()
+			}
+			s.mutex.Unlock()
+
+			return terror.Errorf(ctx, "stream Recv: %w", err)
+		}
+	}
+}
+
+// finish the session once the analysis has returned, it can still be attached to for a while
+func (s *Srv) finishActSession(sess *actSession) {
+	sess.mutex.Lock()
+	close(sess.done)
+	if sess.expiry != nil {
+		sess.expiry.Stop()
+	}
+	sess.mutex.Unlock()
+
+	sess.cancel()
+
+	time.AfterFunc(sessionLinger, func() {
+		s.actSessionsMutex.Lock()
+		delete(s.actSessions, sess.id)
+		s.actSessionsMutex.Unlock()
+	})
+}
+
+// attachActSession connects a client to a session it, or the same peer, started earlier
+func (s *Srv) attachActSession(stream pb.Srv_AnalysisServer, first *pb.ActReq) error {
+	ctx := stream.Context()
+
+	s.actSessionsMutex.Lock()
+	sess, ok := s.actSessions[first.Session]
+	s.actSessionsMutex.Unlock()
+
+	if ok && sess.peer != "" {
+		pr, _ := peer.FromContext(ctx)
+		ok = pr != nil && pr.Addr.String() == sess.peer
+	}
+
+	if !ok {
+		return stream.Send(newErrorReply(fmt.Sprintf("No session %s, it may have finished or been canceled", first.Session)))
+	}
+
+	trace.Event(ctx, "attaching to session", attribute.String("session", sess.id), attribute.Int("seq", int(first.Seq)))
+
+	return sess.attach(stream, first.Seq)
+}
@@ -0,0 +1,263 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/tonistiigi/fsutil"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// planBuilder builds the apps of one kind of plan, the detectors decide which plan an app has
+type planBuilder interface {
+	// source the build's logs are shown as coming from
+	source() string
+	// prepare finishes the plan from the app's source before it is built, it may ask the user
+	// questions. If nil is returned, then an error has been sent.
+	prepare(actx *aCtx, c *client.Client, recvChan chan recvReq, plan *pb.AnalysisResult) (*pb.AnalysisResult, error)
+	// solver for the app's image, the source is mounted as the context
+	solver(ctx context.Context, plan *pb.AnalysisResult, labels map[string]string) (gateway.BuildFunc, error)
+	// describe how the plan would be built from srcDir in a dry run's report
+	describe(srcDir string, plan *pb.AnalysisResult, report *pb.AnalysisReport) error
+	// devDir is where the app's source is in its container, empty if dev mode can't sync to it
+	devDir() string
+}
+
+func planBuilderFor(plan *pb.AnalysisResult) planBuilder {
+	if plan.UseDockerfile {
+		return dockerfileBuilder{}
+	}
+
+	return pythonBuilder{}
+}
+
+// dockerfileBuilder builds the Dockerfile in the app's source, or the one a detector gave
+type dockerfileBuilder struct{}
+
+func (dockerfileBuilder) source() string { return "dockerfile" }
+
+// devDir is empty because a Dockerfile may put the source anywhere, or leave out the tar and rm
+// applySync needs
+func (dockerfileBuilder) devDir() string { return "" }
+
+func (dockerfileBuilder) prepare(actx *aCtx, c *client.Client, recvChan chan recvReq, plan *pb.AnalysisResult) (*pb.AnalysisResult, error) {
+	return plan, nil
+}
+
+func (dockerfileBuilder) solver(ctx context.Context, plan *pb.AnalysisResult, labels map[string]string) (gateway.BuildFunc, error) {
+	frontendOpt := make(map[string]string, len(labels))
+	for k, v := range labels {
+		frontendOpt["label:"+k] = v
+	}
+
+	return func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		r, err := c.Solve(ctx, gateway.SolveRequest{
+			Frontend:    "dockerfile.v0",
+			FrontendOpt: frontendOpt,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := addImageConfig(c, r, plan, labels); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}, nil
+}
+
+func (dockerfileBuilder) describe(srcDir string, plan *pb.AnalysisResult, report *pb.AnalysisReport) error {
+	var dockerfile io.Reader = strings.NewReader(plan.Dockerfile)
+	if plan.Dockerfile == "" {
+		f, err := os.Open(filepath.Join(srcDir, "Dockerfile"))
+		if err != nil {
+			return fmt.Errorf("os Open: %w", err)
+		}
+		defer f.Close()
+		dockerfile = f
+	}
+
+	base, err := dockerfileBaseImage(dockerfile)
+	if err != nil {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("The Dockerfile can't be parsed: %v", err))
+	}
+	report.BaseImage = base
+
+	return nil
+}
+
+// pythonBuilder builds the app with MkLlb after installing its requirements.txt, which is guessed
+// with pipreqs if there isn't one
+type pythonBuilder struct{}
+
+func (pythonBuilder) source() string { return "build" }
+
+func (pythonBuilder) devDir() string { return pythonAppDir }
+
+func (pythonBuilder) prepare(actx *aCtx, c *client.Client, recvChan chan recvReq, plan *pb.AnalysisResult) (*pb.AnalysisResult, error) {
+	requirementsPath := filepath.Join(actx.app.srcDir, "requirements.txt")
+
+	if _, err := os.Stat(requirementsPath); os.IsNotExist(err) {
+		if ok, err := actx.guessRequirements(c, recvChan, requirementsPath); !ok {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, actx.internalError("stat requirements.txt: %w", err)
+	} else if err := actx.send(&pb.ActReply{
+		Source: "Ayup",
+		Variant: &pb.ActReply_Log{
+			Log: "requirements.txt found",
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	reqs, err := scanRequirements(requirementsPath)
+	if err != nil {
+		return nil, actx.internalError("scanRequirements: %w", err)
+	}
+	reqs.apply(plan)
+
+	return plan, nil
+}
+
+// guessRequirements asks the user if requirements.txt should be made with pipreqs and makes it.
+// If false is returned, then an error has been sent.
+func (s *aCtx) guessRequirements(c *client.Client, recvChan chan recvReq, requirementsPath string) (bool, error) {
+	actx, span := s.span("requirements")
+	defer span.End()
+	ctx := actx.ctx
+
+	chosen, err := actx.ask(recvChan, &pb.Choice{
+		Key: "guessRequirements",
+		Variant: &pb.Choice_Bool{
+			Bool: &pb.ChoiceBool{
+				Value:       true,
+				Title:       "No requirements.txt; try guessing it?",
+				Description: "Guess what dependencies the program has by inspecting the source code.",
+				Affirmative: "Yes, guess",
+				Negative:    "No, I'll make it",
+			},
+		},
+	})
+	if chosen == nil {
+		return false, err
+	}
+
+	if !chosen.GetBool().Value {
+		return false, actx.sendError("can't continue without requirements.txt; please provide one!")
+	}
+
+	span.AddEvent("Creating requirements.txt")
+
+	local := llb.Local("context", llb.ExcludePatterns([]string{".git"}))
+	st := pythonSlimPip(pythonSlimLlb(), "install pipreqs").
+		File(llb.Copy(local, ".", ".")).
+		Run(llb.Shlex("pipreqs")).Root()
+
+	dt, err := st.Marshal(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return false, actx.internalError("marshal: %w", err)
+	}
+
+	b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		started := time.Now()
+		r, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: dt.ToPB(),
+		})
+		observeBuild("analysis", started, err)
+		if err != nil {
+			return nil, actx.internalError("client solve: %w", err)
+		}
+
+		reqs, err := r.Ref.ReadFile(ctx, gateway.ReadRequest{
+			Filename: pythonAppDir + "/requirements.txt",
+		})
+		if err != nil {
+			return nil, terror.Errorf(ctx, "ref readfile: %w", err)
+		}
+
+		requirementsFile, err := os.OpenFile(requirementsPath, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return nil, terror.Errorf(ctx, "openfile requirements: %w", err)
+		}
+		defer requirementsFile.Close()
+
+		if _, err := requirementsFile.Write(reqs); err != nil {
+			return nil, terror.Errorf(ctx, "requirementsFile write: %w", err)
+		}
+
+		return r, nil
+	}
+
+	contextFS, err := fsutil.NewFS(actx.app.srcDir)
+	if err != nil {
+		return false, actx.internalError("fsutil newfs: %w", err)
+	}
+
+	statusChan := actx.buildkitStatusSender("pipreqs", nil)
+	if _, err := c.Build(ctx, client.SolveOpt{
+		LocalMounts: map[string]fsutil.FS{
+			"context": contextFS,
+		},
+	}, "ayup", b, statusChan); err != nil {
+		return false, actx.internalError("build: %w", err)
+	}
+
+	return true, nil
+}
+
+func (pythonBuilder) solver(ctx context.Context, plan *pb.AnalysisResult, labels map[string]string) (gateway.BuildFunc, error) {
+	def, err := MkLlb(ctx, plan)
+	if err != nil {
+		return nil, fmt.Errorf("MkLlb: %w", err)
+	}
+
+	// The image config is only used by exports and publishing, running the app ignores it
+	return func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		r, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := addImageConfig(c, r, plan, labels); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}, nil
+}
+
+func (pythonBuilder) describe(srcDir string, plan *pb.AnalysisResult, report *pb.AnalysisReport) error {
+	report.BaseImage = pythonSlimImage
+
+	scan, err := scanRequirements(filepath.Join(srcDir, "requirements.txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		report.GuessRequirements = true
+		report.Reasons = append(report.Reasons, "System dependencies are decided once requirements.txt exists")
+
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	report.PipPackages = scan.packages
+	report.AptPackages = aptDeps(plan)
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// How many of each app's builds are kept in its history
+const keepBuilds = 20
+
+type buildStep struct {
+	Name string `json:"name"`
+	// Seconds, zero if it was cached or didn't finish
+	Duration float64 `json:"duration,omitempty"`
+	Cached   bool    `json:"cached,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// buildRun is stored one per line in the app's build history
+type buildRun struct {
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	// push or start
+	Kind  string      `json:"kind"`
+	Error string      `json:"error,omitempty"`
+	Steps []buildStep `json:"steps,omitempty"`
+}
+
+// buildSteps collects the steps of a build from Buildkit's status updates
+type buildSteps struct {
+	mutex sync.Mutex
+	order []digest.Digest
+	steps map[digest.Digest]*buildStep
+}
+
+func (s *buildSteps) update(vert *client.Vertex) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.steps == nil {
+		s.steps = make(map[digest.Digest]*buildStep)
+	}
+
+	step, ok := s.steps[vert.Digest]
+	if !ok {
+		step = &buildStep{}
+		s.steps[vert.Digest] = step
+		s.order = append(s.order, vert.Digest)
+	}
+
+	step.Name = vert.Name
+	step.Cached = vert.Cached
+	step.Error = vert.Error
+	if vert.Started != nil && vert.Completed != nil && !vert.Cached {
+		step.Duration = vert.Completed.Sub(*vert.Started).Seconds()
+	}
+}
+
+func (s *buildSteps) list() []buildStep {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	steps := make([]buildStep, 0, len(s.order))
+	for _, d := range s.order {
+		steps = append(steps, *s.steps[d])
+	}
+
+	return steps
+}
+
+func (s *app) buildsPath() string {
+	return filepath.Join(s.dir, "builds")
+}
+
+// readBuildRuns returns the app's build history, oldest first
+func (s *app) readBuildRuns() ([]buildRun, error) {
+	f, err := os.Open(s.buildsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []buildRun
+	lines := bufio.NewScanner(f)
+	lines.Buffer(nil, 1024*1024)
+	for lines.Scan() {
+		var run buildRun
+		if err := json.Unmarshal(lines.Bytes(), &run); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, lines.Err()
+}
+
+// recordBuild appends the build of the app's image, started at started, to its history. It is
+// called as soon as the image is solved, steps which Buildkit hasn't reported as done by then
+// have no duration.
+func (s *aCtx) recordBuild(kind string, started time.Time, err error) {
+	run := buildRun{
+		Started:  started.Unix(),
+		Finished: time.Now().Unix(),
+		Kind:     kind,
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if s.steps != nil {
+		run.Steps = s.steps.list()
+	}
+
+	runs, rerr := s.app.readBuildRuns()
+	if rerr != nil {
+		terror.Ackf(s.ctx, "readBuildRuns: %w", rerr)
+	}
+	runs = append(runs, run)
+	if len(runs) > keepBuilds {
+		runs = runs[len(runs)-keepBuilds:]
+	}
+
+	var data []byte
+	for _, r := range runs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			terror.Ackf(s.ctx, "json Marshal: %w", err)
+			return
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	terror.Ackf(s.ctx, "os WriteFile: %w", os.WriteFile(s.app.buildsPath(), data, 0600))
+}
@@ -0,0 +1,148 @@
+package srv
+
+import (
+	"fmt"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/choices"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// defaultChosen is the answer to the choice when the client doesn't make one
+func defaultChosen(choice *pb.Choice) *pb.Chosen {
+	chosen := &pb.Chosen{Seq: choice.Seq}
+
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		chosen.Variant = &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: v.Bool.Value}}
+	case *pb.Choice_Text:
+		chosen.Variant = &pb.Chosen_Text{Text: &pb.ChosenText{Value: v.Text.Value}}
+	case *pb.Choice_Select:
+		chosen.Variant = &pb.Chosen_Select{Select: &pb.ChosenSelect{Value: v.Select.Value}}
+	case *pb.Choice_MultiSelect:
+		chosen.Variant = &pb.Chosen_MultiSelect{MultiSelect: &pb.ChosenMultiSelect{Values: v.MultiSelect.Values}}
+	case *pb.Choice_File:
+		chosen.Variant = &pb.Chosen_File{File: &pb.ChosenFile{Value: v.File.Value}}
+	}
+
+	return chosen
+}
+
+func hasOption(options []*pb.ChoiceOption, value string) bool {
+	return slices.ContainsFunc(options, func(o *pb.ChoiceOption) bool {
+		return o.Value == value
+	})
+}
+
+// checkChosen returns an error which can be shown to the user if the answer doesn't fit the choice
+func checkChosen(choice *pb.Choice, chosen *pb.Chosen) error {
+	if chosen == nil {
+		return fmt.Errorf("expected an answer to '%s'", choices.Title(choice))
+	}
+
+	switch v := choice.Variant.(type) {
+	case *pb.Choice_Bool:
+		if chosen.GetBool() != nil {
+			return nil
+		}
+	case *pb.Choice_Text:
+		c := chosen.GetText()
+		if c == nil {
+			break
+		}
+		if v.Text.Validate == "" {
+			return nil
+		}
+
+		re, err := choices.TextRegexp(v.Text.Validate)
+		if err != nil {
+			return fmt.Errorf("regexp Compile: %w", err)
+		}
+		if !re.MatchString(c.Value) {
+			return fmt.Errorf("'%s' doesn't match `%s`", c.Value, v.Text.Validate)
+		}
+
+		return nil
+	case *pb.Choice_Select:
+		c := chosen.GetSelect()
+		if c == nil {
+			break
+		}
+		if !hasOption(v.Select.Options, c.Value) {
+			return fmt.Errorf("'%s' is not one of the options", c.Value)
+		}
+
+		return nil
+	case *pb.Choice_MultiSelect:
+		c := chosen.GetMultiSelect()
+		if c == nil {
+			break
+		}
+		if v.MultiSelect.Limit > 0 && len(c.Values) > int(v.MultiSelect.Limit) {
+			return fmt.Errorf("no more than %d options can be selected", v.MultiSelect.Limit)
+		}
+		for _, value := range c.Values {
+			if !hasOption(v.MultiSelect.Options, value) {
+				return fmt.Errorf("'%s' is not one of the options", value)
+			}
+		}
+
+		return nil
+	case *pb.Choice_File:
+		c := chosen.GetFile()
+		if c == nil {
+			break
+		}
+
+		return choices.CheckFile(v.File, c.Value)
+	}
+
+	return fmt.Errorf("wrong kind of answer to '%s'", choices.Title(choice))
+}
+
+// ask the client to make the choice and wait for the answer. If the client cancels or the answer
+// doesn't fit, an error is sent to the client and nil returned along with any error sending it.
+func (s *aCtx) ask(recvChan chan recvReq, choice *pb.Choice) (*pb.Chosen, error) {
+	choice.Seq = s.srv.choiceSeq.Add(1)
+	err := s.send(&pb.ActReply{
+		Source:  "ayup",
+		Variant: &pb.ActReply_Choice{Choice: choice},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var r recvReq
+	for {
+		trace.Event(s.ctx, "waiting for choice", attribute.Int("seq", int(choice.Seq)))
+		var ok bool
+		r, ok = <-recvChan
+		if !ok {
+			return nil, s.internalError("stream recv: channel closed")
+		}
+		if r.err != nil {
+			return nil, s.internalError("stream recv: %w", r.err)
+		}
+
+		if r.req.Cancel {
+			return nil, s.sendError("analysis canceled")
+		}
+
+		// e.g. a reattached client answering a choice that was already answered
+		if seq := r.req.Choice.GetSeq(); seq != choice.Seq {
+			trace.Event(s.ctx, "ignoring answer to another choice", attribute.Int("seq", int(seq)))
+			continue
+		}
+
+		break
+	}
+
+	if err := checkChosen(choice, r.req.Choice); err != nil {
+		return nil, s.sendError("%w", err)
+	}
+
+	return r.req.Choice, nil
+}
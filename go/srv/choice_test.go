@@ -0,0 +1,146 @@
+package srv
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func TestCheckChosen(t *testing.T) {
+	options := []*pb.ChoiceOption{{Value: "a"}, {Value: "b"}, {Value: "c"}}
+
+	boolChoice := &pb.Choice{Variant: &pb.Choice_Bool{Bool: &pb.ChoiceBool{Title: "ok?"}}}
+	textChoice := &pb.Choice{Variant: &pb.Choice_Text{Text: &pb.ChoiceText{Validate: "[0-9]+"}}}
+	freeChoice := &pb.Choice{Variant: &pb.Choice_Text{Text: &pb.ChoiceText{}}}
+	badRegexp := &pb.Choice{Variant: &pb.Choice_Text{Text: &pb.ChoiceText{Validate: "("}}}
+	selectChoice := &pb.Choice{Variant: &pb.Choice_Select{Select: &pb.ChoiceSelect{Options: options}}}
+	multiChoice := &pb.Choice{Variant: &pb.Choice_MultiSelect{MultiSelect: &pb.ChoiceMultiSelect{Options: options, Limit: 2}}}
+	fileChoice := &pb.Choice{Variant: &pb.Choice_File{File: &pb.ChoiceFile{Extensions: []string{".py"}}}}
+
+	boolAnswer := &pb.Chosen{Variant: &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: true}}}
+	text := func(v string) *pb.Chosen {
+		return &pb.Chosen{Variant: &pb.Chosen_Text{Text: &pb.ChosenText{Value: v}}}
+	}
+	selected := func(v string) *pb.Chosen {
+		return &pb.Chosen{Variant: &pb.Chosen_Select{Select: &pb.ChosenSelect{Value: v}}}
+	}
+	multi := func(v ...string) *pb.Chosen {
+		return &pb.Chosen{Variant: &pb.Chosen_MultiSelect{MultiSelect: &pb.ChosenMultiSelect{Values: v}}}
+	}
+	file := func(v string) *pb.Chosen {
+		return &pb.Chosen{Variant: &pb.Chosen_File{File: &pb.ChosenFile{Value: v}}}
+	}
+
+	cases := []struct {
+		name   string
+		choice *pb.Choice
+		chosen *pb.Chosen
+		err    bool
+	}{
+		{name: "no answer", choice: boolChoice, chosen: nil, err: true},
+		{name: "bool", choice: boolChoice, chosen: boolAnswer},
+		{name: "bool wrong kind", choice: boolChoice, chosen: text("yes"), err: true},
+		{name: "text", choice: textChoice, chosen: text("5000")},
+		{name: "text partial match", choice: textChoice, chosen: text("5000x"), err: true},
+		{name: "text no validation", choice: freeChoice, chosen: text("anything")},
+		{name: "text bad regexp", choice: badRegexp, chosen: text("("), err: true},
+		{name: "text wrong kind", choice: textChoice, chosen: selected("5000"), err: true},
+		{name: "select", choice: selectChoice, chosen: selected("b")},
+		{name: "select not an option", choice: selectChoice, chosen: selected("d"), err: true},
+		{name: "multi-select", choice: multiChoice, chosen: multi("a", "c")},
+		{name: "multi-select none", choice: multiChoice, chosen: multi()},
+		{name: "multi-select over limit", choice: multiChoice, chosen: multi("a", "b", "c"), err: true},
+		{name: "multi-select not an option", choice: multiChoice, chosen: multi("a", "d"), err: true},
+		{name: "file", choice: fileChoice, chosen: file("app/__main__.py")},
+		{name: "file wrong extension", choice: fileChoice, chosen: file("app/main.js"), err: true},
+		{name: "file outside source", choice: fileChoice, chosen: file("../main.py"), err: true},
+		{name: "file absolute", choice: fileChoice, chosen: file("/etc/main.py"), err: true},
+		{name: "file unclean", choice: fileChoice, chosen: file("app/../../main.py"), err: true},
+		{name: "file empty", choice: fileChoice, chosen: file(""), err: true},
+		{name: "file wrong kind", choice: fileChoice, chosen: text("main.py"), err: true},
+	}
+
+	for _, c := range cases {
+		err := checkChosen(c.choice, c.chosen)
+		if c.err && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		} else if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestDefaultChosen(t *testing.T) {
+	choices := []*pb.Choice{
+		{Variant: &pb.Choice_Bool{Bool: &pb.ChoiceBool{Value: true}}},
+		{Variant: &pb.Choice_Text{Text: &pb.ChoiceText{Value: "5000", Validate: "[0-9]+"}}},
+		{Variant: &pb.Choice_Select{Select: &pb.ChoiceSelect{Value: "a", Options: []*pb.ChoiceOption{{Value: "a"}}}}},
+		{Variant: &pb.Choice_MultiSelect{MultiSelect: &pb.ChoiceMultiSelect{Values: []string{"a"}, Options: []*pb.ChoiceOption{{Value: "a"}}}}},
+		{Variant: &pb.Choice_File{File: &pb.ChoiceFile{Value: "__main__.py", Extensions: []string{".py"}}}},
+	}
+
+	// The daemon's own suggestion has to be a valid answer
+	for i, choice := range choices {
+		choice.Seq = uint32(i)
+
+		chosen := defaultChosen(choice)
+		if chosen.Seq != choice.Seq {
+			t.Errorf("%d: got seq %d", i, chosen.Seq)
+		}
+		if err := checkChosen(choice, chosen); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+// replies collects what is sent to the client
+type replies struct {
+	sent []*pb.ActReply
+}
+
+func (s *replies) Send(reply *pb.ActReply) error {
+	s.sent = append(s.sent, reply)
+	return nil
+}
+
+func TestAskIgnoresOtherChoices(t *testing.T) {
+	stream := &replies{}
+	actx := aCtx{ctx: context.Background(), sendMutex: &sync.Mutex{}, stream: stream, srv: &Srv{}}
+	recvChan := make(chan recvReq, 3)
+
+	answer := func(seq uint32, value bool) recvReq {
+		return recvReq{req: &pb.ActReq{Choice: &pb.Chosen{Seq: seq, Variant: &pb.Chosen_Bool{Bool: &pb.ChosenBool{Value: value}}}}}
+	}
+
+	first := &pb.Choice{Variant: &pb.Choice_Bool{Bool: &pb.ChoiceBool{Title: "first?"}}}
+	recvChan <- answer(1, true)
+	chosen, err := actx.ask(recvChan, first)
+	if err != nil || chosen == nil {
+		t.Fatalf("first: got %v, %v", chosen, err)
+	}
+
+	// The first answer is sent again, e.g. by a client which reattached, before the second's
+	second := &pb.Choice{Variant: &pb.Choice_Bool{Bool: &pb.ChoiceBool{Title: "second?"}}}
+	recvChan <- answer(first.Seq, true)
+	recvChan <- answer(0, true)
+	recvChan <- answer(2, false)
+	chosen, err = actx.ask(recvChan, second)
+	if err != nil || chosen == nil {
+		t.Fatalf("second: got %v, %v", chosen, err)
+	}
+
+	if second.Seq == first.Seq {
+		t.Errorf("the choices share seq %d", first.Seq)
+	}
+	if chosen.Seq != second.Seq || chosen.GetBool().Value {
+		t.Errorf("second: got %v, want the answer to seq %d", chosen, second.Seq)
+	}
+	if len(recvChan) != 0 {
+		t.Errorf("%d answers weren't read", len(recvChan))
+	}
+	if got := stream.sent[1].GetChoice().Seq; got != second.Seq {
+		t.Errorf("the second choice was sent with seq %d", got)
+	}
+}
@@ -0,0 +1,135 @@
+package srv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron schedule, each field is a bit set of the allowed values
+type schedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// If either day field is restricted, then a day matches when either of them do
+	domStar bool
+	dowStar bool
+}
+
+var scheduleMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps e.g. 1,5-10,*/15
+func parseCronField(field string, lower uint, upper uint) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := uint64(1)
+		if hasStep {
+			var err error
+			step, err = strconv.ParseUint(stepStr, 10, 8)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+		}
+
+		lo, hi := uint64(lower), uint64(upper)
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+
+			var err error
+			lo, err = strconv.ParseUint(loStr, 10, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+
+			hi = lo
+			if isRange {
+				hi, err = strconv.ParseUint(hiStr, 10, 8)
+				if err != nil {
+					return 0, fmt.Errorf("invalid range: %s", part)
+				}
+			} else if hasStep {
+				hi = uint64(upper)
+			}
+		}
+
+		if lo < uint64(lower) || hi > uint64(upper) || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d: %s", lower, upper, part)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << i
+		}
+	}
+
+	return bits, nil
+}
+
+// parseSchedule parses the standard five field cron format or one of the @ macros
+func parseSchedule(spec string) (schedule, error) {
+	var s schedule
+
+	if macro, ok := scheduleMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return s, fmt.Errorf("expected 5 fields in schedule: `%s`", spec)
+	}
+
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, fmt.Errorf("month: %w", err)
+	}
+	// 7 is also Sunday
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return s, fmt.Errorf("day of week: %w", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	return s, nil
+}
+
+func (s schedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<t.Month()) == 0 {
+		return false
+	}
+
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<t.Weekday()) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
@@ -0,0 +1,156 @@
+package srv
+
+import (
+	"testing"
+	"time"
+)
+
+func bits(vals ...uint) uint64 {
+	var b uint64
+	for _, v := range vals {
+		b |= 1 << v
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	cases := []struct {
+		field string
+		lower uint
+		upper uint
+		want  uint64
+		err   bool
+	}{
+		{field: "*", lower: 0, upper: 5, want: bits(0, 1, 2, 3, 4, 5)},
+		{field: "3", lower: 0, upper: 59, want: bits(3)},
+		{field: "1,5-7", lower: 0, upper: 59, want: bits(1, 5, 6, 7)},
+		{field: "*/15", lower: 0, upper: 59, want: bits(0, 15, 30, 45)},
+		{field: "10-20/5", lower: 0, upper: 59, want: bits(10, 15, 20)},
+		{field: "50/5", lower: 0, upper: 59, want: bits(50, 55)},
+		{field: "*/2", lower: 1, upper: 7, want: bits(1, 3, 5, 7)},
+		{field: "0", lower: 1, upper: 31, err: true},
+		{field: "60", lower: 0, upper: 59, err: true},
+		{field: "7-3", lower: 0, upper: 59, err: true},
+		{field: "*/0", lower: 0, upper: 59, err: true},
+		{field: "*/x", lower: 0, upper: 59, err: true},
+		{field: "a", lower: 0, upper: 59, err: true},
+		{field: "1-b", lower: 0, upper: 59, err: true},
+		{field: "", lower: 0, upper: 59, err: true},
+		{field: "1,", lower: 0, upper: 59, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseCronField(c.field, c.lower, c.upper)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseCronField(%q): expected an error, got %b", c.field, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", c.field, err)
+		} else if got != c.want {
+			t.Errorf("parseCronField(%q) = %b, want %b", c.field, got, c.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	cases := []struct {
+		spec string
+		want schedule
+		err  bool
+	}{
+		{
+			spec: "30 2 * * 1-5",
+			want: schedule{
+				minute:  bits(30),
+				hour:    bits(2),
+				dom:     bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+				month:   bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+				dow:     bits(1, 2, 3, 4, 5),
+				domStar: true,
+			},
+		},
+		{
+			spec: "@weekly",
+			want: schedule{
+				minute:  bits(0),
+				hour:    bits(0),
+				dom:     bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+				month:   bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+				dow:     bits(0),
+				domStar: true,
+			},
+		},
+		{
+			// 7 is Sunday as well as 0
+			spec: "0 0 1 1 7",
+			want: schedule{
+				minute: bits(0),
+				hour:   bits(0),
+				dom:    bits(1),
+				month:  bits(1),
+				dow:    bits(0, 7),
+			},
+		},
+		{spec: "* * * *", err: true},
+		{spec: "* * * * * *", err: true},
+		{spec: "@often", err: true},
+		{spec: "* 24 * * *", err: true},
+		{spec: "* * 32 * *", err: true},
+		{spec: "* * * 0 *", err: true},
+		{spec: "* * * * 8", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseSchedule(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseSchedule(%q): expected an error, got %+v", c.spec, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", c.spec, err)
+		} else if got != c.want {
+			t.Errorf("parseSchedule(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	cases := []struct {
+		spec string
+		at   string
+		want bool
+	}{
+		{spec: "30 2 * * 1-5", at: "2024-06-03T02:30:00Z", want: true},  // Monday
+		{spec: "30 2 * * 1-5", at: "2024-06-02T02:30:00Z", want: false}, // Sunday
+		{spec: "30 2 * * 1-5", at: "2024-06-03T02:31:00Z", want: false},
+		{spec: "0 0 * * 7", at: "2024-06-02T00:00:00Z", want: true},
+		// With both day fields restricted either may match
+		{spec: "0 0 15 * 1", at: "2024-06-15T00:00:00Z", want: true},
+		{spec: "0 0 15 * 1", at: "2024-06-03T00:00:00Z", want: true},
+		{spec: "0 0 15 * 1", at: "2024-06-04T00:00:00Z", want: false},
+		{spec: "@monthly", at: "2024-07-01T00:00:00Z", want: true},
+		{spec: "@monthly", at: "2024-07-02T00:00:00Z", want: false},
+	}
+
+	for _, c := range cases {
+		s, err := parseSchedule(c.spec)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q): %v", c.spec, err)
+		}
+		at, err := time.Parse(time.RFC3339, c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := s.matches(at); got != c.want {
+			t.Errorf("%q matches %s = %v, want %v", c.spec, c.at, got, c.want)
+		}
+	}
+}
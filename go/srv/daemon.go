@@ -0,0 +1,276 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"premai.io/Ayup/go/internal/conf"
+	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// How long each health check has before it is reported as failing
+const healthTimeout = 5 * time.Second
+
+type rpcSession struct {
+	method  string
+	peer    string
+	started time.Time
+
+	// Set once the handler has read the app's name
+	app string
+}
+
+type sessionKey struct{}
+
+// beginSession records a call while it is in progress so it can be shown by DaemonStatus, the
+// returned function ends it
+func (s *Srv) beginSession(ctx context.Context, method string) (context.Context, func()) {
+	sess := &rpcSession{
+		method:  method,
+		started: time.Now(),
+	}
+	if pr, ok := peer.FromContext(ctx); ok {
+		sess.peer = pr.Addr.String()
+	}
+
+	s.sessionsMutex.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[*rpcSession]struct{})
+	}
+	s.sessions[sess] = struct{}{}
+	s.sessionsMutex.Unlock()
+
+	return context.WithValue(ctx, sessionKey{}, sess), func() {
+		s.sessionsMutex.Lock()
+		delete(s.sessions, sess)
+		s.sessionsMutex.Unlock()
+	}
+}
+
+// trackSession records each streaming call while it is in progress
+func (s *Srv) trackSession(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, end := s.beginSession(stream.Context(), filepath.Base(info.FullMethod))
+	defer end()
+
+	return handler(srv, &sessionStream{
+		ServerStream: stream,
+		ctx:          ctx,
+	})
+}
+
+type sessionStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *sessionStream) Context() context.Context {
+	return s.ctx
+}
+
+// setSessionApp records which app the call is for if it is a tracked session
+func (s *Srv) setSessionApp(ctx context.Context, name string) {
+	sess, ok := ctx.Value(sessionKey{}).(*rpcSession)
+	if !ok {
+		return
+	}
+
+	s.sessionsMutex.Lock()
+	sess.app = name
+	s.sessionsMutex.Unlock()
+}
+
+func (s *Srv) sessionStatuses() []*pb.Session {
+	s.sessionsMutex.Lock()
+	sessions := make([]*pb.Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, &pb.Session{
+			Method:  sess.method,
+			Peer:    sess.peer,
+			App:     sess.app,
+			Started: sess.started.Unix(),
+		})
+	}
+	s.sessionsMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started < sessions[j].Started
+	})
+
+	return sessions
+}
+
+func (s *Srv) peerStatuses() []*pb.PeerStatus {
+	if s.p2pHost == nil {
+		return nil
+	}
+
+	var peers []*pb.PeerStatus
+	for _, id := range s.p2pHost.Network().Peers() {
+		ps := &pb.PeerStatus{
+			PeerId: id.String(),
+		}
+
+		for _, conn := range s.p2pHost.Network().ConnsToPeer(id) {
+			ps.Addrs = append(ps.Addrs, conn.RemoteMultiaddr().String())
+		}
+
+		for _, authedId := range s.P2pAuthedClients {
+			if id == authedId {
+				ps.Authorized = true
+			}
+		}
+
+		peers = append(peers, ps)
+	}
+
+	return peers
+}
+
+// diskUsage adds up the space used by the files under dir. Files which can't be read, such as
+// those owned by a container's user, are skipped.
+func diskUsage(dir string) int64 {
+	var total int64
+	found := false
+
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		found = true
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += st.Blocks * 512
+		} else {
+			total += info.Size()
+		}
+
+		return nil
+	})
+
+	if !found {
+		return -1
+	}
+
+	return total
+}
+
+func healthFromErr(err error) *pb.Health {
+	if err != nil {
+		return &pb.Health{Error: err.Error()}
+	}
+
+	return &pb.Health{Ok: true}
+}
+
+func (s *Srv) buildkitWorkers(ctx context.Context) ([]*pb.BuildkitWorker, error) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "client New: %w", err)
+	}
+	defer c.Close()
+
+	infos, err := c.ListWorkers(ctx)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "client ListWorkers: %w", err)
+	}
+
+	workers := make([]*pb.BuildkitWorker, 0, len(infos))
+	for _, info := range infos {
+		w := &pb.BuildkitWorker{
+			Id: info.ID,
+		}
+
+		for _, p := range info.Platforms {
+			w.Platforms = append(w.Platforms, platforms.Format(p))
+		}
+
+		workers = append(workers, w)
+	}
+
+	return workers, nil
+}
+
+func (s *Srv) DaemonStatus(ctx context.Context, in *pb.DaemonStatusReq) (*pb.DaemonStatusReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.DaemonStatusReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	reply := &pb.DaemonStatusReply{
+		Version:  s.Version,
+		Started:  s.startedAt.Unix(),
+		NetMode:  s.netMode,
+		Peers:    s.peerStatuses(),
+		Sessions: s.sessionStatuses(),
+		Apps:     s.appStatuses(),
+	}
+
+	// The rootless helper and Buildkit's files are missing with an external buildkitd
+	reply.BuildkitDiskUsage = -1
+	if s.rootless() {
+		pingCtx, cancel := context.WithTimeout(ctx, healthTimeout)
+		_, err := s.inrClient.Ping(pingCtx, &inrPb.PingRequest{})
+		cancel()
+		reply.Inrootless = healthFromErr(err)
+
+		reply.BuildkitDiskUsage = diskUsage(filepath.Join(conf.UserRoot(), "buildkit"))
+	}
+
+	if s.rootless() {
+		reply.Supervisor = s.supervisorStatus()
+	}
+
+	var err error
+	reply.Workers, err = s.buildkitWorkers(ctx)
+	reply.Buildkit = healthFromErr(err)
+
+	reply.AppsDiskUsage = diskUsage(s.AppsDir)
+
+	return reply, nil
+}
+
+// CheckVersion tells the client which protocol versions the daemon speaks and if it accepts the
+// client's
+func (s *Srv) CheckVersion(ctx context.Context, in *pb.VersionReq) (*pb.VersionReply, error) {
+	reply := &pb.VersionReply{
+		ProtocolVersion:    rpc.ProtocolVersion,
+		MinProtocolVersion: rpc.MinProtocolVersion,
+		Version:            s.Version,
+	}
+
+	if in.ProtocolVersion < rpc.MinProtocolVersion {
+		reply.Error = &pb.Error{
+			Error: fmt.Sprintf("client protocol version %d is too old, the daemon needs at least %d; upgrade the client", in.ProtocolVersion, rpc.MinProtocolVersion),
+		}
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,494 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/otelfiber"
+	"github.com/gofiber/fiber/v2"
+	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/grpc/status"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+const (
+	dashCookie = "ayup_dashboard"
+	// How long a login lasts
+	dashSessionMaxAge = 24 * time.Hour
+	// How much of the end of a log is shown, searches only look at this much as well
+	dashLogTail = 1024 * 1024
+)
+
+var dashFuncs = template.FuncMap{
+	"unixTime": func(t int64) string {
+		if t == 0 {
+			return "-"
+		}
+		return time.Unix(t, 0).Format(time.DateTime)
+	},
+	"seconds": func(s float64) string {
+		return (time.Duration(s*1000) * time.Millisecond).String()
+	},
+	"since": func(t int64) string {
+		return time.Since(time.Unix(t, 0)).Round(time.Second).String()
+	},
+}
+
+// Each page is parsed with the layout, which includes the page's content template
+var dashPages = func() map[string]*template.Template {
+	pages := make(map[string]*template.Template)
+
+	for _, name := range []string{"login", "index", "app"} {
+		pages[name] = template.Must(template.New("layout.html").Funcs(dashFuncs).ParseFS(
+			dashboardFS, "dashboard/layout.html", "dashboard/"+name+".html",
+		))
+	}
+
+	return pages
+}()
+
+func dashRender(c *fiber.Ctx, page string, data fiber.Map) error {
+	data["Page"] = page
+
+	var buf bytes.Buffer
+	if err := dashPages[page].Execute(&buf, data); err != nil {
+		return terror.Errorf(c.UserContext(), "template Execute: %w", err)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Send(buf.Bytes())
+}
+
+// dashSessions maps the ids in the dashboard's cookies to the hash of the API token that was
+// logged in with, so the token itself isn't stored in the browser. They are kept in memory, so
+// restarting the daemon logs everyone out.
+type dashSessions struct {
+	mutex sync.Mutex
+	byId  map[string]dashSession
+}
+
+type dashSession struct {
+	tokenHash string
+	expires   time.Time
+}
+
+// create a session for the token's hash and return its id
+func (s *dashSessions) create(tokenHash string) (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("rand Read: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(buf[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.byId == nil {
+		s.byId = make(map[string]dashSession)
+	}
+
+	now := time.Now()
+	for other, sess := range s.byId {
+		if now.After(sess.expires) {
+			delete(s.byId, other)
+		}
+	}
+
+	s.byId[id] = dashSession{tokenHash: tokenHash, expires: now.Add(dashSessionMaxAge)}
+
+	return id, nil
+}
+
+// lookup returns the token hash of the session if it exists and hasn't expired
+func (s *dashSessions) lookup(id string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.byId[id]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(sess.expires) {
+		delete(s.byId, id)
+		return "", false
+	}
+
+	return sess.tokenHash, true
+}
+
+func (s *dashSessions) revoke(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.byId, id)
+}
+
+// dashAuth checks the session in the cookie and that its token is still accepted. The cookie
+// is strict same site so that other sites can't use it to post the forms.
+func (s *Srv) dashAuth(c *fiber.Ctx) error {
+	id := c.Cookies(dashCookie)
+	if id == "" {
+		return c.Redirect("/login")
+	}
+
+	tokenHash, ok := s.dashSessions.lookup(id)
+	if !ok {
+		c.ClearCookie(dashCookie)
+		return c.Redirect("/login?msg=" + url.QueryEscape("Session expired, log in again"))
+	}
+
+	ctx, err := s.authTokenHash(c.UserContext(), tokenHash)
+	if err != nil {
+		s.dashSessions.revoke(id)
+		c.ClearCookie(dashCookie)
+		return c.Redirect("/login?msg=" + url.QueryEscape(status.Convert(err).Message()))
+	}
+
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+func (s *Srv) dashLogin(c *fiber.Ctx) error {
+	token := strings.TrimSpace(c.FormValue("token"))
+
+	if _, err := s.authToken(c.UserContext(), token); err != nil {
+		return dashRender(c.Status(fiber.StatusUnauthorized), "login", fiber.Map{
+			"Msg": status.Convert(err).Message(),
+		})
+	}
+
+	id, err := s.dashSessions.create(HashApiToken(token))
+	if err != nil {
+		return terror.Errorf(c.UserContext(), "dashSessions create: %w", err)
+	}
+
+	// Protocol is https when served over TLS or behind a proxy which says it was
+	c.Cookie(&fiber.Cookie{
+		Name:     dashCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(dashSessionMaxAge.Seconds()),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+
+	return c.Redirect("/", fiber.StatusSeeOther)
+}
+
+func (s *Srv) dashLogout(c *fiber.Ctx) error {
+	s.dashSessions.revoke(c.Cookies(dashCookie))
+	c.ClearCookie(dashCookie)
+
+	return c.Redirect("/login", fiber.StatusSeeOther)
+}
+
+type dashApp struct {
+	*pb.AppStatus
+	LastBuild *buildRun
+}
+
+type dashClient struct {
+	PeerId    string
+	Connected bool
+}
+
+func (s *Srv) dashApps() []dashApp {
+	s.appsMutex.Lock()
+	apps := make([]*app, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, a)
+	}
+	s.appsMutex.Unlock()
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].name < apps[j].name
+	})
+
+	var dapps []dashApp
+	for _, a := range apps {
+		da := dashApp{AppStatus: a.status()}
+		if builds, err := a.readBuildRuns(); err == nil && len(builds) > 0 {
+			da.LastBuild = &builds[len(builds)-1]
+		}
+		dapps = append(dapps, da)
+	}
+
+	return dapps
+}
+
+func (s *Srv) dashIndex(c *fiber.Ctx) error {
+	var connected []p2pPeer.ID
+	if s.p2pHost != nil {
+		connected = s.p2pHost.Network().Peers()
+	}
+
+	var clients []dashClient
+	for _, id := range s.P2pAuthedClients {
+		clients = append(clients, dashClient{
+			PeerId:    id.String(),
+			Connected: slices.Contains(connected, id),
+		})
+	}
+
+	return dashRender(c, "index", fiber.Map{
+		"Version":  s.Version,
+		"Started":  s.startedAt.Unix(),
+		"Apps":     s.dashApps(),
+		"Clients":  clients,
+		"Sessions": s.sessionStatuses(),
+		"Msg":      c.Query("msg"),
+	})
+}
+
+// readLogTail returns the lines at the end of the log which contain the search term, if any, and
+// the size of the log
+func readLogTail(path string, search string) ([]string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset := max(0, info.Size()-dashLogTail)
+	data := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	// The first line is likely to have been cut
+	if offset > 0 && len(lines) > 1 {
+		lines = lines[1:]
+	}
+
+	if search != "" {
+		search = strings.ToLower(search)
+		lines = slices.DeleteFunc(lines, func(line string) bool {
+			return !strings.Contains(strings.ToLower(line), search)
+		})
+	}
+
+	return lines, info.Size(), nil
+}
+
+func (s *Srv) dashApp(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	app, err := s.getApp(ctx, c.Params("app"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	builds, err := app.readBuildRuns()
+	if err != nil {
+		terror.Ackf(ctx, "readBuildRuns: %w", err)
+	}
+	slices.Reverse(builds)
+
+	search := c.Query("q")
+	lines, logSize, err := readLogTail(filepath.Join(app.dir, "log"), search)
+	if err != nil {
+		terror.Ackf(ctx, "readLogTail: %w", err)
+	}
+
+	return dashRender(c, "app", fiber.Map{
+		"App":     app.status(),
+		"Builds":  builds,
+		"Search":  search,
+		"Log":     strings.Join(lines, ""),
+		"Matches": len(lines),
+		"LogSize": logSize,
+		"Msg":     c.Query("msg"),
+	})
+}
+
+// dashLive streams what is written to the app's log after the offset in from as server sent
+// events. Each event's ID is the offset after it, which the browser sends back when it
+// reconnects. Pushing or starting the app replaces the log, which is sent as a reset event.
+func (s *Srv) dashLive(ctx context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		app, err := s.getApp(c.UserContext(), c.Params("app"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		path := filepath.Join(app.dir, "log")
+		from := int64(c.QueryInt("from"))
+		if lastId, err := strconv.ParseInt(c.Get("Last-Event-ID"), 10, 64); err == nil {
+			from = lastId
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			var f *os.File
+			defer func() {
+				if f != nil {
+					_ = f.Close()
+				}
+			}()
+
+			// The headers aren't sent until there is some of the body
+			_, _ = fmt.Fprint(w, "retry: 2000\n\n")
+
+			buf := make([]byte, 32*1024)
+			lastWrite := time.Now()
+			for {
+				if f != nil {
+					info, err := os.Stat(path)
+					fInfo, fErr := f.Stat()
+					// Truncated by os.Create or replaced
+					if err == nil && fErr == nil && (!os.SameFile(info, fInfo) || info.Size() < from) {
+						_ = f.Close()
+						f, from = nil, 0
+						_, _ = fmt.Fprint(w, "event: reset\nid: 0\ndata:\n\n")
+					}
+				}
+
+				if f == nil {
+					if f, err = os.Open(path); err == nil {
+						_, err = f.Seek(from, io.SeekStart)
+					}
+					if err != nil && f != nil {
+						_ = f.Close()
+						f = nil
+					}
+				}
+
+				n := 0
+				if f != nil {
+					n, _ = f.Read(buf)
+				}
+
+				if n > 0 {
+					from += int64(n)
+					data, _ := json.Marshal(string(buf[:n]))
+					_, _ = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", from, data)
+					lastWrite = time.Now()
+				} else if time.Since(lastWrite) > 15*time.Second {
+					// Finds out if the browser has gone away
+					_, _ = fmt.Fprint(w, ": keep alive\n\n")
+					lastWrite = time.Now()
+				}
+
+				if err := w.Flush(); err != nil {
+					return
+				}
+
+				if n == len(buf) {
+					continue
+				}
+
+				select {
+				case <-time.After(500 * time.Millisecond):
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+
+		return nil
+	}
+}
+
+func dashRedirect(c *fiber.Ctx, app string, msg string) error {
+	return c.Redirect("/apps/"+app+"?msg="+url.QueryEscape(msg), fiber.StatusSeeOther)
+}
+
+// dashRestart stops the app, if it is running, then starts it from its last build
+func (s *Srv) dashRestart(ctx context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		app, err := s.getApp(c.UserContext(), c.Params("app"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		app.stopWithGrace(c.UserContext(), "Restarted from the dashboard")
+
+		if err := s.startApp(ctx, app); err != nil {
+			return dashRedirect(c, app.name, "Failed to start: "+err.Error())
+		}
+
+		return dashRedirect(c, app.name, "Restarted")
+	}
+}
+
+func (s *Srv) dashStop(c *fiber.Ctx) error {
+	app, err := s.getApp(c.UserContext(), c.Params("app"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	app.stopWithGrace(c.UserContext(), "Stopped from the dashboard")
+
+	return dashRedirect(c, app.name, "Stopped")
+}
+
+func (s *Srv) newDashboard(ctx context.Context) *fiber.App {
+	dash := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+	})
+	// The middleware reads the whole response, which never ends for the live log
+	dash.Use(otelfiber.Middleware(otelfiber.WithNext(func(c *fiber.Ctx) bool {
+		return strings.HasSuffix(c.Path(), "/live")
+	})))
+
+	dash.Get("/login", func(c *fiber.Ctx) error {
+		return dashRender(c, "login", fiber.Map{"Msg": c.Query("msg")})
+	})
+	dash.Post("/login", s.dashLogin)
+	dash.Post("/logout", s.dashLogout)
+
+	dash.Use(s.dashAuth)
+
+	// Apps started from the dashboard outlive the request and are stopped when the daemon is
+	dash.Get("/", s.dashIndex)
+	dash.Get("/apps/:app", s.dashApp)
+	dash.Get("/apps/:app/live", s.dashLive(ctx))
+	dash.Post("/apps/:app/restart", s.dashRestart(context.WithoutCancel(ctx)))
+	dash.Post("/apps/:app/stop", s.dashStop)
+
+	return dash
+}
+
+// serveDashboard on addr until it is shutdown
+func (s *Srv) serveDashboard(ctx context.Context, dash *fiber.App, addr string) {
+	ctx, span := trace.Span(ctx, "dashboard")
+	defer span.End()
+
+	if err := dash.Listen(addr); err != nil {
+		terror.Ackf(ctx, "dashboard Listen: %w", err)
+	}
+}
@@ -0,0 +1,45 @@
+package srv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDashSessions(t *testing.T) {
+	var sessions dashSessions
+
+	id, err := sessions.create("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sessions.create("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == other || id == "hash" {
+		t.Fatalf("session ids are not unique or are the token: %s, %s", id, other)
+	}
+
+	if hash, ok := sessions.lookup(id); !ok || hash != "hash" {
+		t.Errorf("lookup: got %q, %v", hash, ok)
+	}
+	if _, ok := sessions.lookup("unknown"); ok {
+		t.Errorf("an unknown session was found")
+	}
+
+	sessions.revoke(id)
+	if _, ok := sessions.lookup(id); ok {
+		t.Errorf("a revoked session was found")
+	}
+	if _, ok := sessions.lookup(other); !ok {
+		t.Errorf("revoking one session revoked another")
+	}
+
+	sessions.byId[other] = dashSession{tokenHash: "hash", expires: time.Now().Add(-time.Second)}
+	if _, ok := sessions.lookup(other); ok {
+		t.Errorf("an expired session was found")
+	}
+	if len(sessions.byId) != 0 {
+		t.Errorf("the expired session was kept: %v", sessions.byId)
+	}
+}
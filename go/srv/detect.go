@@ -0,0 +1,391 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Detector looks at an app's source and plans how to build it, if it knows how
+type Detector interface {
+	Name() string
+	// Detect returns nil if the detector doesn't know how to build the app
+	Detect(ctx context.Context, srcDir string) (*Detection, error)
+}
+
+// Detection is a detector's plan for building an app
+type Detection struct {
+	// How sure the detector is that the plan is right, from 0 to 1
+	Confidence float64
+	// Why the detector matched, these are shown to the user
+	Reasons []string
+	// How the app is built
+	Plan *pb.AnalysisResult
+}
+
+const (
+	// Detections this close to the most confident one are too close to call, so the user is asked
+	detectorMargin = 0.1
+	// How long an external detector has to print its detection
+	execDetectorTimeout = 30 * time.Second
+)
+
+// builtinDetectors come before the ones from the daemon's config
+var builtinDetectors = []Detector{dockerfileDetector{}, pythonDetector{}}
+
+func (s *Srv) detectors() []Detector {
+	return append(slices.Clone(builtinDetectors), s.Detectors...)
+}
+
+type detectorMatch struct {
+	name string
+	*Detection
+}
+
+func (s detectorMatch) toPb() *pb.DetectorMatch {
+	return &pb.DetectorMatch{Name: s.name, Confidence: s.Confidence, Reasons: s.Reasons}
+}
+
+// runDetectors returns the detections of the detectors which matched, most confident first.
+// Detectors which fail are skipped and their errors are returned for the user to see.
+func (s *Srv) runDetectors(ctx context.Context, srcDir string) ([]detectorMatch, []string) {
+	var matches []detectorMatch
+	var failures []string
+
+	for _, d := range s.detectors() {
+		detection, err := d.Detect(ctx, srcDir)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("Detector %s failed: %v", d.Name(), err))
+			continue
+		}
+		if detection == nil || detection.Confidence <= 0 {
+			continue
+		}
+
+		trace.Event(ctx, "detected", attribute.String("detector", d.Name()), attribute.Float64("confidence", detection.Confidence))
+		detection.Plan.Detector = d.Name()
+		matches = append(matches, detectorMatch{name: d.Name(), Detection: detection})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Confidence > matches[j].Confidence
+	})
+
+	return matches, failures
+}
+
+// closeMatches are the matches which are about as confident as the first
+func closeMatches(matches []detectorMatch) []detectorMatch {
+	for i, m := range matches {
+		if matches[0].Confidence-m.Confidence > detectorMargin {
+			return matches[:i]
+		}
+	}
+
+	return matches
+}
+
+// detect runs the detectors on the app's source and picks the most confident, the user is asked
+// to choose if the detectors disagree. If nil is returned, then an error has been sent.
+func (s *aCtx) detect(recvChan chan recvReq) (*pb.AnalysisResult, error) {
+	actx, span := s.span("detect")
+	defer span.End()
+
+	matches, failures := actx.srv.runDetectors(actx.ctx, actx.app.srcDir)
+	for _, f := range failures {
+		if err := actx.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: f + "\n",
+			},
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, actx.sendError("none of the detectors know how to build the app")
+	}
+
+	chosen := matches[0]
+	if close := closeMatches(matches); len(close) > 1 {
+		var options []*pb.ChoiceOption
+		var names []string
+		for _, m := range close {
+			label := fmt.Sprintf("%s (%.0f%%)", m.name, m.Confidence*100)
+			if len(m.Reasons) > 0 {
+				label += ": " + m.Reasons[0]
+			}
+			options = append(options, &pb.ChoiceOption{Value: m.name, Label: label})
+			names = append(names, m.name)
+		}
+
+		chosenOpt, err := actx.ask(recvChan, &pb.Choice{
+			Key: "detector",
+			Variant: &pb.Choice_Select{
+				Select: &pb.ChoiceSelect{
+					Value:       chosen.name,
+					Title:       "Which detector should build the app?",
+					Description: fmt.Sprintf("%s all know how to build the app and are about as confident.", strings.Join(names, ", ")),
+					Options:     options,
+				},
+			},
+		})
+		if chosenOpt == nil {
+			return nil, err
+		}
+
+		for _, m := range close {
+			if m.name == chosenOpt.GetSelect().Value {
+				chosen = m
+			}
+		}
+	}
+
+	span.SetAttributes(attribute.String("detector", chosen.name))
+
+	if err := actx.send(&pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_Log{
+			Log: fmt.Sprintf("Using the %s detector: %s\n", chosen.name, strings.Join(chosen.Reasons, "; ")),
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	return chosen.Plan, nil
+}
+
+// dockerfileDetector builds the app with the Dockerfile in its source
+type dockerfileDetector struct{}
+
+func (dockerfileDetector) Name() string { return "dockerfile" }
+
+func (dockerfileDetector) Detect(ctx context.Context, srcDir string) (*Detection, error) {
+	if _, err := os.Stat(filepath.Join(srcDir, "Dockerfile")); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os Stat: %w", err)
+	}
+
+	return &Detection{
+		Confidence: 1,
+		Reasons:    []string{"Dockerfile found, it is used to build the app"},
+		Plan:       &pb.AnalysisResult{UseDockerfile: true},
+	}, nil
+}
+
+// pythonDetector builds the app with MkLlb, it matches anything so that requirements.txt can be
+// guessed
+type pythonDetector struct{}
+
+func (pythonDetector) Name() string { return "python" }
+
+func (pythonDetector) Detect(ctx context.Context, srcDir string) (*Detection, error) {
+	plan := &pb.AnalysisResult{UsePythonRequirements: true}
+
+	scan, err := scanRequirements(filepath.Join(srcDir, "requirements.txt"))
+	if err == nil {
+		scan.apply(plan)
+
+		return &Detection{
+			Confidence: 0.8,
+			Reasons:    append([]string{"requirements.txt found, it is installed with pip"}, scan.reasons...),
+			Plan:       plan,
+		}, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	guess := "No requirements.txt, it can be guessed from the imports with pipreqs"
+	if _, err := os.Stat(filepath.Join(srcDir, "__main__.py")); err == nil {
+		return &Detection{
+			Confidence: 0.5,
+			Reasons:    []string{"__main__.py found", guess},
+			Plan:       plan,
+		}, nil
+	}
+
+	return &Detection{
+		Confidence: 0.1,
+		Reasons:    []string{"Nothing else matched, the app may be Python", guess},
+		Plan:       plan,
+	}, nil
+}
+
+// fileDetector builds the app with a Dockerfile from the daemon's host when one of the files is in
+// the root of the source
+type fileDetector struct {
+	name       string
+	files      []string
+	dockerfile string
+	confidence float64
+}
+
+func (s fileDetector) Name() string { return s.name }
+
+func (s fileDetector) Detect(ctx context.Context, srcDir string) (*Detection, error) {
+	for _, f := range s.files {
+		if _, err := os.Stat(filepath.Join(srcDir, f)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("os Stat: %w", err)
+		}
+
+		dockerfile, err := os.ReadFile(s.dockerfile)
+		if err != nil {
+			return nil, fmt.Errorf("os ReadFile: %w", err)
+		}
+
+		return &Detection{
+			Confidence: s.confidence,
+			Reasons:    []string{fmt.Sprintf("%s found, it is built with %s", f, s.dockerfile)},
+			Plan:       &pb.AnalysisResult{UseDockerfile: true, Dockerfile: string(dockerfile)},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// execDetector runs an executable on the daemon's host with the path to the source as its
+// argument. It prints an execDetection as JSON, a confidence of zero means it doesn't match.
+type execDetector struct {
+	name string
+	path string
+}
+
+type execDetection struct {
+	Confidence float64  `json:"confidence"`
+	Reasons    []string `json:"reasons"`
+	// What the app is built with, the source is the build context
+	Dockerfile string `json:"dockerfile"`
+}
+
+func (s execDetector) Name() string { return s.name }
+
+func (s execDetector) Detect(ctx context.Context, srcDir string) (*Detection, error) {
+	ctx, cancel := context.WithTimeout(ctx, execDetectorTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.path, srcDir)
+	cmd.Dir = srcDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", s.path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out execDetection
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("%s: json Unmarshal: %w", s.path, err)
+	}
+
+	if out.Confidence <= 0 {
+		return nil, nil
+	}
+	if out.Confidence > 1 {
+		return nil, fmt.Errorf("%s: confidence is more than 1: %v", s.path, out.Confidence)
+	}
+	if out.Dockerfile == "" {
+		return nil, fmt.Errorf("%s: matched without a dockerfile", s.path)
+	}
+
+	return &Detection{
+		Confidence: out.Confidence,
+		Reasons:    out.Reasons,
+		Plan:       &pb.AnalysisResult{UseDockerfile: true, Dockerfile: out.Dockerfile},
+	}, nil
+}
+
+// ParseDetectors from semicolon deliminated entries which are either '<name> exec=<path>' or
+// '<name> files=<file>,<file> dockerfile=<path> [confidence=<0 to 1>]'
+func ParseDetectors(spec string) ([]Detector, error) {
+	var detectors []Detector
+	names := make(map[string]bool)
+	for _, d := range builtinDetectors {
+		names[d.Name()] = true
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+		if !appNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("`%s`: name must be lower case alphanumeric or '-'", entry)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("`%s`: there is already a detector named %s", entry, name)
+		}
+		names[name] = true
+
+		opts := make(map[string]string)
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("`%s`: expected key=value, got `%s`", entry, field)
+			}
+			opts[key] = value
+		}
+
+		if path, ok := opts["exec"]; ok {
+			if len(opts) > 1 {
+				return nil, fmt.Errorf("`%s`: exec can't be combined with other options", entry)
+			}
+			detectors = append(detectors, execDetector{name: name, path: path})
+			continue
+		}
+
+		d := fileDetector{name: name, dockerfile: opts["dockerfile"], confidence: 0.9}
+		for _, f := range strings.Split(opts["files"], ",") {
+			if f == "" {
+				continue
+			}
+			if !filepath.IsLocal(f) {
+				return nil, fmt.Errorf("`%s`: file is not in the source: %s", entry, f)
+			}
+			d.files = append(d.files, f)
+		}
+		if len(d.files) == 0 || d.dockerfile == "" {
+			return nil, fmt.Errorf("`%s`: expected exec=<path> or files=<file>,<file> dockerfile=<path>", entry)
+		}
+
+		if v, ok := opts["confidence"]; ok {
+			c, err := strconv.ParseFloat(v, 64)
+			if err != nil || c <= 0 || c > 1 {
+				return nil, fmt.Errorf("`%s`: confidence must be more than 0 and at most 1", entry)
+			}
+			d.confidence = c
+		}
+
+		for key := range opts {
+			if key != "files" && key != "dockerfile" && key != "confidence" {
+				return nil, fmt.Errorf("`%s`: unknown option `%s`", entry, key)
+			}
+		}
+
+		detectors = append(detectors, d)
+	}
+
+	return detectors, nil
+}
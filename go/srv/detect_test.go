@@ -0,0 +1,160 @@
+package srv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseDetectors(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []Detector
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: " ; ", want: nil},
+		{spec: "rails exec=/usr/local/bin/detect-rails", want: []Detector{execDetector{name: "rails", path: "/usr/local/bin/detect-rails"}}},
+		{
+			spec: "node files=package.json,yarn.lock dockerfile=/etc/ayup/node.Dockerfile; go files=go.mod dockerfile=/etc/ayup/go.Dockerfile confidence=0.95",
+			want: []Detector{
+				fileDetector{name: "node", files: []string{"package.json", "yarn.lock"}, dockerfile: "/etc/ayup/node.Dockerfile", confidence: 0.9},
+				fileDetector{name: "go", files: []string{"go.mod"}, dockerfile: "/etc/ayup/go.Dockerfile", confidence: 0.95},
+			},
+		},
+		{spec: "Node files=package.json dockerfile=/x", err: true},
+		{spec: "python files=setup.py dockerfile=/x", err: true},
+		{spec: "node files=a dockerfile=/x; node files=b dockerfile=/y", err: true},
+		{spec: "node files", err: true},
+		{spec: "node exec=/x files=a", err: true},
+		{spec: "node files=../package.json dockerfile=/x", err: true},
+		{spec: "node files=/package.json dockerfile=/x", err: true},
+		{spec: "node files=package.json", err: true},
+		{spec: "node dockerfile=/x", err: true},
+		{spec: "node files=a dockerfile=/x confidence=0", err: true},
+		{spec: "node files=a dockerfile=/x confidence=1.5", err: true},
+		{spec: "node files=a dockerfile=/x confidence=high", err: true},
+		{spec: "node files=a dockerfile=/x colour=blue", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseDetectors(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseDetectors(%q): expected an error, got %v", c.spec, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseDetectors(%q): %v", c.spec, err)
+			continue
+		}
+
+		if !slices.EqualFunc(got, c.want, func(a, b Detector) bool {
+			af, aok := a.(fileDetector)
+			bf, bok := b.(fileDetector)
+			if aok && bok {
+				return af.name == bf.name && slices.Equal(af.files, bf.files) &&
+					af.dockerfile == bf.dockerfile && af.confidence == bf.confidence
+			}
+
+			return a == b
+		}) {
+			t.Errorf("ParseDetectors(%q) = %v, want %v", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestCloseMatches(t *testing.T) {
+	match := func(name string, confidence float64) detectorMatch {
+		return detectorMatch{name: name, Detection: &Detection{Confidence: confidence}}
+	}
+
+	cases := []struct {
+		name    string
+		matches []detectorMatch
+		want    []string
+	}{
+		{name: "none", matches: nil, want: nil},
+		{name: "one", matches: []detectorMatch{match("a", 0.8)}, want: []string{"a"}},
+		{name: "clear winner", matches: []detectorMatch{match("a", 1), match("b", 0.8)}, want: []string{"a"}},
+		{name: "tie", matches: []detectorMatch{match("a", 0.8), match("b", 0.8), match("c", 0.1)}, want: []string{"a", "b"}},
+		{name: "within margin", matches: []detectorMatch{match("a", 0.9), match("b", 0.85), match("c", 0.8)}, want: []string{"a", "b", "c"}},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, m := range closeMatches(c.matches) {
+			got = append(got, m.name)
+		}
+
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRunDetectors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("node.Dockerfile", "FROM node\n")
+	srcDir := filepath.Join(dir, "src")
+	if err := os.Mkdir(srcDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Srv{Detectors: []Detector{
+		fileDetector{name: "node", files: []string{"package.json"}, dockerfile: filepath.Join(dir, "node.Dockerfile"), confidence: 0.9},
+		fileDetector{name: "broken", files: []string{"package.json"}, dockerfile: filepath.Join(dir, "missing.Dockerfile"), confidence: 0.9},
+	}}
+
+	names := func(matches []detectorMatch) []string {
+		var names []string
+		for _, m := range matches {
+			names = append(names, m.name)
+		}
+		return names
+	}
+
+	// Python matches anything, but isn't confident without requirements.txt or __main__.py
+	matches, failures := s.runDetectors(context.Background(), srcDir)
+	if got := names(matches); !slices.Equal(got, []string{"python"}) || len(failures) != 0 {
+		t.Errorf("empty source: got %v, %v", got, failures)
+	}
+
+	if err := os.WriteFile(filepath.Join(srcDir, "package.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	matches, failures = s.runDetectors(context.Background(), srcDir)
+	if got := names(matches); !slices.Equal(got, []string{"node", "python"}) {
+		t.Errorf("package.json: got %v", got)
+	}
+	if len(failures) != 1 {
+		t.Errorf("package.json: the broken detector should fail, got %v", failures)
+	}
+	if plan := matches[0].Plan; !plan.UseDockerfile || plan.Dockerfile != "FROM node\n" || plan.Detector != "node" {
+		t.Errorf("package.json: got plan %v", plan)
+	}
+	if _, ok := planBuilderFor(matches[0].Plan).(dockerfileBuilder); !ok {
+		t.Errorf("package.json: the plan isn't built from its Dockerfile")
+	}
+
+	if err := os.WriteFile(filepath.Join(srcDir, "Dockerfile"), []byte("FROM alpine\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ = s.runDetectors(context.Background(), srcDir)
+	if got := names(matches); !slices.Equal(got, []string{"dockerfile", "node", "python"}) {
+		t.Errorf("Dockerfile: got %v", got)
+	}
+	if _, ok := planBuilderFor(matches[len(matches)-1].Plan).(pythonBuilder); !ok {
+		t.Errorf("Dockerfile: the python plan isn't built by the python builder")
+	}
+}
@@ -0,0 +1,197 @@
+package srv
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// devMode lets source be synced to an app while it runs, instead of rebuilding it
+type devMode struct {
+	syncs chan devSync
+	// Closed when the app leaves dev mode
+	done chan struct{}
+	// Restart the app's process after a sync, otherwise the app is expected to reload itself
+	restart bool
+	// Where the source is in the app's container, from devDir
+	dir string
+}
+
+// devSync is the paths in the app's source which changed, relative to its source directory
+type devSync struct {
+	paths []string
+	// Gets the result of applying the sync
+	result chan error
+}
+
+// startDev puts the app in dev mode until stopDev is called, dir is from planBuilder.devDir
+func (s *app) startDev(dir string, restart bool) *devMode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dev = &devMode{
+		syncs:   make(chan devSync),
+		done:    make(chan struct{}),
+		restart: restart,
+		dir:     dir,
+	}
+
+	return s.dev
+}
+
+func (s *app) stopDev() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.dev != nil {
+		close(s.dev.done)
+		s.dev = nil
+	}
+}
+
+// getDev returns nil unless the app is in dev mode
+func (s *app) getDev() *devMode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.dev
+}
+
+// sync the paths to the app and wait for them to be applied
+func (s *devMode) sync(ctx context.Context, paths []string) error {
+	if path := rpc.RebuildFile(paths); path != "" {
+		return fmt.Errorf("%s changed, the app has to be rebuilt", path)
+	}
+
+	result := make(chan error, 1)
+	select {
+	case s.syncs <- devSync{paths: paths, result: result}:
+	case <-s.done:
+		return errors.New("the app is no longer in dev mode")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runInCtr runs a process next to the app in dir and includes its output in any error
+func (s *aCtx) runInCtr(ctr gateway.Container, dir string, stdin io.Reader, args ...string) error {
+	var out bytes.Buffer
+
+	req := gateway.StartRequest{
+		Cwd:    dir,
+		Args:   args,
+		Env:    []string{"PATH=" + defaultPathEnv},
+		Stdout: nopWriteCloser{&out},
+		Stderr: nopWriteCloser{&out},
+	}
+	if stdin != nil {
+		req.Stdin = io.NopCloser(stdin)
+	}
+
+	pid, err := ctr.Start(s.ctx, req)
+	if err != nil {
+		return fmt.Errorf("ctr Start: %w", err)
+	}
+
+	if err := pid.Wait(); err != nil {
+		return fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
+
+// applySync copies the synced files from the app's source into the dev mode directory in its
+// container and removes the ones which no longer exist. This needs tar and rm in the app's image.
+func (s *aCtx) applySync(ctr gateway.Container, paths []string) error {
+	var removed []string
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	files := 0
+
+	for _, path := range paths {
+		if !filepath.IsLocal(path) {
+			return fmt.Errorf("path is not local: %s", path)
+		}
+
+		info, err := os.Lstat(filepath.Join(s.app.srcDir, path))
+		if os.IsNotExist(err) {
+			removed = append(removed, path)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("os Lstat: %w", err)
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := addTarFile(tw, filepath.Join(s.app.srcDir, path), path, info); err != nil {
+			return err
+		}
+		files++
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("tar Close: %w", err)
+	}
+
+	trace.Event(s.ctx, "apply sync", attribute.Int("files", files), attribute.StringSlice("removed", removed))
+
+	if len(removed) > 0 {
+		if err := s.runInCtr(ctr, s.dev.dir, nil, append([]string{"rm", "-rf", "--"}, removed...)...); err != nil {
+			return err
+		}
+	}
+
+	if files > 0 {
+		if err := s.runInCtr(ctr, s.dev.dir, &archive, "tar", "-x", "-f", "-"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addTarFile(tw *tar.Writer, src string, name string, info os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("tar FileInfoHeader: %w", err)
+	}
+	hdr.Name = filepath.ToSlash(name)
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar WriteHeader: %w", err)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("os Open: %w", err)
+	}
+	defer f.Close()
+
+	// The file may have grown since it was stat'ed
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("io CopyN: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// MkDockerfile renders the analysis as a Dockerfile which builds the app the same way as MkLlb
+func MkDockerfile(analysis *pb.AnalysisResult) string {
+	var b strings.Builder
+
+	b.WriteString("# Made by 'ay eject' from Ayup's analysis of the app. Ayup builds the app with this\n")
+	b.WriteString("# file now that it exists, so it can be edited. The app is still started with\n")
+	b.WriteString("# 'python __main__.py' and serves on port 5000.\n")
+	fmt.Fprintf(&b, "FROM %s\n\n", pythonSlimImage)
+	b.WriteString("ENV PYTHONUNBUFFERED=True\n")
+	fmt.Fprintf(&b, "WORKDIR %s\n", pythonAppDir)
+	b.WriteString("# Keep downloaded packages in the cache mount\n")
+	b.WriteString("RUN rm /etc/apt/apt.conf.d/docker-clean\n\n")
+
+	if deps := aptDeps(analysis); len(deps) > 0 {
+		b.WriteString("RUN --mount=type=cache,target=/var/cache/apt,sharing=locked \\\n")
+		fmt.Fprintf(&b, "    apt update && apt install -y %s\n\n", strings.Join(deps, " "))
+	}
+
+	b.WriteString("# Dependencies first, so they are only installed again when requirements.txt changes\n")
+	b.WriteString("COPY requirements.txt .\n")
+	b.WriteString("RUN --mount=type=cache,target=/root/.cache/pip,sharing=locked \\\n")
+	b.WriteString("    pip install -r requirements.txt\n")
+	b.WriteString("COPY . .\n\n")
+
+	b.WriteString("EXPOSE 5000\n")
+	b.WriteString("ENTRYPOINT [\"python\"]\n")
+	b.WriteString("CMD [\"__main__.py\"]\n")
+
+	return b.String()
+}
+
+// dockerignore leaves out the same files as MkLlb when the Dockerfile is built
+const dockerignore = `.git
+.venv
+`
+
+func (s *Srv) Eject(ctx context.Context, in *pb.EjectReq) (*pb.EjectReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.EjectReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	app, err := s.getApp(ctx, in.App)
+	if err != nil {
+		return &pb.EjectReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	built := app.lastBuilt()
+	if built == nil {
+		return &pb.EjectReply{Error: &pb.Error{Error: errNotBuilt.Error()}}, nil
+	}
+
+	// A detector's Dockerfile isn't in the source, so it can be ejected
+	if built.Dockerfile != "" {
+		return &pb.EjectReply{Dockerfile: built.Dockerfile, Dockerignore: dockerignore}, nil
+	}
+
+	if built.UseDockerfile {
+		return &pb.EjectReply{Error: &pb.Error{Error: "the app is already built from its Dockerfile"}}, nil
+	}
+
+	return &pb.EjectReply{
+		Dockerfile:   MkDockerfile(built),
+		Dockerignore: dockerignore,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package srv
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	solverPb "github.com/moby/buildkit/solver/pb"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+// llbSteps renders the images, commands and working directories of MkLlb's build in order
+func llbSteps(t *testing.T, analysis *pb.AnalysisResult) []string {
+	def, err := MkLlb(context.Background(), analysis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var steps []string
+	for _, dt := range def.Def {
+		var op solverPb.Op
+		if err := op.Unmarshal(dt); err != nil {
+			t.Fatal(err)
+		}
+
+		switch v := op.Op.(type) {
+		case *solverPb.Op_Source:
+			if image, ok := strings.CutPrefix(v.Source.Identifier, "docker-image://"); ok {
+				steps = append(steps, "FROM "+image)
+			}
+		case *solverPb.Op_File:
+			for _, a := range v.File.Actions {
+				if rm := a.GetRm(); rm != nil {
+					steps = append(steps, "RUN rm "+rm.Path)
+				}
+			}
+		case *solverPb.Op_Exec:
+			args := v.Exec.Meta.Args
+			if len(args) == 3 && args[0] == "dash" && args[1] == "-c" {
+				args = args[2:]
+			}
+			steps = append(steps, "WORKDIR "+v.Exec.Meta.Cwd, "RUN "+strings.Join(args, " "))
+		}
+	}
+
+	return steps
+}
+
+// dockerfileSteps renders the same as llbSteps from a Dockerfile, leaving out cache mounts
+func dockerfileSteps(dockerfile string) []string {
+	var steps []string
+	workdir := "/"
+
+	for _, line := range strings.Split(strings.ReplaceAll(dockerfile, "\\\n", ""), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "FROM":
+			steps = append(steps, line)
+		case "WORKDIR":
+			workdir = fields[1]
+		case "RUN":
+			args := slices.DeleteFunc(fields[1:], func(f string) bool {
+				return strings.HasPrefix(f, "--mount=")
+			})
+			// MkLlb removes docker-clean before it has a working directory
+			if !strings.HasPrefix(args[0], "rm") {
+				steps = append(steps, "WORKDIR "+workdir)
+			}
+			steps = append(steps, "RUN "+strings.Join(args, " "))
+		}
+	}
+
+	return steps
+}
+
+func TestMkDockerfileMatchesMkLlb(t *testing.T) {
+	analyses := []*pb.AnalysisResult{
+		{UsePythonRequirements: true},
+		{UsePythonRequirements: true, NeedsGit: true},
+		{UsePythonRequirements: true, NeedsGit: true, NeedsLibGL: true, NeedsLibGlib: true},
+	}
+
+	for _, analysis := range analyses {
+		want := llbSteps(t, analysis)
+		got := dockerfileSteps(MkDockerfile(analysis))
+
+		if !slices.Equal(got, want) {
+			t.Errorf("%v:\nMkDockerfile: %q\nMkLlb:        %q", analysis, got, want)
+		}
+	}
+}
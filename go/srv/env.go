@@ -15,13 +15,13 @@ import (
 )
 
 // Load the .ayup-env file and then delete it
-func (s *Srv) loadAyupEnv(ctx context.Context, src pb.Source) (map[string][]byte, []llb.RunOption, error) {
+func (s *app) loadAyupEnv(ctx context.Context, src pb.Source) (map[string][]byte, []llb.RunOption, error) {
 	var path string
 	switch src {
 	case pb.Source_app:
-		path = s.SrcDir
+		path = s.srcDir
 	case pb.Source_assistant:
-		path = s.AssistantDir
+		path = s.assDir
 	}
 
 	path = filepath.Join(path, ".ayup-env")
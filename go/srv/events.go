@@ -0,0 +1,127 @@
+package srv
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/peer"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// How long an app has to keep running after it starts to be considered healthy
+const appHealthyAfter = 30 * time.Second
+
+// Events are dropped for a subscriber which falls this far behind
+const eventBuffer = 256
+
+type eventSub struct {
+	types  []pb.EventType
+	app    string
+	events chan *pb.Event
+}
+
+func (s *eventSub) wants(ev *pb.Event) bool {
+	if s.app != "" && s.app != ev.App {
+		return false
+	}
+
+	return len(s.types) == 0 || slices.Contains(s.types, ev.Type)
+}
+
+// eventBus sends the daemon's events to each subscriber without blocking the daemon
+type eventBus struct {
+	mutex sync.Mutex
+	seq   uint64
+	subs  map[*eventSub]struct{}
+}
+
+func (s *eventBus) subscribe(types []pb.EventType, app string) *eventSub {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sub := &eventSub{
+		types:  types,
+		app:    app,
+		events: make(chan *pb.Event, eventBuffer),
+	}
+
+	if s.subs == nil {
+		s.subs = make(map[*eventSub]struct{})
+	}
+	s.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (s *eventBus) unsubscribe(sub *eventSub) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.subs, sub)
+}
+
+// emit fills in the event's sequence number and time then sends it to the subscribers that want it
+func (s *eventBus) emit(ctx context.Context, ev *pb.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	ev.Seq = s.seq
+	ev.Time = time.Now().Unix()
+
+	trace.Event(ctx, "event", attribute.String("type", ev.Type.String()), attribute.String("app", ev.App))
+
+	for sub := range s.subs {
+		if !sub.wants(ev) {
+			continue
+		}
+
+		select {
+		case sub.events <- ev:
+		default:
+			trace.Event(ctx, "event dropped, subscriber is too slow")
+		}
+	}
+}
+
+// emit the event with the client that caused it, if any, taken from the context
+func (s *Srv) emit(ctx context.Context, ev *pb.Event) {
+	if pr, ok := peer.FromContext(ctx); ok {
+		ev.Peer = pr.Addr.String()
+	}
+
+	s.events.emit(ctx, ev)
+}
+
+func (s *Srv) Events(req *pb.EventsReq, stream pb.Srv_EventsServer) error {
+	ctx := stream.Context()
+
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		terror.Ackf(ctx, "checkPeerAuth: %w", err)
+		return terror.Errorf(ctx, "Not authorized")
+	}
+
+	if req.App != "" {
+		s.setSessionApp(ctx, req.App)
+	}
+
+	sub := s.events.subscribe(req.Types, req.App)
+	defer s.events.unsubscribe(sub)
+
+	for {
+		select {
+		case ev := <-sub.events:
+			if err := stream.Send(ev); err != nil {
+				return terror.Errorf(ctx, "stream Send: %w", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
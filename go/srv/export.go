@@ -0,0 +1,120 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/rpc"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// exportPath is where the last export of the app's build is
+func (s *app) exportPath() string {
+	return filepath.Join(s.dir, rpc.ExportName)
+}
+
+// exportEntries tells buildkit to write the result of the build to the app's export file
+func (s *app) exportEntries(export *pb.Export) []client.ExportEntry {
+	typ := client.ExporterOCI
+	if export.Type == pb.ExportType_exportTar {
+		typ = client.ExporterTar
+	}
+
+	return []client.ExportEntry{{
+		Type: typ,
+		Output: func(map[string]string) (io.WriteCloser, error) {
+			return os.Create(s.exportPath())
+		},
+	}}
+}
+
+// addImageConfig to the result of building the plan, so the exported or published image runs
+// the app like Ayup does. A Dockerfile's own config is set by the frontend and kept as it is, the
+// labels are passed to the frontend instead.
+func addImageConfig(c gateway.Client, r *gateway.Result, plan *pb.AnalysisResult, labels map[string]string) error {
+	if plan.UseDockerfile {
+		return nil
+	}
+
+	img := ocispecs.Image{
+		Platform: workerPlatform(c),
+		Config: ocispecs.ImageConfig{
+			Env:          []string{"PATH=" + defaultPathEnv, "PYTHONUNBUFFERED=True"},
+			Entrypoint:   []string{"python"},
+			Cmd:          []string{"__main__.py"},
+			WorkingDir:   pythonAppDir,
+			ExposedPorts: map[string]struct{}{"5000/tcp": {}},
+			Labels:       labels,
+		},
+	}
+
+	config, err := json.Marshal(img)
+	if err != nil {
+		return fmt.Errorf("json Marshal: %w", err)
+	}
+	r.AddMeta(exptypes.ExporterImageConfigKey, config)
+
+	return nil
+}
+
+// workerPlatform is what buildkit builds for, which isn't the daemon's if buildkit is remote
+func workerPlatform(c gateway.Client) ocispecs.Platform {
+	if ws := c.BuildOpts().Workers; len(ws) > 0 && len(ws[0].Platforms) > 0 {
+		return ws[0].Platforms[0]
+	}
+
+	return platforms.DefaultSpec()
+}
+
+func (s *Srv) DownloadExport(req *pb.DownloadReq, stream pb.Srv_DownloadExportServer) error {
+	ctx := stream.Context()
+
+	sendError := func(msgf string, args ...any) error {
+		return terror.Errorf(ctx, msgf, args...)
+	}
+
+	internalError := func(msgf string, args ...any) error {
+		_ = terror.Errorf(ctx, msgf, args...)
+		return sendError("internal error")
+	}
+
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return internalError("checkPeerAuth: %w", err)
+		}
+
+		return sendError("Not authorized")
+	}
+
+	app, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return err
+	}
+
+	// The export may still be being written
+	if !app.actMutex.TryLock() {
+		return sendError("App is busy: %s", app.name)
+	}
+	defer app.actMutex.Unlock()
+
+	if _, err := os.Stat(app.exportPath()); err != nil {
+		if os.IsNotExist(err) {
+			return sendError("%s has not been exported, use 'ay build'", app.name)
+		}
+		return internalError("os Stat: %w", err)
+	}
+
+	fileSender := rpc.NewFileSender(stream, nil, nil, sendError, internalError)
+
+	return fileSender.SendFiles(ctx, pb.Source_app, app.dir, []string{rpc.ExportName})
+}
@@ -0,0 +1,62 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+// workerClient only implements BuildOpts
+type workerClient struct {
+	gateway.Client
+	platforms []ocispecs.Platform
+}
+
+func (s workerClient) BuildOpts() gateway.BuildOpts {
+	return gateway.BuildOpts{Workers: []gateway.WorkerInfo{{Platforms: s.platforms}}}
+}
+
+func TestAddImageConfig(t *testing.T) {
+	arm := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+	c := workerClient{platforms: []ocispecs.Platform{arm}}
+	labels := map[string]string{"ai.premai.ayup.version": "test"}
+
+	// The frontend's config for the Dockerfile is kept
+	frontendConfig := []byte(`{"config":{"Cmd":["node","server.js"]}}`)
+	r := gateway.NewResult()
+	r.AddMeta(exptypes.ExporterImageConfigKey, frontendConfig)
+	if err := addImageConfig(c, r, &pb.AnalysisResult{UseDockerfile: true}, labels); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Metadata[exptypes.ExporterImageConfigKey]; !bytes.Equal(got, frontendConfig) {
+		t.Errorf("Dockerfile config was replaced with %s", got)
+	}
+
+	r = gateway.NewResult()
+	if err := addImageConfig(c, r, &pb.AnalysisResult{UsePythonRequirements: true}, labels); err != nil {
+		t.Fatal(err)
+	}
+
+	var img ocispecs.Image
+	if err := json.Unmarshal(r.Metadata[exptypes.ExporterImageConfigKey], &img); err != nil {
+		t.Fatal(err)
+	}
+	if img.OS != arm.OS || img.Architecture != arm.Architecture {
+		t.Errorf("got platform %s/%s, want the worker's", img.OS, img.Architecture)
+	}
+	if img.Config.WorkingDir != pythonAppDir {
+		t.Errorf("got working dir %s", img.Config.WorkingDir)
+	}
+	if _, ok := img.Config.ExposedPorts["5000/tcp"]; !ok {
+		t.Errorf("port 5000 isn't exposed: %v", img.Config.ExposedPorts)
+	}
+	if img.Config.Labels["ai.premai.ayup.version"] != "test" {
+		t.Errorf("got labels %v", img.Config.Labels)
+	}
+}
@@ -0,0 +1,123 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/proc"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// When the daemon is given the address of an existing buildkitd it doesn't start rootlesskit or
+// the rootless helper. Instead the app's container network is dialed directly, which requires
+// buildkitd to be on the same host with the container IPs routable from the daemon. Resource
+// limits and OOM detection need the helper, so they are not available.
+
+// rootless is true when the daemon started buildkitd itself inside rootlesskit
+func (s *Srv) rootless() bool {
+	return s.inrClient != nil
+}
+
+// parseLocalAddrs finds the container's own IPv4 addresses in /proc/net/fib_trie, ignoring
+// loopback. An address is listed before the "/32 host LOCAL" line which marks it as local.
+func parseLocalAddrs(fibTrie []byte) []string {
+	var addrs []string
+	var last string
+	seen := make(map[string]bool)
+
+	lines := bufio.NewScanner(bytes.NewReader(fibTrie))
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+
+		if ip, ok := strings.CutPrefix(line, "|-- "); ok {
+			last = ip
+			continue
+		}
+
+		if !strings.Contains(line, "/32 host LOCAL") || last == "" {
+			continue
+		}
+
+		ip := net.ParseIP(last)
+		if ip == nil || ip.IsLoopback() || seen[last] {
+			continue
+		}
+
+		seen[last] = true
+		addrs = append(addrs, last)
+	}
+
+	return addrs
+}
+
+// probeAppAddr finds the address of the app's container from the host. The gated process is
+// found by its token and the addresses are read from /proc/<pid>/net which shows its network
+// namespace, so nothing is needed in the app's image.
+func (s *aCtx) probeAppAddr(gate *appGate) (string, error) {
+	pid, err := proc.WaitGated(s.ctx, gate.token)
+	if err != nil {
+		return "", err
+	}
+
+	fibTrie, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "net", "fib_trie"))
+	if err != nil {
+		return "", terror.Errorf(s.ctx, "os ReadFile: %w", err)
+	}
+
+	addrs := parseLocalAddrs(fibTrie)
+	if len(addrs) < 1 {
+		return "", errors.New("no address found in /proc/net/fib_trie")
+	}
+
+	trace.Event(s.ctx, "app address", attribute.StringSlice("addrs", addrs))
+
+	return addrs[0], nil
+}
+
+// findAppAddr records the address of the app's container so that it can be dialed, then lets
+// the gated process run
+func (s *aCtx) findAppAddr(gate *appGate) {
+	defer func() {
+		terror.Ackf(s.ctx, "gate release: %w", gate.release())
+	}()
+
+	s.app.mutex.Lock()
+	limits := s.app.limits
+	s.app.mutex.Unlock()
+
+	if limits != nil && hasLimits(limits) {
+		_ = s.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: "Warning: resource limits are not supported with an external buildkitd\n",
+			},
+		})
+	}
+
+	addr, err := s.probeAppAddr(gate)
+	if err != nil {
+		terror.Ackf(s.ctx, "probeAppAddr: %w", err)
+		_ = s.send(&pb.ActReply{
+			Source: "ayup",
+			Variant: &pb.ActReply_Log{
+				Log: fmt.Sprintf("Warning: port forwarding won't work, the app's address could not be found: %v\n", err),
+			},
+		})
+		return
+	}
+
+	s.app.mutex.Lock()
+	s.app.addr = addr
+	s.app.mutex.Unlock()
+}
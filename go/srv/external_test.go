@@ -0,0 +1,63 @@
+package srv
+
+import (
+	"slices"
+	"testing"
+)
+
+// From a container on a bridge network
+const containerFibTrie = `Main:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 0.0.0.0
+        /0 universe UNICAST
+     +-- 10.88.0.0/16 2 0 2
+        +-- 10.88.0.0/30 2 0 2
+           |-- 10.88.0.0
+              /16 link UNICAST
+           |-- 10.88.0.3
+              /32 host LOCAL
+        |-- 10.88.255.255
+           /32 link BROADCAST
+     +-- 127.0.0.0/8 2 0 2
+        +-- 127.0.0.0/31 1 0 0
+           |-- 127.0.0.0
+              /8 host LOCAL
+           |-- 127.0.0.1
+              /32 host LOCAL
+        |-- 127.255.255.255
+           /32 link BROADCAST
+Local:
+  +-- 0.0.0.0/0 3 0 5
+     +-- 10.88.0.0/16 2 0 2
+        +-- 10.88.0.0/30 2 0 2
+           |-- 10.88.0.3
+              /32 host LOCAL
+     +-- 127.0.0.0/8 2 0 2
+           |-- 127.0.0.1
+              /32 host LOCAL
+`
+
+func TestParseLocalAddrs(t *testing.T) {
+	cases := []struct {
+		name    string
+		fibTrie string
+		want    []string
+	}{
+		{name: "container", fibTrie: containerFibTrie, want: []string{"10.88.0.3"}},
+		{name: "empty", fibTrie: "", want: nil},
+		{name: "loopback only", fibTrie: "|-- 127.0.0.1\n   /32 host LOCAL\n", want: nil},
+		{
+			name:    "several",
+			fibTrie: "|-- 10.0.0.2\n   /32 host LOCAL\n|-- 10.0.0.255\n   /32 link BROADCAST\n|-- 192.168.1.5\n   /32 host LOCAL\n",
+			want:    []string{"10.0.0.2", "192.168.1.5"},
+		},
+		{name: "no address before", fibTrie: "   /32 host LOCAL\n", want: nil},
+		{name: "not an address", fibTrie: "|-- nonsense\n   /32 host LOCAL\n", want: nil},
+	}
+
+	for _, c := range cases {
+		if got := parseLocalAddrs([]byte(c.fibTrie)); !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -1,13 +1,20 @@
 package srv
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/contrib/otelfiber"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/proxy"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 
 	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
@@ -16,94 +23,263 @@ import (
 	"premai.io/Ayup/go/internal/trace"
 )
 
-func mkProxy() *fiber.App {
-	app := fiber.New(fiber.Config{
+// The HTTP proxy serves each app on its own sub-domain, e.g. myapp.localhost:8080
+const proxyAddr = ":8080"
+
+// runningApp returns the app if it exists and is running, unlike getApp it doesn't create it
+func (s *Srv) runningApp(name string) *app {
+	s.appsMutex.Lock()
+	a := s.apps[name]
+	s.appsMutex.Unlock()
+
+	if a == nil || a.status().State != pb.AppState_running {
+		return nil
+	}
+
+	return a
+}
+
+// appAddr is the address of an app reached through the rootless helper
+type appAddr string
+
+func (s appAddr) Network() string { return "ayup" }
+func (s appAddr) String() string  { return string(s) }
+
+// inrConn is a connection to port 5000 of an app through the rootless helper
+type inrConn struct {
+	app    string
+	stream inrPb.InRootless_ForwardClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (s *inrConn) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		res, err := s.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if res.Closed {
+			return 0, io.EOF
+		}
+
+		s.buf = res.Data
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+func (s *inrConn) Write(p []byte) (int, error) {
+	if err := s.stream.Send(&inrPb.ForwardRequest{Data: p}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *inrConn) CloseWrite() error {
+	return s.stream.CloseSend()
+}
+
+func (s *inrConn) Close() error {
+	err := s.stream.CloseSend()
+	s.cancel()
+
+	return err
+}
+
+func (s *inrConn) LocalAddr() net.Addr  { return appAddr("daemon") }
+func (s *inrConn) RemoteAddr() net.Addr { return appAddr(s.app) }
+
+// Deadlines are not supported, the stream is cancelled on Close instead
+func (s *inrConn) SetDeadline(time.Time) error      { return nil }
+func (s *inrConn) SetReadDeadline(time.Time) error  { return nil }
+func (s *inrConn) SetWriteDeadline(time.Time) error { return nil }
+
+var errNoAppAddr = errors.New("the app is not running or its address is unknown")
+
+// dialApp connects to port 5000 of the app's container
+func (s *Srv) dialApp(ctx context.Context, app *app) (net.Conn, error) {
+	if !s.rootless() {
+		app.mutex.Lock()
+		addr := app.addr
+		app.mutex.Unlock()
+
+		if addr == "" {
+			return nil, errNoAppAddr
+		}
+
+		return net.Dial("tcp", net.JoinHostPort(addr, "5000"))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := s.inrClient.Forward(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("inrClient Forward: %w", err)
+	}
+
+	if err := stream.Send(&inrPb.ForwardRequest{App: app.name}); err != nil {
+		cancel()
+		return nil, fmt.Errorf("stream Send: %w", err)
+	}
+
+	return &inrConn{app: app.name, stream: stream, cancel: cancel}, nil
+}
+
+// newProxy creates the HTTP proxy to the apps, the first label of the host name is the app
+func (s *Srv) newProxy(ctx context.Context) *fiber.App {
+	// The app's name is given as the host to proxy to, so that the connection is made by dialApp
+	client := &fasthttp.Client{
+		NoDefaultUserAgentHeader: true,
+		DisablePathNormalizing:   true,
+		Dial: func(addr string) (net.Conn, error) {
+			name, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			a := s.runningApp(name)
+			if a == nil {
+				return nil, fmt.Errorf("the app is not running: %s", name)
+			}
+
+			return s.dialApp(ctx, a)
+		},
+	}
+
+	proxyApp := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
 		BodyLimit:             1024 * 1024 * 1024,
 	})
-	app.Use(otelfiber.Middleware())
+	proxyApp.Use(otelfiber.Middleware())
+
+	proxyApp.Use(func(c *fiber.Ctx) error {
+		name, _, _ := strings.Cut(c.Hostname(), ".")
+		a := s.runningApp(name)
+		if a == nil {
+			return fiber.NewError(fiber.StatusNotFound, "Not found!")
+		}
 
-	app.Use(func(c *fiber.Ctx) error {
-		if strings.HasPrefix(c.Hostname(), "app.") {
-			return proxy.Do(c, "http://localhost:5000"+c.OriginalURL())
+		err := proxy.Do(c, "http://"+a.name+c.OriginalURL(), client)
+		code := c.Response().StatusCode()
+		if err != nil {
+			code = fiber.StatusBadGateway
 		}
+		proxyRequests.WithLabelValues(a.name, strconv.Itoa(code)).Inc()
 
-		return fiber.NewError(fiber.StatusNotFound, "Not found!")
+		return err
 	})
 
-	return app
+	return proxyApp
+}
+
+func (s *Srv) serveProxy(ctx context.Context, proxyApp *fiber.App, addr string) {
+	ctx, span := trace.Span(ctx, "proxy")
+	defer span.End()
+
+	if err := proxyApp.Listen(addr); err != nil {
+		terror.Ackf(ctx, "proxy Listen: %w", err)
+	}
 }
 
 func (s *Srv) Forward(stream pb.Srv_ForwardServer) error {
 	ctx := stream.Context()
 	genericError := fmt.Errorf("port forwarding failure")
 
-	inrStream, err := s.inrClient.Forward(ctx)
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		terror.Ackf(ctx, "checkPeerAuth: %w", err)
+		return fmt.Errorf("not authorized")
+	}
+
+	first, err := stream.Recv()
 	if err != nil {
-		terror.Ackf(ctx, "inrClient Forward: %w", err)
+		terror.Ackf(ctx, "stream recv: %w", err)
 		return genericError
 	}
 
+	app, err := s.getApp(ctx, first.App)
+	if err != nil {
+		return err
+	}
+
+	forwardsActive.Inc()
+	defer forwardsActive.Dec()
+
+	conn, err := s.dialApp(ctx, app)
+	if errors.Is(err, errNoAppAddr) {
+		return err
+	} else if err != nil {
+		terror.Ackf(ctx, "dialApp: %w", err)
+		return genericError
+	}
+	defer func() { terror.Ackf(ctx, "conn Close: %w", conn.Close()) }()
+	trace.Event(ctx, "connected to port 5000", attribute.String("app", app.name))
+
+	forwardBytes.WithLabelValues("ingress").Add(float64(len(first.Data)))
+	if _, err := conn.Write(first.Data); err != nil {
+		terror.Ackf(ctx, "conn Write: %w", err)
+		return genericError
+	}
+
+	if err := pumpForward(ctx, stream, conn); err != nil {
+		terror.Ackf(ctx, "pumpForward: %w", err)
+		return genericError
+	}
+
+	return nil
+}
+
+// pumpForward copies the client's data to the app and the app's back until both are done
+func pumpForward(ctx context.Context, stream pb.Srv_ForwardServer, conn net.Conn) error {
 	var g errgroup.Group
 
 	g.Go(func() error {
 		for {
 			req, err := stream.Recv()
-			if err != nil {
-				if err != io.EOF {
-					terror.Ackf(ctx, "stream recv: %w", err)
-					return genericError
-				} else {
-					trace.Event(ctx, "ingress done")
-					return nil
+			if err == io.EOF {
+				trace.Event(ctx, "ingress done")
+				// Half close, so the app sees EOF but can still reply, the rootless helper does
+				// the same to its own connection when inrConn's stream is closed
+				if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+					return closer.CloseWrite()
 				}
+				return nil
+			} else if err != nil {
+				// Unblock the egress, the client is gone
+				terror.Ackf(ctx, "conn Close: %w", conn.Close())
+				return fmt.Errorf("stream Recv: %w", err)
 			}
 
-			if err := inrStream.Send(&inrPb.ForwardRequest{
-				Data: req.Data,
-			}); err != nil {
-				terror.Ackf(ctx, "inrStream Send: %w", err)
-				return genericError
+			forwardBytes.WithLabelValues("ingress").Add(float64(len(req.Data)))
+			if _, err := conn.Write(req.Data); err != nil {
+				return fmt.Errorf("conn Write: %w", err)
 			}
-
-			trace.Event(ctx, "ingress recv")
 		}
 	})
 
 	g.Go(func() error {
+		buf := make([]byte, 16*1024)
 		for {
-			req, err := inrStream.Recv()
-			if err != nil {
-				if err != io.EOF {
-					terror.Ackf(ctx, "stream recv: %w", err)
-					return genericError
-				} else {
-					trace.Event(ctx, "ingress done")
-					return nil
-				}
-			}
-
-			if req.Closed {
-				if err := stream.Send(&pb.ForwardResponse{
-					Closed: true,
-				}); err != nil {
-					terror.Ackf(ctx, "stream send: %w", err)
-					return genericError
+			n, err := conn.Read(buf)
+			if err == io.EOF {
+				trace.Event(ctx, "egress done")
+				if err := stream.Send(&pb.ForwardResponse{Closed: true}); err != nil {
+					return fmt.Errorf("stream Send: %w", err)
 				}
-				break
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("conn Read: %w", err)
 			}
 
-			if err := stream.Send(&pb.ForwardResponse{
-				Data: req.Data,
-			}); err != nil {
-				terror.Ackf(ctx, "inrStream Send: %w", err)
-				return genericError
+			forwardBytes.WithLabelValues("egress").Add(float64(n))
+			if err := stream.Send(&pb.ForwardResponse{Data: buf[:n]}); err != nil {
+				return fmt.Errorf("stream Send: %w", err)
 			}
-
-			trace.Event(ctx, "ingress recv")
 		}
-
-		return nil
 	})
 
 	return g.Wait()
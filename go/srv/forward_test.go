@@ -0,0 +1,91 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+// forwardStream is a client which sends its requests then waits for the app's responses
+type forwardStream struct {
+	grpc.ServerStream
+	reqs  []*pb.ForwardRequest
+	resps []*pb.ForwardResponse
+}
+
+func (s *forwardStream) Recv() (*pb.ForwardRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+
+	return req, nil
+}
+
+// Send copies the response like gRPC would, because pumpForward reuses its buffer
+func (s *forwardStream) Send(resp *pb.ForwardResponse) error {
+	s.resps = append(s.resps, proto.Clone(resp).(*pb.ForwardResponse))
+	return nil
+}
+
+func TestPumpForwardHalfCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The app only replies once the client is done sending
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("got "), req...))
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream := &forwardStream{reqs: []*pb.ForwardRequest{{Data: []byte("ping")}}}
+	done := make(chan error)
+	go func() { done <- pumpForward(context.Background(), stream, conn) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pumpForward didn't finish after both sides were done")
+	}
+
+	var got []byte
+	for _, resp := range stream.resps[:len(stream.resps)-1] {
+		got = append(got, resp.Data...)
+	}
+	if string(got) != "got ping" {
+		t.Errorf("got %q", got)
+	}
+	if !stream.resps[len(stream.resps)-1].Closed {
+		t.Errorf("the last response doesn't close the stream")
+	}
+}
@@ -0,0 +1,433 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/moby/buildkit/client"
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+// How long an app must be idle before it is stale, when it's not set by the client or policy
+const defaultStaleAfter = 7 * 24 * time.Hour
+
+// The least time between garbage collections started because the disk is low on space
+const gcCooldown = 10 * time.Minute
+
+// GCPolicy decides when the daemon prunes Buildkit's cache and stale apps by itself
+type GCPolicy struct {
+	// A cron schedule such as @daily, empty to only collect when the disk is low on space
+	Schedule string
+	// Collect when the free space on Buildkit's disk falls below this; a size such as 5G or a
+	// percentage of the disk such as 10%, 0 to disable
+	MinFree string
+	// How much of the cache to keep when collecting; a size or a percentage of the disk
+	KeepStorage string
+	// Remove apps that have been idle for this long, 0 to keep them
+	StaleAppsAfter time.Duration
+}
+
+// buildkitRoot is where Buildkit keeps its cache, empty if it is not managed by the daemon
+func (s *Srv) buildkitRoot() string {
+	if !s.rootless() {
+		return ""
+	}
+
+	return filepath.Join(conf.UserRoot(), "buildkit")
+}
+
+// diskSpace returns the free and total bytes on the file system which path is on
+func diskSpace(path string) (int64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return -1, -1, err
+	}
+
+	return int64(st.Bavail) * st.Bsize, int64(st.Blocks) * st.Bsize, nil
+}
+
+// parseDiskSize parses a size such as 10G or a percentage of total such as 10%
+func parseDiskSize(val string, total int64) (int64, error) {
+	val = strings.TrimSpace(val)
+
+	switch val {
+	case "", "0":
+		return 0, nil
+	}
+
+	if pctStr, ok := strings.CutSuffix(val, "%"); ok {
+		pct, err := strconv.ParseFloat(pctStr, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("disk percentage must be between 0 and 100: %s", val)
+		}
+
+		if total < 0 {
+			return 0, fmt.Errorf("disk size unknown, can't use a percentage: %s", val)
+		}
+
+		return int64(float64(total) * pct / 100), nil
+	}
+
+	bytes, err := units.RAMInBytes(val)
+	if err != nil {
+		return 0, fmt.Errorf("disk size: %w", err)
+	}
+
+	return bytes, nil
+}
+
+func cacheRecord(u *client.UsageInfo) *pb.CacheRecord {
+	r := &pb.CacheRecord{
+		Id:          u.ID,
+		Type:        string(u.RecordType),
+		Description: u.Description,
+		Size:        u.Size,
+		InUse:       u.InUse,
+		Shared:      u.Shared,
+		UsageCount:  uint32(u.UsageCount),
+	}
+
+	if u.LastUsedAt != nil {
+		r.LastUsed = u.LastUsedAt.Unix()
+	}
+
+	return r
+}
+
+// isStale is true if the app isn't running or being built, has no jobs and nothing has been
+// pushed or built for longer than after
+func (s *app) isStale(after time.Duration) bool {
+	s.mutex.Lock()
+	active := s.state == pb.AppState_running || s.state == pb.AppState_building || len(s.jobs) > 0
+	s.mutex.Unlock()
+
+	if active {
+		return false
+	}
+
+	lastUsed := time.Time{}
+	for _, p := range []string{s.dir, s.srcDir, s.builtPath(), filepath.Join(s.dir, "log")} {
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(lastUsed) {
+			lastUsed = info.ModTime()
+		}
+	}
+
+	return !lastUsed.IsZero() && time.Since(lastUsed) > after
+}
+
+func (s *Srv) sortedApps() []*app {
+	s.appsMutex.Lock()
+	apps := make([]*app, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, a)
+	}
+	s.appsMutex.Unlock()
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].name < apps[j].name
+	})
+
+	return apps
+}
+
+// removeApp deletes the app's directory, unless it is in use
+func (s *Srv) removeApp(ctx context.Context, a *app) error {
+	if !a.actMutex.TryLock() {
+		return fmt.Errorf("app is busy: %s", a.name)
+	}
+	defer a.actMutex.Unlock()
+
+	s.appsMutex.Lock()
+	if s.apps[a.name] == a {
+		delete(s.apps, a.name)
+	}
+	s.appsMutex.Unlock()
+
+	trace.Event(ctx, "remove app", attribute.String("app", a.name))
+
+	if err := os.RemoveAll(a.dir); err != nil {
+		return terror.Errorf(ctx, "os RemoveAll: %w", err)
+	}
+
+	return nil
+}
+
+type pruneOpts struct {
+	keepStorage  int64
+	keepDuration time.Duration
+	filters      []string
+	all          bool
+
+	apps       bool
+	staleAfter time.Duration
+}
+
+// prune Buildkit's cache and optionally remove stale apps
+func (s *Srv) prune(ctx context.Context, opts pruneOpts) (*pb.PruneReply, error) {
+	ctx, span := trace.Span(ctx, "prune", attribute.Int64("keepStorage", opts.keepStorage))
+	defer span.End()
+
+	reply := &pb.PruneReply{}
+
+	if opts.apps {
+		for _, a := range s.sortedApps() {
+			if !a.isStale(opts.staleAfter) {
+				continue
+			}
+
+			size := diskUsage(a.dir)
+			if err := s.removeApp(ctx, a); err != nil {
+				terror.Ackf(ctx, "removeApp: %w", err)
+				continue
+			}
+
+			reply.RemovedApps = append(reply.RemovedApps, a.name)
+			if size > 0 {
+				reply.Reclaimed += size
+			}
+		}
+	}
+
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "client New: %w", err)
+	}
+	defer c.Close()
+
+	pruneOpts := []client.PruneOption{
+		client.WithKeepOpt(opts.keepDuration, opts.keepStorage),
+		client.WithFilter(opts.filters),
+	}
+	if opts.all {
+		pruneOpts = append(pruneOpts, client.PruneAll)
+	}
+
+	usageChan := make(chan client.UsageInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for u := range usageChan {
+			reply.Pruned = append(reply.Pruned, cacheRecord(&u))
+			reply.Reclaimed += u.Size
+		}
+	}()
+
+	err = c.Prune(ctx, usageChan, pruneOpts...)
+	close(usageChan)
+	<-done
+
+	if err != nil {
+		return nil, terror.Errorf(ctx, "client Prune: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int64("reclaimed", reply.Reclaimed))
+
+	return reply, nil
+}
+
+// collectGarbage prunes according to the policy and prints what was freed
+func (s *Srv) collectGarbage(ctx context.Context, reason string) {
+	ctx, span := trace.Span(ctx, "gc", attribute.String("reason", reason))
+	defer span.End()
+
+	if err := s.buildkitDown(); err != nil {
+		trace.Event(ctx, "skipped", attribute.String("error", err.Error()))
+		return
+	}
+
+	total := int64(-1)
+	if root := s.buildkitRoot(); root != "" {
+		_, total, _ = diskSpace(root)
+	}
+
+	keepStorage, err := parseDiskSize(s.GC.KeepStorage, total)
+	if err != nil {
+		terror.Ackf(ctx, "parseDiskSize: %w", err)
+		return
+	}
+
+	reply, err := s.prune(ctx, pruneOpts{
+		keepStorage: keepStorage,
+		apps:        s.GC.StaleAppsAfter > 0,
+		staleAfter:  s.GC.StaleAppsAfter,
+	})
+	if err != nil {
+		terror.Ackf(ctx, "prune: %w", err)
+		return
+	}
+
+	s.tuiMutex.Lock()
+	fmt.Println(tui.TitleStyle.Render("Garbage collected:"), reason+";",
+		units.HumanSize(float64(reply.Reclaimed)), "freed,", len(reply.Pruned), "cache records and",
+		len(reply.RemovedApps), "stale apps removed")
+	s.tuiMutex.Unlock()
+}
+
+// runGC checks each minute if the policy's schedule is due or the disk is low on space, until the
+// context is done
+func (s *Srv) runGC(ctx context.Context) {
+	var sched *schedule
+	if s.GC.Schedule != "" {
+		sc, err := parseSchedule(s.GC.Schedule)
+		if err != nil {
+			terror.Ackf(ctx, "parseSchedule: %w", err)
+		} else {
+			sched = &sc
+		}
+	}
+
+	var lastLow time.Time
+
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if s.shuttingDown.Load() {
+			return
+		}
+
+		if sched != nil && sched.matches(next) {
+			s.collectGarbage(ctx, "scheduled")
+			continue
+		}
+
+		root := s.buildkitRoot()
+		if root == "" || time.Since(lastLow) < gcCooldown {
+			continue
+		}
+
+		free, total, err := diskSpace(root)
+		if err != nil {
+			continue
+		}
+
+		minFree, err := parseDiskSize(s.GC.MinFree, total)
+		if err != nil || minFree == 0 || free >= minFree {
+			continue
+		}
+
+		lastLow = time.Now()
+		s.collectGarbage(ctx, fmt.Sprintf("%s free is below %s", units.HumanSize(float64(free)), units.HumanSize(float64(minFree))))
+	}
+}
+
+func (s *Srv) DiskUsage(ctx context.Context, in *pb.DiskUsageReq) (*pb.DiskUsageReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.DiskUsageReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	if err := s.buildkitDown(); err != nil {
+		return &pb.DiskUsageReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	staleAfter := time.Duration(in.StaleAfter) * time.Second
+	if staleAfter <= 0 {
+		staleAfter = defaultStaleAfter
+	}
+
+	reply := &pb.DiskUsageReply{
+		DiskFree:  -1,
+		DiskTotal: -1,
+	}
+
+	if root := s.buildkitRoot(); root != "" {
+		free, total, err := diskSpace(root)
+		terror.Ackf(ctx, "diskSpace: %w", err)
+		reply.DiskFree, reply.DiskTotal = free, total
+	}
+
+	for _, a := range s.sortedApps() {
+		size := diskUsage(a.dir)
+		if size < 0 {
+			continue
+		}
+
+		reply.Apps = append(reply.Apps, &pb.AppDiskUsage{
+			App:   a.name,
+			Size:  size,
+			Stale: a.isStale(staleAfter),
+		})
+	}
+
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "client New: %w", err)
+	}
+	defer c.Close()
+
+	usage, err := c.DiskUsage(ctx, client.WithFilter(in.Filters))
+	if err != nil {
+		return &pb.DiskUsageReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	for _, u := range usage {
+		reply.Records = append(reply.Records, cacheRecord(u))
+	}
+
+	return reply, nil
+}
+
+func (s *Srv) Prune(ctx context.Context, in *pb.PruneReq) (*pb.PruneReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.PruneReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	if err := s.buildkitDown(); err != nil {
+		return &pb.PruneReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	staleAfter := time.Duration(in.StaleAfter) * time.Second
+	if staleAfter <= 0 {
+		staleAfter = defaultStaleAfter
+	}
+
+	reply, err := s.prune(ctx, pruneOpts{
+		keepStorage:  in.KeepStorage,
+		keepDuration: time.Duration(in.KeepDuration) * time.Second,
+		filters:      in.Filters,
+		all:          in.All,
+		apps:         in.Apps,
+		staleAfter:   staleAfter,
+	})
+	if err != nil {
+		return &pb.PruneReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,95 @@
+package srv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func TestParseDiskSize(t *testing.T) {
+	const total = 200 * 1024 * 1024 * 1024
+
+	cases := []struct {
+		val   string
+		total int64
+		want  int64
+		err   bool
+	}{
+		{val: "", total: total, want: 0},
+		{val: " 0 ", total: total, want: 0},
+		{val: "10G", total: total, want: 10 * 1024 * 1024 * 1024},
+		{val: "512m", total: total, want: 512 * 1024 * 1024},
+		{val: "10%", total: total, want: total / 10},
+		{val: "100%", total: total, want: total},
+		{val: "0.5%", total: 1000, want: 5},
+		{val: "10%", total: -1, err: true},
+		{val: "0%", total: total, err: true},
+		{val: "101%", total: total, err: true},
+		{val: "ten%", total: total, err: true},
+		{val: "lots", total: total, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseDiskSize(c.val, c.total)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseDiskSize(%q, %d): expected an error, got %d", c.val, c.total, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseDiskSize(%q, %d): %v", c.val, c.total, err)
+		} else if got != c.want {
+			t.Errorf("parseDiskSize(%q, %d) = %d, want %d", c.val, c.total, got, c.want)
+		}
+	}
+}
+
+func TestAppIsStale(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+
+	newApp := func(t *testing.T) *app {
+		dir := t.TempDir()
+		a := &app{dir: dir, srcDir: filepath.Join(dir, "src")}
+		if err := os.Mkdir(a.srcDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{a.dir, a.srcDir} {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return a
+	}
+
+	a := newApp(t)
+	if !a.isStale(24 * time.Hour) {
+		t.Errorf("an app untouched for two days is not stale after a day")
+	}
+	if a.isStale(72 * time.Hour) {
+		t.Errorf("an app untouched for two days is stale after three")
+	}
+
+	a.state = pb.AppState_running
+	if a.isStale(24 * time.Hour) {
+		t.Errorf("a running app is stale")
+	}
+
+	a = newApp(t)
+	a.jobs = []*job{{}}
+	if a.isStale(24 * time.Hour) {
+		t.Errorf("an app with jobs is stale")
+	}
+
+	a = newApp(t)
+	if err := os.WriteFile(a.builtPath(), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if a.isStale(24 * time.Hour) {
+		t.Errorf("a recently built app is stale")
+	}
+}
@@ -0,0 +1,371 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// How many runs of each job have their history and logs kept
+const keepJobRuns = 20
+
+// A job declared in .ayup-conf as AYUP_JOB_<NAME>="<schedule> <command>"
+type job struct {
+	name    string
+	spec    string
+	sched   schedule
+	command string
+}
+
+// jobRun is stored one per line in the job's history file
+type jobRun struct {
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+	ExitCode int32  `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// cutFields splits off the first n whitespace separated fields and returns the rest unchanged
+func cutFields(s string, n int) ([]string, string) {
+	var fields []string
+
+	for len(fields) < n {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			break
+		}
+
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			i = len(s)
+		}
+
+		fields = append(fields, s[:i])
+		s = s[i:]
+	}
+
+	return fields, strings.TrimSpace(s)
+}
+
+func parseJob(key string, val string) (*job, error) {
+	name := strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+	if !appNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid job name: %s", key)
+	}
+
+	fieldCount := 5
+	if strings.HasPrefix(strings.TrimSpace(val), "@") {
+		fieldCount = 1
+	}
+
+	fields, command := cutFields(val, fieldCount)
+	if command == "" {
+		return nil, fmt.Errorf("AYUP_JOB_%s: expected a schedule followed by a command", key)
+	}
+
+	spec := strings.Join(fields, " ")
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, fmt.Errorf("AYUP_JOB_%s: %w", key, err)
+	}
+
+	return &job{
+		name:    name,
+		spec:    spec,
+		sched:   sched,
+		command: command,
+	}, nil
+}
+
+func jobsFromEnv(env map[string]string) ([]*job, error) {
+	var jobs []*job
+
+	for k, v := range env {
+		key, ok := strings.CutPrefix(k, "AYUP_JOB_")
+		if !ok {
+			continue
+		}
+
+		j, err := parseJob(key, v)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].name < jobs[j].name
+	})
+
+	return jobs, nil
+}
+
+func (s *app) jobDir(name string) string {
+	return filepath.Join(s.dir, "jobs", name)
+}
+
+func jobLogPath(dir string, started int64) string {
+	return filepath.Join(dir, strconv.FormatInt(started, 10)+".log")
+}
+
+// readJobRuns returns the job's history, oldest first
+func readJobRuns(dir string) ([]jobRun, error) {
+	f, err := os.Open(filepath.Join(dir, "runs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []jobRun
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var run jobRun
+		if err := json.Unmarshal(lines.Bytes(), &run); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, lines.Err()
+}
+
+// recordJobRun appends to the job's history and deletes the oldest runs over the limit
+func recordJobRun(ctx context.Context, dir string, run jobRun) error {
+	runs, err := readJobRuns(dir)
+	if err != nil {
+		return terror.Errorf(ctx, "readJobRuns: %w", err)
+	}
+	runs = append(runs, run)
+
+	if len(runs) > keepJobRuns {
+		for _, old := range runs[:len(runs)-keepJobRuns] {
+			if err := os.Remove(jobLogPath(dir, old.Started)); err != nil && !os.IsNotExist(err) {
+				terror.Ackf(ctx, "os Remove: %w", err)
+			}
+		}
+		runs = runs[len(runs)-keepJobRuns:]
+	}
+
+	var data []byte
+	for _, r := range runs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return terror.Errorf(ctx, "json Marshal: %w", err)
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "runs"), data, 0600); err != nil {
+		return terror.Errorf(ctx, "os WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Srv) runJob(ctx context.Context, app *app, j *job) {
+	ctx, span := trace.Span(ctx, "job", attribute.String("app", app.name), attribute.String("job", j.name))
+	defer span.End()
+
+	defer func() {
+		app.mutex.Lock()
+		delete(app.runningJobs, j.name)
+		app.mutex.Unlock()
+	}()
+
+	dir := app.jobDir(j.name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		terror.Ackf(ctx, "os MkdirAll: %w", err)
+		return
+	}
+
+	run := jobRun{
+		Started: time.Now().Unix(),
+	}
+
+	logFile, err := os.Create(jobLogPath(dir, run.Started))
+	if err != nil {
+		terror.Ackf(ctx, "os Create: %w", err)
+		return
+	}
+
+	run.ExitCode, err = s.runTask(ctx, app, []string{"sh", "-c", j.command}, logFile, nil, nil)
+	if err != nil {
+		run.Error = err.Error()
+		_, _ = fmt.Fprintf(logFile, "\nError: %v\n", err)
+	}
+	run.Finished = time.Now().Unix()
+
+	terror.Ackf(ctx, "logFile Close: %w", logFile.Close())
+	terror.Ackf(ctx, "recordJobRun: %w", recordJobRun(ctx, dir, run))
+}
+
+// startDueJobs which are scheduled at t, unless the previous run is still going
+func (s *Srv) startDueJobs(ctx context.Context, t time.Time) {
+	if s.shuttingDown.Load() {
+		return
+	}
+
+	s.appsMutex.Lock()
+	apps := make([]*app, 0, len(s.apps))
+	for _, a := range s.apps {
+		apps = append(apps, a)
+	}
+	s.appsMutex.Unlock()
+
+	for _, a := range apps {
+		a.mutex.Lock()
+		for _, j := range a.jobs {
+			if !j.sched.matches(t) {
+				continue
+			}
+
+			if a.runningJobs[j.name] {
+				trace.Event(ctx, "job still running", attribute.String("app", a.name), attribute.String("job", j.name))
+				continue
+			}
+
+			if a.runningJobs == nil {
+				a.runningJobs = make(map[string]bool)
+			}
+			a.runningJobs[j.name] = true
+
+			go s.runJob(ctx, a, j)
+		}
+		a.mutex.Unlock()
+	}
+}
+
+// runScheduler checks for due jobs at the start of each minute until the context is done
+func (s *Srv) runScheduler(ctx context.Context) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		s.startDueJobs(ctx, next)
+	}
+}
+
+func (s *Srv) Jobs(ctx context.Context, in *pb.JobsReq) (*pb.JobsReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.JobsReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	app, err := s.getApp(ctx, in.App)
+	if err != nil {
+		return &pb.JobsReply{Error: &pb.Error{Error: err.Error()}}, nil
+	}
+
+	app.mutex.Lock()
+	jobs := app.jobs
+	running := make(map[string]bool, len(app.runningJobs))
+	for name := range app.runningJobs {
+		running[name] = true
+	}
+	app.mutex.Unlock()
+
+	reply := &pb.JobsReply{}
+	for _, j := range jobs {
+		runs, err := readJobRuns(app.jobDir(j.name))
+		if err != nil {
+			return nil, terror.Errorf(ctx, "readJobRuns: %w", err)
+		}
+
+		pj := &pb.Job{
+			Name:     j.name,
+			Schedule: j.spec,
+			Command:  j.command,
+			Running:  running[j.name],
+		}
+
+		for i := len(runs) - 1; i >= 0; i-- {
+			pj.Runs = append(pj.Runs, &pb.JobRun{
+				Started:  runs[i].Started,
+				Finished: runs[i].Finished,
+				ExitCode: runs[i].ExitCode,
+				Error:    runs[i].Error,
+			})
+		}
+
+		reply.Jobs = append(reply.Jobs, pj)
+	}
+
+	return reply, nil
+}
+
+func (s *Srv) JobLog(ctx context.Context, in *pb.JobLogReq) (*pb.JobLogReply, error) {
+	replyError := func(msgf string, args ...any) (*pb.JobLogReply, error) {
+		return &pb.JobLogReply{
+			Error: &pb.Error{
+				Error: fmt.Sprintf(msgf, args...),
+			},
+		}, nil
+	}
+
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return replyError("Not authorized")
+	}
+
+	app, err := s.getApp(ctx, in.App)
+	if err != nil {
+		return replyError("%v", err)
+	}
+
+	if !appNameRegex.MatchString(in.Job) {
+		return replyError("invalid job name: %s", in.Job)
+	}
+
+	dir := app.jobDir(in.Job)
+	runs, err := readJobRuns(dir)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "readJobRuns: %w", err)
+	}
+
+	if int(in.Run) >= len(runs) {
+		return replyError("job %s has %d runs recorded", in.Job, len(runs))
+	}
+
+	run := runs[len(runs)-1-int(in.Run)]
+	log, err := os.ReadFile(jobLogPath(dir, run.Started))
+	if err != nil {
+		return nil, terror.Errorf(ctx, "os ReadFile: %w", err)
+	}
+
+	return &pb.JobLogReply{
+		Log: log,
+	}, nil
+}
@@ -3,14 +3,19 @@ package srv
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
 	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/host"
 	p2pPeer "github.com/libp2p/go-libp2p/core/peer"
 
 	"google.golang.org/grpc"
@@ -32,28 +37,74 @@ import (
 	tr "go.opentelemetry.io/otel/trace"
 )
 
-type Push struct {
-	hasAssistant bool
-
-	analysis *pb.AnalysisResult
-}
-
 type Srv struct {
 	pb.UnimplementedSrvServer
 
-	AssistantDir string
-	SrcDir       string
+	// Each app's source, assistant, build info and job history are kept in a sub directory of this
+	AppsDir string
+	// Secrets such as registry credentials, only the daemon's user can read them
+	SecretsDir string
 
 	Host             string
 	P2pPrivKey       string
 	P2pAuthedClients []p2pPeer.ID
 
+	// The address of an existing buildkitd to use instead of starting one in rootlesskit
 	BuildkitdAddr string
 
+	Version string
+	// Print the output of rootlesskit, the rootless helper and buildkitd
+	Verbose bool
+	// Where Prometheus metrics are served, empty to not serve them
+	MetricsAddr string
+	// Where the HTTP/JSON API is served, empty to not serve it
+	ApiAddr string
+	// The peer each API bearer token acts as, keyed by the token's hash
+	ApiTokens map[string]p2pPeer.ID
+	// Where the web dashboard is served, empty to not serve it. It is logged into with an API token.
+	DashboardAddr string
+	// Where events are posted, each request is signed with the secret
+	Webhooks      []Webhook
+	WebhookSecret string
+	// Registry hosts that images are published to over plain HTTP
+	InsecureRegistries []string
+	// Tried after the built in detectors to find out how to build each app, see ParseDetectors
+	Detectors []Detector
+
+	// Default resource limits for apps, these can be overridden in an app's .ayup-conf
+	AppLimits Limits
+	// How long apps have to exit after SIGTERM before they are killed
+	StopGracePeriod time.Duration
+	// When Buildkit's cache and stale apps are pruned automatically
+	GC GCPolicy
+
 	inrClient inrPb.InRootlessClient
 
-	// Instance of a push, here while we don't have apps, users, sessions etc.
-	push Push
+	shutdown     func()
+	shuttingDown atomic.Bool
+	restarting   atomic.Bool
+	// Numbers the choices sent to clients, so an answer can't be taken for a later choice's
+	choiceSeq atomic.Uint32
+
+	startedAt time.Time
+	netMode   string
+	p2pHost   host.Host
+
+	sessionsMutex sync.Mutex
+	sessions      map[*rpcSession]struct{}
+
+	appsMutex sync.Mutex
+	apps      map[string]*app
+
+	buildkitMutex sync.Mutex
+	buildkit      buildkitState
+
+	events eventBus
+
+	actSessionsMutex sync.Mutex
+	actSessions      map[string]*actSession
+
+	dashSessions dashSessions
 
 	tuiMutex sync.Mutex
 }
@@ -125,11 +176,9 @@ func (s *Srv) checkPeerAuth(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
-func (s *Srv) runRootlessBuildkit(ctx context.Context, selfExe string) (tr.Span, chan<- proc.In, <-chan proc.Out) {
+func (s *Srv) runRootlessBuildkit(ctx context.Context, selfExe string, log io.Writer) (tr.Span, chan<- proc.In, <-chan proc.Out) {
 	ctx, span := trace.Span(ctx, "start buildkit")
 
-	s.BuildkitdAddr = "unix://" + filepath.Join(conf.UserRuntimeDir(), "buildkit", "buildkit.sock")
-
 	cmdArgs := []string{
 		"--port-driver=builtin",
 		"--net=slirp4netns",
@@ -138,6 +187,10 @@ func (s *Srv) runRootlessBuildkit(ctx context.Context, selfExe string) (tr.Span,
 		"--copy-up=/var/lib/cni",
 		"--disable-host-loopback",
 		"--detach-netns",
+		// Allows us to set resource limits on apps using cgroup v2 delegation
+		"--pidns",
+		"--cgroupns",
+		"--evacuate-cgroup2=ayup",
 
 		selfExe, "daemon", "start-in-rootless",
 
@@ -152,8 +205,10 @@ func (s *Srv) runRootlessBuildkit(ctx context.Context, selfExe string) (tr.Span,
 	}
 
 	cmd := exec.Command("rootlesskit", cmdArgs...)
+	// Stop Ctrl-C reaching buildkit before the apps running in it have been stopped
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	pi, po := proc.Start(ctx, cmd)
+	pi, po := proc.StartWithLog(ctx, cmd, log)
 
 	return span, pi, po
 }
@@ -165,13 +220,45 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 
 	ctx, stopSigFunc := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stopSigFunc()
+	s.shutdown = stopSigFunc
+	s.startedAt = time.Now()
+
+	if len(s.Webhooks) > 0 && s.WebhookSecret == "" {
+		return fmt.Errorf("webhooks need a secret to sign their requests with")
+	}
+
+	if s.GC.Schedule != "" {
+		if _, err := parseSchedule(s.GC.Schedule); err != nil {
+			return fmt.Errorf("GC schedule: %w", err)
+		}
+	}
 
 	selfExe, err := os.Executable()
 	if err != nil {
 		return terror.Errorf(ctx, "os Executable: %w", err)
 	}
 
-	buildkitSpan, _, buildkitOut := s.runRootlessBuildkit(ctx, selfExe)
+	// Buildkit is stopped after the apps, which run inside it
+	buildkitCtx, stopBuildkit := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopBuildkit()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	rootless := s.BuildkitdAddr == ""
+	s.initBuildkitState(!rootless)
+	if rootless {
+		s.BuildkitdAddr = "unix://" + filepath.Join(conf.UserRuntimeDir(), "buildkit", "buildkit.sock")
+		s.netMode = "slirp4netns, builtin port driver, detached netns"
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.superviseBuildkit(buildkitCtx, selfExe)
+		}()
+	} else {
+		s.netMode = "external buildkitd, container addresses dialed directly"
+	}
 
 	privKey, err := rpc.EnsurePrivKey(ctx, "AYUP_SERVER_P2P_PRIV_KEY", s.P2pPrivKey)
 	if err != nil {
@@ -187,6 +274,7 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 	if err != nil {
 		return terror.Errorf(ctx, "listen: %w", err)
 	}
+	s.p2pHost = host
 
 	if host != nil {
 		for _, maddr := range host.Addrs() {
@@ -210,52 +298,103 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 				otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
 			),
 		),
+		grpc.ChainUnaryInterceptor(s.observeUnary),
+		grpc.ChainStreamInterceptor(s.observeStream, s.trackSession),
 	)
 	pb.RegisterSrvServer(srv, s)
 	span.AddEvent("Listening")
 
-	inrConn, err := grpc.NewClient("unix://"+conf.InrootlessAddr(),
-		grpc.WithStatsHandler(
-			otelgrpc.NewClientHandler(
-				otelgrpc.WithTracerProvider(span.TracerProvider()),
-				otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
+	if rootless {
+		inrConn, err := grpc.NewClient("unix://"+conf.InrootlessAddr(),
+			grpc.WithStatsHandler(
+				otelgrpc.NewClientHandler(
+					otelgrpc.WithTracerProvider(span.TracerProvider()),
+					otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
+				),
 			),
-		),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
-	if err != nil {
-		return terror.Errorf(ctx, "grpc NewClient: %w", err)
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return terror.Errorf(ctx, "grpc NewClient: %w", err)
+		}
+
+		s.inrClient = inrPb.NewInRootlessClient(inrConn)
 	}
 
-	s.inrClient = inrPb.NewInRootlessClient(inrConn)
+	if err := s.loadApps(ctx); err != nil {
+		return err
+	}
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	// The supervisor decides when rootless Buildkit is ready, builds and restarting apps wait on it
+	if !rootless {
+		if _, err := s.buildkitWorkers(ctx); err != nil {
+			// It may still be starting, so this isn't fatal
+			fmt.Println(tui.ErrorStyle.Render("Buildkitd Error!"), err)
+		} else {
+			fmt.Println(titleStyle.Render("Using buildkitd:"), s.BuildkitdAddr)
+		}
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	// Apps started by the daemon must outlive the signal so they can be given their grace period
+	go s.restartApps(context.WithoutCancel(ctx))
+	go s.runScheduler(ctx)
+	go s.runGC(ctx)
+	if s.MetricsAddr != "" {
+		go s.serveMetrics(ctx, s.MetricsAddr)
+	}
+	for _, hook := range s.Webhooks {
+		go s.runWebhook(ctx, hook)
+	}
 
-		for pout := range buildkitOut {
-			if pout.Err != nil {
-				s.tuiMutex.Lock()
-				fmt.Println(tui.ErrorStyle.Render("Buildkitd Error!"), pout.Err)
-				s.tuiMutex.Unlock()
-			}
-		}
+	proxy := s.newProxy(ctx)
+	go s.serveProxy(ctx, proxy, proxyAddr)
 
-		buildkitSpan.End()
-		stopSigFunc()
-	}()
+	var api *fiber.App
+	if s.ApiAddr != "" {
+		api = s.newApi(ctx)
+		go s.serveApi(ctx, api, s.ApiAddr)
+	}
 
-	if _, err := s.inrClient.Ping(ctx, &inrPb.PingRequest{}, grpc.WaitForReady(true)); err != nil {
-		return terror.Errorf(ctx, "inrClient Ping: %w", err)
+	var dash *fiber.App
+	if s.DashboardAddr != "" {
+		dash = s.newDashboard(ctx)
+		go s.serveDashboard(ctx, dash, s.DashboardAddr)
 	}
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		<-ctx.Done()
 
-		srv.GracefulStop()
+		s.shuttingDown.Store(true)
+		s.tuiMutex.Lock()
+		fmt.Println(titleStyle.Render("Shutting down:"), "stopping apps")
+		s.tuiMutex.Unlock()
+
+		s.stopApps(context.WithoutCancel(ctx))
+
+		terror.Ackf(ctx, "proxy ShutdownWithTimeout: %w", proxy.ShutdownWithTimeout(10*time.Second))
+		if api != nil {
+			terror.Ackf(ctx, "api ShutdownWithTimeout: %w", api.ShutdownWithTimeout(10*time.Second))
+		}
+		if dash != nil {
+			terror.Ackf(ctx, "dashboard ShutdownWithTimeout: %w", dash.ShutdownWithTimeout(10*time.Second))
+		}
+
+		// Streams such as tasks and port forwarding may not end by themselves
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			srv.Stop()
+		}
+
+		stopBuildkit()
 	}()
 
 	if err := srv.Serve(lis); err != nil {
@@ -263,5 +402,9 @@ func (s *Srv) RunServer(pctx context.Context) (err error) {
 		return terror.Errorf(ctx, "serve: %w", err)
 	}
 
+	if s.restarting.Load() {
+		return ErrRestart
+	}
+
 	return nil
 }
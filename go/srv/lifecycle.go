@@ -0,0 +1,317 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	solverPb "github.com/moby/buildkit/solver/pb"
+	"go.opentelemetry.io/otel/attribute"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// ErrRestart is returned by RunServer when a client asked for the daemon to be restarted
+var ErrRestart = errors.New("restart requested")
+
+// How long an app started by the daemon has to build and start before its dependents are started
+// anyway
+const startTimeout = 5 * time.Minute
+
+// The names of the apps which were running when the daemon last stopped, one per line
+func (s *Srv) runningAppsPath() string {
+	return filepath.Join(s.AppsDir, "running")
+}
+
+// startApp builds and runs the app from its last build without a client attached. Logs are
+// written to the app's directory. Returns once the app is running or has failed to start.
+func (s *Srv) startApp(ctx context.Context, app *app) error {
+	ctx, span := trace.Span(ctx, "start app", attribute.String("app", app.name))
+	defer span.End()
+
+	built := app.lastBuilt()
+	if built == nil {
+		return errNotBuilt
+	}
+
+	if err := s.buildkitDown(); err != nil {
+		return err
+	}
+
+	if !app.actMutex.TryLock() {
+		return terror.Errorf(ctx, "app is busy: %s", app.name)
+	}
+
+	logFile, err := os.Create(filepath.Join(app.dir, "log"))
+	if err != nil {
+		app.actMutex.Unlock()
+		return terror.Errorf(ctx, "os Create: %w", err)
+	}
+
+	actx := aCtx{
+		ctx:       ctx,
+		sendMutex: &sync.Mutex{},
+		srv:       s,
+		app:       app,
+		appLog:    logFile,
+	}
+
+	app.setState(pb.AppState_building, 0)
+	s.emit(ctx, &pb.Event{Type: pb.EventType_buildStarted, App: app.name})
+	started := make(chan struct{})
+	markStarted := sync.OnceFunc(func() { close(started) })
+
+	// Once the process is started, pushing a new version can stop it
+	unlock := sync.OnceFunc(app.actMutex.Unlock)
+	actx.onStarted = func() {
+		unlock()
+		markStarted()
+	}
+
+	go func() {
+		defer func() {
+			terror.Ackf(ctx, "logFile Close: %w", logFile.Close())
+		}()
+
+		err := s.buildAndExec(actx, built)
+		unlock()
+
+		app.mutex.Lock()
+		if app.state == pb.AppState_building {
+			app.state = pb.AppState_failed
+			s.emit(ctx, &pb.Event{Type: pb.EventType_buildFinished, App: app.name})
+		}
+		app.mutex.Unlock()
+
+		if err != nil {
+			_ = actx.sendError("Failed to start app: %w", err)
+		}
+
+		markStarted()
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(startTimeout):
+		trace.Event(ctx, "timed out waiting for app to start")
+	}
+
+	return nil
+}
+
+func (s *Srv) buildAndExec(actx aCtx, built *pb.AnalysisResult) error {
+	ctx := actx.ctx
+	app := actx.app
+
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return terror.Errorf(ctx, "client New: %w", err)
+	}
+
+	localMounts, err := app.builtMounts(built)
+	if err != nil {
+		return terror.Errorf(ctx, "builtMounts: %w", err)
+	}
+
+	b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		started := time.Now()
+		app.builtMutex.RLock()
+		r, err := solveBuilt(ctx, c, built, "start")
+		app.builtMutex.RUnlock()
+		actx.recordBuild("start", started, err)
+		if err != nil {
+			return nil, err
+		}
+
+		ctr, err := c.NewContainer(ctx, gateway.NewContainerRequest{
+			Hostname: "app",
+			Mounts: []gateway.Mount{
+				{
+					Dest:      "/",
+					MountType: solverPb.MountType_BIND,
+					Ref:       r.Ref,
+				},
+			},
+		})
+		if err != nil {
+			return nil, terror.Errorf(ctx, "gateway client NewContainer: %w", err)
+		}
+		defer func() { terror.Ackf(ctx, "ctr Release: %w", ctr.Release(ctx)) }()
+
+		if err := actx.execProcess(ctr, nil, "app", nil); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}
+
+	statusChan := actx.buildkitStatusSender("build", nil)
+	if _, err := c.Build(ctx, client.SolveOpt{
+		LocalMounts: localMounts,
+	}, "ayup", b, statusChan); err != nil {
+		return terror.Errorf(ctx, "client Build: %w", err)
+	}
+
+	return nil
+}
+
+// startOrder sorts the apps so that each comes after the apps it depends on. Dependencies which
+// are not in the list are ignored and cycles are broken arbitrarily.
+func startOrder(ctx context.Context, apps []*app) []*app {
+	byName := make(map[string]*app, len(apps))
+	for _, a := range apps {
+		byName[a.name] = a
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].name < apps[j].name
+	})
+
+	visited := make(map[string]bool, len(apps))
+	var order []*app
+
+	var visit func(a *app, path []string)
+	visit = func(a *app, path []string) {
+		if visited[a.name] {
+			return
+		}
+
+		for _, p := range path {
+			if p == a.name {
+				trace.Event(ctx, "dependency cycle", attribute.StringSlice("path", path))
+				return
+			}
+		}
+
+		a.mutex.Lock()
+		deps := a.dependsOn
+		a.mutex.Unlock()
+
+		for _, dep := range deps {
+			if d, ok := byName[dep]; ok {
+				visit(d, append(path, a.name))
+			}
+		}
+
+		if !visited[a.name] {
+			visited[a.name] = true
+			order = append(order, a)
+		}
+	}
+
+	for _, a := range apps {
+		visit(a, nil)
+	}
+
+	return order
+}
+
+// restartApps which were running when the daemon last stopped
+func (s *Srv) restartApps(ctx context.Context) {
+	ctx, span := trace.Span(ctx, "restart apps")
+	defer span.End()
+
+	data, err := os.ReadFile(s.runningAppsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			terror.Ackf(ctx, "os ReadFile: %w", err)
+		}
+		return
+	}
+
+	if err := s.waitBuildkit(ctx, startTimeout); err != nil {
+		terror.Ackf(ctx, "waitBuildkit: %w", err)
+		return
+	}
+
+	var apps []*app
+	for _, name := range strings.Fields(string(data)) {
+		a, err := s.getApp(ctx, name)
+		if err != nil {
+			terror.Ackf(ctx, "getApp: %w", err)
+			continue
+		}
+
+		apps = append(apps, a)
+	}
+
+	for _, a := range startOrder(ctx, apps) {
+		if s.shuttingDown.Load() {
+			return
+		}
+
+		terror.Ackf(ctx, "startApp: %w", s.startApp(ctx, a))
+	}
+
+	terror.Ackf(ctx, "os Remove: %w", os.Remove(s.runningAppsPath()))
+}
+
+// stopApps gives each running app its grace period to exit after recording which were running
+// so that they can be started again
+func (s *Srv) stopApps(ctx context.Context) {
+	ctx, span := trace.Span(ctx, "stop apps")
+	defer span.End()
+
+	s.appsMutex.Lock()
+	var running []*app
+	var names []string
+	for _, a := range s.apps {
+		a.mutex.Lock()
+		if a.state == pb.AppState_running {
+			running = append(running, a)
+			names = append(names, a.name)
+		}
+		a.mutex.Unlock()
+	}
+	s.appsMutex.Unlock()
+
+	sort.Strings(names)
+	trace.Event(ctx, "running apps", attribute.StringSlice("names", names))
+
+	if len(names) > 0 {
+		data := []byte(strings.Join(names, "\n") + "\n")
+		terror.Ackf(ctx, "os WriteFile: %w", os.WriteFile(s.runningAppsPath(), data, 0600))
+	} else if err := os.Remove(s.runningAppsPath()); err != nil && !os.IsNotExist(err) {
+		terror.Ackf(ctx, "os Remove: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, a := range running {
+		wg.Add(1)
+		go func(a *app) {
+			defer wg.Done()
+			a.stopWithGrace(ctx, "The daemon is shutting down")
+		}(a)
+	}
+	wg.Wait()
+}
+
+// Restart stops the apps and then the daemon, which starts itself again with the same arguments
+func (s *Srv) Restart(ctx context.Context, in *pb.RestartReq) (*pb.RestartReply, error) {
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return nil, terror.Errorf(ctx, "checkPeerAuth: %w", err)
+		}
+
+		return &pb.RestartReply{
+			Error: &pb.Error{
+				Error: "Not authorized",
+			},
+		}, nil
+	}
+
+	trace.Event(ctx, "restart requested")
+	s.restarting.Store(true)
+	s.shutdown()
+
+	return &pb.RestartReply{}, nil
+}
@@ -0,0 +1,67 @@
+package srv
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestStartOrder(t *testing.T) {
+	cases := []struct {
+		name string
+		deps map[string][]string
+		want []string
+	}{
+		{
+			name: "independent",
+			deps: map[string][]string{"web": nil, "db": nil, "api": nil},
+			want: []string{"api", "db", "web"},
+		},
+		{
+			name: "chain",
+			deps: map[string][]string{"web": {"api"}, "api": {"db"}, "db": nil},
+			want: []string{"db", "api", "web"},
+		},
+		{
+			name: "diamond",
+			deps: map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil},
+			want: []string{"d", "b", "c", "a"},
+		},
+		{
+			name: "missing dependency",
+			deps: map[string][]string{"web": {"cache", "db"}, "db": nil},
+			want: []string{"db", "web"},
+		},
+		{
+			name: "cycle",
+			deps: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "self",
+			deps: map[string][]string{"a": {"a"}, "b": {"a"}},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "cycle with dependent",
+			deps: map[string][]string{"web": {"a"}, "a": {"b"}, "b": {"a"}},
+			want: []string{"b", "a", "web"},
+		},
+	}
+
+	for _, c := range cases {
+		var apps []*app
+		for name, deps := range c.deps {
+			apps = append(apps, &app{name: name, dependsOn: deps})
+		}
+
+		var got []string
+		for _, a := range startOrder(context.Background(), apps) {
+			got = append(got, a.name)
+		}
+
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package srv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+
+	inrPb "premai.io/Ayup/go/internal/grpc/inrootless"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+)
+
+// Limits on an app's resources as given by the user. Zero values mean no limit, or when merging,
+// use the default.
+type Limits struct {
+	// A size such as 512M or a percentage of the system's memory such as 75%
+	MemoryMax string
+	// CPU quota in cores
+	Cpus float64
+	// Relative CPU weight between 1 and 10000
+	CpuWeight uint64
+	PidsMax   int64
+}
+
+const cpuPeriod = 100000
+
+func limitsFromEnv(env map[string]string) (Limits, error) {
+	var l Limits
+	var err error
+
+	l.MemoryMax = env["AYUP_MEMORY_MAX"]
+
+	if v, ok := env["AYUP_CPUS"]; ok {
+		if l.Cpus, err = strconv.ParseFloat(v, 64); err != nil {
+			return l, fmt.Errorf("AYUP_CPUS: %w", err)
+		}
+	}
+
+	if v, ok := env["AYUP_CPU_WEIGHT"]; ok {
+		if l.CpuWeight, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return l, fmt.Errorf("AYUP_CPU_WEIGHT: %w", err)
+		}
+	}
+
+	if v, ok := env["AYUP_PIDS_MAX"]; ok {
+		if l.PidsMax, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return l, fmt.Errorf("AYUP_PIDS_MAX: %w", err)
+		}
+	}
+
+	return l, nil
+}
+
+// merge returns the limits with any non-zero values from o replacing them
+func (s Limits) merge(o Limits) Limits {
+	if o.MemoryMax != "" {
+		s.MemoryMax = o.MemoryMax
+	}
+	if o.Cpus != 0 {
+		s.Cpus = o.Cpus
+	}
+	if o.CpuWeight != 0 {
+		s.CpuWeight = o.CpuWeight
+	}
+	if o.PidsMax != 0 {
+		s.PidsMax = o.PidsMax
+	}
+
+	return s
+}
+
+func parseMemory(ctx context.Context, val string) (int64, error) {
+	val = strings.TrimSpace(val)
+
+	switch val {
+	case "", "0", "max":
+		return 0, nil
+	}
+
+	if pctStr, ok := strings.CutSuffix(val, "%"); ok {
+		pct, err := strconv.ParseFloat(pctStr, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("memory percentage must be between 0 and 100: %s", val)
+		}
+
+		var info syscall.Sysinfo_t
+		if err := syscall.Sysinfo(&info); err != nil {
+			return 0, terror.Errorf(ctx, "syscall Sysinfo: %w", err)
+		}
+
+		total := float64(info.Totalram) * float64(info.Unit)
+		return int64(total * pct / 100), nil
+	}
+
+	bytes, err := units.RAMInBytes(val)
+	if err != nil {
+		return 0, fmt.Errorf("memory size: %w", err)
+	}
+
+	return bytes, nil
+}
+
+func (s Limits) resolve(ctx context.Context) (*pb.Limits, error) {
+	memoryMax, err := parseMemory(ctx, s.MemoryMax)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Cpus < 0 {
+		return nil, fmt.Errorf("cpus can not be negative: %f", s.Cpus)
+	}
+
+	if s.CpuWeight > 10000 {
+		return nil, fmt.Errorf("cpu weight must be between 1 and 10000: %d", s.CpuWeight)
+	}
+
+	return &pb.Limits{
+		MemoryMax: memoryMax,
+		Cpus:      s.Cpus,
+		CpuWeight: s.CpuWeight,
+		PidsMax:   s.PidsMax,
+	}, nil
+}
+
+func hasLimits(l *pb.Limits) bool {
+	return l.MemoryMax > 0 || l.Cpus > 0 || l.CpuWeight > 0 || l.PidsMax > 0
+}
+
+func limitRequest(app string, l *pb.Limits) *inrPb.LimitRequest {
+	req := &inrPb.LimitRequest{
+		App:       app,
+		MemoryMax: l.MemoryMax,
+		CpuWeight: l.CpuWeight,
+		PidsMax:   l.PidsMax,
+	}
+
+	if l.Cpus > 0 {
+		req.CpuQuota = int64(l.Cpus * cpuPeriod)
+		req.CpuPeriod = cpuPeriod
+	}
+
+	return req
+}
+
+func fmtLimits(l *pb.Limits) string {
+	if l == nil || !hasLimits(l) {
+		return "none"
+	}
+
+	var parts []string
+	if l.MemoryMax > 0 {
+		parts = append(parts, "memory "+units.BytesSize(float64(l.MemoryMax)))
+	}
+	if l.Cpus > 0 {
+		parts = append(parts, fmt.Sprintf("cpus %g", l.Cpus))
+	}
+	if l.CpuWeight > 0 {
+		parts = append(parts, fmt.Sprintf("cpu weight %d", l.CpuWeight))
+	}
+	if l.PidsMax > 0 {
+		parts = append(parts, fmt.Sprintf("pids %d", l.PidsMax))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// gateScript holds the app's process until the rootless helper has put it in the app's cgroup,
+// or the daemon has found its address, then replaces itself with the app. It is a shell script
+// so that it doesn't depend on what the image was built with. The token is the script's $0.
+const gateScript = `read -r gate; exec "$@"`
+
+// appGate is the stdin of the app's gated process and the token which identifies it
+type appGate struct {
+	token string
+	stdin *os.File
+	open  *os.File
+}
+
+func newAppGate() (*appGate, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("rand Read: %w", err)
+	}
+
+	// A pipe's buffer means opening the gate doesn't wait on the process
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("os Pipe: %w", err)
+	}
+
+	return &appGate{
+		token: "ayup-gate-" + hex.EncodeToString(nonce[:]),
+		stdin: r,
+		open:  w,
+	}, nil
+}
+
+func (s *appGate) args(args []string) []string {
+	return append([]string{"/bin/sh", "-c", gateScript, s.token}, args...)
+}
+
+// release lets the app run, its stdin is at EOF after that
+func (s *appGate) release() error {
+	if _, err := s.open.WriteString("\n"); err != nil {
+		return fmt.Errorf("gate write: %w", err)
+	}
+
+	return s.open.Close()
+}
+
+// close the gate once the app has exited
+func (s *appGate) close() {
+	_ = s.open.Close()
+	_ = s.stdin.Close()
+}
@@ -0,0 +1,197 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"runtime"
+	"slices"
+	"testing"
+
+	"premai.io/Ayup/go/internal/proc"
+)
+
+func TestParseMemory(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		val  string
+		want int64
+		err  bool
+	}{
+		{val: "", want: 0},
+		{val: "0", want: 0},
+		{val: "max", want: 0},
+		{val: " 512M ", want: 512 * 1024 * 1024},
+		{val: "2G", want: 2 * 1024 * 1024 * 1024},
+		{val: "1024", want: 1024},
+		{val: "0%", err: true},
+		{val: "101%", err: true},
+		{val: "x%", err: true},
+		{val: "lots", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseMemory(ctx, c.val)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseMemory(%q): expected an error, got %d", c.val, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseMemory(%q): %v", c.val, err)
+		} else if got != c.want {
+			t.Errorf("parseMemory(%q) = %d, want %d", c.val, got, c.want)
+		}
+	}
+
+	// A percentage depends on the machine, so only check it's in proportion
+	half, err := parseMemory(ctx, "50%")
+	if err != nil {
+		t.Fatalf("parseMemory(50%%): %v", err)
+	}
+	all, err := parseMemory(ctx, "100%")
+	if err != nil {
+		t.Fatalf("parseMemory(100%%): %v", err)
+	}
+	if half <= 0 || all-2*half > 1 || 2*half-all > 1 {
+		t.Errorf("50%% = %d is not half of 100%% = %d", half, all)
+	}
+}
+
+func TestLimitsFromEnv(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		want Limits
+		err  bool
+	}{
+		{name: "empty", env: map[string]string{}, want: Limits{}},
+		{
+			name: "all",
+			env: map[string]string{
+				"AYUP_MEMORY_MAX": "2G",
+				"AYUP_CPUS":       "1.5",
+				"AYUP_CPU_WEIGHT": "100",
+				"AYUP_PIDS_MAX":   "512",
+				"OTHER":           "ignored",
+			},
+			want: Limits{MemoryMax: "2G", Cpus: 1.5, CpuWeight: 100, PidsMax: 512},
+		},
+		{name: "bad cpus", env: map[string]string{"AYUP_CPUS": "one"}, err: true},
+		{name: "negative weight", env: map[string]string{"AYUP_CPU_WEIGHT": "-1"}, err: true},
+		{name: "bad pids", env: map[string]string{"AYUP_PIDS_MAX": "1.5"}, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := limitsFromEnv(c.env)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLimitsMerge(t *testing.T) {
+	defaults := Limits{MemoryMax: "75%", CpuWeight: 100, PidsMax: 4096}
+
+	cases := []struct {
+		name     string
+		override Limits
+		want     Limits
+	}{
+		{name: "nothing", override: Limits{}, want: defaults},
+		{
+			name:     "some",
+			override: Limits{MemoryMax: "1G", Cpus: 2},
+			want:     Limits{MemoryMax: "1G", Cpus: 2, CpuWeight: 100, PidsMax: 4096},
+		},
+		{
+			name:     "all",
+			override: Limits{MemoryMax: "1G", Cpus: 0.5, CpuWeight: 10, PidsMax: 64},
+			want:     Limits{MemoryMax: "1G", Cpus: 0.5, CpuWeight: 10, PidsMax: 64},
+		},
+	}
+
+	for _, c := range cases {
+		if got := defaults.merge(c.override); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAppGateArgs(t *testing.T) {
+	gate, err := newAppGate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gate.close()
+
+	other, err := newAppGate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+
+	if gate.token == other.token {
+		t.Errorf("gates share a token: %s", gate.token)
+	}
+
+	args := gate.args([]string{"python", "__main__.py"})
+	want := []string{"/bin/sh", "-c", gateScript, gate.token, "python", "__main__.py"}
+	if !slices.Equal(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+}
+
+func TestAppGateRunsNonPython(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("gated processes are found in /proc")
+	}
+
+	gate, err := newAppGate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gate.close()
+
+	// e.g. the CMD of a Dockerfile or exec detector's image, which may not have Python
+	args := gate.args([]string{"echo", "started", "$HOME"})
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = gate.stdin
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	pid, err := proc.WaitGated(context.Background(), gate.token)
+	if err != nil {
+		t.Fatal(err)
+	} else if pid != cmd.Process.Pid {
+		t.Errorf("got pid %d, want %d", pid, cmd.Process.Pid)
+	}
+	if out.Len() != 0 {
+		t.Errorf("the app ran before the gate was released: %q", out.String())
+	}
+
+	if err := gate.release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "started $HOME\n" {
+		t.Errorf("got %q", got)
+	}
+}
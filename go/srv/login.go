@@ -73,6 +73,7 @@ func (s *Srv) Login(ctx context.Context, in *pb.LoginReq) (*pb.LoginReply, error
 	s.P2pAuthedClients = append(s.P2pAuthedClients, peerId)
 
 	_ = conf.Append(ctx, "AYUP_P2P_AUTHORIZED_CLIENTS", peerId.String())
+	s.emit(ctx, &pb.Event{Type: pb.EventType_clientAuthorized})
 
 	return &pb.LoginReply{}, nil
 }
@@ -0,0 +1,197 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Metrics are always collected, but only served if the daemon has a metrics address
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_rpc_requests_total",
+		Help: "RPCs handled by the daemon by method and gRPC status code",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ayup_rpc_duration_seconds",
+		Help:    "How long RPCs took to handle, streams last as long as the client is connected",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"method"})
+
+	uploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ayup_upload_bytes_total",
+		Help: "Bytes of app source received",
+	})
+	uploadFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ayup_upload_files_total",
+		Help: "Files of app source received",
+	})
+
+	buildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ayup_build_duration_seconds",
+		Help:    "How long Buildkit builds took by what they were for and whether they succeeded",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"kind", "result"})
+	buildVertexes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_build_vertexes_total",
+		Help: "Completed build steps by whether they were cached, the cache hit ratio is cached=true over all",
+	}, []string{"cached"})
+
+	forwardsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ayup_forwards_active",
+		Help: "Port forwarding connections in progress",
+	})
+	forwardBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_forward_bytes_total",
+		Help: "Bytes port forwarded by direction, ingress is from the client to the app",
+	}, []string{"direction"})
+
+	appStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_app_starts_total",
+		Help: "Times each app's process was started, including when the daemon restarts it",
+	}, []string{"app"})
+	appExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_app_exits_total",
+		Help: "Times each app's process ended by the state it ended in",
+	}, []string{"app", "state"})
+	appHealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_app_health_checks_total",
+		Help: "Results of each app's health check, it passes by running for 30s after starting and fails by exiting before then",
+	}, []string{"app", "result"})
+	appHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ayup_app_healthy",
+		Help: "1 while the app is running and has passed its health check",
+	}, []string{"app"})
+
+	buildkitUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ayup_buildkit_up",
+		Help: "1 if Buildkit is running and ready for builds",
+	})
+	buildkitRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ayup_buildkit_restarts_total",
+		Help: "Times the supervisor has had to start Buildkit again after it exited",
+	})
+
+	proxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ayup_proxy_requests_total",
+		Help: "HTTP requests proxied to each app by status code",
+	}, []string{"app", "code"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcRequests, rpcDuration,
+		uploadBytes, uploadFiles,
+		buildDuration, buildVertexes,
+		forwardsActive, forwardBytes,
+		appStarts, appExits, appHealthChecks, appHealthy,
+		buildkitUp, buildkitRestarts,
+		proxyRequests,
+	)
+}
+
+func observeRpc(fullMethod string, started time.Time, err error) {
+	method := filepath.Base(fullMethod)
+
+	rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	rpcDuration.WithLabelValues(method).Observe(time.Since(started).Seconds())
+}
+
+func (s *Srv) observeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	started := time.Now()
+	res, err := handler(ctx, req)
+	observeRpc(info.FullMethod, started, err)
+
+	return res, err
+}
+
+func (s *Srv) observeStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	started := time.Now()
+	err := handler(srv, stream)
+	observeRpc(info.FullMethod, started, err)
+
+	return err
+}
+
+func observeChunks(chunks *pb.FileChunks) {
+	for _, chunk := range chunks.GetChunk() {
+		uploadBytes.Add(float64(len(chunk.Data)))
+		if chunk.Last {
+			uploadFiles.Inc()
+		}
+	}
+}
+
+// observeBuild records the duration of a build started at started, kind is what it was for e.g.
+// app or task
+func observeBuild(kind string, started time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	buildDuration.WithLabelValues(kind, result).Observe(time.Since(started).Seconds())
+}
+
+// observeAppHealth records the result of an app's health check and whether it is now healthy
+func observeAppHealth(app string, passed bool) {
+	result, healthy := "fail", 0.0
+	if passed {
+		result, healthy = "pass", 1
+	}
+
+	appHealthChecks.WithLabelValues(app, result).Inc()
+	appHealthy.WithLabelValues(app).Set(healthy)
+}
+
+// observeVertex counts a build step the first time it is seen to be complete
+func observeVertex(vert *client.Vertex, completed map[string]bool) {
+	if vert.Completed == nil || completed[vert.Digest.String()] {
+		return
+	}
+	completed[vert.Digest.String()] = true
+
+	buildVertexes.WithLabelValues(strconv.FormatBool(vert.Cached)).Inc()
+}
+
+// serveMetrics on addr until the context is done
+func (s *Srv) serveMetrics(ctx context.Context, addr string) {
+	ctx, span := trace.Span(ctx, "metrics")
+	defer span.End()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		terror.Ackf(ctx, "metrics Shutdown: %w", srv.Shutdown(context.WithoutCancel(ctx)))
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		terror.Ackf(ctx, "metrics ListenAndServe: %w", err)
+	}
+}
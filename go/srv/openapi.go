@@ -0,0 +1,187 @@
+package srv
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+type jsonObj = map[string]any
+
+var fiberParamRegex = regexp.MustCompile(`:(\w+)`)
+
+func schemaRef(msg protoreflect.MessageDescriptor) jsonObj {
+	return jsonObj{"$ref": "#/components/schemas/" + string(msg.Name())}
+}
+
+// fieldSchema follows the protojson encoding, 64bit integers are strings
+func fieldSchema(field protoreflect.FieldDescriptor) jsonObj {
+	var schema jsonObj
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		schema = jsonObj{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		schema = jsonObj{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		schema = jsonObj{"type": "integer", "format": "int64", "minimum": 0}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		schema = jsonObj{"type": "string", "format": "int64"}
+	case protoreflect.FloatKind:
+		schema = jsonObj{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		schema = jsonObj{"type": "number", "format": "double"}
+	case protoreflect.StringKind:
+		schema = jsonObj{"type": "string"}
+	case protoreflect.BytesKind:
+		schema = jsonObj{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		names := make([]string, values.Len())
+		for i := range names {
+			names[i] = string(values.Get(i).Name())
+		}
+		schema = jsonObj{"type": "string", "enum": names}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		schema = schemaRef(field.Message())
+	}
+
+	if field.IsList() {
+		return jsonObj{"type": "array", "items": schema}
+	}
+
+	return schema
+}
+
+func messageSchema(msg protoreflect.MessageDescriptor) jsonObj {
+	props := jsonObj{}
+	fields := msg.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		props[field.JSONName()] = fieldSchema(field)
+	}
+
+	return jsonObj{"type": "object", "properties": props}
+}
+
+func jsonContent(schema jsonObj) jsonObj {
+	return jsonObj{"application/json": jsonObj{"schema": schema}}
+}
+
+// bodyContent of a route's request or reply which is either a message or a content type
+func bodyContent(body any) jsonObj {
+	switch b := body.(type) {
+	case proto.Message:
+		return jsonContent(schemaRef(b.ProtoReflect().Descriptor()))
+	case string:
+		return jsonObj{b: jsonObj{"schema": jsonObj{"type": "string", "format": "binary"}}}
+	}
+
+	return nil
+}
+
+// openApiDoc describes the HTTP API using the messages and service in grpc/srv/lib.proto
+func openApiDoc(routes []apiRoute) ([]byte, error) {
+	file := pb.File_grpc_srv_lib_proto
+
+	schemas := jsonObj{
+		"ApiError": jsonObj{
+			"type": "object",
+			"properties": jsonObj{
+				"code":    jsonObj{"type": "string"},
+				"message": jsonObj{"type": "string"},
+			},
+		},
+	}
+	msgs := file.Messages()
+	for i := 0; i < msgs.Len(); i++ {
+		schemas[string(msgs.Get(i).Name())] = messageSchema(msgs.Get(i))
+	}
+
+	errorResponse := jsonObj{
+		"description": "The request failed before reaching the service",
+		"content":     jsonContent(jsonObj{"$ref": "#/components/schemas/ApiError"}),
+	}
+
+	paths := jsonObj{}
+	service := file.Services().ByName(protoreflect.Name("Srv"))
+	methods := service.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		method := methods.Get(i)
+		if method.IsStreamingClient() || method.IsStreamingServer() {
+			continue
+		}
+
+		paths["/"+string(service.FullName())+"/"+string(method.Name())] = jsonObj{
+			"post": jsonObj{
+				"operationId": string(method.Name()),
+				"requestBody": jsonObj{"content": jsonContent(schemaRef(method.Input()))},
+				"responses": jsonObj{
+					"200": jsonObj{
+						"description": "The reply, which has an error field if the service failed to do what was requested",
+						"content":     jsonContent(schemaRef(method.Output())),
+					},
+					"default": errorResponse,
+				},
+			},
+		}
+	}
+
+	for _, r := range routes {
+		var params []jsonObj
+		for _, m := range fiberParamRegex.FindAllStringSubmatch(r.path, -1) {
+			params = append(params, jsonObj{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   jsonObj{"type": "string"},
+			})
+		}
+
+		op := jsonObj{
+			"summary":    r.summary,
+			"parameters": params,
+			"responses": jsonObj{
+				"200": jsonObj{
+					"description": "OK",
+					"content":     bodyContent(r.reply),
+				},
+				"default": errorResponse,
+			},
+		}
+		if r.req != nil {
+			op["requestBody"] = jsonObj{"content": bodyContent(r.req)}
+		}
+
+		path := fiberParamRegex.ReplaceAllString(r.path, "{$1}")
+		ops, ok := paths[path].(jsonObj)
+		if !ok {
+			ops = jsonObj{}
+			paths[path] = ops
+		}
+		ops[strings.ToLower(r.method)] = op
+	}
+
+	return json.Marshal(jsonObj{
+		"openapi": "3.0.3",
+		"info": jsonObj{
+			"title":       "Ayup",
+			"description": "HTTP/JSON gateway to the Srv service in " + file.Path() + ". Unary methods use the Connect protocol's JSON encoding.",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": jsonObj{
+			"schemas": schemas,
+			"securitySchemes": jsonObj{
+				"bearer": jsonObj{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []jsonObj{{"bearer": []string{}}},
+	})
+}
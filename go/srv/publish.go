@@ -0,0 +1,163 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/joho/godotenv"
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/tonistiigi/fsutil"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+// Labels added to published and exported images
+const (
+	revisionLabel = "org.opencontainers.image.revision"
+	versionLabel  = "io.premai.ayup.version"
+)
+
+// registryCredsPath is where the credentials for the registry at host are kept in the secret store
+func registryCredsPath(secretsDir string, host string) (string, error) {
+	if host == "" || strings.ContainsAny(host, `/\`) || !filepath.IsLocal(host) {
+		return "", fmt.Errorf("not a registry host: '%s'", host)
+	}
+
+	return filepath.Join(secretsDir, "registries", host), nil
+}
+
+// SetRegistryCreds saves the username and secret, such as a password or token, which are used to
+// push images to the registry at host
+func SetRegistryCreds(secretsDir string, host string, username string, secret string) error {
+	path, err := registryCredsPath(secretsDir, host)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("os MkdirAll: %w", err)
+	}
+
+	content, err := godotenv.Marshal(map[string]string{
+		"USERNAME": username,
+		"SECRET":   secret,
+	})
+	if err != nil {
+		return fmt.Errorf("godotenv Marshal: %w", err)
+	}
+
+	if err := os.WriteFile(path, []byte(content+"\n"), 0600); err != nil {
+		return fmt.Errorf("os WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// registryAuth gives Buildkit the credentials in the secret store when it pushes to a registry
+type registryAuth struct {
+	auth.UnimplementedAuthServer
+	secretsDir string
+}
+
+func (s *registryAuth) Register(server *grpc.Server) {
+	auth.RegisterAuthServer(server, s)
+}
+
+// Credentials for the host, which are empty if it has none so that it is accessed anonymously
+func (s *registryAuth) Credentials(ctx context.Context, req *auth.CredentialsRequest) (*auth.CredentialsResponse, error) {
+	path, err := registryCredsPath(s.secretsDir, req.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := godotenv.Read(path)
+	if errors.Is(err, os.ErrNotExist) {
+		trace.Event(ctx, "no registry credentials", attribute.String("host", req.Host))
+		return &auth.CredentialsResponse{}, nil
+	} else if err != nil {
+		return nil, terror.Errorf(ctx, "godotenv Read: %w", err)
+	}
+
+	trace.Event(ctx, "registry credentials", attribute.String("host", req.Host))
+
+	return &auth.CredentialsResponse{
+		Username: creds["USERNAME"],
+		Secret:   creds["SECRET"],
+	}, nil
+}
+
+// imageLabels identify what the app's image was built from
+func (s *aCtx) imageLabels(revision string) map[string]string {
+	labels := map[string]string{
+		versionLabel: s.srv.Version,
+	}
+	if revision != "" {
+		labels[revisionLabel] = revision
+	}
+
+	return labels
+}
+
+// publish builds the app again and pushes its image to the registry at ref. It is called once the
+// app has been built, so the build comes from Buildkit's cache and this mostly uploads the image.
+func (s *aCtx) publish(c *client.Client, named reference.Named, localMounts map[string]fsutil.FS, solve gateway.BuildFunc) error {
+	actx, span := s.span("publish", attribute.String("ref", named.String()))
+	defer span.End()
+	ctx := actx.ctx
+
+	attrs := map[string]string{
+		"name": named.String(),
+		"push": "true",
+	}
+	if slices.Contains(s.srv.InsecureRegistries, reference.Domain(named)) {
+		attrs["registry.insecure"] = "true"
+	}
+
+	if err := actx.send(&pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_Log{
+			Log: fmt.Sprintf("Publishing to %s\n", named),
+		},
+	}); err != nil {
+		return err
+	}
+
+	statusChan := actx.buildkitStatusSender("publish", nil)
+	if _, err := c.Build(ctx, client.SolveOpt{
+		LocalMounts: localMounts,
+		Exports: []client.ExportEntry{{
+			Type:  client.ExporterImage,
+			Attrs: attrs,
+		}},
+		Session: []session.Attachable{
+			&registryAuth{secretsDir: s.srv.SecretsDir},
+		},
+	}, "ayup", solve, statusChan); err != nil {
+		// The build is stopped as well, so this has to be an error
+		err = fmt.Errorf("publish: %s: %w", named, err)
+		if sendErr := actx.sendError("%w", err); sendErr != nil {
+			return sendErr
+		}
+		return err
+	}
+
+	return actx.send(&pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_Log{
+			Log: fmt.Sprintf("Published %s\n", named),
+		},
+	})
+}
@@ -0,0 +1,141 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+var (
+	gitRegex    = regexp.MustCompile(`@\s+git`)
+	opencvRegex = regexp.MustCompile(`^\s*opencv-python\b`)
+	// Like pip, a # is only a comment at the start of a line or after whitespace, so URL
+	// fragments such as #egg= are kept
+	commentRegex = regexp.MustCompile(`(^|\s)#.*$`)
+)
+
+// requirementsScan is what was found in requirements.txt
+type requirementsScan struct {
+	needsGit     bool
+	needsLibGL   bool
+	needsLibGlib bool
+
+	// The requirements without comments or blank lines
+	packages []string
+	// Why each system dependency is needed
+	reasons []string
+}
+
+func scanRequirements(path string) (requirementsScan, error) {
+	var scan requirementsScan
+
+	f, err := os.Open(path)
+	if err != nil {
+		return scan, fmt.Errorf("os Open: %w", err)
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(commentRegex.ReplaceAllString(lines.Text(), ""))
+
+		if gitRegex.MatchString(line) {
+			scan.needsGit = true
+			scan.reasons = append(scan.reasons, fmt.Sprintf("requirements.txt:%d installs from git, so git is installed", n))
+		}
+
+		if opencvRegex.MatchString(line) {
+			scan.needsLibGL = true
+			scan.needsLibGlib = true
+			scan.reasons = append(scan.reasons, fmt.Sprintf("requirements.txt:%d needs OpenCV, so libgl1 and libglib2.0-0 are installed", n))
+		}
+
+		if line != "" {
+			scan.packages = append(scan.packages, line)
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		return scan, fmt.Errorf("scanner: %w", err)
+	}
+
+	return scan, nil
+}
+
+func (s requirementsScan) apply(analysis *pb.AnalysisResult) {
+	analysis.NeedsGit = s.needsGit
+	analysis.NeedsLibGL = s.needsLibGL
+	analysis.NeedsLibGlib = s.needsLibGlib
+}
+
+// dockerfileBaseImage is the image the last stage of the Dockerfile is built from, build args
+// are not substituted
+func dockerfileBaseImage(dockerfile io.Reader) (string, error) {
+	res, err := parser.Parse(dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("parser Parse: %w", err)
+	}
+
+	base := ""
+	for _, node := range res.AST.Children {
+		if strings.EqualFold(node.Value, "from") && node.Next != nil {
+			base = node.Next.Value
+		}
+	}
+
+	return base, nil
+}
+
+// analysisReport analyses the source in srcDir like a push would, without asking questions or
+// building anything
+func (s *aCtx) analysisReport(srcDir string, hasAssistant bool) (*pb.AnalysisReport, error) {
+	report := &pb.AnalysisReport{
+		Entrypoint: []string{"python", "__main__.py"},
+		Ports:      []uint32{5000},
+		Assistant:  hasAssistant,
+	}
+
+	if hasAssistant {
+		report.Reasons = append(report.Reasons, "An assistant was uploaded, it runs first and may change the source, which isn't reflected here")
+	}
+
+	matches, failures := s.srv.runDetectors(s.ctx, srcDir)
+	report.Reasons = append(report.Reasons, failures...)
+	if len(matches) == 0 {
+		report.Result = &pb.AnalysisResult{}
+		report.Reasons = append(report.Reasons, "None of the detectors know how to build the app, a push would fail")
+
+		return report, nil
+	}
+
+	for _, m := range matches {
+		report.Matches = append(report.Matches, m.toPb())
+	}
+
+	top := matches[0]
+	report.Result = top.Plan
+	report.Detector = top.name
+	report.Reasons = append(report.Reasons, top.Reasons...)
+
+	if close := closeMatches(matches); len(close) > 1 {
+		var names []string
+		for _, m := range close {
+			names = append(names, m.name)
+		}
+		report.Reasons = append(report.Reasons,
+			fmt.Sprintf("The %s detectors are about as confident, a push would ask which to use", strings.Join(names, ", ")))
+	}
+
+	if err := planBuilderFor(top.Plan).describe(srcDir, top.Plan, report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
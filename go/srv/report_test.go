@@ -0,0 +1,158 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScanRequirements(t *testing.T) {
+	cases := []struct {
+		name         string
+		requirements string
+		packages     []string
+		git          bool
+		libGL        bool
+		reasons      int
+	}{
+		{name: "empty", requirements: ""},
+		{
+			name:         "plain",
+			requirements: "# web\nflask==3.0\n\n  requests  # http\n",
+			packages:     []string{"flask==3.0", "requests"},
+		},
+		{
+			name:         "git",
+			requirements: "mylib @ git+https://example.com/mylib.git\n",
+			packages:     []string{"mylib @ git+https://example.com/mylib.git"},
+			git:          true,
+			reasons:      1,
+		},
+		{
+			name:         "opencv",
+			requirements: "numpy\nopencv-python>=4\n",
+			packages:     []string{"numpy", "opencv-python>=4"},
+			libGL:        true,
+			reasons:      1,
+		},
+		{
+			name:         "egg fragment",
+			requirements: "git+https://example.com/x.git#egg=x  # pinned\n",
+			packages:     []string{"git+https://example.com/x.git#egg=x"},
+		},
+		{
+			name:         "commented out",
+			requirements: "# opencv-python\n# x @ git+https://example.com/x.git\n",
+		},
+	}
+
+	dir := t.TempDir()
+	for _, c := range cases {
+		path := filepath.Join(dir, "requirements.txt")
+		if err := os.WriteFile(path, []byte(c.requirements), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		scan, err := scanRequirements(path)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if !slices.Equal(scan.packages, c.packages) {
+			t.Errorf("%s: got packages %q, want %q", c.name, scan.packages, c.packages)
+		}
+		if scan.needsGit != c.git {
+			t.Errorf("%s: got needsGit %v", c.name, scan.needsGit)
+		}
+		if scan.needsLibGL != c.libGL || scan.needsLibGlib != c.libGL {
+			t.Errorf("%s: got needsLibGL %v and needsLibGlib %v", c.name, scan.needsLibGL, scan.needsLibGlib)
+		}
+		if len(scan.reasons) != c.reasons {
+			t.Errorf("%s: got reasons %q", c.name, scan.reasons)
+		}
+	}
+
+	if _, err := scanRequirements(filepath.Join(dir, "missing.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestDockerfileBaseImage(t *testing.T) {
+	cases := []struct {
+		name       string
+		dockerfile string
+		want       string
+		err        bool
+	}{
+		{name: "simple", dockerfile: "FROM python:3.12\nCMD [\"python\"]\n", want: "python:3.12"},
+		{name: "lower case", dockerfile: "from alpine\n", want: "alpine"},
+		{
+			name:       "multi-stage",
+			dockerfile: "FROM golang:1.22 AS build\nRUN go build\nFROM gcr.io/distroless/static\nCOPY --from=build /app /app\n",
+			want:       "gcr.io/distroless/static",
+		},
+		{name: "platform", dockerfile: "FROM --platform=linux/amd64 debian:bookworm\n", want: "debian:bookworm"},
+		{name: "unsubstituted arg", dockerfile: "ARG BASE=alpine\nFROM $BASE\n", want: "$BASE"},
+		{name: "no from", dockerfile: "RUN true\n", want: ""},
+		{name: "empty", dockerfile: "", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := dockerfileBaseImage(strings.NewReader(c.dockerfile))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", c.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAnalysisReportReadsSrcDir(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "requirements.txt"), []byte("opencv-python\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actx := aCtx{ctx: context.Background(), srv: &Srv{}}
+	report, err := actx.analysisReport(srcDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Detector != "python" {
+		t.Errorf("got detector %q", report.Detector)
+	}
+	if !slices.Equal(report.PipPackages, []string{"opencv-python"}) {
+		t.Errorf("got pip packages %q", report.PipPackages)
+	}
+	if !slices.Contains(report.AptPackages, "libgl1") {
+		t.Errorf("got apt packages %q", report.AptPackages)
+	}
+	if report.BaseImage != pythonSlimImage {
+		t.Errorf("got base image %q", report.BaseImage)
+	}
+
+	report, err = actx.analysisReport(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.GuessRequirements || !report.Assistant {
+		t.Errorf("got %v", report)
+	}
+	if !report.Result.GetUsePythonRequirements() {
+		t.Errorf("got plan %v, want the Python one", report.Result)
+	}
+}
@@ -0,0 +1,267 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"premai.io/Ayup/go/internal/conf"
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/logfile"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+	"premai.io/Ayup/go/internal/tui"
+)
+
+const (
+	// The delay before Buildkit is started again after it exits, doubled each time it exits again
+	minBuildkitBackoff = time.Second
+	maxBuildkitBackoff = time.Minute
+	// If Buildkit ran for this long before exiting then the backoff is reset
+	buildkitStableAfter = 2 * time.Minute
+	// How often Buildkit is asked for its workers while waiting for it to come up
+	buildkitReadyInterval = time.Second
+)
+
+var errBuildkitDown = errors.New("Buildkit is not running")
+
+type buildkitState struct {
+	up bool
+	// Closed when Buildkit is up, replaced when it goes down
+	upChan chan struct{}
+
+	restarts  uint32
+	lastExit  time.Time
+	lastError string
+	nextStart time.Time
+}
+
+func (s *Srv) initBuildkitState(up bool) {
+	s.buildkitMutex.Lock()
+	defer s.buildkitMutex.Unlock()
+
+	s.buildkit.upChan = make(chan struct{})
+	s.buildkit.up = up
+	if up {
+		buildkitUp.Set(1)
+		close(s.buildkit.upChan)
+	}
+}
+
+func (s *Srv) setBuildkitUp(ctx context.Context) {
+	s.buildkitMutex.Lock()
+	defer s.buildkitMutex.Unlock()
+
+	if s.buildkit.up {
+		return
+	}
+
+	trace.Event(ctx, "buildkit up")
+	buildkitUp.Set(1)
+	s.buildkit.up = true
+	s.buildkit.nextStart = time.Time{}
+	close(s.buildkit.upChan)
+}
+
+func (s *Srv) setBuildkitExited(ctx context.Context, reason string, nextStart time.Time) {
+	s.buildkitMutex.Lock()
+	defer s.buildkitMutex.Unlock()
+
+	trace.Event(ctx, "buildkit exited", attribute.String("reason", reason))
+	if s.buildkit.up {
+		s.buildkit.up = false
+		s.buildkit.upChan = make(chan struct{})
+	}
+	buildkitUp.Set(0)
+	buildkitRestarts.Inc()
+	s.buildkit.restarts++
+	s.buildkit.lastExit = time.Now()
+	s.buildkit.lastError = reason
+	s.buildkit.nextStart = nextStart
+}
+
+// buildkitDown returns an error explaining why builds can't be done at the moment or nil if they
+// can
+func (s *Srv) buildkitDown() error {
+	s.buildkitMutex.Lock()
+	defer s.buildkitMutex.Unlock()
+
+	if s.buildkit.up {
+		return nil
+	}
+
+	if s.buildkit.lastExit.IsZero() {
+		return fmt.Errorf("%w yet, it is still starting; try again shortly", errBuildkitDown)
+	}
+
+	return fmt.Errorf("%w, it is being restarted after exiting (%s); try again shortly", errBuildkitDown, s.buildkit.lastError)
+}
+
+// waitBuildkit until it is up or the timeout expires
+func (s *Srv) waitBuildkit(ctx context.Context, timeout time.Duration) error {
+	s.buildkitMutex.Lock()
+	upChan := s.buildkit.upChan
+	s.buildkitMutex.Unlock()
+
+	select {
+	case <-upChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return s.buildkitDown()
+	}
+}
+
+func (s *Srv) supervisorStatus() *pb.BuildkitSupervisor {
+	s.buildkitMutex.Lock()
+	defer s.buildkitMutex.Unlock()
+
+	st := &pb.BuildkitSupervisor{
+		Degraded:  !s.buildkit.up,
+		Restarts:  s.buildkit.restarts,
+		LastError: s.buildkit.lastError,
+	}
+
+	if !s.buildkit.lastExit.IsZero() {
+		st.LastExit = s.buildkit.lastExit.Unix()
+	}
+
+	if !s.buildkit.nextStart.IsZero() {
+		st.NextStart = s.buildkit.nextStart.Unix()
+	}
+
+	return st
+}
+
+// pollBuildkitReady marks Buildkit as up once it lists its workers
+func (s *Srv) pollBuildkitReady(ctx context.Context) {
+	for {
+		if _, err := s.buildkitWorkers(ctx); err == nil {
+			s.setBuildkitUp(ctx)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(buildkitReadyInterval):
+		}
+	}
+}
+
+// consoleLog prints each line written to it with the component's name in front
+type consoleLog struct {
+	srv       *Srv
+	component string
+
+	mutex sync.Mutex
+	buf   []byte
+}
+
+func (s *consoleLog) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.buf = append(s.buf, p...)
+
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		s.srv.tuiMutex.Lock()
+		fmt.Println(tui.VersionStyle.Render(s.component+":"), string(s.buf[:i]))
+		s.srv.tuiMutex.Unlock()
+
+		s.buf = s.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// componentLogs opens the log files of the rootless Buildkit stack. When verbose, the output is
+// also printed, buildkitd's is read back from its log which is written by the rootless helper.
+func (s *Srv) componentLogs(ctx context.Context) (io.Writer, func()) {
+	var log io.Writer = io.Discard
+	closeLog := func() {}
+
+	f, err := logfile.Open(conf.LogPath("inrootless"))
+	if err != nil {
+		terror.Ackf(ctx, "logfile Open: %w", err)
+	} else {
+		log = f
+		closeLog = func() { terror.Ackf(ctx, "logfile Close: %w", f.Close()) }
+	}
+
+	if !s.Verbose {
+		return log, closeLog
+	}
+
+	go func() {
+		buildkitdLog := &consoleLog{srv: s, component: "buildkitd"}
+		terror.Ackf(ctx, "logfile Follow: %w", logfile.Follow(ctx, conf.LogPath("buildkitd"), buildkitdLog))
+	}()
+
+	return io.MultiWriter(log, &consoleLog{srv: s, component: "inrootless"}), closeLog
+}
+
+// superviseBuildkit runs the rootless Buildkit stack and starts it again, with an exponential
+// backoff, each time it exits. Returns when the context is done and Buildkit has exited.
+func (s *Srv) superviseBuildkit(ctx context.Context, selfExe string) {
+	backoff := minBuildkitBackoff
+
+	log, closeLog := s.componentLogs(ctx)
+	defer closeLog()
+
+	for {
+		started := time.Now()
+		span, _, out := s.runRootlessBuildkit(ctx, selfExe, log)
+
+		readyCtx, cancelReady := context.WithCancel(ctx)
+		go s.pollBuildkitReady(readyCtx)
+
+		reason := "exited"
+		for pout := range out {
+			if pout.Err != nil {
+				s.tuiMutex.Lock()
+				fmt.Println(tui.ErrorStyle.Render("Buildkitd Error!"), pout.Err)
+				s.tuiMutex.Unlock()
+
+				reason = pout.Err.Error()
+			}
+		}
+
+		cancelReady()
+		span.End()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > buildkitStableAfter {
+			backoff = minBuildkitBackoff
+		}
+
+		s.setBuildkitExited(ctx, reason, time.Now().Add(backoff))
+
+		s.tuiMutex.Lock()
+		fmt.Println(tui.ErrorStyle.Render("Buildkit exited:"), "starting it again in", backoff, "see 'ay daemon logs --component inrootless'")
+		s.tuiMutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxBuildkitBackoff)
+	}
+}
@@ -2,6 +2,7 @@ package srv
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -25,14 +26,27 @@ func (s *Srv) Download(req *pb.DownloadReq, stream pb.Srv_DownloadServer) error
 		return sendError("internal error")
 	}
 
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return internalError("checkPeerAuth: %w", err)
+		}
+
+		return sendError("Not authorized")
+	}
+
+	app, err := s.getApp(ctx, req.App)
+	if err != nil {
+		return err
+	}
+
 	fileSender := rpc.NewFileSender(stream, nil, nil, sendError, internalError)
 
-	if err := fileSender.SendDir(ctx, pb.Source_app, s.SrcDir); err != nil {
+	if err := fileSender.SendDir(ctx, pb.Source_app, app.srcDir); err != nil {
 		return err
 	}
 
-	if s.push.hasAssistant {
-		if err := fileSender.SendDir(ctx, pb.Source_assistant, s.AssistantDir); err != nil {
+	if app.hasAssistant {
+		if err := fileSender.SendDir(ctx, pb.Source_assistant, app.assDir); err != nil {
 			return err
 		}
 	}
@@ -40,9 +54,59 @@ func (s *Srv) Download(req *pb.DownloadReq, stream pb.Srv_DownloadServer) error
 	return nil
 }
 
+// clearSrc removes the app's source and assistant before a new version is uploaded
+func (s *app) clearSrc() error {
+	return clearUploadDirs(s.srcDir, s.assDir)
+}
+
+func clearUploadDirs(srcDir string, assDir string) error {
+	if err := os.RemoveAll(assDir); err != nil {
+		return fmt.Errorf("os RemoveAll: %w", err)
+	}
+
+	if err := os.RemoveAll(srcDir); err != nil {
+		return fmt.Errorf("os RemoveAll: %w", err)
+	}
+
+	if err := os.MkdirAll(srcDir, 0700); err != nil {
+		return fmt.Errorf("os MkdirAll: %w", err)
+	}
+
+	return nil
+}
+
+// firstChunks returns the already received first message before reading from the stream
+type firstChunks struct {
+	first  *pb.FileChunks
+	stream pb.Srv_UploadServer
+
+	// The paths in the app's source which were received
+	paths []string
+}
+
+func (s *firstChunks) Recv() (*pb.FileChunks, error) {
+	chunks := s.first
+	var err error
+
+	if chunks != nil {
+		s.first = nil
+	} else {
+		chunks, err = s.stream.Recv()
+	}
+	observeChunks(chunks)
+
+	for _, chunk := range chunks.GetChunk() {
+		if chunk.Source == pb.Source_app && (chunk.Last || chunk.Removed) {
+			s.paths = append(s.paths, chunk.Path)
+		}
+	}
+
+	return chunks, err
+}
+
 func (s *Srv) Upload(stream pb.Srv_UploadServer) error {
 	ctx := stream.Context()
-	ctx, span := trace.Span(ctx, "upload", attr.String("srcDir", s.SrcDir), attr.String("assDir", s.AssistantDir))
+	ctx, span := trace.Span(ctx, "upload")
 	defer span.End()
 
 	sendErrorClose := func(msgf string, args ...any) error {
@@ -69,21 +133,53 @@ func (s *Srv) Upload(stream pb.Srv_UploadServer) error {
 		return sendErrorClose("Not authorized")
 	}
 
-	if _, err := os.Stat(s.AssistantDir); err == nil {
-		if err := os.RemoveAll(s.AssistantDir); err != nil {
-			return internalError("RemoveAll: %w", err)
+	first, err := stream.Recv()
+	if err != nil {
+		return internalError("stream recv: %w", err)
+	}
+
+	app, err := s.getApp(ctx, first.App)
+	if err != nil {
+		return sendErrorClose("%w", err)
+	}
+	span.SetAttributes(attr.String("app", app.name), attr.String("srcDir", app.srcDir), attr.String("assDir", app.assDir))
+
+	srcDir, assDir := app.srcDir, app.assDir
+
+	// A sync goes to the app while it runs, which holds actMutex. A dry run's source goes to a
+	// scratch directory, so it doesn't wait for the app or replace its source.
+	var dev *devMode
+	if first.Analyze {
+		if first.Incremental || first.Sync {
+			return sendErrorClose("A dry run's upload can't be incremental")
 		}
+
+		app.analyzeMutex.Lock()
+		defer app.analyzeMutex.Unlock()
+
+		srcDir, assDir = app.analyzeDirs()
+	} else if first.Sync {
+		if dev = app.getDev(); dev == nil {
+			return sendErrorClose("App is not running in dev mode: %s", app.name)
+		}
+	} else if !app.actMutex.TryLock() {
+		return sendErrorClose("App is busy: %s", app.name)
+	} else {
+		defer app.actMutex.Unlock()
 	}
 
-	if err := os.RemoveAll(s.SrcDir); err != nil && !os.IsNotExist(err) {
-		return internalError("RemoveAll: %w", err)
+	if dev == nil && !first.Analyze {
+		s.emit(ctx, &pb.Event{Type: pb.EventType_pushStarted, App: app.name})
 	}
 
-	if err := os.MkdirAll(s.SrcDir, 0700); err != nil {
-		return internalError("os MkdirAll: %w", err)
+	if !first.Incremental && !first.Sync {
+		if err := clearUploadDirs(srcDir, assDir); err != nil {
+			return internalError("clearUploadDirs: %w", err)
+		}
 	}
 
-	fileRecvr := rpc.NewFileRecver(stream, nil, sendErrorClose, internalError, s.SrcDir, s.AssistantDir)
+	chunks := firstChunks{first: first, stream: stream}
+	fileRecvr := rpc.NewFileRecver(&chunks, nil, sendErrorClose, internalError, srcDir, assDir)
 
 	if err := fileRecvr.RecvDirs(ctx); err != nil {
 		if !errors.Is(err, io.EOF) {
@@ -91,11 +187,29 @@ func (s *Srv) Upload(stream pb.Srv_UploadServer) error {
 		}
 	}
 
+	if dev != nil {
+		if err := dev.sync(ctx, chunks.paths); err != nil {
+			return sendErrorClose("sync: %w", err)
+		}
+
+		if err := stream.SendAndClose(&pb.Result{}); err != nil {
+			return internalError("stream send and close: %w", err)
+		}
+
+		return nil
+	}
+
 	if err := stream.SendAndClose(&pb.Result{}); err != nil {
 		return internalError("stream send and close: %w", err)
 	}
 
-	s.push.hasAssistant = fileRecvr.RecvedAssistant
+	if first.Analyze {
+		app.analyzeAssistant = fileRecvr.RecvedAssistant
+		return nil
+	}
+
+	app.hasAssistant = fileRecvr.RecvedAssistant || (first.Incremental && app.hasAssistant)
+	s.emit(ctx, &pb.Event{Type: pb.EventType_uploadDone, App: app.name, Ok: true})
 
 	return nil
 }
@@ -0,0 +1,259 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	gatewayapi "github.com/moby/buildkit/frontend/gateway/pb"
+	solverPb "github.com/moby/buildkit/solver/pb"
+	"go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+var errNotBuilt = errors.New("the app has not been built yet, push it first")
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (s nopWriteCloser) Close() error {
+	return nil
+}
+
+// runTask starts a throwaway container from the app's last build and runs args in it. The build
+// is solved again from the same analysis and a snapshot of the source that was built, which
+// buildkit's cache turns into the same image.
+//
+// Tasks are not started through an appGate, so they aren't put in the app's cgroup or taken for
+// its process when its address is found.
+func (s *Srv) runTask(ctx context.Context, app *app, args []string, out io.Writer, signals <-chan syscall.Signal, statusChan chan *client.SolveStatus) (int32, error) {
+	ctx, span := trace.Span(ctx, "task", attribute.String("app", app.name), attribute.StringSlice("args", args))
+	defer span.End()
+
+	handedOff := false
+	defer func() {
+		if statusChan != nil && !handedOff {
+			close(statusChan)
+		}
+	}()
+
+	built := app.lastBuilt()
+	if built == nil {
+		return 0, errNotBuilt
+	}
+
+	if err := s.buildkitDown(); err != nil {
+		return 0, err
+	}
+
+	c, err := client.New(ctx, s.BuildkitdAddr)
+	if err != nil {
+		return 0, terror.Errorf(ctx, "client New: %w", err)
+	}
+
+	localMounts, err := app.builtMounts(built)
+	if err != nil {
+		return 0, terror.Errorf(ctx, "builtMounts: %w", err)
+	}
+
+	var exitCode int32
+
+	b := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		app.builtMutex.RLock()
+		r, err := solveBuilt(ctx, c, built, "task")
+		app.builtMutex.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+
+		ctr, err := c.NewContainer(ctx, gateway.NewContainerRequest{
+			Hostname: app.name,
+			Mounts: []gateway.Mount{
+				{
+					Dest:      "/",
+					MountType: solverPb.MountType_BIND,
+					Ref:       r.Ref,
+				},
+			},
+		})
+		if err != nil {
+			return nil, terror.Errorf(ctx, "gateway client NewContainer: %w", err)
+		}
+		defer func() { terror.Ackf(ctx, "ctr Release: %w", ctr.Release(ctx)) }()
+
+		pid, err := ctr.Start(ctx, gateway.StartRequest{
+			Cwd:  "/app",
+			Args: args,
+			Env: []string{
+				"PATH=" + defaultPathEnv,
+			},
+			Stdout: nopWriteCloser{out},
+			Stderr: nopWriteCloser{out},
+		})
+		if err != nil {
+			return nil, terror.Errorf(ctx, "ctr Start: %w", err)
+		}
+
+		waitChan := make(chan error, 1)
+		go func() {
+			waitChan <- pid.Wait()
+		}()
+
+		for {
+			select {
+			case err := <-waitChan:
+				var exitError *gatewayapi.ExitError
+				if err != nil && errors.As(err, &exitError) && exitError.ExitCode < gatewayapi.UnknownExitStatus {
+					exitCode = int32(exitError.ExitCode)
+				} else if err != nil {
+					return nil, terror.Errorf(ctx, "pid Wait: %w", err)
+				}
+
+				trace.Event(ctx, "task exited", attribute.Int("exitCode", int(exitCode)))
+
+				return r, nil
+			case sig := <-signals:
+				trace.Event(ctx, "signal task", attribute.String("signal", sig.String()))
+
+				if err := pid.Signal(ctx, sig); err != nil {
+					return nil, terror.Errorf(ctx, "pid Signal: %w", err)
+				}
+			}
+		}
+	}
+
+	handedOff = true
+	if _, err := c.Build(ctx, client.SolveOpt{
+		LocalMounts: localMounts,
+	}, "ayup", b, statusChan); err != nil {
+		return 0, terror.Errorf(ctx, "client Build: %w", err)
+	}
+
+	return exitCode, nil
+}
+
+// solveBuilt solves the app's image from the analysis of its last build. The locals are expected
+// to be the app's builtMounts. The solve is evaluated so that the locals have been read by the
+// time it returns.
+func solveBuilt(ctx context.Context, c gateway.Client, built *pb.AnalysisResult, kind string) (*gateway.Result, error) {
+	req := gateway.SolveRequest{
+		Frontend: "dockerfile.v0",
+		Evaluate: true,
+	}
+
+	if !built.UseDockerfile {
+		def, err := MkLlb(ctx, built)
+		if err != nil {
+			return nil, err
+		}
+
+		req = gateway.SolveRequest{
+			Definition: def.ToPB(),
+			Evaluate:   true,
+		}
+	}
+
+	started := time.Now()
+	r, err := c.Solve(ctx, req)
+	observeBuild(kind, started, err)
+	if err != nil {
+		return nil, terror.Errorf(ctx, "gateway client Solve: %w", err)
+	}
+
+	return r, nil
+}
+
+// Run a one-off command, such as a database migration, in a container created from the app's
+// last build. The output is streamed back followed by the exit code.
+func (s *Srv) Run(stream pb.Srv_RunServer) error {
+	ctx := stream.Context()
+	span := tr.SpanFromContext(ctx)
+	ctx = trace.SetSpanKind(ctx, tr.SpanKindServer)
+
+	actx := aCtx{
+		ctx:       ctx,
+		sendMutex: &sync.Mutex{},
+		stream:    stream,
+		srv:       s,
+	}
+
+	if ok, err := s.checkPeerAuth(ctx); !ok || err != nil {
+		if err != nil {
+			return actx.internalError("checkPeerAuth: %w", err)
+		}
+
+		return actx.sendError("Not authorized")
+	}
+
+	if s.shuttingDown.Load() {
+		return actx.sendError("The daemon is shutting down")
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return terror.Errorf(ctx, "stream Recv: %w", err)
+	}
+
+	app, err := s.getApp(ctx, first.App)
+	if err != nil {
+		return actx.sendError("%w", err)
+	}
+	span.SetAttributes(attribute.String("app", app.name))
+	actx.app = app
+
+	if len(first.Args) < 1 {
+		return actx.sendError("no command given")
+	}
+
+	signals := make(chan syscall.Signal)
+	go func() {
+		// Each cancel escalates the signal like when the app is ran
+		escalation := []syscall.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL}
+
+		for i := 0; ; {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+
+			if !req.Cancel || i >= len(escalation) {
+				continue
+			}
+
+			select {
+			case signals <- escalation[i]:
+				i++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	out := logWriter{actx: &actx, source: "task"}
+	statusChan := actx.buildkitStatusSender("build", nil)
+
+	exitCode, err := s.runTask(ctx, app, first.Args, &out, signals, statusChan)
+	if err != nil {
+		if errors.Is(err, errNotBuilt) || errors.Is(err, errBuildkitDown) {
+			return actx.sendError("%w", err)
+		}
+		return actx.internalError("runTask: %w", err)
+	}
+
+	return actx.send(&pb.ActReply{
+		Source: "ayup",
+		Variant: &pb.ActReply_ExitCode{
+			ExitCode: exitCode,
+		},
+	})
+}
@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+	"premai.io/Ayup/go/internal/terror"
+	"premai.io/Ayup/go/internal/trace"
+)
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 5
+)
+
+type Webhook struct {
+	URL string
+	// The events posted to the URL, all of them if empty
+	Events []pb.EventType
+}
+
+// ParseWebhooks from semicolon deliminated '<url> [<event>,<event>...]' entries
+func ParseWebhooks(spec string) ([]Webhook, error) {
+	var hooks []Webhook
+
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("`%s`: expected '<url> [<event>,<event>...]'", entry)
+		}
+
+		if !strings.HasPrefix(fields[0], "http://") && !strings.HasPrefix(fields[0], "https://") {
+			return nil, fmt.Errorf("`%s`: not an HTTP URL", fields[0])
+		}
+
+		hook := Webhook{URL: fields[0]}
+		if len(fields) == 2 {
+			for _, name := range strings.Split(fields[1], ",") {
+				typ, ok := pb.EventType_value[name]
+				if !ok || typ == int32(pb.EventType_unknownEvent) {
+					return nil, fmt.Errorf("`%s`: unknown event `%s`", entry, name)
+				}
+				hook.Events = append(hook.Events, pb.EventType(typ))
+			}
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// signWebhook signs the timestamp and body together, so that a receiver can reject requests
+// which are replayed later
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// runWebhook posts the events the hook wants until the context is done. Each hook has its own
+// subscription and runs in its own goroutine, so a slow receiver only holds up its own events.
+func (s *Srv) runWebhook(ctx context.Context, hook Webhook) {
+	sub := s.events.subscribe(hook.Events, "")
+	defer s.events.unsubscribe(sub)
+
+	client := http.Client{Timeout: webhookTimeout}
+
+	// Once a delivery has used all its attempts each event is only tried once, until the
+	// receiver responds again, otherwise the retries would fill the hook's buffer
+	up := true
+
+	for {
+		select {
+		case ev := <-sub.events:
+			up = s.deliverWebhook(ctx, &client, hook, ev, up)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverWebhook retries with a backoff when the receiver can't be reached or has a temporary
+// problem, other failures are given up on. Returns false if the receiver is still down after the
+// last attempt.
+func (s *Srv) deliverWebhook(ctx context.Context, client *http.Client, hook Webhook, ev *pb.Event, up bool) bool {
+	ctx, span := trace.Span(ctx, "webhook", attribute.String("url", hook.URL), attribute.String("type", ev.Type.String()))
+	defer span.End()
+
+	body, err := protojson.Marshal(ev)
+	if err != nil {
+		terror.Ackf(ctx, "protojson Marshal: %w", err)
+		return up
+	}
+
+	attempts := webhookAttempts
+	if !up {
+		attempts = 1
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(ctx, client, hook.URL, s.WebhookSecret, ev, body)
+		if err == nil {
+			return true
+		}
+
+		if !retry {
+			_ = terror.Errorf(ctx, "postWebhook: not retrying: %w", err)
+			return true
+		}
+
+		if attempt >= attempts {
+			_ = terror.Errorf(ctx, "postWebhook: giving up after %d attempts: %w", attempt, err)
+			return false
+		}
+
+		trace.Event(ctx, "retrying webhook", attribute.Int("attempt", attempt), attribute.String("error", err.Error()))
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return up
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client, url string, secret string, ev *pb.Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("http NewRequest: %w", err)
+	}
+
+	// Each attempt is signed with the time it was sent at
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Ayup")
+	req.Header.Set("X-Ayup-Event", ev.Type.String())
+	req.Header.Set("X-Ayup-Delivery", strconv.FormatUint(ev.Seq, 10))
+	req.Header.Set("X-Ayup-Timestamp", timestamp)
+	req.Header.Set("X-Ayup-Signature", signWebhook(secret, timestamp, body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("client Do: %w", err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("%s", res.Status)
+}
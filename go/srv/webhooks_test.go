@@ -0,0 +1,127 @@
+package srv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	pb "premai.io/Ayup/go/internal/grpc/srv"
+)
+
+func TestParseWebhooks(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []Webhook
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: " ; ", want: nil},
+		{spec: "https://example.com/all", want: []Webhook{{URL: "https://example.com/all"}}},
+		{
+			spec: "https://example.com/hook appCrashed,buildFinished; http://localhost:8000",
+			want: []Webhook{
+				{URL: "https://example.com/hook", Events: []pb.EventType{pb.EventType_appCrashed, pb.EventType_buildFinished}},
+				{URL: "http://localhost:8000"},
+			},
+		},
+		{spec: "example.com/hook", err: true},
+		{spec: "ftp://example.com", err: true},
+		{spec: "https://example.com appCrashed extra", err: true},
+		{spec: "https://example.com appExploded", err: true},
+		{spec: "https://example.com unknownEvent", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseWebhooks(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseWebhooks(%q): expected an error, got %v", c.spec, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseWebhooks(%q): %v", c.spec, err)
+			continue
+		}
+
+		if !slices.EqualFunc(got, c.want, func(a, b Webhook) bool {
+			return a.URL == b.URL && slices.Equal(a.Events, b.Events)
+		}) {
+			t.Errorf("ParseWebhooks(%q) = %v, want %v", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"appCrashed"}`)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("secret", "1700000000", body); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Changing any part changes the signature
+	for _, other := range []string{
+		signWebhook("other", "1700000000", body),
+		signWebhook("secret", "1700000001", body),
+		signWebhook("secret", "1700000000", []byte(`{"type":"appStarted"}`)),
+	} {
+		if other == want {
+			t.Errorf("signature doesn't depend on all of its inputs: %s", other)
+		}
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		up       bool
+		wantUp   bool
+		attempts int32
+	}{
+		{name: "ok", statuses: []int{200}, up: true, wantUp: true, attempts: 1},
+		{name: "retried", statuses: []int{503, 204}, up: true, wantUp: true, attempts: 2},
+		{name: "not retried", statuses: []int{400}, up: true, wantUp: true, attempts: 1},
+		{name: "down", statuses: []int{503}, up: false, wantUp: false, attempts: 1},
+		{name: "back up", statuses: []int{200}, up: false, wantUp: true, attempts: 1},
+	}
+
+	for _, c := range cases {
+		var attempts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := attempts.Add(1)
+
+			body, _ := io.ReadAll(r.Body)
+			timestamp := r.Header.Get("X-Ayup-Timestamp")
+			if timestamp == "" || r.Header.Get("X-Ayup-Signature") != signWebhook("secret", timestamp, body) {
+				t.Errorf("%s: bad signature", c.name)
+			}
+
+			w.WriteHeader(c.statuses[min(int(n), len(c.statuses))-1])
+		}))
+
+		s := &Srv{WebhookSecret: "secret"}
+		ev := &pb.Event{Type: pb.EventType_appCrashed, Seq: 1}
+		up := s.deliverWebhook(context.Background(), srv.Client(), Webhook{URL: srv.URL}, ev, c.up)
+		srv.Close()
+
+		if up != c.wantUp {
+			t.Errorf("%s: got up %v, want %v", c.name, up, c.wantUp)
+		}
+		if n := attempts.Load(); n != c.attempts {
+			t.Errorf("%s: got %d attempts, want %d", c.name, n, c.attempts)
+		}
+	}
+}